@@ -1,23 +1,37 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"clonebox/internal/models"
+	"clonebox/internal/oidc"
+	"clonebox/internal/qr"
+	"clonebox/internal/token"
+	"clonebox/internal/totp"
 	"clonebox/internal/validator"
-	"crypto/md5"
-	"crypto/sha256"
+	"clonebox/internal/webauthn"
+	"clonebox/ui"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
+	"github.com/justinas/nosurf"
 	"google.golang.org/genai"
 )
 
@@ -38,6 +52,52 @@ type userSignupForm struct {
 type userLoginForm struct {
 	Email               string `form:"email"`
 	Password            string `form:"password"`
+	RememberMe          bool   `form:"remember_me"`
+	validator.Validator `form:"-"`
+}
+
+type accountProfileForm struct {
+	Name                string `form:"name"`
+	validator.Validator `form:"-"`
+}
+
+type accountEmailForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+type userReauthenticateForm struct {
+	Password            string `form:"password"`
+	validator.Validator `form:"-"`
+}
+
+type userLoginTwoFactorForm struct {
+	Code                string `form:"code"`
+	validator.Validator `form:"-"`
+}
+
+// accountTwoFactorForm takes a code to confirm enrollment with, or the password to turn two-factor authentication off
+// with.
+type accountTwoFactorForm struct {
+	Code                string `form:"code"`
+	Password            string `form:"password"`
+	validator.Validator `form:"-"`
+}
+
+// userVerifyForm only carries the error shown for a link that can't be used.
+type userVerifyForm struct {
+	validator.Validator `form:"-"`
+}
+
+type userPasswordForgotForm struct {
+	Email               string `form:"email"`
+	validator.Validator `form:"-"`
+}
+
+type userPasswordResetForm struct {
+	Token               string `form:"token"`
+	NewPassword         string `form:"new_password"`
+	NewPasswordConfirm  string `form:"new_password_confirm"`
 	validator.Validator `form:"-"`
 }
 
@@ -48,14 +108,51 @@ type accountPasswordUpdateForm struct {
 	validator.Validator `form:"-"`
 }
 
+type accountPasskeyForm struct {
+	Name                string `form:"name"`
+	validator.Validator `form:"-"`
+}
+
+type accountPasskeyDeleteForm struct {
+	ID string `form:"id"`
+}
+
+type accountSessionRevokeForm struct {
+	ID string `form:"id"`
+}
+
 type linkShortenForm struct {
 	OriginalLink        string `form:"original_link"`
+	Alias               string `form:"alias"`
+	Expires             int    `form:"expires"`
+	MaxUses             int    `form:"max_uses"`
 	ShortLink           string `form:"short_link"`
 	validator.Validator `form:"-"`
 }
 
+// reservedAliases can't be used as custom short link aliases, as they're (or may become) routes or are confusing.
+var reservedAliases = []string{
+	"static", "admin", "api", "bulk", "stats", "edit", "new", "my", "mine", "links", "login", "logout", "signup",
+	"user", "account", "file", "files", "shorten", "qr", "about", "tools", "ping",
+}
+
+type linkEditForm struct {
+	OriginalLink        string `form:"original_link"`
+	Interstitial        bool   `form:"interstitial"`
+	validator.Validator `form:"-"`
+}
+
+type linkBulkForm struct {
+	validator.Validator `form:"-"`
+}
+
+type linkActiveForm struct {
+	Active bool `form:"active"`
+}
+
 type fileShareForm struct {
-	Filename string `form:"file_name"`
+	Filename            string `form:"file_name"`
+	validator.Validator `form:"-"`
 }
 
 type fileUploadForm struct {
@@ -186,7 +283,7 @@ func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Try to create a new user record in the database. If the email already exists then add an error message to the form and re-display it.
-	err = app.users.Insert(form.Name, form.Email, form.Password)
+	id, err := app.users.Insert(form.Name, form.Email, form.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrDuplicateEmail) {
 			form.AddFieldError("email", "Email is already in use")
@@ -201,8 +298,16 @@ func (app *application) userSignupPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// New users can't upload or shorten until they've followed the link mailed to them
+	err = app.sendVerification(id, form.Name, form.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
 	// Otherwise add a confirmation flash message to the session confirming that signup worked.
-	app.sessionManager.Put(r.Context(), "flash", "Signup success")
+	app.sessionManager.Put(r.Context(), "flash",
+		"Signup success. We've sent you an email with a link to verify your address")
 
 	// Redirect the user to the login page.
 	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
@@ -234,9 +339,30 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Throttled logins aren't attempted at all, so a right guess doesn't get through while waiting. Allowed ones count
+	// as failed until the password turns out right
+	decision, err := app.attemptLogin(r, form.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !decision.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
+		form.AddNonFieldError(throttledLoginMessage(decision))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusTooManyRequests, "login.tmpl.html", data)
+		return
+	}
+
 	id, err := app.users.Authenticate(form.Email, form.Password)
 	if err != nil {
 		if errors.Is(err, models.ErrInvalidCredentials) {
+			err = app.failLogin(r, form.Email)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
 			form.AddNonFieldError("Email or Password is incorrect")
 			data := app.newTemplateData(r)
 			data.Form = form
@@ -247,307 +373,2041 @@ func (app *application) userLoginPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.sessionManager.RenewToken(r.Context())
+	err = app.passLogin(r, form.Email)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	app.sessionManager.Put(r.Context(), "authenticatedUserId", id)
+	user, err := app.users.Get(id)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
 
-	path := app.sessionManager.GetString(r.Context(), "originalPath")
-	if path != "" {
-		app.sessionManager.Remove(r.Context(), "originalPath")
-		http.Redirect(w, r, path, http.StatusSeeOther)
+	// Users with two-factor authentication aren't logged in until they've also entered a code
+	_, err = app.twoFactor.Secret(id)
+	if err == nil {
+		err = app.sessionManager.RenewToken(r.Context())
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.sessionManager.Put(r.Context(), "twoFactorUserId", id)
+		app.sessionManager.Put(r.Context(), "twoFactorStarted", time.Now().Unix())
+		app.sessionManager.Put(r.Context(), "twoFactorRememberMe", form.RememberMe)
+		app.sessionManager.Remove(r.Context(), "twoFactorAttempts")
+		http.Redirect(w, r, "/user/login/2fa", http.StatusSeeOther)
+		return
+	} else if !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, err)
 		return
 	}
-	http.Redirect(w, r, "/about", http.StatusSeeOther)
-}
 
-func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
-	// Uses the RenewToken() method on the current session to change the session ID
-	err := app.sessionManager.RenewToken(r.Context())
+	// The IP isn't reset, one right password says nothing about the other logins made from it
+	err = app.loginThrottle.emails.Reset(loginEmailKey(form.Email))
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	app.sessionManager.Remove(r.Context(), "authenticatedUserId")
-
-	app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully")
-
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	app.logIn(w, r, user, form.RememberMe)
 }
 
-func (app *application) accountView(w http.ResponseWriter, r *http.Request) {
-	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
-	user, err := app.users.Get(userId)
-	if errors.Is(err, models.ErrNoRecord) {
+func (app *application) userLoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	if app.pendingTwoFactor(r) == 0 {
 		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
-	} else if err != nil {
-		app.serverError(w, err)
+		return
 	}
 
 	data := app.newTemplateData(r)
-	data.User = user
-	app.render(w, http.StatusOK, "account.tmpl.html", data)
-	//fmt.Fprintf(w, "%+v", user)
+	data.Form = userLoginTwoFactorForm{}
+	app.render(w, http.StatusOK, "login_2fa.tmpl.html", data)
 }
 
-func (app *application) accountPasswordUpdate(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData(r)
-	data.Form = accountPasswordUpdateForm{}
-	app.render(w, http.StatusOK, "change_password.tmpl.html", data)
-}
+// userLoginTwoFactorPost is the second step of logging in for users with two-factor authentication, taking either a
+// code from their authenticator app or one of their recovery codes.
+func (app *application) userLoginTwoFactorPost(w http.ResponseWriter, r *http.Request) {
+	id := app.pendingTwoFactor(r)
+	if id == 0 {
+		app.clearTwoFactor(r)
+		app.sessionManager.Put(r.Context(), "flash", "Your login has expired, please log in again")
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
 
-func (app *application) accountPasswordUpdatePost(w http.ResponseWriter, r *http.Request) {
-	var form accountPasswordUpdateForm
+	var form userLoginTwoFactorForm
 	err := app.decodePostForm(r, &form)
 	if err != nil {
-		app.serverError(w, err)
+		app.clientError(w, http.StatusBadRequest)
 		return
 	}
 
-	form.CheckField(validator.NotBlank(form.CurrentPassword), "currentPassword", "This field cannot be blank")
-	form.CheckField(validator.NotBlank(form.NewPassword), "newPassword", "This field cannot be blank")
-	form.CheckField(validator.MinChars(form.NewPassword, 8), "newPassword", "This field must be at least 8 characters long")
-	form.CheckField(validator.NotBlank(form.NewPasswordConfirm), "newPasswordConfirm", "This field cannot be blank")
-	form.CheckField(form.NewPassword == form.NewPasswordConfirm, "newPasswordConfirm", "Passwords do not match")
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
 
 	if !form.Valid() {
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "change_password.tmpl.html", data)
+		app.render(w, http.StatusUnprocessableEntity, "login_2fa.tmpl.html", data)
 		return
 	}
 
-	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
-	err = app.users.PasswordUpdate(userId, form.CurrentPassword, form.NewPassword)
+	user, err := app.users.Get(id)
 	if err != nil {
-		if errors.Is(err, models.ErrInvalidCredentials) {
-			form.AddFieldError("currentPassword", "Entered password is not your current password")
-			data := app.newTemplateData(r)
-			data.Form = form
-			app.render(w, http.StatusUnprocessableEntity, "change_password.tmpl.html", data)
-		} else {
-			app.serverError(w, err)
-		}
+		app.serverError(w, err)
 		return
 	}
 
-	app.sessionManager.Put(r.Context(), "flash", "Password successfully changed")
-	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
-
-}
-
-func (app *application) linkShorten(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData(r)
-	data.Form = linkShortenForm{}
-
-	app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
-}
-
-func (app *application) linkShortenPost(w http.ResponseWriter, r *http.Request) {
-	var form linkShortenForm
-	err := app.decodePostForm(r, &form)
+	// Codes count against the same limits as passwords, otherwise logging in again would allow endless guesses
+	decision, err := app.attemptLogin(r, user.Email)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-
-	// Valid URL checks
-	originalLink := form.OriginalLink
-	if !strings.HasPrefix(originalLink, "http://") && !strings.HasPrefix(originalLink, "https://") {
-		originalLink = "https://" + originalLink
-	}
-	form.CheckField(validator.IsURL(originalLink), "originalLink", "This field must be a valid URL")
-	if !form.Valid() {
+	if !decision.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
+		form.AddNonFieldError(throttledLoginMessage(decision))
 		data := app.newTemplateData(r)
 		data.Form = form
-		app.render(w, http.StatusUnprocessableEntity, "link_shorten.tmpl.html", data)
+		app.render(w, http.StatusTooManyRequests, "login_2fa.tmpl.html", data)
 		return
 	}
 
-	// Check if user entered link is already in db. If so, directly render that
-	exists, err := app.links.Exists(originalLink)
+	err = app.checkTwoFactorCode(id, form.Code)
 	if err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
+		if !errors.Is(err, models.ErrInvalidCredentials) {
 			app.serverError(w, err)
 			return
 		}
-		app.errorLog.Printf("%v", err)
-	}
 
-	if exists {
-		short, err := app.links.GetShort(originalLink)
+		err = app.failLogin(r, user.Email)
 		if err != nil {
 			app.serverError(w, err)
+			return
+		}
+
+		// Six digit codes can be guessed, so only a few tries are allowed before the password is needed again
+		attempts := app.sessionManager.GetInt(r.Context(), "twoFactorAttempts") + 1
+		if attempts >= twoFactorMaxAttempts {
+			app.clearTwoFactor(r)
+			app.sessionManager.Put(r.Context(), "flash", "Too many incorrect codes, please log in again")
+			http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+			return
 		}
+		app.sessionManager.Put(r.Context(), "twoFactorAttempts", attempts)
 
+		form.AddFieldError("code", "This code is incorrect or has already been used")
 		data := app.newTemplateData(r)
-		form.ShortLink = fmt.Sprintf("%s/shorten/%s", r.Host, short)
 		data.Form = form
-		app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
+		app.render(w, http.StatusUnauthorized, "login_2fa.tmpl.html", data)
 		return
 	}
 
-	// Begin shortening logic
-	hash := sha256.Sum256([]byte(originalLink))
-	shortLink := fmt.Sprintf("%x", hash[0:3]) // Does this result in collisions?
-
-	// TODO Definitely unit test this
-	// If originalLink is a duplicate, earlier code would have caught it (and served existing)
-	// If shortLink is a duplicate, re-hash until no hash collision
-	err = app.links.Insert(originalLink, shortLink)
-	for errors.Is(err, models.ErrDuplicateLink) {
-		betterHash := sha256.Sum256([]byte(shortLink + originalLink))
-		shortLink = fmt.Sprintf("%x", betterHash[0:3])
-
-		err = app.links.Insert(originalLink, shortLink)
+	err = app.passLogin(r, user.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
 	}
-
+	err = app.loginThrottle.emails.Reset(loginEmailKey(user.Email))
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
 
-	data := app.newTemplateData(r)
-	form.OriginalLink = originalLink
-	form.ShortLink = fmt.Sprintf("%s/shorten/%s", r.Host, shortLink)
-	data.Form = form
-	app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
+	rememberMe := app.sessionManager.GetBool(r.Context(), "twoFactorRememberMe")
+	app.clearTwoFactor(r)
+	app.logIn(w, r, user, rememberMe)
 }
 
-func (app *application) linkRedirect(w http.ResponseWriter, r *http.Request) {
-	params := httprouter.ParamsFromContext(r.Context())
-	hash := params.ByName("hash")
-
-	originalLink, err := app.links.GetOriginal(hash)
+// userLoginPasskeyBeginPost starts logging in with a passkey, sending the passkey script the options for
+// navigator.credentials.get(). Any of the user's passkeys for this site can answer, so no email address is needed.
+func (app *application) userLoginPasskeyBeginPost(w http.ResponseWriter, r *http.Request) {
+	challenge, err := webauthn.NewChallenge()
 	if err != nil {
-		if errors.Is(err, models.ErrNoRecord) {
-			app.clientError(w, http.StatusNotFound)
-			return
-		}
 		app.serverError(w, err)
 		return
 	}
+	app.sessionManager.Put(r.Context(), "passkeyLoginChallenge", challenge)
 
-	http.Redirect(w, r, originalLink, http.StatusSeeOther)
+	app.writeJSON(w, http.StatusOK, app.relyingParty(r).RequestOptions(challenge))
 }
 
-func (app *application) fileUpload(w http.ResponseWriter, r *http.Request) {
-	data := app.newTemplateData(r)
-	data.Form = fileShareForm{}
-
-	app.render(w, http.StatusOK, "file_upload.tmpl.html", data)
-}
+// userLoginPasskeyFinishPost logs the user in once their passkey has signed the challenge. Passkeys check the user
+// themselves (with a PIN or biometrics) as well as being something they have, so they skip two-factor
+// authentication.
+func (app *application) userLoginPasskeyFinishPost(w http.ResponseWriter, r *http.Request) {
+	// The challenge is good for one attempt, successful or not
+	challenge := app.sessionManager.PopBytes(r.Context(), "passkeyLoginChallenge")
+	if challenge == nil {
+		app.jsonError(w, http.StatusBadRequest, "Your login has expired, please try again")
+		return
+	}
 
-func (app *application) fileUploadPost(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(100 << 20) // 100MB -> 2^20 is 1MB
+	body, err := readPasskeyResponse(w, r)
 	if err != nil {
-		app.serverError(w, err)
+		app.jsonError(w, http.StatusBadRequest, "Your passkey's response couldn't be read")
 		return
 	}
-
-	uploadedFile, header, err := r.FormFile("file")
+	assertion, err := webauthn.ParseAssertion(body)
 	if err != nil {
+		app.jsonError(w, http.StatusBadRequest, "Your passkey's response couldn't be read")
+		return
+	}
+
+	passkey, err := app.passkeys.Get(assertion.CredentialID())
+	if errors.Is(err, models.ErrNoRecord) {
+		app.jsonError(w, http.StatusUnauthorized, "This passkey isn't registered, log in with your password")
+		return
+	} else if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	defer uploadedFile.Close()
 
-	// Unique file name - store in db?
-	fileUUID := uuid.New().String()
-	storagePath := "/clonebox/uploads/"
-	dst, err := os.Create(storagePath + fileUUID)
+	handle := assertion.UserHandle()
+	if handle != nil && !bytes.Equal(handle, userHandle(passkey.UserID)) {
+		app.jsonError(w, http.StatusUnauthorized, "This passkey couldn't be verified")
+		return
+	}
+
+	signCount, err := app.relyingParty(r).VerifyAssertion(challenge, assertion, passkey.PublicKey, passkey.SignCount)
 	if err != nil {
-		app.serverError(w, err)
+		app.infoLog.Printf("passkey login for user %d failed: %s", passkey.UserID, err)
+		app.jsonError(w, http.StatusUnauthorized, "This passkey couldn't be verified")
 		return
 	}
-	defer dst.Close()
 
-	// Need to use teeReader to avoid weird read-once limitation on multipart form file
-	// This handles saving to disk and checksum calc in same pass
-	h := md5.New()
-	teeReader := io.TeeReader(uploadedFile, h)
-	_, err = io.Copy(dst, teeReader)
+	err = app.passkeys.Use(passkey.ID, signCount)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-	checksum := fmt.Sprintf("%x", h.Sum(nil))
 
-	// Begin DB Storage
-	// Checking for existing file w/ matching checksum. If exists, delete previously copied. Using this approach because of
-	// io.Reader limitations -- TODO: Find a better way
-	existingFile, err := app.files.GetByChecksum(checksum)
+	user, err := app.users.Get(passkey.UserID)
 	if err != nil {
-		if errors.Is(err, models.ErrNoRecord) {
-			// Currently storing storagePath in case i use a per-user dir approach
-			err = app.files.Insert(header.Filename, fileUUID, int(header.Size), checksum, storagePath)
-			if err != nil {
-				app.serverError(w, err)
-				return
-			}
-
-			http.Redirect(w, r, fmt.Sprintf("/file/view/%s", fileUUID), http.StatusSeeOther)
-			return
-		}
 		app.serverError(w, err)
 		return
 	}
 
-	// Delete dupe upload
-	err = os.Remove(storagePath + fileUUID)
+	app.clearTwoFactor(r)
+	path, err := app.startSession(r, user, false)
 	if err != nil {
 		app.serverError(w, err)
 		return
 	}
-
-	http.Redirect(w, r, fmt.Sprintf("/file/view/%s", existingFile.FileUUID), http.StatusSeeOther)
+	app.writeJSON(w, http.StatusOK, map[string]string{"redirect": path})
 }
 
-func (app *application) fileView(w http.ResponseWriter, r *http.Request) {
-	params := httprouter.ParamsFromContext(r.Context())
-	fileNameUUID := params.ByName("uuid")
+// userLoginSSOPost starts logging in through the single sign-on identity provider, sending the user there. The
+// values tying their return to this login are kept in the session.
+func (app *application) userLoginSSOPost(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		app.notFound(w)
+		return
+	}
 
-	uploadedFile, err := app.files.GetByUUID(fileNameUUID)
+	login, err := oidc.NewLogin()
 	if err != nil {
-		if errors.Is(err, models.ErrNoRecord) {
-			app.clientError(w, http.StatusNotFound)
-			return
-		}
 		app.serverError(w, err)
 		return
 	}
 
-	data := app.newTemplateData(r)
-	data.File = uploadedFile
+	authURL, err := app.sso.AuthURL(r.Context(), app.absoluteURL(r, "/user/login/sso/callback"), login)
+	if err != nil {
+		app.errorLog.Printf("single sign-on unavailable: %s", err)
+		app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("Logging in with %s isn't possible right now, please try again later", app.ssoName))
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	}
 
-	app.render(w, http.StatusOK, "file_download.tmpl.html", data)
+	app.sessionManager.Put(r.Context(), "ssoState", login.State)
+	app.sessionManager.Put(r.Context(), "ssoNonce", login.Nonce)
+	app.sessionManager.Put(r.Context(), "ssoVerifier", login.Verifier)
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
 }
 
-func (app *application) fileDownload(w http.ResponseWriter, r *http.Request) {
-	params := httprouter.ParamsFromContext(r.Context())
-	fileNameUUID := params.ByName("uuid")
+// userLoginSSOCallback is where the identity provider sends the user back to, with a code to redeem for their ID
+// token. The identity provider is trusted to have applied its own second factors, so two-factor authentication is
+// skipped.
+func (app *application) userLoginSSOCallback(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		app.notFound(w)
+		return
+	}
 
-	uploadedFile, err := app.files.GetByUUID(fileNameUUID)
-	if err != nil {
-		if errors.Is(err, models.ErrNoRecord) {
-			app.clientError(w, http.StatusNotFound)
-			return
+	// The login values are good for one callback, successful or not
+	login := &oidc.Login{
+		State:    app.sessionManager.PopString(r.Context(), "ssoState"),
+		Nonce:    app.sessionManager.PopString(r.Context(), "ssoNonce"),
+		Verifier: app.sessionManager.PopString(r.Context(), "ssoVerifier"),
+	}
+
+	fail := func(message string) {
+		app.sessionManager.Put(r.Context(), "flash", message)
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+	}
+
+	q := r.URL.Query()
+	if !oidc.CheckState(q.Get("state"), login.State) {
+		fail(fmt.Sprintf("Your login with %s has expired, please try again", app.ssoName))
+		return
+	}
+	if q.Get("error") != "" {
+		if q.Get("error") == "access_denied" {
+			fail(fmt.Sprintf("Logging in with %s was cancelled", app.ssoName))
+		} else {
+			app.errorLog.Printf("single sign-on error: %s %s", q.Get("error"), q.Get("error_description"))
+			fail(fmt.Sprintf("Logging in with %s failed, please try again", app.ssoName))
 		}
-		app.serverError(w, err)
 		return
 	}
 
-	if _, err = os.Stat(uploadedFile.StoragePath); err != nil {
-		app.clientError(w, http.StatusNotFound)
+	claims, err := app.sso.Exchange(r.Context(), q.Get("code"), app.absoluteURL(r, "/user/login/sso/callback"), login)
+	if err != nil {
+		app.errorLog.Printf("single sign-on failed: %s", err)
+		fail(fmt.Sprintf("Logging in with %s failed, please try again", app.ssoName))
+		return
+	}
+
+	user, err := app.ssoUser(claims)
+	if errors.Is(err, errSSOUnverifiedEmail) {
+		fail(fmt.Sprintf("%s hasn't verified your email address, so it can't be used to log in here", app.ssoName))
+		return
+	} else if errors.Is(err, errSSOUnverifiedAccount) {
+		fail(fmt.Sprintf("An account with your email address hasn't been verified yet. Verify it, or reset its "+
+			"password, before logging in with %s", app.ssoName))
+		return
+	} else if err != nil {
+		app.serverError(w, err)
 		return
 	}
 
-	fileNameAndPath := uploadedFile.StoragePath + uploadedFile.FileUUID
-	http.ServeFile(w, r, fileNameAndPath)
+	app.clearTwoFactor(r)
+	app.logIn(w, r, user, false)
+}
+
+// userReauthenticate asks a logged in user for their password again, before a sensitive account change.
+func (app *application) userReauthenticate(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = userReauthenticateForm{}
+	app.render(w, http.StatusOK, "reauthenticate.tmpl.html", data)
+}
+
+// userReauthenticatePost checks the password of a logged in user, and sends them back to the page that asked for it.
+// Wrong passwords count towards the login throttle, so this can't be used to guess around it.
+func (app *application) userReauthenticatePost(w http.ResponseWriter, r *http.Request) {
+	var form userReauthenticateForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "reauthenticate.tmpl.html", data)
+		return
+	}
+
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	decision, err := app.attemptLogin(r, user.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	if !decision.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(decision.RetryAfter.Seconds()))))
+		form.AddNonFieldError(throttledLoginMessage(decision))
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusTooManyRequests, "reauthenticate.tmpl.html", data)
+		return
+	}
+
+	id, err := app.users.Authenticate(user.Email, form.Password)
+	if errors.Is(err, models.ErrInvalidCredentials) || (err == nil && id != user.ID) {
+		err = app.failLogin(r, user.Email)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		form.AddFieldError("password", "Password is incorrect")
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnauthorized, "reauthenticate.tmpl.html", data)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.passLogin(r, user.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.loginThrottle.emails.Reset(loginEmailKey(user.Email))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "authenticatedAt", time.Now().Unix())
+	path := app.sessionManager.PopString(r.Context(), "originalPath")
+	if path == "" {
+		path = "/account/view"
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+func (app *application) userLogoutPost(w http.ResponseWriter, r *http.Request) {
+	// Uses the RenewToken() method on the current session to change the session ID
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	err = app.userSessions.Delete(userId, app.sessionManager.GetString(r.Context(), "userSessionId"))
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, err)
+		return
+	}
+	app.clearLogin(r.Context())
+
+	app.sessionManager.Put(r.Context(), "flash", "You've been logged out successfully")
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// userVerify verifies the email address of the user a mailed link was sent to. Without a token, it tells the user to
+// check their mail and lets them ask for a new link.
+func (app *application) userVerify(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = userVerifyForm{}
+	if app.isAuthenticated(r) {
+		user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		data.User = user
+	}
+
+	plaintext := r.URL.Query().Get("token")
+	if plaintext == "" {
+		app.render(w, http.StatusOK, "verify.tmpl.html", data)
+		return
+	}
+
+	userID, err := app.useToken(plaintext, models.ScopeVerification)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			var form userVerifyForm
+			form.AddNonFieldError("This verification link is invalid or has expired")
+			data.Form = form
+			app.render(w, http.StatusBadRequest, "verify.tmpl.html", data)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	err = app.users.SetVerified(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	// Links that were sent earlier are no longer needed
+	err = app.tokens.DeleteAllForUser(userID, models.ScopeVerification)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your email address has been verified")
+	if app.isAuthenticated(r) {
+		http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// userVerifyPost mails the logged-in user a new verification link.
+func (app *application) userVerifyPost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if user.Verified {
+		app.sessionManager.Put(r.Context(), "flash", "Your email address is already verified")
+		http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+		return
+	}
+
+	err = app.sendVerification(user.ID, user.Name, user.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", fmt.Sprintf("We've sent a new verification link to %s", user.Email))
+	http.Redirect(w, r, "/user/verify", http.StatusSeeOther)
+}
+
+func (app *application) userPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = userPasswordForgotForm{}
+	app.render(w, http.StatusOK, "password_forgot.tmpl.html", data)
+}
+
+// userPasswordForgotPost mails a password reset link to the given address if it belongs to a user. The response is
+// the same either way, so the form can't be used to find out who has an account.
+func (app *application) userPasswordForgotPost(w http.ResponseWriter, r *http.Request) {
+	var form userPasswordForgotForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "password_forgot.tmpl.html", data)
+		return
+	}
+
+	user, err := app.users.GetByEmail(form.Email)
+	if err == nil {
+		err = app.sendPasswordReset(user)
+	}
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash",
+		fmt.Sprintf("If %s belongs to an account, we've sent it a link to reset the password", form.Email))
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+// userPasswordReset shows the form for choosing a new password. The token is only checked here, it's used up when the
+// form is submitted, so mail scanners following the link don't spend it.
+func (app *application) userPasswordReset(w http.ResponseWriter, r *http.Request) {
+	form := userPasswordResetForm{Token: r.URL.Query().Get("token")}
+	data := app.newTemplateData(r)
+
+	if _, err := app.tokenSigner.Check(models.ScopePasswordReset, form.Token); err != nil {
+		form.AddNonFieldError("This reset link is invalid or has expired")
+		data.Form = form
+		app.render(w, http.StatusBadRequest, "password_reset.tmpl.html", data)
+		return
+	}
+
+	data.Form = form
+	app.render(w, http.StatusOK, "password_reset.tmpl.html", data)
+}
+
+func (app *application) userPasswordResetPost(w http.ResponseWriter, r *http.Request) {
+	var form userPasswordResetForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.NewPassword), "newPassword", "This field cannot be blank")
+	form.CheckField(validator.MinChars(form.NewPassword, 8), "newPassword", "This field must be at least 8 characters long")
+	form.CheckField(validator.NotBlank(form.NewPasswordConfirm), "newPasswordConfirm", "This field cannot be blank")
+	form.CheckField(form.NewPassword == form.NewPasswordConfirm, "newPasswordConfirm", "Passwords do not match")
+
+	// The token is only used once the new password is acceptable, so a typo doesn't cost the user their link
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "password_reset.tmpl.html", data)
+		return
+	}
+
+	userID, err := app.useToken(form.Token, models.ScopePasswordReset)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			form.AddNonFieldError("This reset link is invalid or has expired")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, http.StatusBadRequest, "password_reset.tmpl.html", data)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	// Logs the user out everywhere, whoever had their old password is no longer let in
+	err = app.users.PasswordReset(userID, form.NewPassword)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.tokens.DeleteAllForUser(userID, models.ScopePasswordReset)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.userSessions.DeleteAllForUser(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	// Following the link proved the user can read mail sent to their address
+	err = app.users.SetVerified(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	// Nor is anyone still guessing the old password locking the user out
+	user, err := app.users.Get(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.loginThrottle.emails.Reset(loginEmailKey(user.Email))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your password has been reset, please log in with your new password")
+	http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+}
+
+func (app *application) accountView(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	user, err := app.users.Get(userId)
+	if errors.Is(err, models.ErrNoRecord) {
+		http.Redirect(w, r, "/user/login", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	usedBytes, usedFiles, err := app.files.Usage(userId)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	_, err = app.twoFactor.Secret(userId)
+	if err != nil && !errors.Is(err, models.ErrNoRecord) {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Usage = &storageUsage{Bytes: usedBytes, Files: usedFiles, Quota: app.quotaFor(user)}
+	data.TwoFactor = &twoFactorData{Enabled: err == nil}
+	data.Passkeys, err = app.passkeys.ByUser(userId)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.render(w, http.StatusOK, "account.tmpl.html", data)
+	//fmt.Fprintf(w, "%+v", user)
+}
+
+func (app *application) accountPasswordUpdate(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = accountPasswordUpdateForm{}
+	app.render(w, http.StatusOK, "change_password.tmpl.html", data)
+}
+
+func (app *application) accountPasswordUpdatePost(w http.ResponseWriter, r *http.Request) {
+	var form accountPasswordUpdateForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.CurrentPassword), "currentPassword", "This field cannot be blank")
+	form.CheckField(validator.NotBlank(form.NewPassword), "newPassword", "This field cannot be blank")
+	form.CheckField(validator.MinChars(form.NewPassword, 8), "newPassword", "This field must be at least 8 characters long")
+	form.CheckField(validator.NotBlank(form.NewPasswordConfirm), "newPasswordConfirm", "This field cannot be blank")
+	form.CheckField(form.NewPassword == form.NewPasswordConfirm, "newPasswordConfirm", "Passwords do not match")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "change_password.tmpl.html", data)
+		return
+	}
+
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	err = app.users.PasswordUpdate(userId, form.CurrentPassword, form.NewPassword)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			form.AddFieldError("currentPassword", "Entered password is not your current password")
+			data := app.newTemplateData(r)
+			data.Form = form
+			app.render(w, http.StatusUnprocessableEntity, "change_password.tmpl.html", data)
+		} else {
+			app.serverError(w, err)
+		}
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Password successfully changed")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+
+}
+
+// accountProfile shows the form for changing the user's display name.
+func (app *application) accountProfile(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = accountProfileForm{Name: user.Name}
+	app.render(w, http.StatusOK, "profile.tmpl.html", data)
+}
+
+func (app *application) accountProfilePost(w http.ResponseWriter, r *http.Request) {
+	var form accountProfileForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.Name = strings.TrimSpace(form.Name)
+	form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Name, 255), "name", "This field cannot be more than 255 characters long")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "profile.tmpl.html", data)
+		return
+	}
+
+	err = app.users.UpdateName(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"), form.Name)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your name has been changed")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// accountEmail shows the form for changing the user's email address, and the address waiting to be confirmed if
+// they've asked for a change already.
+func (app *application) accountEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.User = user
+	data.Form = accountEmailForm{}
+	app.render(w, http.StatusOK, "email_change.tmpl.html", data)
+}
+
+// accountEmailPost mails a confirmation link to the address the user wants to change to. Their email stays the same
+// until the link is followed.
+func (app *application) accountEmailPost(w http.ResponseWriter, r *http.Request) {
+	var form accountEmailForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	form.Email = strings.TrimSpace(form.Email)
+	form.CheckField(validator.NotBlank(form.Email), "email", "This field cannot be blank")
+	form.CheckField(validator.Matches(form.Email, validator.EmailRX), "email", "This field must be a valid email address")
+	form.CheckField(!strings.EqualFold(form.Email, user.Email), "email", "This is already your email address")
+	if form.Valid() {
+		// Caught early so the user isn't sent a link that can't work. It's checked again when the link is followed
+		_, err = app.users.GetByEmail(form.Email)
+		if err == nil {
+			form.AddFieldError("email", "Email is already in use")
+		} else if !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.User = user
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "email_change.tmpl.html", data)
+		return
+	}
+
+	err = app.users.SetPendingEmail(user.ID, form.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	err = app.sendEmailChange(user, form.Email)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash",
+		fmt.Sprintf("We've sent a link to %s, follow it to change your email address", form.Email))
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// accountEmailConfirm changes the email address of the user a confirmation link was sent to, and lets the old address
+// know. It works without being logged in, as the link may be opened on another device.
+func (app *application) accountEmailConfirm(w http.ResponseWriter, r *http.Request) {
+	next := "/user/login"
+	if app.isAuthenticated(r) {
+		next = "/account/view"
+	}
+	fail := func(message string) {
+		app.sessionManager.Put(r.Context(), "flash", message)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+
+	userID, err := app.useToken(r.URL.Query().Get("token"), models.ScopeEmailChange)
+	if errors.Is(err, models.ErrNoRecord) {
+		fail("This confirmation link is invalid or has expired")
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	user, err := app.users.Get(userID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.users.ConfirmEmail(userID)
+	if errors.Is(err, models.ErrDuplicateEmail) {
+		fail(fmt.Sprintf("%s has been taken by another account in the meantime", user.PendingEmail))
+		return
+	} else if errors.Is(err, models.ErrNoRecord) {
+		fail("This confirmation link is invalid or has expired")
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// Links to verify the old address are of no use anymore, the new one is verified by this
+	err = app.tokens.DeleteAllForUser(userID, models.ScopeVerification)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.sendMail(user.Email, "email_changed.tmpl", map[string]string{
+		"Name":  user.Name,
+		"Email": user.PendingEmail,
+	})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Your email address has been changed")
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// accountTwoFactor shows whether two-factor authentication is on, or, while it's off, the secret to set it up with.
+// The secret is kept in the session until the user confirms it with a code.
+func (app *application) accountTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Form = accountTwoFactorForm{}
+	data.TwoFactor, err = app.twoFactorState(r, user)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.render(w, http.StatusOK, "two_factor.tmpl.html", data)
+}
+
+// twoFactorState returns what the two-factor authentication page shows for user, starting enrollment if they haven't
+// enabled it.
+func (app *application) twoFactorState(r *http.Request, user *models.User) (*twoFactorData, error) {
+	_, err := app.twoFactor.Secret(user.ID)
+	if err == nil {
+		left, err := app.twoFactor.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &twoFactorData{Enabled: true, CodesLeft: left}, nil
+	} else if !errors.Is(err, models.ErrNoRecord) {
+		return nil, err
+	}
+
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if secret == "" {
+		secret, err = totp.NewSecret()
+		if err != nil {
+			return nil, err
+		}
+		app.sessionManager.Put(r.Context(), "totpSecret", secret)
+	}
+
+	return twoFactorEnrollment(user, secret)
+}
+
+// accountTwoFactorEnablePost turns on two-factor authentication once the user has entered a code for the secret
+// they were shown, and shows their recovery codes.
+func (app *application) accountTwoFactorEnablePost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	secret := app.sessionManager.GetString(r.Context(), "totpSecret")
+	if secret == "" {
+		http.Redirect(w, r, "/account/2fa", http.StatusSeeOther)
+		return
+	}
+
+	var form accountTwoFactorForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	step, ok := totp.Validate(secret, strings.Join(strings.Fields(form.Code), ""), time.Now())
+	form.CheckField(validator.NotBlank(form.Code), "code", "This field cannot be blank")
+	form.CheckField(form.Code == "" || ok, "code", "This code is incorrect, check the clock of your device")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		data.TwoFactor, err = twoFactorEnrollment(user, secret)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.render(w, http.StatusUnprocessableEntity, "two_factor.tmpl.html", data)
+		return
+	}
+
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = token.Hash(normalizeRecoveryCode(code))
+	}
+
+	err = app.twoFactor.Enable(user.ID, secret, step, hashes)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Remove(r.Context(), "totpSecret")
+
+	// The codes are rendered straight away rather than after a redirect, so they're never stored anywhere in plain
+	data := app.newTemplateData(r)
+	data.Form = accountTwoFactorForm{}
+	data.TwoFactor = &twoFactorData{Enabled: true, RecoveryCodes: codes, CodesLeft: len(codes)}
+	app.render(w, http.StatusOK, "two_factor.tmpl.html", data)
+}
+
+// accountTwoFactorDisablePost turns off two-factor authentication, which takes the user's password.
+func (app *application) accountTwoFactorDisablePost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	var form accountTwoFactorForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Password), "password", "This field cannot be blank")
+	if form.Valid() {
+		_, err = app.users.Authenticate(user.Email, form.Password)
+		if errors.Is(err, models.ErrInvalidCredentials) {
+			form.AddFieldError("password", "Entered password is not your current password")
+		} else if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		data.TwoFactor, err = app.twoFactorState(r, user)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+		app.render(w, http.StatusUnprocessableEntity, "two_factor.tmpl.html", data)
+		return
+	}
+
+	err = app.twoFactor.Disable(user.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Two-factor authentication has been turned off")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// accountPasskeyBeginPost starts registering a passkey, sending the passkey script the options for
+// navigator.credentials.create(). The name the user gave it is kept in the session until the passkey is created.
+func (app *application) accountPasskeyBeginPost(w http.ResponseWriter, r *http.Request) {
+	user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	var form accountPasskeyForm
+	err = app.decodePostForm(r, &form)
+	if err != nil {
+		app.jsonError(w, http.StatusBadRequest, http.StatusText(http.StatusBadRequest))
+		return
+	}
+
+	form.CheckField(validator.NotBlank(form.Name), "name", "This field cannot be blank")
+	form.CheckField(validator.MaxChars(form.Name, 100), "name", "This field cannot be more than 100 characters long")
+	if !form.Valid() {
+		app.jsonError(w, http.StatusUnprocessableEntity, form.FieldErrors["name"])
+		return
+	}
+
+	existing, err := app.passkeys.ByUser(user.ID)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	exclude := make([][]byte, len(existing))
+	for i, p := range existing {
+		exclude[i] = p.ID
+	}
+
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.sessionManager.Put(r.Context(), "passkeyChallenge", challenge)
+	app.sessionManager.Put(r.Context(), "passkeyName", strings.TrimSpace(form.Name))
+
+	options := app.relyingParty(r).CreationOptions(challenge, userHandle(user.ID), user.Email, user.Name, exclude)
+	app.writeJSON(w, http.StatusOK, options)
+}
+
+// accountPasskeyFinishPost stores the passkey the browser created.
+func (app *application) accountPasskeyFinishPost(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+
+	challenge := app.sessionManager.PopBytes(r.Context(), "passkeyChallenge")
+	name := app.sessionManager.PopString(r.Context(), "passkeyName")
+	if challenge == nil {
+		app.jsonError(w, http.StatusBadRequest, "Adding the passkey took too long, please try again")
+		return
+	}
+
+	body, err := readPasskeyResponse(w, r)
+	if err != nil {
+		app.jsonError(w, http.StatusBadRequest, "Your passkey's response couldn't be read")
+		return
+	}
+
+	credential, err := app.relyingParty(r).VerifyRegistration(challenge, body)
+	if err != nil {
+		app.infoLog.Printf("passkey registration for user %d failed: %s", userId, err)
+		app.jsonError(w, http.StatusBadRequest, "This passkey couldn't be verified")
+		return
+	}
+
+	err = app.passkeys.Insert(userId, name, credential.ID, credential.PublicKey, credential.SignCount)
+	if errors.Is(err, models.ErrDuplicatePasskey) {
+		app.jsonError(w, http.StatusConflict, "This passkey is already registered")
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Passkey added, you can now log in with it")
+	app.writeJSON(w, http.StatusOK, map[string]string{"redirect": "/account/view"})
+}
+
+// accountPasskeyDeletePost removes one of the user's passkeys.
+func (app *application) accountPasskeyDeletePost(w http.ResponseWriter, r *http.Request) {
+	var form accountPasskeyDeleteForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(form.ID)
+	if err != nil {
+		app.notFound(w)
+		return
+	}
+
+	err = app.passkeys.Delete(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"), id)
+	if errors.Is(err, models.ErrNoRecord) {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Passkey removed")
+	http.Redirect(w, r, "/account/view", http.StatusSeeOther)
+}
+
+// accountSessions lists the devices the user is logged in on.
+func (app *application) accountSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.userSessions.ByUser(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Sessions = sessions
+	data.CurrentSession = app.sessionManager.GetString(r.Context(), "userSessionId")
+	app.render(w, http.StatusOK, "sessions.tmpl.html", data)
+}
+
+// accountSessionRevokePost logs out one of the user's other sessions. The authenticate middleware turns it away on
+// its next request.
+func (app *application) accountSessionRevokePost(w http.ResponseWriter, r *http.Request) {
+	var form accountSessionRevokeForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.userSessions.Delete(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"), form.ID)
+	if errors.Is(err, models.ErrNoRecord) {
+		app.notFound(w)
+		return
+	} else if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Session logged out")
+	http.Redirect(w, r, "/account/sessions", http.StatusSeeOther)
+}
+
+// accountSessionRevokeAllPost logs the user out everywhere, this session included.
+func (app *application) accountSessionRevokeAllPost(w http.ResponseWriter, r *http.Request) {
+	err := app.userSessions.DeleteAllForUser(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	err = app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	app.clearLogin(r.Context())
+
+	app.sessionManager.Put(r.Context(), "flash", "You've been logged out everywhere")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (app *application) linkShorten(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = linkShortenForm{}
+
+	app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
+}
+
+func (app *application) linkShortenPost(w http.ResponseWriter, r *http.Request) {
+	var form linkShortenForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	originalLink, alias := app.checkShortenFields(r, &form.Validator, form.OriginalLink, form.Alias)
+
+	// Expiry (in days, 0 for never) and use limit (0 for unlimited) checks
+	form.CheckField(validator.PermittedValue(form.Expires, 0, 1, 7, 30), "expires", "This field must equal 0, 1, 7 or 30")
+	form.CheckField(form.MaxUses >= 0, "maxUses", "This field cannot be negative")
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "link_shorten.tmpl.html", data)
+		return
+	}
+
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+
+	// Check if the user has a working link to this destination already. If so, directly render that. Links with an
+	// expiry or use limit are always new, reusing one would hand out a link that stops working for someone else, and
+	// so are ones given an alias, which is asking for another link
+	exists := false
+	if alias == "" && form.Expires == 0 && form.MaxUses == 0 {
+		exists, err = app.links.Exists(userId, originalLink)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				app.serverError(w, err)
+				return
+			}
+			app.errorLog.Printf("%v", err)
+		}
+	}
+
+	if exists {
+		short, err := app.links.GetShort(userId, originalLink)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		data := app.newTemplateData(r)
+		form.ShortLink = app.absoluteURL(r, fmt.Sprintf("/shorten/%s", short))
+		data.QRTarget = fmt.Sprintf("/shorten/%s", short)
+		data.Form = form
+		app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
+		return
+	}
+
+	var expires time.Time
+	if form.Expires > 0 {
+		expires = time.Now().UTC().AddDate(0, 0, form.Expires)
+	}
+
+	if alias != "" {
+		err = app.links.Insert(originalLink, alias, userId, expires, form.MaxUses)
+		if err != nil {
+			if errors.Is(err, models.ErrDuplicateLink) {
+				form.AddFieldError("alias", "This alias is already taken")
+				data := app.newTemplateData(r)
+				data.Form = form
+				app.render(w, http.StatusUnprocessableEntity, "link_shorten.tmpl.html", data)
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+
+		data := app.newTemplateData(r)
+		form.OriginalLink = originalLink
+		form.ShortLink = app.absoluteURL(r, fmt.Sprintf("/shorten/%s", alias))
+		data.Form = form
+		data.QRTarget = fmt.Sprintf("/shorten/%s", alias)
+		app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
+		return
+	}
+
+	// Begin shortening logic. If originalLink is a duplicate, earlier code would have caught it (and served existing)
+	shortLink, err := app.shortCodes.Generate(func(code string) error {
+		// Treat reserved words like a taken code, so they're skipped
+		if validator.PermittedValue(strings.ToLower(code), reservedAliases...) {
+			return models.ErrDuplicateLink
+		}
+		return app.links.Insert(originalLink, code, userId, expires, form.MaxUses)
+	})
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	form.OriginalLink = originalLink
+	form.ShortLink = app.absoluteURL(r, fmt.Sprintf("/shorten/%s", shortLink))
+	data.Form = form
+	data.QRTarget = fmt.Sprintf("/shorten/%s", shortLink)
+	app.render(w, http.StatusOK, "link_shorten.tmpl.html", data)
+}
+
+func (app *application) linkRedirect(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	hash := params.ByName("hash")
+
+	// A trailing + asks for the preview page instead of the redirect. Links can also force the preview.
+	preview := strings.HasSuffix(hash, "+")
+	hash = strings.TrimSuffix(hash, "+")
+
+	link, err := app.links.Get(hash)
+	if err == nil {
+		err = link.Usable()
+	}
+	if err != nil {
+		app.linkUnavailable(w, r, link, err)
+		return
+	}
+
+	if preview || link.Interstitial {
+		app.linkPreview(w, r, link)
+		return
+	}
+
+	app.followLink(w, r, hash)
+}
+
+// linkContinuePost follows a link from its preview page. The continue button posts the CSRF token, so a forced preview
+// can't be skipped by linking past it.
+func (app *application) linkContinuePost(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	app.followLink(w, r, params.ByName("hash"))
+}
+
+// followLink redirects to the destination of the link with the given hash.
+func (app *application) followLink(w http.ResponseWriter, r *http.Request, hash string) {
+	// Use checks the link can still be followed and counts the visit in one go
+	link, err := app.links.Use(hash)
+	if err != nil {
+		app.linkUnavailable(w, r, link, err)
+		return
+	}
+
+	app.recordClick(r, hash)
+	http.Redirect(w, r, link.OriginalLink, http.StatusSeeOther)
+}
+
+// linkUnavailable responds to a link that can't be followed, err says why.
+func (app *application) linkUnavailable(w http.ResponseWriter, r *http.Request, link *models.LinkMapping, err error) {
+	switch {
+	case errors.Is(err, models.ErrNoRecord):
+		app.clientError(w, http.StatusNotFound)
+	case errors.Is(err, models.ErrLinkInactive):
+		// Deactivated links are gone, but the code stays reserved so it can be turned back on
+		app.clientError(w, http.StatusGone)
+	case errors.Is(err, models.ErrLinkExpired), errors.Is(err, models.ErrLinkUsedUp):
+		data := app.newTemplateData(r)
+		data.Link = link
+		app.render(w, http.StatusGone, "link_expired.tmpl.html", data)
+	default:
+		app.serverError(w, err)
+	}
+}
+
+// linkPreview renders the interstitial page showing where a short link leads and who created it. Viewing it
+// doesn't count as a use of the link.
+func (app *application) linkPreview(w http.ResponseWriter, r *http.Request, link *models.LinkMapping) {
+	preview := &linkPreviewData{}
+	if u, err := url.Parse(link.OriginalLink); err == nil {
+		preview.Host = u.Hostname()
+	}
+
+	if link.OwnerID != 0 {
+		creator, err := app.users.Get(link.OwnerID)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			app.serverError(w, err)
+			return
+		}
+		if creator != nil {
+			preview.Creator = creator.Name
+		}
+	}
+
+	data := app.newTemplateData(r)
+	data.Link = link
+	data.LinkPreview = preview
+
+	app.render(w, http.StatusOK, "link_preview.tmpl.html", data)
+}
+
+// ownedLink returns the link named by the hash route parameter, if it belongs to the logged-in user. Otherwise it
+// sends a 404 (links of other users aren't acknowledged to exist) and returns nil.
+func (app *application) ownedLink(w http.ResponseWriter, r *http.Request) *models.LinkMapping {
+	params := httprouter.ParamsFromContext(r.Context())
+
+	link, err := app.links.Get(params.ByName("hash"))
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.notFound(w)
+		} else {
+			app.serverError(w, err)
+		}
+		return nil
+	}
+
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	if link.OwnerID == 0 || link.OwnerID != userId {
+		app.notFound(w)
+		return nil
+	}
+
+	return link
+}
+
+func (app *application) linkList(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+
+	links, err := app.links.ByOwner(userId)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Links = links
+
+	app.render(w, http.StatusOK, "link_list.tmpl.html", data)
+}
+
+func (app *application) linkEdit(w http.ResponseWriter, r *http.Request) {
+	link := app.ownedLink(w, r)
+	if link == nil {
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Link = link
+	data.Form = linkEditForm{OriginalLink: link.OriginalLink, Interstitial: link.Interstitial}
+
+	app.render(w, http.StatusOK, "link_edit.tmpl.html", data)
+}
+
+func (app *application) linkEditPost(w http.ResponseWriter, r *http.Request) {
+	link := app.ownedLink(w, r)
+	if link == nil {
+		return
+	}
+
+	var form linkEditForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	originalLink := normalizeLink(form.OriginalLink)
+	form.CheckField(validator.IsURL(originalLink), "originalLink", "This field must be a valid URL")
+	if form.Valid() {
+		message := app.checkDestination(r, originalLink)
+		form.CheckField(message == "", "originalLink", message)
+	}
+
+	if form.Valid() {
+		err = app.links.Retarget(link.ShortLink, originalLink)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	if form.Valid() && form.Interstitial != link.Interstitial {
+		err = app.links.SetInterstitial(link.ShortLink, form.Interstitial)
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Link = link
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "link_edit.tmpl.html", data)
+		return
+	}
+
+	app.sessionManager.Put(r.Context(), "flash", "Link updated")
+	http.Redirect(w, r, "/account/links", http.StatusSeeOther)
+}
+
+func (app *application) linkActivePost(w http.ResponseWriter, r *http.Request) {
+	link := app.ownedLink(w, r)
+	if link == nil {
+		return
+	}
+
+	var form linkActiveForm
+	err := app.decodePostForm(r, &form)
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	err = app.links.SetActive(link.ShortLink, form.Active)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if form.Active {
+		app.sessionManager.Put(r.Context(), "flash", "Link activated")
+	} else {
+		app.sessionManager.Put(r.Context(), "flash", "Link deactivated")
+	}
+	http.Redirect(w, r, "/account/links", http.StatusSeeOther)
+}
+
+func (app *application) linkStats(w http.ResponseWriter, r *http.Request) {
+	link := app.ownedLink(w, r)
+	if link == nil {
+		return
+	}
+	hash := link.ShortLink
+
+	now := time.Now().UTC()
+	since := now.Truncate(24*time.Hour).AddDate(0, 0, -(statsDays - 1))
+
+	daily, err := app.clicks.Daily(hash, since)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	referrers, err := app.clicks.Referrers(hash, since, 10)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	agents, err := app.clicks.Agents(hash, since)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	stats := &linkStats{
+		Days:      statsDays,
+		Chart:     newClickChart(daily, now, statsDays),
+		Referrers: referrers,
+		Agents:    agents,
+	}
+	for _, d := range daily {
+		stats.Clicks += d.Clicks
+	}
+
+	data := app.newTemplateData(r)
+	data.Link = link
+	data.Stats = stats
+
+	app.render(w, http.StatusOK, "link_stats.tmpl.html", data)
+}
+
+func (app *application) linkBulk(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = linkBulkForm{}
+
+	app.render(w, http.StatusOK, "link_bulk.tmpl.html", data)
+}
+
+// linkBulkPost imports a CSV of links (see parseBulkLinks) and responds with a CSV of the outcome of every row.
+func (app *application) linkBulkPost(w http.ResponseWriter, r *http.Request) {
+	var form linkBulkForm
+
+	// Checking the links can take longer than the server's write timeout allows
+	app.extendWriteDeadline(w, bulkDeadline)
+
+	file, _, err := r.FormFile("csv")
+	if err != nil && !errors.Is(err, http.ErrMissingFile) {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	var rows []*bulkRow
+	if file == nil {
+		form.AddFieldError("csv", "Choose a CSV file to import")
+	} else {
+		defer file.Close()
+
+		content, err := io.ReadAll(io.LimitReader(file, bulkMaxBytes+1))
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		form.CheckField(len(content) <= bulkMaxBytes, "csv", "This file is too large, import at most 1 MiB at once")
+		if form.Valid() {
+			rows, err = parseBulkLinks(content)
+			form.CheckField(err == nil, "csv", fmt.Sprintf("This file isn't valid CSV: %v", err))
+		}
+		if form.Valid() {
+			form.CheckField(len(rows) > 0, "csv", "This file doesn't contain any links")
+			form.CheckField(len(rows) <= bulkMaxRows, "csv", fmt.Sprintf("At most %d links can be imported at once", bulkMaxRows))
+		}
+	}
+
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "link_bulk.tmpl.html", data)
+		return
+	}
+
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	err = app.importLinks(r, userId, rows)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "links-import.csv"))
+	err = writeBulkResults(w, rows)
+	if err != nil {
+		app.errorLog.Printf("writing bulk import results: %v", err)
+	}
+}
+
+// linkExport downloads all of the user's links with their click counts as CSV.
+func (app *application) linkExport(w http.ResponseWriter, r *http.Request) {
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+
+	links, err := app.links.ByOwner(userId)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	clicks, err := app.clicks.Totals(userId)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", "links.csv"))
+	err = app.writeLinkExport(w, r, links, clicks)
+	if err != nil {
+		app.errorLog.Printf("writing link export: %v", err)
+	}
+}
+
+// qrCode serves a QR code for one of this application's short links or file pages, given by the target query
+// parameter. It's a PNG unless format=svg is asked for. Codes are only made for pages that exist, so this can't be
+// used to generate codes for arbitrary content.
+func (app *application) qrCode(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	kind, id, ok := app.qrTarget(r, query.Get("target"))
+	if !ok {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	var path string
+	switch kind {
+	case "link":
+		_, err = app.links.Get(id)
+		path = fmt.Sprintf("/shorten/%s", id)
+	case "file":
+		_, err = app.files.GetByUUID(id)
+		path = fmt.Sprintf("/file/view/%s", id)
+	}
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	code, err := qr.EncodeString(app.absoluteURL(r, path), qr.M)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	// Without a canonical URL the code holds the request's host, and a forged one mustn't end up in a shared cache
+	if app.canonicalURL != "" {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = code.SVG(w)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		err = code.PNG(w, qrScale)
+	}
+	if err != nil {
+		app.errorLog.Printf("writing QR code for %s: %v", path, err)
+	}
+}
+
+func (app *application) fileUpload(w http.ResponseWriter, r *http.Request) {
+	data := app.newTemplateData(r)
+	data.Form = fileShareForm{}
+
+	app.render(w, http.StatusOK, "file_upload.tmpl.html", data)
+}
+
+func (app *application) fileUploadPost(w http.ResponseWriter, r *http.Request) {
+	var form fileShareForm
+
+	userId := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	user, err := app.users.Get(userId)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	quota := app.quotaFor(user)
+
+	// The body is read part by part instead of with ParseMultipartForm, so quotas are enforced while the upload streams
+	// in rather than after all of it has been buffered to disk. nosurf would have to buffer it to find the token, so
+	// this route is exempt there (see noSurf) and the token -- which the form sends first -- is checked here instead.
+	// The quota may be unlimited, so the whole request is capped as well
+	r.Body = http.MaxBytesReader(w, r.Body, app.uploadMaxBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		app.clientError(w, http.StatusBadRequest)
+		return
+	}
+
+	part, err := mr.NextPart()
+	if err != nil || part.FormName() != "csrf_token" {
+		http.Error(w, "CSRF validation failed", http.StatusBadRequest)
+		return
+	}
+	token, err := io.ReadAll(io.LimitReader(part, 1024))
+	if err != nil || !nosurf.VerifyToken(nosurf.Token(r), string(token)) {
+		http.Error(w, "CSRF validation failed", http.StatusBadRequest)
+		return
+	}
+
+	var fileUUIDs []string
+	var stored []*models.File
+
+	// Files before the one that went over quota or the size limit have been stored, so the user is told which they were
+	rejectUpload := func(message string) {
+		form.AddFieldError("file", message)
+		data := app.newTemplateData(r)
+		data.Form = form
+		data.Files = stored
+		app.render(w, http.StatusRequestEntityTooLarge, "file_upload.tmpl.html", data)
+	}
+	tooLarge := fmt.Sprintf("This upload is too large, upload at most %s at once", humanBytes(app.uploadMaxBytes))
+
+	for {
+		var maxBytesErr *http.MaxBytesError
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.As(err, &maxBytesErr) {
+			rejectUpload(tooLarge)
+			return
+		}
+		if err != nil {
+			app.clientError(w, http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			continue
+		}
+
+		fileUUID, err := app.storeUpload(r.Context(), userId, part.FileName(), part, quota)
+		if err != nil {
+			var quotaErr *quotaError
+			switch {
+			case errors.As(err, &quotaErr):
+				rejectUpload(quotaErr.Error())
+			case errors.As(err, &maxBytesErr):
+				rejectUpload(tooLarge)
+			default:
+				app.serverError(w, err)
+			}
+			return
+		}
+		fileUUIDs = append(fileUUIDs, fileUUID)
+		stored = append(stored, &models.File{FileName: part.FileName(), FileUUID: fileUUID})
+	}
+
+	form.CheckField(len(fileUUIDs) > 0, "file", "Choose at least one file to upload")
+	if !form.Valid() {
+		data := app.newTemplateData(r)
+		data.Form = form
+		app.render(w, http.StatusUnprocessableEntity, "file_upload.tmpl.html", data)
+		return
+	}
+
+	if len(fileUUIDs) == 1 {
+		http.Redirect(w, r, fmt.Sprintf("/file/view/%s", fileUUIDs[0]), http.StatusSeeOther)
+		return
+	}
+
+	// Several files at once get grouped into a collection with its own share link
+	collectionUUID := uuid.New().String()
+	err = app.collections.Insert(collectionUUID, fileUUIDs)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/file/collection/%s", collectionUUID), http.StatusSeeOther)
+}
+
+func (app *application) fileView(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	fileNameUUID := params.ByName("uuid")
+
+	uploadedFile, err := app.files.GetByUUID(fileNameUUID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.File = uploadedFile
+	data.QRTarget = fmt.Sprintf("/file/view/%s", uploadedFile.FileUUID)
+
+	// A missing blob shouldn't stop the metadata page from rendering -- the download link will 404 on its own
+	preview, err := app.newFilePreview(uploadedFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		app.serverError(w, err)
+		return
+	}
+	data.Preview = preview
+
+	app.render(w, http.StatusOK, "file_download.tmpl.html", data)
+}
+
+func (app *application) fileDownload(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	fileNameUUID := params.ByName("uuid")
+
+	uploadedFile, err := app.files.GetByUUID(fileNameUUID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	app.serveFile(w, r, uploadedFile, "attachment", "")
+}
+
+// filePreview serves a file inline so it can be embedded by the view page. Only media types which browsers can't
+// execute are served this way, everything else (HTML, SVG, ...) is sent to the forced download instead.
+func (app *application) filePreview(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	fileNameUUID := params.ByName("uuid")
+
+	uploadedFile, err := app.files.GetByUUID(fileNameUUID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	if uploadedFile.Quarantined() {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	contentType, err := sniffFile(filepath.Join(uploadedFile.StoragePath, uploadedFile.FileUUID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	kind := previewKind(contentType, uploadedFile.FileName)
+	if kind == "" || kind == "text" {
+		http.Redirect(w, r, fmt.Sprintf("/file/download/%s", uploadedFile.FileUUID), http.StatusSeeOther)
+		return
+	}
+
+	// PDFs are embedded with <object>, which X-Frame-Options: deny would block, so allow same-origin embedding only
+	if kind == "pdf" {
+		w.Header().Set("X-Frame-Options", "sameorigin")
+	}
+
+	app.serveFile(w, r, uploadedFile, "inline", contentType)
+}
+
+// fileThumbnail serves the thumbnail of an uploaded file. Thumbnails never change for a given UUID, so they can be
+// cached for a long time. If there isn't one (not an image, generation failed, or it's still being generated) a
+// placeholder is served instead, which isn't cached so the real thumbnail shows up once it exists.
+func (app *application) fileThumbnail(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	fileNameUUID := params.ByName("uuid")
+
+	uploadedFile, err := app.files.GetByUUID(fileNameUUID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	thumb, err := os.ReadFile(thumbnailPath(uploadedFile))
+	if uploadedFile.Quarantined() {
+		// Quarantined files only ever get the placeholder
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			app.errorLog.Printf("thumbnail for %s: %v", uploadedFile.FileUUID, err)
+		}
+
+		placeholder, err := fs.ReadFile(ui.Files, "static/img/thumb-placeholder.svg")
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(placeholder)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(thumb)
+}
+
+func (app *application) fileCollectionView(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	collectionUUID := params.ByName("uuid")
+
+	collection, err := app.collections.Get(collectionUUID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Collection = collection
+
+	app.render(w, http.StatusOK, "file_collection.tmpl.html", data)
+}
+
+// fileCollectionZip streams every file of a collection as a single ZIP archive. The archive is written straight to the
+// response as it's built, so nothing is buffered in memory or on disk.
+func (app *application) fileCollectionZip(w http.ResponseWriter, r *http.Request) {
+	params := httprouter.ParamsFromContext(r.Context())
+	collectionUUID := params.ByName("uuid")
+
+	collection, err := app.collections.Get(collectionUUID)
+	if err != nil {
+		if errors.Is(err, models.ErrNoRecord) {
+			app.clientError(w, http.StatusNotFound)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+
+	// Collections can be as large as the files in them, far more than can be sent within the server's write timeout
+	app.extendWriteDeadline(w, 0)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", fmt.Sprintf("collection-%s.zip", collection.CollectionUUID)))
+
+	// Once the first byte is written the status is already 200, so errors past this point can only be logged
+	zw := zip.NewWriter(w)
+	names := map[string]int{}
+	for _, file := range collection.Files {
+		if file.Quarantined() {
+			continue
+		}
+		err = writeZipEntry(zw, file, zipEntryName(file.FileName, names))
+		if err != nil {
+			app.errorLog.Printf("zip of collection %s: %v", collection.CollectionUUID, err)
+			return
+		}
+	}
+
+	if err = zw.Close(); err != nil {
+		app.errorLog.Printf("zip of collection %s: %v", collection.CollectionUUID, err)
+	}
+}
+
+// adminFiles lists the latest uploads with their scan results, so quarantined files can be reviewed.
+func (app *application) adminFiles(w http.ResponseWriter, r *http.Request) {
+	files, err := app.files.Latest(100)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	data := app.newTemplateData(r)
+	data.Files = files
+
+	app.render(w, http.StatusOK, "admin_files.tmpl.html", data)
 }
 
 func (app *application) billSplit(w http.ResponseWriter, r *http.Request) {
@@ -1,15 +1,36 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"clonebox/internal/assert"
+	"clonebox/internal/models"
+	"clonebox/internal/models/mocks"
+	"clonebox/internal/oidc"
+	"clonebox/internal/oidc/oidctest"
+	"clonebox/internal/totp"
+	"clonebox/internal/webauthn/webauthntest"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/png"
+	"io"
+	"log"
 	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestPing(t *testing.T) {
@@ -85,117 +106,2180 @@ func TestSnippetView(t *testing.T) {
 	}
 }
 
-func TestUserSignup(t *testing.T) {
+func TestHome(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, _, body := ts.get(t, "/")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "/shorten/abcde")
+
+	// Anyone could use up a one-time link, or see an expiring or disabled one, if they were listed
+	for _, short := range []string{"once1", "expir", "inact"} {
+		if strings.Contains(body, "/shorten/"+short) {
+			t.Errorf("link %s is listed on the home page", short)
+		}
+	}
+}
+
+func TestLinkShortenAlias(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	csrfToken := ts.login(t)
+
+	tests := []struct {
+		name     string
+		original string
+		alias    string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "No alias",
+			original: "https://nonexistent.com",
+			alias:    "",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+		},
+		{
+			name:     "Valid alias",
+			original: "https://nonexistent.com",
+			alias:    "my-link_1",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/my-link_1",
+		},
+		{
+			name:     "Too short",
+			original: "https://nonexistent.com",
+			alias:    "ab",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "at least 3 characters",
+		},
+		{
+			name:     "Too long",
+			original: "https://nonexistent.com",
+			alias:    strings.Repeat("a", 33),
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "more than 32 characters",
+		},
+		{
+			name:     "Bad characters",
+			original: "https://nonexistent.com",
+			alias:    "a/b.c",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "Only letters, numbers",
+		},
+		{
+			name:     "Reserved",
+			original: "https://nonexistent.com",
+			alias:    "Admin",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This alias is reserved",
+		},
+		{
+			name:     "Taken",
+			original: "https://nonexistent.com",
+			alias:    "abcde",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This alias is already taken",
+		},
+		{
+			name:     "Link already shortened",
+			original: "https://existent.com",
+			alias:    "second-link",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/second-link",
+		},
+		{
+			name:     "Existing alias",
+			original: "https://existent.com",
+			alias:    "abcde",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This alias is already taken",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("original_link", tt.original)
+			form.Add("alias", tt.alias)
+			form.Add("csrf_token", csrfToken)
+
+			code, _, body := ts.postForm(t, "/shorten", form)
+			assert.Equal(t, code, tt.wantCode)
+			assert.StringContains(t, body, tt.wantBody)
+		})
+	}
+
+	t.Run("Another user's link", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		csrfToken := ts.loginAs(t, "admin@example.com")
+
+		// Alice's link isn't handed out, she can disable or retarget it
+		form := url.Values{}
+		form.Add("original_link", "https://existent.com")
+		form.Add("alias", "admins-link")
+		form.Add("csrf_token", csrfToken)
+		code, _, body := ts.postForm(t, "/shorten", form)
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "/shorten/admins-link")
+	})
+}
+
+func TestLinkRedirect(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, header, _ := ts.get(t, "/shorten/abcde")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "https://existent.com")
+
+	code, _, _ = ts.get(t, "/shorten/qwerty")
+	assert.Equal(t, code, http.StatusNotFound)
+
+	code, _, _ = ts.get(t, "/shorten/inact")
+	assert.Equal(t, code, http.StatusGone)
+
+	code, _, body := ts.get(t, "/shorten/expir")
+	assert.Equal(t, code, http.StatusGone)
+	assert.StringContains(t, body, "expired on 01 Jan 2025")
+
+	code, _, body = ts.get(t, "/shorten/once1")
+	assert.Equal(t, code, http.StatusGone)
+	assert.StringContains(t, body, "could only be used 1 time")
+	assert.Equal(t, strings.Contains(body, "https://onetime.com"), false)
+}
+
+func TestLinkPreview(t *testing.T) {
 	t.Parallel()
 	app := newTestApplication(t)
 	ts := newTestServer(t, app.routes())
 	defer ts.Close()
-	_, _, body := ts.get(t, "/user/signup")
-	validCSRFToken := extractCSRFToken(t, body)
-	const (
-		validName     = "Bob"
-		validPassword = "validPa$$word"
-		validEmail    = "bob@example.com"
-		formTag       = "<form action='/user/signup' method='POST' novalidate>"
-	)
 
 	tests := []struct {
 		name         string
-		userName     string
-		userEmail    string
-		userPassword string
-		csrfToken    string
+		urlPath      string
 		wantCode     int
-		wantFormTag  string
+		wantLocation string
+		wantBody     []string
 	}{
 		{
-			name:         "Valid submission",
-			userName:     validName,
-			userEmail:    validEmail,
-			userPassword: validPassword,
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusSeeOther,
+			name:     "Requested preview",
+			urlPath:  "/shorten/abcde+",
+			wantCode: http.StatusOK,
+			wantBody: []string{"This short link leads to existent.com", "https://existent.com", "Alice Jones", "01 Jan 2025",
+				"action='/shorten/abcde' method='POST'"},
 		},
 		{
-			name:         "Invalid CSRF Token",
-			userName:     validName,
-			userEmail:    validEmail,
-			userPassword: validPassword,
-			csrfToken:    "wrongToken",
-			wantCode:     http.StatusBadRequest,
+			name:     "Forced preview",
+			urlPath:  "/shorten/other",
+			wantCode: http.StatusOK,
+			wantBody: []string{"This short link leads to others.com", "https://others.com/landing?ref=qr", "Bob Admin"},
 		},
 		{
-			name:         "Empty name",
-			userName:     "",
-			userEmail:    validEmail,
-			userPassword: validPassword,
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusUnprocessableEntity,
-			wantFormTag:  formTag,
+			name:     "Forced preview linked past",
+			urlPath:  "/shorten/other?continue=1",
+			wantCode: http.StatusOK,
+			wantBody: []string{"This short link leads to others.com"},
 		},
 		{
-			name:         "Empty email",
-			userName:     validName,
-			userEmail:    "",
-			userPassword: validPassword,
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusUnprocessableEntity,
-			wantFormTag:  formTag,
+			name:     "Preview of expired link",
+			urlPath:  "/shorten/expir+",
+			wantCode: http.StatusGone,
+			wantBody: []string{"expired on 01 Jan 2025"},
 		},
 		{
-			name:         "Empty password",
-			userName:     validName,
-			userEmail:    validEmail,
-			userPassword: "",
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusUnprocessableEntity,
-			wantFormTag:  formTag,
+			name:     "Preview of inactive link",
+			urlPath:  "/shorten/inact+",
+			wantCode: http.StatusGone,
 		},
 		{
-			name:         "Invalid email",
-			userName:     validName,
-			userEmail:    "bob@example.",
-			userPassword: validPassword,
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusUnprocessableEntity,
-			wantFormTag:  formTag,
+			name:     "Preview of unknown link",
+			urlPath:  "/shorten/qwerty+",
+			wantCode: http.StatusNotFound,
 		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, header, body := ts.get(t, tt.urlPath)
+			assert.Equal(t, code, tt.wantCode)
+			assert.Equal(t, header.Get("Location"), tt.wantLocation)
+			for _, want := range tt.wantBody {
+				assert.StringContains(t, body, want)
+			}
+		})
+	}
+
+	t.Run("Continue from forced preview", func(t *testing.T) {
+		_, _, body := ts.get(t, "/shorten/other")
+
+		// Continuing needs the form's CSRF token, so it can't be done from another site
+		form := url.Values{}
+		code, _, _ := ts.postForm(t, "/shorten/other", form)
+		assert.Equal(t, code, http.StatusBadRequest)
+
+		form.Add("csrf_token", extractCSRFToken(t, body))
+		code, header, _ := ts.postForm(t, "/shorten/other", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "https://others.com/landing?ref=qr")
+
+		code, _, _ = ts.postForm(t, "/shorten/qwerty", form)
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	t.Run("Force preview", func(t *testing.T) {
+		csrfToken := ts.login(t)
+
+		code, _, body := ts.get(t, "/shorten/abcde/edit")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "name='interstitial'")
+
+		form := url.Values{}
+		form.Add("original_link", "https://existent.com")
+		form.Add("interstitial", "true")
+		form.Add("csrf_token", csrfToken)
+
+		code, _, _ = ts.postForm(t, "/shorten/abcde/edit", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+}
+
+func TestLinkShortenPolicy(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	csrfToken := ts.login(t)
+
+	tests := []struct {
+		name     string
+		path     string
+		original string
+		wantBody string
+	}{
 		{
-			name:         "Short password",
-			userName:     validName,
-			userEmail:    validEmail,
-			userPassword: "pa$$",
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusUnprocessableEntity,
-			wantFormTag:  formTag,
+			name:     "Localhost",
+			path:     "/shorten",
+			original: "http://localhost:8080/admin",
+			wantBody: "Links to internal or private addresses aren&#39;t allowed",
 		},
 		{
-			name:         "Duplicate email",
-			userName:     validName,
-			userEmail:    "dupe@mock.com",
-			userPassword: validPassword,
-			csrfToken:    validCSRFToken,
-			wantCode:     http.StatusUnprocessableEntity,
-			wantFormTag:  formTag,
+			name:     "Private address",
+			path:     "/shorten",
+			original: "10.0.0.1",
+			wantBody: "Links to internal or private addresses aren&#39;t allowed",
+		},
+		{
+			name:     "Blocked domain",
+			path:     "/shorten",
+			original: "https://www.blocked.example/",
+			wantBody: "Links to this domain aren&#39;t allowed",
+		},
+		{
+			name:     "Own short link",
+			path:     "/shorten",
+			original: ts.URL + "/shorten/abcde",
+			wantBody: "This is already a short link",
+		},
+		{
+			name:     "Retarget to private address",
+			path:     "/shorten/abcde/edit",
+			original: "http://192.168.1.1/",
+			wantBody: "Links to internal or private addresses aren&#39;t allowed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("original_link", tt.original)
+			form.Add("csrf_token", csrfToken)
+
+			code, _, body := ts.postForm(t, tt.path, form)
+			assert.Equal(t, code, http.StatusUnprocessableEntity)
+			assert.StringContains(t, body, tt.wantBody)
+		})
+	}
+}
+
+func TestLinkShortenLimits(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	csrfToken := ts.login(t)
+
+	tests := []struct {
+		name     string
+		original string
+		expires  string
+		maxUses  string
+		wantCode int
+		wantBody string
+		notShort string
+	}{
+		{
+			name:     "Expiring",
+			original: "https://nonexistent.com",
+			expires:  "7",
+			maxUses:  "0",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+		},
+		{
+			name:     "One-time",
+			original: "https://nonexistent.com",
+			expires:  "0",
+			maxUses:  "1",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+		},
+		{
+			name:     "Invalid expiry",
+			original: "https://nonexistent.com",
+			expires:  "3",
+			maxUses:  "0",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This field must equal 0, 1, 7 or 30",
+		},
+		{
+			name:     "Negative uses",
+			original: "https://nonexistent.com",
+			expires:  "0",
+			maxUses:  "-1",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This field cannot be negative",
+		},
+		{
+			name:     "Link already shortened",
+			original: "https://existent.com",
+			expires:  "1",
+			maxUses:  "0",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+			notShort: "abcde",
+		},
+		{
+			name:     "Existing link expired",
+			original: "https://expired.com",
+			expires:  "0",
+			maxUses:  "0",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+			notShort: "expir",
+		},
+		{
+			name:     "Existing link used up",
+			original: "https://onetime.com",
+			expires:  "0",
+			maxUses:  "0",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+			notShort: "once1",
+		},
+		{
+			name:     "Existing link disabled",
+			original: "https://inactive.com",
+			expires:  "0",
+			maxUses:  "0",
+			wantCode: http.StatusOK,
+			wantBody: "/shorten/",
+			notShort: "inact",
 		},
 	}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			form := url.Values{}
-			form.Add("name", tt.userName)
-			form.Add("email", tt.userEmail)
-			form.Add("password", tt.userPassword)
-			form.Add("csrf_token", tt.csrfToken)
-			code, _, body := ts.postForm(t, "/user/signup", form)
-			assert.Equal(t, code, tt.wantCode)
-			if tt.wantFormTag != "" {
-				if tt.wantFormTag != "" {
-					assert.StringContains(t, body, tt.wantFormTag)
-				}
-			}
-		})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("original_link", tt.original)
+			form.Add("expires", tt.expires)
+			form.Add("max_uses", tt.maxUses)
+			form.Add("csrf_token", csrfToken)
+
+			code, _, body := ts.postForm(t, "/shorten", form)
+			assert.Equal(t, code, tt.wantCode)
+			assert.StringContains(t, body, tt.wantBody)
+			// Links that don't work, or will stop working, aren't handed out again
+			if tt.notShort != "" && strings.Contains(body, "/shorten/"+tt.notShort) {
+				t.Errorf("existing link %s was reused", tt.notShort)
+			}
+		})
+	}
+}
+
+func TestLinkStats(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		code, header, _ := ts.get(t, "/shorten/abcde/stats")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	ts.login(t)
+
+	t.Run("Stats", func(t *testing.T) {
+		code, _, body := ts.get(t, "/shorten/abcde/stats")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "8 clicks in the last 30 days")
+		assert.StringContains(t, body, `<svg class="chart"`)
+		assert.StringContains(t, body, "5 clicks, 4 unique")
+		assert.StringContains(t, body, "news.example.org")
+		assert.StringContains(t, body, "Direct / unknown")
+		assert.StringContains(t, body, "mobile")
+	})
+
+	t.Run("Unknown link", func(t *testing.T) {
+		code, _, _ := ts.get(t, "/shorten/qwerty/stats")
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	t.Run("Someone else's link", func(t *testing.T) {
+		code, _, _ := ts.get(t, "/shorten/other/stats")
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+}
+
+func TestLinkList(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, header, _ := ts.get(t, "/account/links")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	ts.login(t)
+
+	code, _, body := ts.get(t, "/account/links")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "https://existent.com")
+	assert.StringContains(t, body, "https://inactive.com")
+	assert.StringContains(t, body, "Deactivate")
+	assert.StringContains(t, body, "Activate")
+	assert.Equal(t, strings.Contains(body, "https://others.com"), false)
+}
+
+func TestLinkEdit(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	csrfToken := ts.login(t)
+
+	t.Run("Edit form", func(t *testing.T) {
+		code, _, body := ts.get(t, "/shorten/abcde/edit")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "value='https://existent.com'")
+	})
+
+	t.Run("Someone else's link", func(t *testing.T) {
+		code, _, _ := ts.get(t, "/shorten/other/edit")
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	tests := []struct {
+		name     string
+		short    string
+		original string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "Retarget",
+			short:    "abcde",
+			original: "elsewhere.com",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Invalid URL",
+			short:    "abcde",
+			original: "?nval?durl",
+			wantCode: http.StatusUnprocessableEntity,
+			wantBody: "This field must be a valid URL",
+		},
+		{
+			name:     "Destination shortened before",
+			short:    "abcde",
+			original: "https://inactive.com",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Someone else's link",
+			short:    "other",
+			original: "https://elsewhere.com",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("original_link", tt.original)
+			form.Add("csrf_token", csrfToken)
+
+			code, _, body := ts.postForm(t, "/shorten/"+tt.short+"/edit", form)
+			assert.Equal(t, code, tt.wantCode)
+			assert.StringContains(t, body, tt.wantBody)
+		})
+	}
+}
+
+func TestLinkActive(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	csrfToken := ts.login(t)
+
+	tests := []struct {
+		name     string
+		short    string
+		active   string
+		wantCode int
+	}{
+		{name: "Deactivate", short: "abcde", active: "false", wantCode: http.StatusSeeOther},
+		{name: "Activate", short: "inact", active: "true", wantCode: http.StatusSeeOther},
+		{name: "Someone else's link", short: "other", active: "false", wantCode: http.StatusNotFound},
+		{name: "Unknown link", short: "qwerty", active: "false", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("active", tt.active)
+			form.Add("csrf_token", csrfToken)
+
+			code, header, _ := ts.postForm(t, "/shorten/"+tt.short+"/active", form)
+			assert.Equal(t, code, tt.wantCode)
+			if code == http.StatusSeeOther {
+				assert.Equal(t, header.Get("Location"), "/account/links")
+			}
+		})
+	}
+}
+
+func TestLinkBulk(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		code, header, _ := ts.get(t, "/shorten/bulk")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	csrfToken := ts.login(t)
+	form := url.Values{}
+	form.Add("csrf_token", csrfToken)
+
+	t.Run("Form", func(t *testing.T) {
+		code, _, body := ts.get(t, "/shorten/bulk")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, `action="/shorten/bulk"`)
+
+		// Other short links still redirect, and are followed when posted to from their preview
+		code, _, _ = ts.get(t, "/shorten/abcde")
+		assert.Equal(t, code, http.StatusSeeOther)
+		code, header, _ := ts.postForm(t, "/shorten/abcde", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "https://existent.com")
+	})
+
+	t.Run("Import", func(t *testing.T) {
+		upload := strings.Join([]string{
+			"url,alias",
+			"https://new-one.com",
+			"new-two.com, my-alias",
+			"https://existent.com",
+			"https://existent.com,other-alias",
+			"http://",
+			"https://blocked.example/page",
+			"http://127.0.0.1/",
+			"https://new-three.com,abcde",
+			"https://new-four.com,my-alias",
+			"=1+1",
+			"new-one.com",
+			"",
+		}, "\n")
+
+		code, header, body := ts.postFiles(t, "/shorten/bulk", form,
+			[]testUpload{{field: "csv", fileName: "links.csv", content: []byte(upload)}})
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, header.Get("Content-Type"), "text/csv; charset=utf-8")
+		assert.StringContains(t, header.Get("Content-Disposition"), "attachment")
+
+		records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+		assert.NilError(t, err)
+		assert.Equal(t, len(records), 12)
+		assert.Equal(t, strings.Join(records[0], ","), "line,original_link,alias,short_link,status,error")
+
+		byLine := map[string][]string{}
+		for _, record := range records[1:] {
+			byLine[record[0]] = record
+		}
+
+		tests := []struct {
+			line       string
+			wantLink   string
+			wantShort  string
+			wantStatus string
+			wantError  string
+		}{
+			{line: "2", wantLink: "https://new-one.com", wantShort: ts.URL + "/shorten/", wantStatus: "created"},
+			{line: "3", wantLink: "https://new-two.com", wantShort: ts.URL + "/shorten/my-alias", wantStatus: "created"},
+			{line: "4", wantLink: "https://existent.com", wantShort: ts.URL + "/shorten/abcde", wantStatus: "exists"},
+			{line: "5", wantLink: "https://existent.com", wantShort: ts.URL + "/shorten/other-alias", wantStatus: "created"},
+			{line: "6", wantStatus: "error", wantError: "This field must be a valid URL"},
+			{line: "7", wantStatus: "error", wantError: "Links to this domain aren't allowed"},
+			{line: "8", wantStatus: "error", wantError: "Links to internal or private addresses aren't allowed"},
+			{line: "9", wantStatus: "error", wantError: "This alias is already taken"},
+			{line: "10", wantStatus: "error", wantError: "This alias is already on line 3"},
+			{line: "11", wantLink: "'=1+1", wantStatus: "error", wantError: "Links to internal or private addresses aren't allowed"},
+			{line: "12", wantStatus: "error", wantError: "This link is already on line 2"},
+		}
+
+		for _, tt := range tests {
+			record := byLine[tt.line]
+			assert.Equal(t, len(record), 6)
+			if tt.wantLink != "" {
+				assert.Equal(t, record[1], tt.wantLink)
+			}
+			assert.Equal(t, strings.HasPrefix(record[3], tt.wantShort), true)
+			assert.Equal(t, record[4], tt.wantStatus)
+			assert.Equal(t, record[5], tt.wantError)
+		}
+	})
+
+	t.Run("Invalid uploads", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			files    []testUpload
+			wantBody string
+		}{
+			{name: "No file", wantBody: "Choose a CSV file to import"},
+			{
+				name:     "Not CSV",
+				files:    []testUpload{{field: "csv", fileName: "links.csv", content: []byte("\"https://example.com")}},
+				wantBody: "This file isn&#39;t valid CSV",
+			},
+			{
+				name:     "Only a header",
+				files:    []testUpload{{field: "csv", fileName: "links.csv", content: []byte("url,alias\n\n")}},
+				wantBody: "This file doesn&#39;t contain any links",
+			},
+			{
+				name:     "Too many links",
+				files:    []testUpload{{field: "csv", fileName: "links.csv", content: bytes.Repeat([]byte("https://example.com\n"), 501)}},
+				wantBody: "At most 500 links can be imported at once",
+			},
+			{
+				name:     "Too large",
+				files:    []testUpload{{field: "csv", fileName: "links.csv", content: bytes.Repeat([]byte("a"), bulkMaxBytes+1)}},
+				wantBody: "This file is too large, import at most 1 MiB at once",
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				code, _, body := ts.postFiles(t, "/shorten/bulk", form, tt.files)
+				assert.Equal(t, code, http.StatusUnprocessableEntity)
+				assert.StringContains(t, body, tt.wantBody)
+			})
+		}
+
+		// Much larger requests aren't read at all
+		files := []testUpload{{field: "csv", fileName: "links.csv", content: bytes.Repeat([]byte("a"), bulkMaxBody)}}
+		code, _, _ := ts.postFiles(t, "/shorten/bulk", form, files)
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+}
+
+func TestLinkExport(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, header, _ := ts.get(t, "/account/links/export")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	ts.login(t)
+	code, header, body := ts.get(t, "/account/links/export")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Disposition"), `attachment; filename="links.csv"`)
+
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Join(records[0], ","), "short_link,original_link,created,expires,max_uses,uses,active,clicks")
+	// Only alice's own links
+	assert.Equal(t, len(records), 5)
+	assert.Equal(t, strings.Join(records[1], ","),
+		ts.URL+"/shorten/abcde,https://existent.com,2025-01-01T10:00:00Z,,0,0,true,8")
+	assert.Equal(t, strings.Contains(body, "others.com"), false)
+}
+
+func TestQRCode(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name            string
+		target          string
+		format          string
+		wantCode        int
+		wantContentType string
+	}{
+		{name: "Short link", target: "/shorten/abcde", wantCode: http.StatusOK, wantContentType: "image/png"},
+		{name: "Short link SVG", target: "/shorten/abcde", format: "svg", wantCode: http.StatusOK, wantContentType: "image/svg+xml"},
+		{name: "File page", target: "/file/view/123456", format: "png", wantCode: http.StatusOK, wantContentType: "image/png"},
+		{name: "Absolute URL", target: ts.URL + "/shorten/abcde", wantCode: http.StatusOK, wantContentType: "image/png"},
+		{name: "Other host", target: "https://example.com/shorten/abcde", wantCode: http.StatusBadRequest},
+		{name: "Other page", target: "/account/view", wantCode: http.StatusBadRequest},
+		{name: "Query string", target: "/shorten/abcde?ref=qr", wantCode: http.StatusBadRequest},
+		{name: "Nested path", target: "/shorten/abcde/stats", wantCode: http.StatusBadRequest},
+		{name: "No target", target: "", wantCode: http.StatusBadRequest},
+		{name: "Bad format", target: "/shorten/abcde", format: "gif", wantCode: http.StatusBadRequest},
+		{name: "Unknown link", target: "/shorten/qwerty", wantCode: http.StatusNotFound},
+		{name: "Unknown file", target: "/file/view/987654", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			query.Add("target", tt.target)
+			if tt.format != "" {
+				query.Add("format", tt.format)
+			}
+
+			code, header, body := ts.get(t, "/qr?"+query.Encode())
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, header.Get("Content-Type"), tt.wantContentType)
+			if tt.wantContentType == "image/png" {
+				_, err := png.Decode(strings.NewReader(body))
+				assert.NilError(t, err)
+			} else {
+				assert.StringContains(t, body, "<svg")
+			}
+		})
+	}
+
+	t.Run("Caching", func(t *testing.T) {
+		// Shared caches only get to keep codes that don't depend on the request's host
+		_, header, _ := ts.get(t, "/qr?target=%2fshorten%2fabcde")
+		assert.Equal(t, header.Get("Cache-Control"), "private, max-age=86400")
+
+		app := newTestApplication(t)
+		app.canonicalURL = "https://clonebox.app"
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		_, header, _ = ts.get(t, "/qr?target=%2fshorten%2fabcde")
+		assert.Equal(t, header.Get("Cache-Control"), "public, max-age=86400")
+	})
+
+	t.Run("Shown on pages", func(t *testing.T) {
+		_, _, body := ts.get(t, "/file/view/123456")
+		assert.StringContains(t, body, `src="/qr?target=%2ffile%2fview%2f123456"`)
+
+		csrfToken := ts.login(t)
+		form := url.Values{}
+		form.Add("original_link", "https://existent.com")
+		form.Add("csrf_token", csrfToken)
+
+		_, _, body = ts.postForm(t, "/shorten", form)
+		assert.StringContains(t, body, `src="/qr?target=%2fshorten%2fabcde"`)
+	})
+}
+
+func TestUserSignup(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	_, _, body := ts.get(t, "/user/signup")
+	validCSRFToken := extractCSRFToken(t, body)
+	const (
+		validName     = "Bob"
+		validPassword = "validPa$$word"
+		validEmail    = "bob@example.com"
+		formTag       = "<form action='/user/signup' method='POST' novalidate>"
+	)
+
+	tests := []struct {
+		name         string
+		userName     string
+		userEmail    string
+		userPassword string
+		csrfToken    string
+		wantCode     int
+		wantFormTag  string
+	}{
+		{
+			name:         "Valid submission",
+			userName:     validName,
+			userEmail:    validEmail,
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusSeeOther,
+		},
+		{
+			name:         "Invalid CSRF Token",
+			userName:     validName,
+			userEmail:    validEmail,
+			userPassword: validPassword,
+			csrfToken:    "wrongToken",
+			wantCode:     http.StatusBadRequest,
+		},
+		{
+			name:         "Empty name",
+			userName:     "",
+			userEmail:    validEmail,
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Empty email",
+			userName:     validName,
+			userEmail:    "",
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Empty password",
+			userName:     validName,
+			userEmail:    validEmail,
+			userPassword: "",
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Invalid email",
+			userName:     validName,
+			userEmail:    "bob@example.",
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Short password",
+			userName:     validName,
+			userEmail:    validEmail,
+			userPassword: "pa$$",
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+		{
+			name:         "Duplicate email",
+			userName:     validName,
+			userEmail:    "dupe@mock.com",
+			userPassword: validPassword,
+			csrfToken:    validCSRFToken,
+			wantCode:     http.StatusUnprocessableEntity,
+			wantFormTag:  formTag,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{}
+			form.Add("name", tt.userName)
+			form.Add("email", tt.userEmail)
+			form.Add("password", tt.userPassword)
+			form.Add("csrf_token", tt.csrfToken)
+			code, _, body := ts.postForm(t, "/user/signup", form)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantFormTag != "" {
+				if tt.wantFormTag != "" {
+					assert.StringContains(t, body, tt.wantFormTag)
+				}
+			}
+		})
+	}
+}
+
+var verifyLinkRX = regexp.MustCompile(`(/user/verify\?token=\S+)`)
+
+// Returns the path of the verification link in a mail.
+func extractVerifyLink(t *testing.T, body string) string {
+	t.Helper()
+	matches := verifyLinkRX.FindStringSubmatch(body)
+	if len(matches) < 2 {
+		t.Fatal("No verification link found in mail")
+	}
+	return matches[1]
+}
+
+func TestUserVerify(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	app.canonicalURL = "https://clonebox.app"
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	mail := app.mailer.(*testMailer)
+
+	_, _, body := ts.get(t, "/user/signup")
+	form := url.Values{}
+	form.Add("name", "Dave")
+	form.Add("email", "dave@example.com")
+	form.Add("password", "validPa$$word")
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	code, _, _ := ts.postForm(t, "/user/signup", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	msg := mail.next(t)
+	assert.Equal(t, msg.To, "dave@example.com")
+	assert.StringContains(t, msg.Body, "Hi Dave,")
+	assert.StringContains(t, msg.Body, "https://clonebox.app/user/verify?token=")
+	link := extractVerifyLink(t, msg.Body)
+
+	t.Run("No token", func(t *testing.T) {
+		code, _, body := ts.get(t, "/user/verify")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "Follow the link in the email we sent you")
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		code, _, body := ts.get(t, "/user/verify?token=abc.def")
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.StringContains(t, body, "This verification link is invalid or has expired")
+	})
+
+	t.Run("Wrong scope", func(t *testing.T) {
+		plaintext, err := app.newToken(4, "other", time.Hour)
+		assert.NilError(t, err)
+		code, _, _ := ts.get(t, "/user/verify?token="+url.QueryEscape(plaintext))
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+
+	t.Run("Valid token", func(t *testing.T) {
+		code, header, _ := ts.get(t, link)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+
+		_, _, body := ts.get(t, "/user/login")
+		assert.StringContains(t, body, "Your email address has been verified")
+	})
+
+	t.Run("Used token", func(t *testing.T) {
+		code, _, _ := ts.get(t, link)
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+}
+
+func TestRequireVerified(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+	mail := app.mailer.(*testMailer)
+
+	csrfToken := ts.loginAs(t, "carol@example.com")
+
+	for _, path := range []string{"/shorten", "/file", "/shorten/bulk"} {
+		code, header, _ := ts.get(t, path)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/verify")
+	}
+
+	code, _, body := ts.get(t, "/user/verify")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Please verify your email address first")
+	assert.StringContains(t, body, "<strong>carol@example.com</strong>")
+	assert.StringContains(t, body, "<form action='/user/verify' method='POST'>")
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, `(not verified, <a href="/user/verify">verify</a>)`)
+
+	// Asking for a new link
+	form := url.Values{}
+	form.Add("csrf_token", csrfToken)
+	code, header, _ := ts.postForm(t, "/user/verify", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/verify")
+
+	msg := mail.next(t)
+	assert.Equal(t, msg.To, "carol@example.com")
+
+	_, _, body = ts.get(t, "/user/verify")
+	assert.StringContains(t, body, "We&#39;ve sent a new verification link to carol@example.com")
+
+	// Following it while logged in leads back to the account
+	code, header, _ = ts.get(t, extractVerifyLink(t, msg.Body))
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+}
+
+func TestUserVerifyPostVerified(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	form := url.Values{}
+	form.Add("csrf_token", ts.login(t))
+	code, header, _ := ts.postForm(t, "/user/verify", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+
+	select {
+	case msg := <-app.mailer.(*testMailer).sent:
+		t.Errorf("unexpected mail to %s", msg.To)
+	default:
+	}
+}
+
+var resetLinkRX = regexp.MustCompile(`/user/password/reset\?token=(\S+)`)
+
+func TestUserPasswordReset(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	app.canonicalURL = "https://clonebox.app"
+	mail := app.mailer.(*testMailer)
+
+	// Alice is logged in on one device and resets her password on another
+	device := newTestServer(t, app.routes())
+	defer device.Close()
+	device.login(t)
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/password/forgot")
+	csrfToken := extractCSRFToken(t, body)
+
+	forgot := func(email string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("email", email)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/user/password/forgot", form)
+	}
+
+	t.Run("Invalid email", func(t *testing.T) {
+		code, _, body := forgot("alice@")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.StringContains(t, body, "This field must be a valid email address")
+	})
+
+	// Unknown and known addresses get the same response
+	code, header, _ := forgot("nobody@example.com")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+	_, _, body = ts.get(t, "/user/login")
+	assert.StringContains(t, body, "If nobody@example.com belongs to an account, we&#39;ve sent it a link")
+
+	code, header, _ = forgot("alice@example.com")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+	_, _, body = ts.get(t, "/user/login")
+	assert.StringContains(t, body, "If alice@example.com belongs to an account, we&#39;ve sent it a link")
+
+	// Only the known address was sent mail
+	msg := mail.next(t)
+	assert.Equal(t, msg.To, "alice@example.com")
+	assert.StringContains(t, msg.Body, "https://clonebox.app/user/password/reset?token=")
+	matches := resetLinkRX.FindStringSubmatch(msg.Body)
+	if len(matches) < 2 {
+		t.Fatal("No reset link found in mail")
+	}
+	resetToken, err := url.QueryUnescape(matches[1])
+	assert.NilError(t, err)
+
+	reset := func(token, password, confirm string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("token", token)
+		form.Add("new_password", password)
+		form.Add("new_password_confirm", confirm)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/user/password/reset", form)
+	}
+
+	t.Run("Invalid link", func(t *testing.T) {
+		code, _, body := ts.get(t, "/user/password/reset?token=abc.def")
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.StringContains(t, body, "This reset link is invalid or has expired")
+	})
+
+	t.Run("Verification token", func(t *testing.T) {
+		plaintext, err := app.newToken(1, models.ScopeVerification, time.Hour)
+		assert.NilError(t, err)
+		code, _, _ := reset(plaintext, "n3wPa$$word", "n3wPa$$word")
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+
+	t.Run("Form", func(t *testing.T) {
+		code, _, body := ts.get(t, "/user/password/reset?token="+url.QueryEscape(resetToken))
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, fmt.Sprintf("<input type='hidden' name='token' value='%s'>", resetToken))
+	})
+
+	t.Run("Mismatched passwords", func(t *testing.T) {
+		code, _, body := reset(resetToken, "n3wPa$$word", "other")
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.StringContains(t, body, "Passwords do not match")
+	})
+
+	t.Run("Valid reset", func(t *testing.T) {
+		code, header, _ := reset(resetToken, "n3wPa$$word", "n3wPa$$word")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+
+		// The other device's session has ended
+		code, header, _ = device.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	t.Run("Used link", func(t *testing.T) {
+		code, _, body := reset(resetToken, "n3wPa$$word", "n3wPa$$word")
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.StringContains(t, body, "This reset link is invalid or has expired")
+	})
+}
+
+// wrongTOTPCode returns a code that isn't valid for secret right now.
+func wrongTOTPCode(t *testing.T, secret string) string {
+	t.Helper()
+	for _, code := range []string{"000000", "111111", "222222", "333333"} {
+		if _, ok := totp.Validate(secret, code, time.Now()); !ok {
+			return code
+		}
+	}
+	t.Fatal("no wrong code found")
+	return ""
+}
+
+func TestUserLoginThrottle(t *testing.T) {
+	t.Parallel()
+
+	attempt := func(ts *testServer, email, password string) (int, http.Header, string) {
+		_, _, body := ts.get(t, "/user/login")
+		form := url.Values{}
+		form.Add("email", email)
+		form.Add("password", password)
+		form.Add("csrf_token", extractCSRFToken(t, body))
+		return ts.postForm(t, "/user/login", form)
+	}
+
+	t.Run("Delay", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		for i := 0; i <= loginEmailPolicy.Free; i++ {
+			code, _, body := attempt(ts, "alice@example.com", "wrong")
+			assert.Equal(t, code, http.StatusUnauthorized)
+			assert.StringContains(t, body, "Email or Password is incorrect")
+		}
+
+		// Not even the right password is let through while waiting, whatever the case of the address
+		code, header, body := attempt(ts, "Alice@Example.com", "p@ssw0rd")
+		assert.Equal(t, code, http.StatusTooManyRequests)
+		assert.Equal(t, header.Get("Retry-After"), "1")
+		assert.StringContains(t, body, "Too many failed login attempts, please wait 1 second before trying again")
+
+		// Other users logging in from the same IP aren't held up
+		code, _, _ = attempt(ts, "carol@example.com", "p@ssw0rd")
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+
+	t.Run("Lockout", func(t *testing.T) {
+		app := newTestApplication(t)
+		var securityLog bytes.Buffer
+		app.securityLog = log.New(&securityLog, "", 0)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		// Earlier failures whose delays have passed
+		earlier := time.Now().Add(-10 * time.Minute)
+		for i := 1; i < loginEmailPolicy.LockoutAfter; i++ {
+			_, err := app.loginThrottle.emails.Fail(loginEmailKey("alice@example.com"), earlier)
+			assert.NilError(t, err)
+		}
+
+		code, _, _ := attempt(ts, "alice@example.com", "wrong")
+		assert.Equal(t, code, http.StatusUnauthorized)
+		assert.StringContains(t, securityLog.String(), "login for alice@example.com locked for 15m0s")
+
+		code, header, body := attempt(ts, "alice@example.com", "p@ssw0rd")
+		assert.Equal(t, code, http.StatusTooManyRequests)
+		assert.Equal(t, header.Get("Retry-After"), "900")
+		assert.StringContains(t, body, "logging in is locked for 15 minutes")
+	})
+
+	t.Run("Concurrent guesses", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		_, _, body := ts.get(t, "/user/login")
+		form := url.Values{}
+		form.Add("email", "alice@example.com")
+		form.Add("password", "wrong")
+		form.Add("csrf_token", extractCSRFToken(t, body))
+
+		// Guesses sent at once are each counted before they're checked, so only the free ones get through
+		var wg sync.WaitGroup
+		var unauthorized atomic.Int32
+		for range 20 {
+			wg.Go(func() {
+				code, _, _ := ts.postForm(t, "/user/login", form)
+				if code == http.StatusUnauthorized {
+					unauthorized.Add(1)
+				}
+			})
+		}
+		wg.Wait()
+		assert.Equal(t, int(unauthorized.Load()), loginEmailPolicy.Free+1)
+	})
+
+	t.Run("Reset by login", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		for i := 0; i < loginEmailPolicy.Free; i++ {
+			attempt(ts, "alice@example.com", "wrong")
+		}
+		code, _, _ := attempt(ts, "alice@example.com", "p@ssw0rd")
+		assert.Equal(t, code, http.StatusSeeOther)
+
+		// The count starts over, so there's no delay yet
+		for i := 0; i <= loginEmailPolicy.Free; i++ {
+			code, _, _ := attempt(ts, "alice@example.com", "wrong")
+			assert.Equal(t, code, http.StatusUnauthorized)
+		}
+	})
+
+	t.Run("Two-factor codes", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		submitCode := func(code string) (int, http.Header, string) {
+			_, _, body := ts.get(t, "/user/login/2fa")
+			form := url.Values{}
+			form.Add("code", code)
+			form.Add("csrf_token", extractCSRFToken(t, body))
+			return ts.postForm(t, "/user/login/2fa", form)
+		}
+
+		// Wrong codes count as failed logins, and the right password doesn't start the count over
+		for i := 0; i <= loginEmailPolicy.Free; i++ {
+			code, header, _ := attempt(ts, "erin@example.com", "p@ssw0rd")
+			assert.Equal(t, code, http.StatusSeeOther)
+			assert.Equal(t, header.Get("Location"), "/user/login/2fa")
+
+			code, _, _ = submitCode("wrong")
+			assert.Equal(t, code, http.StatusUnauthorized)
+		}
+
+		code, header, body := submitCode("ABCD EFGH IJKL MNOP")
+		assert.Equal(t, code, http.StatusTooManyRequests)
+		assert.Equal(t, header.Get("Retry-After"), "1")
+		assert.StringContains(t, body, "Too many failed login attempts, please wait 1 second before trying again")
+
+		code, _, _ = attempt(ts, "erin@example.com", "p@ssw0rd")
+		assert.Equal(t, code, http.StatusTooManyRequests)
+	})
+
+	t.Run("IP lockout", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		for i := 0; i < loginIPPolicy.LockoutAfter; i++ {
+			_, err := app.loginThrottle.ips.Fail("127.0.0.1", time.Now())
+			assert.NilError(t, err)
+		}
+
+		code, header, _ := attempt(ts, "carol@example.com", "p@ssw0rd")
+		assert.Equal(t, code, http.StatusTooManyRequests)
+		assert.Equal(t, header.Get("Retry-After"), "3600")
+	})
+}
+
+func TestUserLoginRememberMe(t *testing.T) {
+	t.Parallel()
+
+	login := func(ts *testServer, rememberMe bool) http.Header {
+		_, _, body := ts.get(t, "/user/login")
+		form := url.Values{}
+		form.Add("email", "alice@example.com")
+		form.Add("password", "p@ssw0rd")
+		if rememberMe {
+			form.Add("remember_me", "true")
+		}
+		form.Add("csrf_token", extractCSRFToken(t, body))
+		code, header, _ := ts.postForm(t, "/user/login", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		return header
+	}
+	sessionCookie := func(header http.Header) *http.Cookie {
+		for _, c := range (&http.Response{Header: header}).Cookies() {
+			if c.Name == "session" {
+				return c
+			}
+		}
+		t.Fatal("no session cookie set")
+		return nil
+	}
+
+	app := newTestApplication(t)
+	// Every login has been idle too long by its next request, unless it's remembered
+	app.idleTimeout = time.Nanosecond
+
+	t.Run("Default", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		cookie := sessionCookie(login(ts, false))
+		assert.Equal(t, cookie.Expires.IsZero(), true)
+
+		code, header, _ := ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	t.Run("Remembered", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		cookie := sessionCookie(login(ts, true))
+		assert.Equal(t, cookie.Expires.After(time.Now().Add(29*24*time.Hour)), true)
+
+		code, _, _ := ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusOK)
+	})
+}
+
+func TestRequireRecentLogin(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	reauthenticate := func(csrfToken, password string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("password", password)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/user/reauthenticate", form)
+	}
+
+	csrfToken := ts.login(t)
+	code, _, _ := ts.get(t, "/account/password/update")
+	assert.Equal(t, code, http.StatusOK)
+
+	// The login is now too old for changing the password
+	app.reauthAfter = -time.Hour
+	code, header, _ := ts.get(t, "/account/password/update")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/reauthenticate")
+
+	form := url.Values{}
+	form.Add("currentPassword", "p@ssw0rd")
+	form.Add("newPassword", "n3wp@ssw0rd")
+	form.Add("newPasswordConfirm", "n3wp@ssw0rd")
+	form.Add("csrf_token", csrfToken)
+	code, header, _ = ts.postForm(t, "/account/password/update", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/reauthenticate")
+
+	// Adding a passkey is another way in, so it needs a recent login too
+	code, _ = ts.postPasskey(t, "/account/passkeys/begin", csrfToken, "application/x-www-form-urlencoded",
+		[]byte("name=Laptop"))
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	code, _, body := ts.get(t, "/user/reauthenticate")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "<form action='/user/reauthenticate' method='POST' novalidate>")
+
+	code, _, body = reauthenticate(csrfToken, "wrong")
+	assert.Equal(t, code, http.StatusUnauthorized)
+	assert.StringContains(t, body, "Password is incorrect")
+
+	// Entering the password makes the login recent again, and returns to the page that asked for it
+	app.reauthAfter = 10 * time.Minute
+	code, header, _ = reauthenticate(csrfToken, "p@ssw0rd")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/password/update")
+
+	code, _, _ = ts.get(t, "/account/password/update")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestUserLoginTwoFactor(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	submitCode := func(csrfToken, code string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("code", code)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/user/login/2fa", form)
+	}
+	logout := func(csrfToken string) {
+		form := url.Values{}
+		form.Add("csrf_token", csrfToken)
+		ts.postForm(t, "/user/logout", form)
+	}
+
+	t.Run("No pending login", func(t *testing.T) {
+		code, header, _ := ts.get(t, "/user/login/2fa")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	// The password alone doesn't log in
+	_, _, body := ts.get(t, "/user/login")
+	csrfToken := extractCSRFToken(t, body)
+	form := url.Values{}
+	form.Add("email", "erin@example.com")
+	form.Add("password", "p@ssw0rd")
+	form.Add("csrf_token", csrfToken)
+	code, header, _ := ts.postForm(t, "/user/login", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login/2fa")
+
+	code, header, _ = ts.get(t, "/account/view")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+
+	code, _, body = ts.get(t, "/user/login/2fa")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "<form action='/user/login/2fa' method='POST' novalidate>")
+
+	code, _, body = submitCode(csrfToken, wrongTOTPCode(t, mocks.MockTOTPSecret))
+	assert.Equal(t, code, http.StatusUnauthorized)
+	assert.StringContains(t, body, "This code is incorrect or has already been used")
+
+	totpCode, err := totp.Code(mocks.MockTOTPSecret, time.Now())
+	assert.NilError(t, err)
+	// Continues to the page that asked for the login
+	code, header, _ = submitCode(csrfToken, totpCode)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+
+	code, _, body = ts.get(t, "/account/view")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Erin Secure")
+	logout(csrfToken)
+
+	// The same code can't be used twice, a recovery code can (once) instead
+	ts.loginAs(t, "erin@example.com")
+	code, _, _ = submitCode(csrfToken, totpCode)
+	assert.Equal(t, code, http.StatusUnauthorized)
+	code, header, _ = submitCode(csrfToken, "ABCD EFGH IJKL MNOP")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/about")
+	logout(csrfToken)
+
+	ts.loginAs(t, "erin@example.com")
+	code, _, _ = submitCode(csrfToken, "abcd-efgh-ijkl-mnop")
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	t.Run("Too many attempts", func(t *testing.T) {
+		// Only the pending login's own limit is under test here, TestUserLoginThrottle covers the other
+		app.loginThrottle.emails.Policy.Free = 2 * twoFactorMaxAttempts
+
+		ts.loginAs(t, "erin@example.com")
+		for i := 1; i < twoFactorMaxAttempts; i++ {
+			code, _, _ := submitCode(csrfToken, "wrong")
+			assert.Equal(t, code, http.StatusUnauthorized)
+		}
+
+		code, header, _ := submitCode(csrfToken, "wrong")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+
+		_, _, body := ts.get(t, "/user/login")
+		assert.StringContains(t, body, "Too many incorrect codes, please log in again")
+
+		code, _, _ = ts.get(t, "/user/login/2fa")
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+}
+
+func TestAccountProfile(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csrfToken := ts.login(t)
+
+	code, _, body := ts.get(t, "/account/profile")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "value='Alice Jones'")
+
+	update := func(name string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("name", name)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/account/profile", form)
+	}
+
+	code, _, body = update("  ")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "This field cannot be blank")
+
+	code, header, _ := update("Alice Smith")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, "Your name has been changed")
+	assert.StringContains(t, body, "Alice Smith")
+}
+
+var emailChangeLinkRX = regexp.MustCompile(`(/account/email/confirm\?token=\S+)`)
+
+func TestAccountEmailChange(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	mail := app.mailer.(*testMailer)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csrfToken := ts.login(t)
+
+	change := func(email string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("email", email)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/account/email", form)
+	}
+	confirmLink := func(to string) string {
+		msg := mail.next(t)
+		assert.Equal(t, msg.To, to)
+		matches := emailChangeLinkRX.FindStringSubmatch(msg.Body)
+		if len(matches) < 2 {
+			t.Fatal("No confirmation link found in mail")
+		}
+		return matches[1]
+	}
+
+	code, _, body := ts.get(t, "/account/email")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Your email address is alice@example.com.")
+
+	tests := []struct {
+		name    string
+		email   string
+		wantErr string
+	}{
+		{name: "Blank", email: "", wantErr: "This field cannot be blank"},
+		{name: "Invalid", email: "alice@", wantErr: "This field must be a valid email address"},
+		{name: "Unchanged", email: "Alice@Example.com", wantErr: "This is already your email address"},
+		{name: "Taken", email: "admin@example.com", wantErr: "Email is already in use"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _, body := change(tt.email)
+			assert.Equal(t, code, http.StatusUnprocessableEntity)
+			assert.StringContains(t, body, tt.wantErr)
+		})
+	}
+
+	// Nothing changes until the new address is confirmed
+	code, header, _ := change("alice@example.org")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+	link := confirmLink("alice@example.org")
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, "We&#39;ve sent a link to alice@example.org")
+	assert.StringContains(t, body, "Waiting for you to confirm alice@example.org")
+	assert.StringContains(t, body, "alice@example.com")
+
+	// The link works on a device that isn't logged in, and the old address is told about the change
+	other := newTestServer(t, app.routes())
+	defer other.Close()
+	code, header, _ = other.get(t, link)
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/user/login")
+	_, _, body = other.get(t, "/user/login")
+	assert.StringContains(t, body, "Your email address has been changed")
+
+	msg := mail.next(t)
+	assert.Equal(t, msg.To, "alice@example.com")
+	assert.StringContains(t, msg.Body, "changed to alice@example.org")
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, "alice@example.org")
+	assert.Equal(t, strings.Contains(body, "Waiting for you to confirm"), false)
+
+	t.Run("Used link", func(t *testing.T) {
+		code, header, _ := ts.get(t, link)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/account/view")
+		_, _, body := ts.get(t, "/account/view")
+		assert.StringContains(t, body, "This confirmation link is invalid or has expired")
+	})
+
+	t.Run("Taken before confirming", func(t *testing.T) {
+		code, _, _ := change("dupe@mock.com")
+		assert.Equal(t, code, http.StatusSeeOther)
+
+		ts.get(t, confirmLink("dupe@mock.com"))
+		_, _, body := ts.get(t, "/account/view")
+		assert.StringContains(t, body, "dupe@mock.com has been taken by another account in the meantime")
+	})
+}
+
+var (
+	totpKeyRX      = regexp.MustCompile(`Key: <code>([A-Z2-7]+)</code>`)
+	recoveryCodeRX = regexp.MustCompile(`<li><code>([a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4}-[a-z2-7]{4})</code></li>`)
+)
+
+func TestAccountTwoFactor(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csrfToken := ts.login(t)
+
+	code, _, body := ts.get(t, "/account/view")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, `Off (<a href="/account/2fa">Manage</a>)`)
+
+	code, _, body = ts.get(t, "/account/2fa")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "<div class='qr'><svg")
+	assert.StringContains(t, body, "href='otpauth://totp/Clonebox:alice@example.com?")
+	matches := totpKeyRX.FindStringSubmatch(body)
+	if len(matches) < 2 {
+		t.Fatal("No TOTP key found in body")
+	}
+	secret := matches[1]
+
+	// The secret stays the same until it's confirmed
+	_, _, body = ts.get(t, "/account/2fa")
+	assert.StringContains(t, body, "Key: <code>"+secret+"</code>")
+
+	enable := func(code string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("code", code)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/account/2fa/enable", form)
+	}
+
+	code, _, body = enable(wrongTOTPCode(t, secret))
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "This code is incorrect")
+
+	totpCode, err := totp.Code(secret, time.Now())
+	assert.NilError(t, err)
+	code, _, body = enable(totpCode)
+	assert.Equal(t, code, http.StatusOK)
+	recoveryCodes := recoveryCodeRX.FindAllStringSubmatch(body, -1)
+	assert.Equal(t, len(recoveryCodes), recoveryCodeCount)
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, `On (<a href="/account/2fa">Manage</a>)`)
+	_, _, body = ts.get(t, "/account/2fa")
+	assert.StringContains(t, body, "You have 10 recovery codes left")
+
+	// Logging in again takes a code, the one used to enable it is spent
+	form := url.Values{}
+	form.Add("csrf_token", csrfToken)
+	ts.postForm(t, "/user/logout", form)
+	ts.login(t)
+
+	form = url.Values{}
+	form.Add("code", totpCode)
+	form.Add("csrf_token", csrfToken)
+	code, _, _ = ts.postForm(t, "/user/login/2fa", form)
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	form.Set("code", recoveryCodes[0][1])
+	code, _, _ = ts.postForm(t, "/user/login/2fa", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+
+	disable := func(password string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("password", password)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/account/2fa/disable", form)
+	}
+
+	code, _, body = disable("wrong")
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.StringContains(t, body, "Entered password is not your current password")
+
+	code, header, _ := disable("p@ssw0rd")
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, "Two-factor authentication has been turned off")
+	assert.StringContains(t, body, `Off (<a href="/account/2fa">Manage</a>)`)
+}
+
+var passkeyIDRX = regexp.MustCompile(`<input type='hidden' name='id' value='([^']+)'>`)
+
+// registerPasskey adds a passkey on auth to the logged in user's account.
+func registerPasskey(t *testing.T, ts *testServer, csrfToken string, auth *webauthntest.Authenticator, name string) {
+	t.Helper()
+	code, options := ts.postPasskey(t, "/account/passkeys/begin", csrfToken, "application/x-www-form-urlencoded",
+		[]byte(url.Values{"name": {name}}.Encode()))
+	assert.Equal(t, code, http.StatusOK)
+
+	credential, err := auth.Create(options)
+	assert.NilError(t, err)
+	code, body := ts.postPasskey(t, "/account/passkeys/finish", csrfToken, "application/json", credential)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, string(body), `{"redirect":"/account/view"}`)
+}
+
+// loginWithPasskey logs in with a passkey on auth, and returns the finishing response.
+func loginWithPasskey(t *testing.T, ts *testServer, auth *webauthntest.Authenticator) (int, string) {
+	t.Helper()
+	// Test servers listen on different ports, the browser reports the one it's on
+	auth.Origin = ts.URL
+	_, _, body := ts.get(t, "/user/login")
+	csrfToken := extractCSRFToken(t, body)
+
+	code, options := ts.postPasskey(t, "/user/login/passkey/begin", csrfToken, "application/x-www-form-urlencoded", nil)
+	assert.Equal(t, code, http.StatusOK)
+
+	assertion, err := auth.Get(options)
+	assert.NilError(t, err)
+	code, resp := ts.postPasskey(t, "/user/login/passkey/finish", csrfToken, "application/json", assertion)
+	return code, string(resp)
+}
+
+var sessionIDRX = regexp.MustCompile(`<input type='hidden' name='id' value='([0-9a-f-]{36})'>`)
+
+func TestAccountSessions(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	// Two devices logged in as the same user
+	laptop := newTestServer(t, app.routes())
+	defer laptop.Close()
+	phone := newTestServer(t, app.routes())
+	defer phone.Close()
+
+	csrfToken := laptop.login(t)
+	phone.login(t)
+
+	code, _, body := laptop.get(t, "/account/sessions")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "This device")
+	// Only the other device can be logged out from here
+	matches := sessionIDRX.FindAllStringSubmatch(body, -1)
+	assert.Equal(t, len(matches), 1)
+
+	t.Run("Revoke", func(t *testing.T) {
+		form := url.Values{}
+		form.Add("id", matches[0][1])
+		form.Add("csrf_token", csrfToken)
+		code, header, _ := laptop.postForm(t, "/account/sessions/revoke", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/account/sessions")
+
+		code, header, _ = phone.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+
+		code, _, _ = laptop.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusOK)
+
+		// Already revoked
+		code, _, _ = laptop.postForm(t, "/account/sessions/revoke", form)
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	t.Run("Other user's session", func(t *testing.T) {
+		phone.loginAs(t, "carol@example.com")
+		sessions, err := app.userSessions.ByUser(3)
+		assert.NilError(t, err)
+		assert.Equal(t, len(sessions), 1)
+
+		form := url.Values{}
+		form.Add("id", sessions[0].ID)
+		form.Add("csrf_token", csrfToken)
+		code, _, _ := laptop.postForm(t, "/account/sessions/revoke", form)
+		assert.Equal(t, code, http.StatusNotFound)
+
+		code, _, _ = phone.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusOK)
+	})
+
+	t.Run("Log out everywhere", func(t *testing.T) {
+		phoneCSRFToken := phone.login(t)
+
+		form := url.Values{}
+		form.Add("csrf_token", csrfToken)
+		code, header, _ := laptop.postForm(t, "/account/sessions/revoke-all", form)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/")
+
+		for _, ts := range []*testServer{laptop, phone} {
+			code, _, _ := ts.get(t, "/account/view")
+			assert.Equal(t, code, http.StatusSeeOther)
+		}
+
+		// Logging out removes the session from the list
+		phone.login(t)
+		form = url.Values{}
+		form.Add("csrf_token", phoneCSRFToken)
+		phone.postForm(t, "/user/logout", form)
+		sessions, err := app.userSessions.ByUser(1)
+		assert.NilError(t, err)
+		assert.Equal(t, len(sessions), 0)
+	})
+}
+
+func TestAccountPasskeys(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	csrfToken := ts.login(t)
+	auth := webauthntest.New(ts.URL)
+
+	t.Run("Blank name", func(t *testing.T) {
+		code, body := ts.postPasskey(t, "/account/passkeys/begin", csrfToken, "application/x-www-form-urlencoded",
+			[]byte("name=+"))
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.StringContains(t, string(body), "This field cannot be blank")
+	})
+
+	t.Run("Finish without begin", func(t *testing.T) {
+		code, body := ts.postPasskey(t, "/account/passkeys/finish", csrfToken, "application/json", []byte("{}"))
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.StringContains(t, string(body), "please try again")
+	})
+
+	t.Run("Missing CSRF token", func(t *testing.T) {
+		code, _ := ts.postPasskey(t, "/account/passkeys/begin", "", "application/x-www-form-urlencoded",
+			[]byte("name=Laptop"))
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+
+	registerPasskey(t, ts, csrfToken, auth, "Laptop")
+
+	code, _, body := ts.get(t, "/account/view")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Passkey added, you can now log in with it")
+	assert.StringContains(t, body, "<td>Laptop</td>")
+	assert.StringContains(t, body, "<td>Never</td>")
+
+	t.Run("Already registered", func(t *testing.T) {
+		// The authenticator is told about the user's existing passkeys, and refuses to make another
+		code, options := ts.postPasskey(t, "/account/passkeys/begin", csrfToken, "application/x-www-form-urlencoded",
+			[]byte("name=Again"))
+		assert.Equal(t, code, http.StatusOK)
+		_, err := auth.Create(options)
+		if !errors.Is(err, webauthntest.ErrExcluded) {
+			t.Errorf("got %v; want ErrExcluded", err)
+		}
+	})
+
+	t.Run("Wrong origin", func(t *testing.T) {
+		code, options := ts.postPasskey(t, "/account/passkeys/begin", csrfToken, "application/x-www-form-urlencoded",
+			[]byte("name=Phishing"))
+		assert.Equal(t, code, http.StatusOK)
+		credential, err := webauthntest.New("https://evil.example").Create(options)
+		assert.NilError(t, err)
+
+		code, body := ts.postPasskey(t, "/account/passkeys/finish", csrfToken, "application/json", credential)
+		assert.Equal(t, code, http.StatusBadRequest)
+		assert.StringContains(t, string(body), "This passkey couldn't be verified")
+	})
+
+	matches := passkeyIDRX.FindStringSubmatch(body)
+	if len(matches) < 2 {
+		t.Fatal("No passkey ID found in body")
+	}
+
+	remove := func(id string) (int, http.Header, string) {
+		form := url.Values{}
+		form.Add("id", id)
+		form.Add("csrf_token", csrfToken)
+		return ts.postForm(t, "/account/passkeys/delete", form)
+	}
+
+	code, header, _ := remove(matches[1])
+	assert.Equal(t, code, http.StatusSeeOther)
+	assert.Equal(t, header.Get("Location"), "/account/view")
+
+	_, _, body = ts.get(t, "/account/view")
+	assert.StringContains(t, body, "Passkey removed")
+	if passkeyIDRX.MatchString(body) {
+		t.Error("removed passkey still listed")
+	}
+
+	code, _, _ = remove(matches[1])
+	assert.Equal(t, code, http.StatusNotFound)
+}
+
+func TestUserLoginPasskey(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+
+	// Erin has two-factor authentication, which a passkey stands in for
+	setup := newTestServer(t, app.routes())
+	defer setup.Close()
+	auth := webauthntest.New(setup.URL)
+	csrfToken := setup.loginAs(t, "erin@example.com")
+	totpCode, err := totp.Code(mocks.MockTOTPSecret, time.Now())
+	assert.NilError(t, err)
+	form := url.Values{}
+	form.Add("code", totpCode)
+	form.Add("csrf_token", csrfToken)
+	code, _, _ := setup.postForm(t, "/user/login/2fa", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	registerPasskey(t, setup, csrfToken, auth, "Phone")
+
+	t.Run("Valid", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, body := loginWithPasskey(t, ts, auth)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, body, `{"redirect":"/about"}`)
+
+		code, _, page := ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, page, "Erin Secure")
+	})
+
+	t.Run("Unregistered passkey", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		// A passkey made for this site, but never stored
+		stranger := webauthntest.New(ts.URL)
+		options, err := json.Marshal(map[string]any{
+			"rp":        map[string]string{"id": "127.0.0.1"},
+			"user":      map[string]string{"id": "AQ"},
+			"challenge": "AQ",
+		})
+		assert.NilError(t, err)
+		_, err = stranger.Create(options)
+		assert.NilError(t, err)
+
+		code, body := loginWithPasskey(t, ts, stranger)
+		assert.Equal(t, code, http.StatusUnauthorized)
+		assert.StringContains(t, body, "This passkey isn")
+
+		code, _, _ = ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+
+	t.Run("Replayed response", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		_, _, body := ts.get(t, "/user/login")
+		csrfToken := extractCSRFToken(t, body)
+		_, options := ts.postPasskey(t, "/user/login/passkey/begin", csrfToken, "application/x-www-form-urlencoded", nil)
+		auth.Origin = ts.URL
+		assertion, err := auth.Get(options)
+		assert.NilError(t, err)
+
+		code, _ := ts.postPasskey(t, "/user/login/passkey/finish", csrfToken, "application/json", assertion)
+		assert.Equal(t, code, http.StatusOK)
+
+		// The challenge is used up, and logging in renewed the session anyway
+		_, _, body = ts.get(t, "/user/login")
+		csrfToken = extractCSRFToken(t, body)
+		code, _ = ts.postPasskey(t, "/user/login/passkey/finish", csrfToken, "application/json", assertion)
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+
+	t.Run("Without user verification", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		auth.SkipUserVerification = true
+		defer func() { auth.SkipUserVerification = false }()
+
+		code, body := loginWithPasskey(t, ts, auth)
+		assert.Equal(t, code, http.StatusUnauthorized)
+		assert.StringContains(t, body, "This passkey couldn")
+	})
+}
+
+// ssoLogin goes through single sign-on with the identity provider logging in as user, and returns the response to
+// the callback.
+func ssoLogin(t *testing.T, ts *testServer, iss *oidctest.Issuer, user *oidctest.User) (int, http.Header) {
+	t.Helper()
+	iss.LogIn(user)
+
+	_, _, body := ts.get(t, "/user/login")
+	assert.StringContains(t, body, "Log in with Example SSO")
+	form := url.Values{}
+	form.Add("csrf_token", extractCSRFToken(t, body))
+	code, header, _ := ts.postForm(t, "/user/login/sso", form)
+	assert.Equal(t, code, http.StatusSeeOther)
+	if !strings.HasPrefix(header.Get("Location"), iss.URL+"/authorize?") {
+		t.Fatalf("redirected to %q; want the identity provider", header.Get("Location"))
+	}
+
+	// The identity provider sends the browser back to the callback
+	rs, err := ts.Client().Get(header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+	callback, err := url.Parse(rs.Header.Get("Location"))
+	assert.NilError(t, err)
+	assert.Equal(t, callback.Path, "/user/login/sso/callback")
+
+	code, header, _ = ts.get(t, callback.RequestURI())
+	return code, header
+}
+
+func TestUserLoginSSO(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	iss := oidctest.NewIssuer("clonebox", "secret")
+	defer iss.Close()
+	app.sso = &oidc.Client{Issuer: iss.URL, ClientID: "clonebox", ClientSecret: "secret"}
+	app.ssoName = "Example SSO"
+
+	t.Run("New user", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, header := ssoLogin(t, ts, iss, &oidctest.User{
+			Subject: "dave-1", Email: "dave@example.com", EmailVerified: true, Name: "Dave Remote",
+		})
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/about")
+
+		_, _, body := ts.get(t, "/account/view")
+		assert.StringContains(t, body, "Dave Remote")
+		assert.StringContains(t, body, "dave@example.com")
+		if strings.Contains(body, "not verified") {
+			t.Error("provisioned user isn't verified")
+		}
+	})
+
+	t.Run("Linked by email", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, _ := ssoLogin(t, ts, iss, &oidctest.User{
+			Subject: "alice-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice at Work",
+		})
+		assert.Equal(t, code, http.StatusSeeOther)
+		_, _, body := ts.get(t, "/account/view")
+		assert.StringContains(t, body, "Alice Jones")
+
+		// From then on the account is found by its subject, whatever its email address
+		ts2 := newTestServer(t, app.routes())
+		defer ts2.Close()
+		code, _ = ssoLogin(t, ts2, iss, &oidctest.User{Subject: "alice-1", Email: "alice@new.example"})
+		assert.Equal(t, code, http.StatusSeeOther)
+		_, _, body = ts2.get(t, "/account/view")
+		assert.StringContains(t, body, "Alice Jones")
+	})
+
+	t.Run("Unverified account", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		// Whoever signed up with the address may not own it, so the account isn't handed to them
+		code, header := ssoLogin(t, ts, iss, &oidctest.User{
+			Subject: "carol-1", Email: "carol@example.com", EmailVerified: true, Name: "Carol Remote",
+		})
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+
+		_, _, body := ts.get(t, "/user/login")
+		assert.StringContains(t, body, "An account with your email address hasn&#39;t been verified yet")
+		code, _, _ = ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+
+	t.Run("Unverified email", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, header := ssoLogin(t, ts, iss, &oidctest.User{Subject: "mallory-1", Email: "admin@example.com"})
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+
+		_, _, body := ts.get(t, "/user/login")
+		assert.StringContains(t, body, "Example SSO hasn&#39;t verified your email address")
+		code, _, _ = ts.get(t, "/account/view")
+		assert.Equal(t, code, http.StatusSeeOther)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, header := ssoLogin(t, ts, iss, nil)
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+		_, _, body := ts.get(t, "/user/login")
+		assert.StringContains(t, body, "Logging in with Example SSO was cancelled")
+	})
+
+	t.Run("Forged callback", func(t *testing.T) {
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		// A callback this session didn't start, e.g. a link from someone else's login
+		code, header, _ := ts.get(t, "/user/login/sso/callback?code=abc&state=xyz")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+		_, _, body := ts.get(t, "/user/login")
+		assert.StringContains(t, body, "Your login with Example SSO has expired")
+	})
+}
+
+func TestUserLoginSSODisabled(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	_, _, body := ts.get(t, "/user/login")
+	if strings.Contains(body, "/user/login/sso") {
+		t.Error("login page offers single sign-on without an identity provider")
 	}
+
+	code, _, _ := ts.get(t, "/user/login/sso/callback?code=abc&state=xyz")
+	assert.Equal(t, code, http.StatusNotFound)
 }
 
 func TestSnippetCreate(t *testing.T) {
@@ -262,8 +2346,10 @@ func TestLinkShorten(t *testing.T) {
 		form2.Add("original_link", "https://existent.com")
 		form2.Add("csrf_token", validCSRFToken)
 
-		code, _, _ = ts.postForm(t, "/shorten", form2)
+		code, _, body = ts.postForm(t, "/shorten", form2)
 		assert.Equal(t, code, http.StatusOK)
+		// Short links are absolute, including the scheme
+		assert.StringContains(t, body, fmt.Sprintf(`value="%s/shorten/abcde"`, ts.URL))
 	})
 
 	t.Run("Bad Form", func(t *testing.T) {
@@ -313,7 +2399,265 @@ func TestFileUpload(t *testing.T) {
 		assert.Equal(t, code, http.StatusOK)
 		assert.StringContains(t, body, "<form action=\"/file\" method=\"post\" enctype=\"multipart/form-data\">")
 
-		// TODO: Multipart form upload test
+	})
+
+	t.Run("Single file", func(t *testing.T) {
+		validCSRFToken := ts.login(t)
+		form := url.Values{"csrf_token": {validCSRFToken}}
+
+		code, header, _ := ts.postFiles(t, "/file", form, []testUpload{
+			{fileName: "notes.txt", content: []byte("some notes")},
+		})
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.StringContains(t, header.Get("Location"), "/file/view/")
+	})
+
+	t.Run("Multiple files", func(t *testing.T) {
+		validCSRFToken := ts.login(t)
+		form := url.Values{"csrf_token": {validCSRFToken}}
+
+		code, header, _ := ts.postFiles(t, "/file", form, []testUpload{
+			{fileName: "notes.txt", content: []byte("some notes")},
+			{fileName: "more_notes.txt", content: []byte("some more notes")},
+		})
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.StringContains(t, header.Get("Location"), "/file/collection/")
+	})
+
+	t.Run("No files", func(t *testing.T) {
+		validCSRFToken := ts.login(t)
+		form := url.Values{"csrf_token": {validCSRFToken}}
+
+		code, _, body := ts.postFiles(t, "/file", form, nil)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.StringContains(t, body, "Choose at least one file to upload")
+	})
+
+	t.Run("Invalid CSRF Token", func(t *testing.T) {
+		ts.login(t)
+		form := url.Values{"csrf_token": {"wrongToken"}}
+
+		code, _, _ := ts.postFiles(t, "/file", form, []testUpload{
+			{fileName: "notes.txt", content: []byte("some notes")},
+		})
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+
+	t.Run("Missing CSRF Token", func(t *testing.T) {
+		ts.login(t)
+
+		code, _, _ := ts.postFiles(t, "/file", nil, []testUpload{
+			{fileName: "notes.txt", content: []byte("some notes")},
+		})
+		assert.Equal(t, code, http.StatusBadRequest)
+	})
+}
+
+func TestFileUploadQuota(t *testing.T) {
+	t.Parallel()
+
+	// The mock user already stores 10 bytes in 1 file
+	tests := []struct {
+		name       string
+		quota      storageQuota
+		maxBytes   int64 // Limit on the upload request, if not the default
+		files      []testUpload
+		wantCode   int
+		wantBody   string
+		wantStored string // File stored before the quota was reached
+	}{
+		{
+			name:     "Within quota",
+			quota:    storageQuota{Bytes: 30, Files: 5},
+			files:    []testUpload{{fileName: "a.txt", content: bytes.Repeat([]byte("a"), 20)}},
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Unlimited",
+			quota:    storageQuota{},
+			files:    []testUpload{{fileName: "a.txt", content: bytes.Repeat([]byte("a"), 1<<20)}},
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:     "Over byte quota",
+			quota:    storageQuota{Bytes: 30, Files: 5},
+			files:    []testUpload{{fileName: "a.txt", content: bytes.Repeat([]byte("a"), 21)}},
+			wantCode: http.StatusRequestEntityTooLarge,
+			wantBody: "This upload would go over your storage quota of 30 B",
+		},
+		{
+			name:     "Over file quota",
+			quota:    storageQuota{Bytes: 30, Files: 1},
+			files:    []testUpload{{fileName: "a.txt", content: []byte("a")}},
+			wantCode: http.StatusRequestEntityTooLarge,
+			wantBody: "You&#39;ve reached your limit of 1 files",
+		},
+		{
+			name:  "Over quota partway",
+			quota: storageQuota{Bytes: 30, Files: 5},
+			files: []testUpload{
+				{fileName: "small.txt", content: []byte("small")},
+				{fileName: "big.txt", content: bytes.Repeat([]byte("b"), 21)},
+			},
+			wantCode:   http.StatusRequestEntityTooLarge,
+			wantBody:   "This upload would go over your storage quota of 30 B",
+			wantStored: "small.txt",
+		},
+		{
+			name:     "Unlimited over size limit",
+			quota:    storageQuota{},
+			maxBytes: 4 << 10,
+			files:    []testUpload{{fileName: "a.txt", content: bytes.Repeat([]byte("a"), 8<<10)}},
+			wantCode: http.StatusRequestEntityTooLarge,
+			wantBody: "This upload is too large, upload at most 4.0 KiB at once",
+		},
+		{
+			name:     "Over size limit partway",
+			quota:    storageQuota{},
+			maxBytes: 4 << 10,
+			files: []testUpload{
+				{fileName: "small.txt", content: []byte("small")},
+				{fileName: "big.txt", content: bytes.Repeat([]byte("b"), 8<<10)},
+			},
+			wantCode:   http.StatusRequestEntityTooLarge,
+			wantBody:   "This upload is too large, upload at most 4.0 KiB at once",
+			wantStored: "small.txt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.defaultQuota = tt.quota
+			if tt.maxBytes != 0 {
+				app.uploadMaxBytes = tt.maxBytes
+			}
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			validCSRFToken := ts.login(t)
+			form := url.Values{"csrf_token": {validCSRFToken}}
+
+			code, _, body := ts.postFiles(t, "/file", form, tt.files)
+			assert.Equal(t, code, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.StringContains(t, body, tt.wantBody)
+
+				// Nothing of the rejected upload should be left behind, the files before it are listed
+				entries, err := os.ReadDir(app.uploadDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.wantStored == "" {
+					assert.Equal(t, len(entries), 0)
+				} else {
+					assert.Equal(t, len(entries), 1)
+					assert.StringContains(t, body, fmt.Sprintf("<a href='/file/view/%s'>%s</a>", entries[0].Name(),
+						tt.wantStored))
+				}
+			}
+		})
+	}
+}
+
+func TestAccountView(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	app.defaultQuota = storageQuota{Bytes: 1 << 20, Files: 5}
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	ts.login(t)
+	code, _, body := ts.get(t, "/account/view")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "Alice Jones")
+	assert.StringContains(t, body, `<progress value="10" max="1048576"></progress>`)
+	assert.StringContains(t, body, "10 B of 1.0 MiB used")
+	assert.StringContains(t, body, "1 of 5 files")
+}
+
+func TestFileCollection(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+
+	// Both mock collection files share a storage path, so give them different content
+	storagePath := t.TempDir()
+	blobs := map[string]string{"123456": "first file", "654321": "second file"}
+	for name, content := range blobs {
+		if err := os.WriteFile(filepath.Join(storagePath, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app.collections = &mocks.CollectionModel{StoragePath: storagePath}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	t.Run("View", func(t *testing.T) {
+		code, _, body := ts.get(t, "/file/collection/abcdef")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, `<a href="/file/view/123456">test_file.pdf</a>`)
+		assert.StringContains(t, body, `<a href="/file/view/654321">test_file.pdf</a>`)
+		assert.StringContains(t, body, `<img class="thumb" src="/file/thumb/654321"`)
+		assert.StringContains(t, body, `href="/file/collection/abcdef/zip"`)
+	})
+
+	t.Run("Non-existent UUID", func(t *testing.T) {
+		code, _, _ := ts.get(t, "/file/collection/qwerty")
+		assert.Equal(t, code, http.StatusNotFound)
+
+		code, _, _ = ts.get(t, "/file/collection/qwerty/zip")
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	t.Run("ZIP", func(t *testing.T) {
+		code, header, body := ts.get(t, "/file/collection/abcdef/zip")
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, header.Get("Content-Type"), "application/zip")
+		assert.Equal(t, header.Get("Content-Disposition"), `attachment; filename="collection-abcdef.zip"`)
+
+		zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []struct{ name, content string }{
+			{"test_file.pdf", "first file"},
+			{"test_file (1).pdf", "second file"},
+		}
+		assert.Equal(t, len(zr.File), len(want))
+		for i, f := range zr.File {
+			assert.Equal(t, f.Name, want[i].name)
+
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(content), want[i].content)
+		}
+	})
+
+	t.Run("ZIP past the write timeout", func(t *testing.T) {
+		srv := httptest.NewUnstartedServer(app.routes())
+		srv.Config.WriteTimeout = time.Nanosecond
+		srv.Start()
+		defer srv.Close()
+
+		rs, err := srv.Client().Get(srv.URL + "/file/collection/abcdef/zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+		body, err := io.ReadAll(rs.Body)
+		assert.NilError(t, err)
+
+		_, err = zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		assert.NilError(t, err)
 	})
 }
 
@@ -465,3 +2809,306 @@ func minimalValidPNG(t *testing.T) []byte {
 	}
 	return buf.Bytes()
 }
+
+func TestFileDownload(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+
+	// Write the mock file's blob to a temp dir so there are real bytes to serve
+	storagePath := t.TempDir()
+	content := []byte("0123456789")
+	if err := os.WriteFile(filepath.Join(storagePath, "123456"), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app.files = &mocks.FileModel{StoragePath: storagePath}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		urlPath     string
+		header      map[string]string
+		wantCode    int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:     "Full download",
+			urlPath:  "/file/download/123456",
+			wantCode: http.StatusOK,
+			wantBody: "0123456789",
+			wantHeaders: map[string]string{
+				"ETag":                `"abcdef"`,
+				"Content-Disposition": `attachment; filename="test_file.pdf"`,
+				"Content-Type":        "application/pdf",
+				"Accept-Ranges":       "bytes",
+			},
+		},
+		{
+			name:     "Matching If-None-Match",
+			urlPath:  "/file/download/123456",
+			header:   map[string]string{"If-None-Match": `"abcdef"`},
+			wantCode: http.StatusNotModified,
+		},
+		{
+			name:     "Stale If-None-Match",
+			urlPath:  "/file/download/123456",
+			header:   map[string]string{"If-None-Match": `"qwerty"`},
+			wantCode: http.StatusOK,
+			wantBody: "0123456789",
+		},
+		{
+			name:     "Byte range",
+			urlPath:  "/file/download/123456",
+			header:   map[string]string{"Range": "bytes=2-5"},
+			wantCode: http.StatusPartialContent,
+			wantBody: "2345",
+			wantHeaders: map[string]string{
+				"Content-Range": "bytes 2-5/10",
+			},
+		},
+		{
+			name:     "Byte range with stale If-Range",
+			urlPath:  "/file/download/123456",
+			header:   map[string]string{"Range": "bytes=2-5", "If-Range": `"qwerty"`},
+			wantCode: http.StatusOK,
+			wantBody: "0123456789",
+		},
+		{
+			name:     "Non-existent UUID",
+			urlPath:  "/file/download/987654",
+			wantCode: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+tt.urlPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+
+			rs, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rs.Body.Close()
+
+			body, err := io.ReadAll(rs.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assert.Equal(t, rs.StatusCode, tt.wantCode)
+			if tt.wantBody != "" {
+				assert.Equal(t, string(body), tt.wantBody)
+			}
+			for k, v := range tt.wantHeaders {
+				assert.Equal(t, rs.Header.Get(k), v)
+			}
+		})
+	}
+}
+
+func TestFilePreview(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name            string
+		content         []byte
+		wantViewBody    string
+		wantNotViewBody string
+		wantCode        int
+		wantContentType string
+	}{
+		{
+			name:            "PDF is embedded",
+			content:         []byte("%PDF-1.4 test document"),
+			wantViewBody:    `<object data="/file/preview/123456" type="application/pdf">`,
+			wantCode:        http.StatusOK,
+			wantContentType: "application/pdf",
+		},
+		{
+			name:            "Image is shown inline",
+			content:         minimalValidPNG(t),
+			wantViewBody:    `<img src="/file/preview/123456"`,
+			wantCode:        http.StatusOK,
+			wantContentType: "image/png",
+		},
+		{
+			name:            "Text is rendered escaped",
+			content:         []byte("package main\n\nfunc main() { println(\"<b>hi</b>\") }\n"),
+			wantViewBody:    "println(&#34;&lt;b&gt;hi&lt;/b&gt;&#34;)",
+			wantNotViewBody: "<b>hi</b>",
+			wantCode:        http.StatusSeeOther,
+		},
+		{
+			name:            "HTML is download only",
+			content:         []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"),
+			wantNotViewBody: `class="preview"`,
+			wantCode:        http.StatusSeeOther,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			storagePath := t.TempDir()
+			if err := os.WriteFile(filepath.Join(storagePath, "123456"), tt.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			app.files = &mocks.FileModel{StoragePath: storagePath}
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			code, _, body := ts.get(t, "/file/view/123456")
+			assert.Equal(t, code, http.StatusOK)
+			if tt.wantViewBody != "" {
+				assert.StringContains(t, body, tt.wantViewBody)
+			}
+			if tt.wantNotViewBody != "" && strings.Contains(body, tt.wantNotViewBody) {
+				t.Errorf("got: %v, expected not to contain: %v", body, tt.wantNotViewBody)
+			}
+
+			code, header, _ := ts.get(t, "/file/preview/123456")
+			assert.Equal(t, code, tt.wantCode)
+			if code == http.StatusSeeOther {
+				assert.Equal(t, header.Get("Location"), "/file/download/123456")
+			}
+			if tt.wantContentType != "" {
+				assert.Equal(t, header.Get("Content-Type"), tt.wantContentType)
+				assert.Equal(t, header.Get("Content-Disposition"), `inline; filename="test_file.pdf"`)
+			}
+		})
+	}
+}
+
+func TestFileThumbnail(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		content          []byte
+		wantContentType  string
+		wantCacheControl string
+	}{
+		{
+			name:             "Image gets a thumbnail",
+			content:          minimalValidPNG(t),
+			wantContentType:  "image/png",
+			wantCacheControl: "public, max-age=31536000, immutable",
+		},
+		{
+			name:             "Unsupported format gets the placeholder",
+			content:          []byte("%PDF-1.4 test document"),
+			wantContentType:  "image/svg+xml",
+			wantCacheControl: "no-cache",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			storagePath := t.TempDir()
+			if err := os.WriteFile(filepath.Join(storagePath, "123456"), tt.content, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			app.files = &mocks.FileModel{StoragePath: storagePath}
+
+			file, err := app.files.GetByUUID("123456")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NilError(t, app.generateThumbnail(file))
+
+			ts := newTestServer(t, app.routes())
+			defer ts.Close()
+
+			code, header, _ := ts.get(t, "/file/thumb/123456")
+			assert.Equal(t, code, http.StatusOK)
+			assert.Equal(t, header.Get("Content-Type"), tt.wantContentType)
+			assert.Equal(t, header.Get("Cache-Control"), tt.wantCacheControl)
+		})
+	}
+
+	t.Run("Non-existent UUID", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, _, _ := ts.get(t, "/file/thumb/987654")
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+}
+
+func TestFileQuarantine(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	storagePath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(storagePath, "999999"), []byte("%PDF-1.4 not really eicar"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	app.files = &mocks.FileModel{StoragePath: storagePath}
+
+	ts := newTestServer(t, app.routes())
+	defer ts.Close()
+
+	code, _, body := ts.get(t, "/file/view/999999")
+	assert.Equal(t, code, http.StatusOK)
+	assert.StringContains(t, body, "quarantined")
+	if strings.Contains(body, "/file/preview/999999") {
+		t.Errorf("quarantined file should not be previewed")
+	}
+
+	code, _, _ = ts.get(t, "/file/download/999999")
+	assert.Equal(t, code, http.StatusForbidden)
+
+	code, _, _ = ts.get(t, "/file/preview/999999")
+	assert.Equal(t, code, http.StatusForbidden)
+
+	code, header, _ := ts.get(t, "/file/thumb/999999")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, header.Get("Content-Type"), "image/svg+xml")
+}
+
+func TestAdminFiles(t *testing.T) {
+	t.Parallel()
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+
+		code, header, _ := ts.get(t, "/admin/files")
+		assert.Equal(t, code, http.StatusSeeOther)
+		assert.Equal(t, header.Get("Location"), "/user/login")
+	})
+
+	t.Run("Not an admin", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		ts.login(t)
+
+		code, _, _ := ts.get(t, "/admin/files")
+		assert.Equal(t, code, http.StatusNotFound)
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		app := newTestApplication(t)
+		ts := newTestServer(t, app.routes())
+		defer ts.Close()
+		ts.loginAs(t, "admin@example.com")
+
+		code, _, body := ts.get(t, "/admin/files")
+		assert.Equal(t, code, http.StatusOK)
+		assert.StringContains(t, body, "eicar.com")
+		assert.StringContains(t, body, "Eicar-Test-Signature")
+		assert.StringContains(t, body, `<td class="error">infected</td>`)
+	})
+}
@@ -1,14 +1,52 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
+	"clonebox/internal/mailer"
+	"clonebox/internal/models"
+	"clonebox/internal/oidc"
+	"clonebox/internal/qr"
+	"clonebox/internal/scanner"
+	"clonebox/internal/throttle"
+	"clonebox/internal/thumbnail"
+	"clonebox/internal/token"
+	"clonebox/internal/totp"
+	"clonebox/internal/urlpolicy"
+	"clonebox/internal/validator"
+	"clonebox/internal/webauthn"
+	"clonebox/ui"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
 	"time"
 
 	"github.com/go-playground/form/v4"
+	"github.com/google/uuid"
 	"github.com/justinas/nosurf"
 )
 
@@ -35,6 +73,19 @@ func (app *application) notFound(w http.ResponseWriter) {
 	app.clientError(w, http.StatusNotFound)
 }
 
+// extendWriteDeadline gives a handler that can take longer than the server's WriteTimeout until d from now to finish
+// its response. A zero d removes the deadline.
+func (app *application) extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	err := http.NewResponseController(w).SetWriteDeadline(deadline)
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		app.errorLog.Printf("extending write deadline: %v", err)
+	}
+}
+
 func (app *application) render(w http.ResponseWriter, status int, page string, data *templateData) {
 	ts, ok := app.templateCache[page]
 	if !ok {
@@ -59,13 +110,53 @@ func (app *application) render(w http.ResponseWriter, status int, page string, d
 	buf.WriteTo(w)
 }
 
+// serveFile writes the blob of an uploaded file to the response. The checksum is the content hash of the blob, so it
+// doubles as a strong ETag; with it set, ServeContent takes care of If-None-Match, If-Range and Range requests. If
+// contentType is empty, it's picked from the original file name's extension. Quarantined files are never served.
+func (app *application) serveFile(w http.ResponseWriter, r *http.Request, file *models.File, disposition, contentType string) {
+	if file.Quarantined() {
+		app.clientError(w, http.StatusForbidden)
+		return
+	}
+
+	blob, err := os.Open(filepath.Join(file.StoragePath, file.FileUUID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			app.notFound(w)
+			return
+		}
+		app.serverError(w, err)
+		return
+	}
+	defer blob.Close()
+
+	info, err := blob.Stat()
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", fmt.Sprintf("%q", file.Checksum))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, file.FileName))
+
+	http.ServeContent(w, r, file.FileName, info.ModTime(), blob)
+}
+
 func (app *application) newTemplateData(r *http.Request) *templateData {
-	return &templateData{
+	data := &templateData{
 		CurrentYear:     time.Now().Year(),
 		Flash:           app.sessionManager.PopString(r.Context(), "flash"),
 		IsAuthenticated: app.isAuthenticated(r),
 		CSRFToken:       nosurf.Token(r),
 	}
+	if app.sso != nil {
+		data.SSOName = app.ssoName
+	}
+	return data
 }
 
 func (app *application) decodePostForm(r *http.Request, dst any) error {
@@ -100,3 +191,1615 @@ func (app *application) isAuthenticated(r *http.Request) bool {
 
 	return isAuthenticated
 }
+
+// contentDisposition builds a Content-Disposition header value for the given disposition type ("attachment" or
+// "inline"). Following RFC 6266, a plain ASCII filename parameter is always included as a fallback for old clients,
+// and names containing anything else are also sent in the RFC 5987 filename* form so browsers get the exact name back.
+func contentDisposition(disposition, fileName string) string {
+	fallback := strings.Map(func(r rune) rune {
+		switch {
+		case r == '"' || r == '\\':
+			return '_'
+		case r < 0x20 || r > 0x7e:
+			return '_'
+		}
+		return r
+	}, fileName)
+
+	if fallback == fileName {
+		return fmt.Sprintf("%s; filename=\"%s\"", disposition, fileName)
+	}
+
+	// RFC 5987 ext-value: UTF-8 bytes, percent-encoding everything outside of attr-char
+	var encoded strings.Builder
+	for _, b := range []byte(fileName) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback, encoded.String())
+}
+
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// storeUpload streams an uploaded file to the upload directory and records it in the db as owned by ownerID,
+// returning the UUID it can be viewed under. The upload is cut off with a *quotaError as soon as it would take the
+// owner over quota. Files are de-duplicated by checksum -- if the same content was uploaded before, the new copy is
+// removed and the existing file's UUID is returned instead, after scanning the content again if the scanner couldn't
+// the first time. Its bytes still count against the quota while streaming, as the checksum isn't known until the end.
+func (app *application) storeUpload(ctx context.Context, ownerID int, fileName string, src io.Reader, quota storageQuota) (string, error) {
+	usedBytes, usedFiles, err := app.files.Usage(ownerID)
+	if err != nil {
+		return "", err
+	}
+	if quota.Files > 0 && usedFiles >= quota.Files {
+		return "", &quotaError{fmt.Sprintf("You've reached your limit of %d files", quota.Files)}
+	}
+	if quota.Bytes > 0 {
+		src = &quotaReader{r: src, remaining: quota.Bytes - usedBytes, limit: quota.Bytes}
+	}
+
+	// Unique file name - store in db?
+	fileUUID := uuid.New().String()
+	storagePath := app.uploadDir
+	dst, err := os.Create(filepath.Join(storagePath, fileUUID))
+	if err != nil {
+		return "", err
+	}
+
+	// Anything going wrong from here on leaves a partial (or unreferenced) blob behind, so remove it
+	stored := false
+	defer func() {
+		dst.Close()
+		if !stored {
+			os.Remove(filepath.Join(storagePath, fileUUID))
+		}
+	}()
+
+	// Need to use teeReader to avoid weird read-once limitation on multipart form file
+	// This handles saving to disk and checksum calc in same pass
+	h := md5.New()
+	teeReader := io.TeeReader(src, h)
+	fileSize, err := io.Copy(dst, teeReader)
+	if err != nil {
+		return "", err
+	}
+	checksum := fmt.Sprintf("%x", h.Sum(nil))
+
+	// Begin DB Storage
+	// Checking for existing file w/ matching checksum. If exists, the copy just written is removed by the deferred
+	// cleanup. Using this approach because of io.Reader limitations -- TODO: Find a better way
+	existingFile, err := app.files.GetByChecksum(checksum)
+	if err != nil {
+		if !errors.Is(err, models.ErrNoRecord) {
+			return "", err
+		}
+
+		scanStatus, scanResult, err := app.scanUpload(ctx, filepath.Join(storagePath, fileUUID))
+		if err != nil {
+			return "", err
+		}
+
+		// Currently storing storagePath in case i use a per-user dir approach
+		err = app.files.Insert(fileName, fileUUID, int(fileSize), checksum, storagePath, scanStatus, scanResult, ownerID)
+		if err != nil {
+			return "", err
+		}
+		stored = true
+
+		if scanStatus != models.ScanClean && scanStatus != models.ScanUnscanned {
+			app.errorLog.Printf("upload %s (%q) quarantined: %s %s", fileUUID, fileName, scanStatus, scanResult)
+			return fileUUID, nil
+		}
+
+		// Thumbnails are generated in the background so big images don't hold up the redirect
+		app.background(func() {
+			file := &models.File{FileUUID: fileUUID, StoragePath: storagePath}
+			if err := app.generateThumbnail(file); err != nil {
+				app.errorLog.Printf("thumbnail for %s: %v", fileUUID, err)
+			}
+		})
+
+		return fileUUID, nil
+	}
+
+	// Files the scanner couldn't give a verdict on (it was down, or the file was too big for it) get another go with
+	// the new copy, rather than staying quarantined for good
+	if existingFile.ScanStatus == models.ScanFailed && scanner.Enabled(app.scanner) {
+		err = app.rescanUpload(ctx, existingFile, filepath.Join(storagePath, fileUUID))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return existingFile.FileUUID, nil
+}
+
+// rescanUpload scans a new copy of a file at path, and records the outcome against the existing file.
+func (app *application) rescanUpload(ctx context.Context, file *models.File, path string) error {
+	scanStatus, scanResult, err := app.scanUpload(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	err = app.files.SetScan(file.FileUUID, scanStatus, scanResult)
+	if err != nil {
+		return err
+	}
+
+	if scanStatus != models.ScanClean {
+		app.errorLog.Printf("upload %s (%q) still quarantined: %s %s", file.FileUUID, file.FileName, scanStatus, scanResult)
+		return nil
+	}
+
+	app.infoLog.Printf("upload %s (%q) released from quarantine after scanning it again", file.FileUUID, file.FileName)
+	app.background(func() {
+		if err := app.generateThumbnail(file); err != nil {
+			app.errorLog.Printf("thumbnail for %s: %v", file.FileUUID, err)
+		}
+	})
+	return nil
+}
+
+// storageQuota is how much a user may store through file sharing. Zero means unlimited.
+type storageQuota struct {
+	Bytes int64
+	Files int
+}
+
+// storageUsage is shown on the account page.
+type storageUsage struct {
+	Bytes int64
+	Files int
+	Quota storageQuota
+}
+
+// quotaFor returns a user's storage quota: their own overrides where set, the configured default otherwise.
+func (app *application) quotaFor(user *models.User) storageQuota {
+	quota := app.defaultQuota
+	if user.QuotaBytes != nil {
+		quota.Bytes = *user.QuotaBytes
+	}
+	if user.QuotaFiles != nil {
+		quota.Files = *user.QuotaFiles
+	}
+	return quota
+}
+
+// quotaError is returned when an upload would take a user over their storage quota. Its message is shown to the
+// user on the upload form.
+type quotaError struct {
+	message string
+}
+
+func (e *quotaError) Error() string {
+	return e.message
+}
+
+// quotaReader wraps an upload and fails with a *quotaError as soon as more than remaining bytes are read from it,
+// so an upload over quota is stopped while streaming instead of after it's been written out in full.
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	limit     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if q.remaining <= 0 {
+		// Only fail if there's actually more data, so a file which exactly fills the quota is fine
+		var b [1]byte
+		n, err := q.r.Read(b[:])
+		if n > 0 {
+			return 0, &quotaError{fmt.Sprintf("This upload would go over your storage quota of %s", humanBytes(q.limit))}
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > q.remaining {
+		p = p[:q.remaining]
+	}
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	return n, err
+}
+
+// scanUpload runs the configured scanner over a freshly written upload, returning the scan status and result to
+// record for it. A scanner which can't reach a verdict (e.g. clamd is down) doesn't fail the upload -- the file is
+// quarantined as ScanFailed instead, so nothing unscanned slips through while it's unavailable.
+func (app *application) scanUpload(ctx context.Context, path string) (string, string, error) {
+	if !scanner.Enabled(app.scanner) {
+		return models.ScanUnscanned, "", nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	result, err := app.scanner.Scan(ctx, f)
+	if err != nil {
+		app.errorLog.Printf("scanning %s: %v", path, err)
+		return models.ScanFailed, truncateScanResult(err.Error()), nil
+	}
+	if !result.Clean {
+		return models.ScanInfected, truncateScanResult(result.Signature), nil
+	}
+
+	return models.ScanClean, "", nil
+}
+
+// scanResultMax is the number of characters the files.scan_result column holds.
+const scanResultMax = 255
+
+// truncateScanResult cuts a scanner's error or reply down to what can be stored. Either comes from outside, so it
+// might not even be valid UTF-8.
+func truncateScanResult(s string) string {
+	s = strings.ToValidUTF8(s, "\uFFFD")
+	n := 0
+	for i := range s {
+		if n == scanResultMax {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
+
+// zipEntryName turns an uploaded file name into a safe, unique name for an entry in a ZIP archive. Path separators
+// are stripped so entries can't escape the extraction directory, and repeated names get a " (n)" suffix. seen tracks
+// the names already used in the archive.
+func zipEntryName(fileName string, seen map[string]int) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(fileName)
+	if name == "" || name == "." || name == ".." {
+		name = "file"
+	}
+
+	n := seen[name]
+	seen[name] = n + 1
+	if n == 0 {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	unique := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+	if _, exists := seen[unique]; exists {
+		return zipEntryName(unique, seen)
+	}
+	seen[unique] = 1
+	return unique
+}
+
+// writeZipEntry copies an uploaded file's blob into the archive under the given name.
+func writeZipEntry(zw *zip.Writer, file *models.File, name string) error {
+	blob, err := os.Open(filepath.Join(file.StoragePath, file.FileUUID))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: file.UploadTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, blob)
+	return err
+}
+
+// thumbnailSize is the bounding box (in pixels) image thumbnails are scaled down to fit within.
+const thumbnailSize = 256
+
+// background runs fn in a new goroutine, recovering and logging any panic so it can't take the whole server down.
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.errorLog.Print(fmt.Errorf("%s", err))
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// thumbnailPath returns where the thumbnail of an uploaded file is stored -- next to its blob, keyed by the file UUID.
+func thumbnailPath(file *models.File) string {
+	return filepath.Join(file.StoragePath, file.FileUUID+".thumb.png")
+}
+
+// generateThumbnail creates the thumbnail for an uploaded file. The thumbnail is written to a temporary file first
+// and then renamed into place, so fileThumbnail never serves a half written image. Files which aren't a supported
+// image format are skipped, fileThumbnail serves the placeholder for those.
+func (app *application) generateThumbnail(file *models.File) error {
+	src, err := os.Open(filepath.Join(file.StoragePath, file.FileUUID))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(file.StoragePath, file.FileUUID+".thumb-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = thumbnail.Generate(src, tmp, thumbnailSize)
+	if err != nil {
+		if errors.Is(err, thumbnail.ErrUnsupported) {
+			return nil
+		}
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), thumbnailPath(file))
+}
+
+// previewTextLimit caps how much of a text file is rendered on the file view page.
+const previewTextLimit = 64 << 10
+
+// previewData holds what the file view page needs to show an uploaded file inline.
+type previewData struct {
+	Kind        string
+	ContentType string
+	Text        string
+	Truncated   bool
+}
+
+// sniffFile detects the content type of the file at path from its first 512 bytes, like billSplitPost does for receipts.
+func sniffFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+
+	return http.DetectContentType(head[:n]), nil
+}
+
+// previewKind maps a sniffed content type to how the file can be shown inline: "image", "pdf", "video", "audio" or
+// "text". An empty string means the file must only ever be downloaded. Anything a browser could execute or render as
+// a document (HTML, XML, SVG) is never previewed, and the file name is checked too since the sniffer reports SVG
+// as plain text or XML.
+func previewKind(contentType, fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".html", ".htm", ".xhtml", ".svg", ".svgz", ".xml", ".xsl", ".xslt":
+		return ""
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	switch {
+	case mediaType == "image/svg+xml":
+		return ""
+	case strings.HasPrefix(mediaType, "image/"):
+		return "image"
+	case mediaType == "application/pdf":
+		return "pdf"
+	case strings.HasPrefix(mediaType, "video/"):
+		return "video"
+	case strings.HasPrefix(mediaType, "audio/"), mediaType == "application/ogg":
+		return "audio"
+	case mediaType == "text/plain":
+		return "text"
+	}
+
+	return ""
+}
+
+// newFilePreview sniffs an uploaded file and builds its preview. A nil preview means the file is download only. Text
+// files are read here (up to previewTextLimit) so the template can render them escaped. Quarantined files get none.
+func (app *application) newFilePreview(file *models.File) (*previewData, error) {
+	if file.Quarantined() {
+		return nil, nil
+	}
+
+	path := filepath.Join(file.StoragePath, file.FileUUID)
+	contentType, err := sniffFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := previewKind(contentType, file.FileName)
+	if kind == "" {
+		return nil, nil
+	}
+
+	preview := &previewData{Kind: kind, ContentType: contentType}
+	if kind == "text" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		text, err := io.ReadAll(io.LimitReader(f, previewTextLimit+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(text) > previewTextLimit {
+			text = text[:previewTextLimit]
+			preview.Truncated = true
+		}
+		preview.Text = strings.ToValidUTF8(string(text), "�")
+	}
+
+	return preview, nil
+}
+
+// normalizeLink adds a scheme to links entered without one, e.g. "example.com" becomes "https://example.com".
+func normalizeLink(link string) string {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, "http://") && !strings.HasPrefix(link, "https://") {
+		link = "https://" + link
+	}
+	return link
+}
+
+// checkDestination applies the link policy to a destination URL, returning a message for the form when it's not
+// allowed and "" when it is. Links back to this application's short links are caught under the request's host and
+// the canonical host too.
+func (app *application) checkDestination(r *http.Request, link string) string {
+	err := app.linkPolicy.Check(r.Context(), link, r.Host, app.baseHost(r))
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, urlpolicy.ErrScheme):
+		return "Only http and https links can be shortened"
+	case errors.Is(err, urlpolicy.ErrInternal):
+		return "Links to internal or private addresses aren't allowed"
+	case errors.Is(err, urlpolicy.ErrSelfReference):
+		return "This is already a short link"
+	case errors.Is(err, urlpolicy.ErrBlocked):
+		return "Links to this domain aren't allowed"
+	default:
+		return "This field must be a valid URL"
+	}
+}
+
+// checkShortenFields makes the checks on a destination and custom alias that every way of shortening a link shares,
+// adding failures to v under "originalLink" and "alias". It returns the normalised link and the trimmed alias, which
+// is empty if one should be generated.
+func (app *application) checkShortenFields(r *http.Request, v *validator.Validator, originalLink, alias string) (string, string) {
+	// Valid URL checks
+	originalLink = normalizeLink(originalLink)
+	v.CheckField(validator.IsURL(originalLink), "originalLink", "This field must be a valid URL")
+	if validator.IsURL(originalLink) {
+		message := app.checkDestination(r, originalLink)
+		v.CheckField(message == "", "originalLink", message)
+	}
+
+	// Custom alias checks
+	alias = strings.TrimSpace(alias)
+	if alias != "" {
+		v.CheckField(validator.MinChars(alias, 3), "alias", "This field must be at least 3 characters long")
+		v.CheckField(validator.MaxChars(alias, 32), "alias", "This field cannot be more than 32 characters long")
+		v.CheckField(validator.Matches(alias, validator.AliasRX), "alias", "Only letters, numbers, - and _ are allowed")
+		v.CheckField(!validator.PermittedValue(strings.ToLower(alias), reservedAliases...), "alias", "This alias is reserved")
+	}
+
+	return originalLink, alias
+}
+
+// clientIP returns the IP of the client that made the request.
+// Cloudflare proxy -> Caddy -> Go
+func clientIP(r *http.Request) string {
+	// 1. Cloudflare's specific header
+	if cf := r.Header.Get("CF-Connecting-IP"); cf != "" {
+		return strings.TrimSpace(cf)
+	}
+
+	// 2. X-Forwarded-For is a comma-separated list
+	// The first IP should be the original client
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ips := strings.Split(forwarded, ",")
+		return strings.TrimSpace(ips[0])
+	}
+
+	// 3. Default fallback, without the port
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// hashIP returns a keyed hash of a client IP, so clicks from the same client can be counted without storing the IP.
+func (app *application) hashIP(ip string) string {
+	mac := hmac.New(sha256.New, app.ipHashKey)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// referrerHost returns the host of the page a request was referred from, or "" when there's no (valid) referrer.
+func referrerHost(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Coarse user agent classes recorded for clicks.
+const (
+	agentBot     = "bot"
+	agentMobile  = "mobile"
+	agentTablet  = "tablet"
+	agentDesktop = "desktop"
+	agentOther   = "other"
+)
+
+// agentClass sorts a User-Agent header into one of a few coarse classes. It doesn't try to be exact, it only needs to
+// be good enough for click statistics.
+func agentClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+
+	switch {
+	case ua == "":
+		return agentOther
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "crawler"), strings.Contains(ua, "spider"),
+		strings.Contains(ua, "curl/"), strings.Contains(ua, "wget/"), strings.Contains(ua, "python-"),
+		strings.Contains(ua, "go-http-client"), strings.Contains(ua, "preview"):
+		return agentBot
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return agentTablet
+	case strings.Contains(ua, "mobi"), strings.Contains(ua, "iphone"), strings.Contains(ua, "android"):
+		return agentMobile
+	case strings.Contains(ua, "windows"), strings.Contains(ua, "macintosh"), strings.Contains(ua, "x11"),
+		strings.Contains(ua, "linux"), strings.Contains(ua, "cros"):
+		return agentDesktop
+	default:
+		return agentOther
+	}
+}
+
+// recordClick stores a click on a short link in the background, so the redirect isn't held up by the write.
+func (app *application) recordClick(r *http.Request, short string) {
+	click := &models.Click{
+		ShortLink:    short,
+		Clicked:      time.Now().UTC(),
+		ReferrerHost: referrerHost(r),
+		AgentClass:   agentClass(r.UserAgent()),
+		IPHash:       app.hashIP(clientIP(r)),
+	}
+
+	app.background(func() {
+		err := app.clicks.Insert(click)
+		if err != nil {
+			app.errorLog.Printf("recording click on %s: %v", short, err)
+		}
+	})
+}
+
+// statsDays is how many days of clicks the stats page covers.
+const statsDays = 30
+
+// Dimensions of the daily clicks chart, in SVG user units.
+const (
+	chartWidth  = 600
+	chartHeight = 150
+	chartGap    = 2
+)
+
+type chartBar struct {
+	Day    time.Time
+	Clicks int
+	Unique int
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// clickChart is a bar chart of daily clicks, drawn as inline SVG by the stats template. SVG attributes aren't styles,
+// so this works within the Content-Security-Policy without any script.
+type clickChart struct {
+	Width  int
+	Height int
+	Max    int
+	Bars   []chartBar
+}
+
+// newClickChart lays out one bar per day for the days up to and including today. Days missing from daily had no
+// clicks.
+func newClickChart(daily []*models.DailyClicks, today time.Time, days int) *clickChart {
+	byDay := map[string]*models.DailyClicks{}
+	for _, d := range daily {
+		byDay[d.Day.Format(time.DateOnly)] = d
+	}
+
+	chart := &clickChart{Width: chartWidth, Height: chartHeight}
+	start := today.UTC().Truncate(24*time.Hour).AddDate(0, 0, -(days - 1))
+	for i := range days {
+		bar := chartBar{Day: start.AddDate(0, 0, i)}
+		if d, ok := byDay[bar.Day.Format(time.DateOnly)]; ok {
+			bar.Clicks = d.Clicks
+			bar.Unique = d.Unique
+		}
+		chart.Max = max(chart.Max, bar.Clicks)
+		chart.Bars = append(chart.Bars, bar)
+	}
+
+	slot := chartWidth / days
+	for i := range chart.Bars {
+		bar := &chart.Bars[i]
+		bar.X = i * slot
+		bar.Width = slot - chartGap
+		if chart.Max > 0 {
+			bar.Height = bar.Clicks * chartHeight / chart.Max
+		}
+		bar.Y = chartHeight - bar.Height
+	}
+
+	return chart
+}
+
+// linkStats holds everything shown on a short link's stats page.
+type linkStats struct {
+	Days      int
+	Clicks    int
+	Chart     *clickChart
+	Referrers []*models.ClickCount
+	Agents    []*models.ClickCount
+}
+
+// linkPreviewData is what the interstitial page shows about a short link, besides the link itself.
+type linkPreviewData struct {
+	Host    string
+	Creator string // Empty when the creator isn't known
+}
+
+// qrTarget checks that target, as given to /qr, is a short link or file page of this application: either a path or
+// an absolute URL on its host. It returns the kind ("link" or "file") and the short code or file UUID.
+func (app *application) qrTarget(r *http.Request, target string) (kind, id string, ok bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", "", false
+	}
+	if u.Scheme != "" || u.Host != "" {
+		if u.Scheme != "http" && u.Scheme != "https" || !strings.EqualFold(u.Host, app.baseHost(r)) {
+			return "", "", false
+		}
+	}
+
+	if id, found := strings.CutPrefix(u.Path, "/shorten/"); found && validator.Matches(id, validator.AliasRX) {
+		return "link", id, true
+	}
+	if id, found := strings.CutPrefix(u.Path, "/file/view/"); found && validator.Matches(id, validator.AliasRX) {
+		return "file", id, true
+	}
+	return "", "", false
+}
+
+// qrScale is the width of a QR code module in pixels, in the PNGs served by /qr.
+const qrScale = 8
+
+// parseBaseURL checks the configured canonical URL, returning it as "scheme://host" without a trailing slash. The
+// application is always served from the root, so the URL can't have a path.
+func parseBaseURL(raw string) (string, error) {
+	if raw == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("base URL %q must be an absolute http or https URL", raw)
+	}
+	if strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("base URL %q must not have a path, query or credentials", raw)
+	}
+
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), nil
+}
+
+// parseTrustedProxies parses a comma or space separated list of IP addresses and CIDR ranges.
+func parseTrustedProxies(raw string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if strings.Contains(field, "/") {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy: %w", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy: %w", err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// fromTrustedProxy reports whether the request was made by one of the configured reverse proxies, whose forwarded
+// headers can be believed.
+func (app *application) fromTrustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := addr.Addr().Unmap()
+	for _, prefix := range app.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedValue returns the first value of a forwarded header, which proxies append to.
+func forwardedValue(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+// baseURL returns the scheme and host absolute URLs to this application start with, e.g. "https://clonebox.app".
+// The configured canonical URL wins. Without one it's worked out from the request, where X-Forwarded-Proto and
+// X-Forwarded-Host are only used if the request came from a trusted proxy -- anyone else could send them.
+func (app *application) baseURL(r *http.Request) string {
+	if app.canonicalURL != "" {
+		return app.canonicalURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if app.fromTrustedProxy(r) {
+		if proto := strings.ToLower(forwardedValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := forwardedValue(r, "X-Forwarded-Host"); forwarded != "" && !strings.ContainsAny(forwarded, "/\\@?# ") {
+			host = forwarded
+		}
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// baseHost returns the host part of baseURL.
+func (app *application) baseHost(r *http.Request) string {
+	_, host, _ := strings.Cut(app.baseURL(r), "://")
+	return host
+}
+
+// absoluteURL returns the absolute URL of a path on this application, for places where a relative link won't do:
+// short links, QR codes. Everything builds them through here so they're the same everywhere. Emails use mailURL.
+func (app *application) absoluteURL(r *http.Request, path string) string {
+	return app.baseURL(r) + path
+}
+
+// mailURL returns the absolute URL of a path for a link in an email. Only the configured canonical URL is used: the
+// request's host is up to whoever sent it, who could have a password reset link point at their own server. Without
+// one the link is left relative, which main only allows when mail goes to the mail log.
+func (app *application) mailURL(path string) string {
+	return app.canonicalURL + path
+}
+
+// Limits on a single bulk link import. The request may be a little larger than the file, for the rest of the form,
+// and the deadline covers checking the most rows with every lookup running into its time limit.
+const (
+	bulkMaxBytes     = 1 << 20
+	bulkMaxBody      = bulkMaxBytes + 64<<10
+	bulkMaxRows      = 500
+	bulkCheckWorkers = 25
+	bulkCheckTimeout = 2 * time.Second
+	bulkDeadline     = time.Minute
+)
+
+// Outcomes of a bulk import row.
+const (
+	bulkCreated = "created"
+	bulkExists  = "exists"
+	bulkFailed  = "error"
+)
+
+// bulkRow is one link of a bulk import, and once imported its outcome.
+type bulkRow struct {
+	Line         int // Line of the uploaded CSV the link was on
+	OriginalLink string
+	Alias        string
+	ShortLink    string // Absolute short URL, for created and existing links
+	Status       string
+	Error        string
+}
+
+// parseBulkLinks reads the CSV of a bulk import: one link per row, optionally followed by a custom alias. A first row
+// starting with "url" or "original_link" is a header and skipped, as are empty rows. A byte order mark, which
+// spreadsheet applications like to add, is ignored.
+func parseBulkLinks(data []byte) ([]*bulkRow, error) {
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	rows := []*bulkRow{}
+	for first := true; ; first = false {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		link := strings.TrimSpace(record[0])
+		if first && (strings.EqualFold(link, "url") || strings.EqualFold(link, "original_link")) {
+			continue
+		}
+
+		row := &bulkRow{OriginalLink: link}
+		row.Line, _ = cr.FieldPos(0)
+		if len(record) > 1 {
+			row.Alias = strings.TrimSpace(record[1])
+		}
+		if row.OriginalLink == "" && row.Alias == "" {
+			continue
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// importLinks shortens the links of a bulk import for a user, filling in each row's outcome. Rows are checked the
+// same way linkShortenPost checks its form, and the new links are inserted in one transaction. Rows that fail only
+// fail themselves; the returned error is for problems that stop the whole import, which then inserts nothing.
+func (app *application) importLinks(r *http.Request, userId int, rows []*bulkRow) error {
+	// Checking a destination can mean a DNS lookup, so the checks are made a few at a time with a time limit each,
+	// rather than one after the other
+	checks := make([]struct {
+		v           validator.Validator
+		link, alias string
+	}, len(rows))
+	limit := make(chan struct{}, bulkCheckWorkers)
+	var wg sync.WaitGroup
+	for i, row := range rows {
+		wg.Go(func() {
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			ctx, cancel := context.WithTimeout(r.Context(), bulkCheckTimeout)
+			defer cancel()
+			c := &checks[i]
+			c.link, c.alias = app.checkShortenFields(r.WithContext(ctx), &c.v, row.OriginalLink, row.Alias)
+		})
+	}
+	wg.Wait()
+
+	var pending []*bulkRow
+	seenLinks := map[string]int{}
+	seenAliases := map[string]int{}
+
+	for i, row := range rows {
+		v, link, alias := checks[i].v, checks[i].link, checks[i].alias
+
+		// Links without an alias reuse the one the user has, and aliases are unique, so the same one twice in a file
+		// can't both be imported. A link given an alias is a new one, however many there are to the same destination.
+		if line, ok := seenLinks[link]; ok && alias == "" {
+			v.AddFieldError("originalLink", fmt.Sprintf("This link is already on line %d", line))
+		}
+		if line, ok := seenAliases[strings.ToLower(alias)]; ok && alias != "" {
+			v.AddFieldError("alias", fmt.Sprintf("This alias is already on line %d", line))
+		}
+
+		if !v.Valid() {
+			row.Status = bulkFailed
+			row.Error = joinFieldErrors(v.FieldErrors, "originalLink", "alias")
+			continue
+		}
+
+		row.OriginalLink, row.Alias = link, alias
+		if alias != "" {
+			seenAliases[strings.ToLower(alias)] = row.Line
+			pending = append(pending, row)
+			continue
+		}
+		seenLinks[link] = row.Line
+
+		// Links the user shortened before keep their short link, like in linkShortenPost
+		short, err := app.links.GetShort(userId, link)
+		if err == nil {
+			row.ShortLink = app.absoluteURL(r, fmt.Sprintf("/shorten/%s", short))
+			row.Status = bulkExists
+			continue
+		}
+		if !errors.Is(err, models.ErrNoRecord) {
+			return err
+		}
+
+		pending = append(pending, row)
+	}
+
+	return app.links.InsertBatch(func(insert models.LinkInsertFunc) error {
+		for _, row := range pending {
+			short := row.Alias
+			var err error
+			if short != "" {
+				err = insert(row.OriginalLink, short, userId, time.Time{}, 0)
+				if errors.Is(err, models.ErrDuplicateLink) {
+					row.Status = bulkFailed
+					row.Error = "This alias is already taken"
+					continue
+				}
+			} else {
+				short, err = app.shortCodes.Generate(func(code string) error {
+					if validator.PermittedValue(strings.ToLower(code), reservedAliases...) {
+						return models.ErrDuplicateLink
+					}
+					return insert(row.OriginalLink, code, userId, time.Time{}, 0)
+				})
+			}
+			if err != nil {
+				return err
+			}
+
+			row.ShortLink = app.absoluteURL(r, fmt.Sprintf("/shorten/%s", short))
+			row.Status = bulkCreated
+		}
+		return nil
+	})
+}
+
+// joinFieldErrors joins the field errors of the given fields, in that order.
+func joinFieldErrors(fieldErrors map[string]string, fields ...string) string {
+	var messages []string
+	for _, field := range fields {
+		if message, ok := fieldErrors[field]; ok {
+			messages = append(messages, message)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// csvSafe stops spreadsheet applications from running a user supplied CSV value as a formula.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// writeBulkResults writes the outcome of a bulk import as CSV, one row per imported link.
+func writeBulkResults(w io.Writer, rows []*bulkRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"line", "original_link", "alias", "short_link", "status", "error"})
+	for _, row := range rows {
+		cw.Write([]string{
+			strconv.Itoa(row.Line), csvSafe(row.OriginalLink), csvSafe(row.Alias), row.ShortLink, row.Status, row.Error,
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeLinkExport writes a user's links and their click counts as CSV.
+func (app *application) writeLinkExport(w io.Writer, r *http.Request, links []*models.LinkMapping, clicks map[string]int) error {
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"short_link", "original_link", "created", "expires", "max_uses", "uses", "active", "clicks"})
+	for _, l := range links {
+		cw.Write([]string{
+			app.absoluteURL(r, fmt.Sprintf("/shorten/%s", l.ShortLink)),
+			csvSafe(l.OriginalLink),
+			formatTime(l.Created),
+			formatTime(l.Expires),
+			strconv.Itoa(l.MaxUses),
+			strconv.Itoa(l.Uses),
+			strconv.FormatBool(l.Active),
+			strconv.Itoa(clicks[l.ShortLink]),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// verificationTTL is how long the link sent to verify an email address stays valid, passwordResetTTL the one to
+// reset a password.
+const (
+	verificationTTL  = 48 * time.Hour
+	passwordResetTTL = time.Hour
+	emailChangeTTL   = 24 * time.Hour
+)
+
+// sendMail renders the "subject" and "body" templates of ui/mail/<name> with data and sends the result to the given
+// address. Sending happens in the background, so a slow mail server doesn't hold up the response (or, by how long it
+// takes, give away whether a message was sent at all).
+func (app *application) sendMail(to, name string, data any) error {
+	tmpl, err := texttemplate.ParseFS(ui.Files, "mail/"+name)
+	if err != nil {
+		return err
+	}
+
+	var subject, body bytes.Buffer
+	if err = tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return err
+	}
+	if err = tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return err
+	}
+
+	msg := &mailer.Message{To: to, Subject: strings.TrimSpace(subject.String()), Body: body.String()}
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := app.mailer.Send(ctx, msg); err != nil {
+			app.errorLog.Printf("sending %s to %s: %s", name, to, err)
+		}
+	})
+
+	return nil
+}
+
+// newToken issues a token for one of userID's actions and stores its hash. The plaintext is only ever sent to the
+// user.
+func (app *application) newToken(userID int, scope string, ttl time.Duration) (string, error) {
+	plaintext, hash, expiry, err := app.tokenSigner.New(scope, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	if err = app.tokens.Insert(hash, userID, scope, expiry); err != nil {
+		return "", err
+	}
+	return plaintext, nil
+}
+
+// useToken redeems a token issued by newToken and returns the user it was issued to. Tampered, expired, already
+// used and unknown tokens all return models.ErrNoRecord.
+func (app *application) useToken(plaintext, scope string) (int, error) {
+	hash, err := app.tokenSigner.Check(scope, plaintext)
+	if err != nil {
+		return 0, models.ErrNoRecord
+	}
+
+	return app.tokens.Use(hash, scope)
+}
+
+// sendVerification mails a user a link to verify their email address with. Links sent before stop working.
+func (app *application) sendVerification(userID int, name, email string) error {
+	err := app.tokens.DeleteAllForUser(userID, models.ScopeVerification)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := app.newToken(userID, models.ScopeVerification, verificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.sendMail(email, "verification.tmpl", map[string]string{
+		"Name":      name,
+		"Link":      app.mailURL("/user/verify?token=" + url.QueryEscape(plaintext)),
+		"ExpiresIn": fmt.Sprintf("%d hours", int(verificationTTL.Hours())),
+	})
+}
+
+// sendPasswordReset mails a user a link to choose a new password with. Links sent before stop working.
+func (app *application) sendPasswordReset(user *models.User) error {
+	err := app.tokens.DeleteAllForUser(user.ID, models.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := app.newToken(user.ID, models.ScopePasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.sendMail(user.Email, "password_reset.tmpl", map[string]string{
+		"Name":      user.Name,
+		"Link":      app.mailURL("/user/password/reset?token=" + url.QueryEscape(plaintext)),
+		"ExpiresIn": fmt.Sprintf("%d minutes", int(passwordResetTTL.Minutes())),
+	})
+}
+
+// sendEmailChange mails a link to confirm an email change to the new address, which only takes effect once it's
+// followed. Links sent before, possibly to another address, stop working.
+func (app *application) sendEmailChange(user *models.User, email string) error {
+	err := app.tokens.DeleteAllForUser(user.ID, models.ScopeEmailChange)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := app.newToken(user.ID, models.ScopeEmailChange, emailChangeTTL)
+	if err != nil {
+		return err
+	}
+
+	return app.sendMail(email, "email_change.tmpl", map[string]string{
+		"Name":      user.Name,
+		"Email":     email,
+		"Link":      app.mailURL("/account/email/confirm?token=" + url.QueryEscape(plaintext)),
+		"ExpiresIn": fmt.Sprintf("%d hours", int(emailChangeTTL.Hours())),
+	})
+}
+
+// logIn starts an authenticated session for user, and sends them on to the page they were headed to.
+func (app *application) logIn(w http.ResponseWriter, r *http.Request, user *models.User, rememberMe bool) {
+	path, err := app.startSession(r, user, rememberMe)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, path, http.StatusSeeOther)
+}
+
+// startSession logs user in on the current session, and returns the path to send them on to: the page they were
+// trying to reach, or /about. Remembered sessions outlast the browser and don't time out when idle, others end after
+// idleTimeout without a request.
+func (app *application) startSession(r *http.Request, user *models.User, rememberMe bool) (string, error) {
+	// Logging in again over an existing login, e.g. to confirm a sensitive change, replaces it
+	previousUser := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+	if previousUser != 0 {
+		err := app.userSessions.Delete(previousUser, app.sessionManager.GetString(r.Context(), "userSessionId"))
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			return "", err
+		}
+		if previousUser == user.ID && app.sessionManager.GetBool(r.Context(), "rememberMe") {
+			rememberMe = true
+		}
+	}
+
+	// Changing the session ID on login guards against session fixation
+	err := app.sessionManager.RenewToken(r.Context())
+	if err != nil {
+		return "", err
+	}
+
+	app.sessionManager.Put(r.Context(), "authenticatedUserId", user.ID)
+	app.sessionManager.Put(r.Context(), "sessionVersion", user.SessionVersion)
+	app.sessionManager.Put(r.Context(), "authenticatedAt", time.Now().Unix())
+	app.sessionManager.Put(r.Context(), "rememberMe", rememberMe)
+	app.sessionManager.RememberMe(r.Context(), rememberMe)
+	err = app.recordUserSession(r, user.ID)
+	if err != nil {
+		return "", err
+	}
+
+	path := app.sessionManager.PopString(r.Context(), "originalPath")
+	if path == "" {
+		path = "/about"
+	}
+	return path, nil
+}
+
+// clearLogin logs the current session out.
+func (app *application) clearLogin(ctx context.Context) {
+	app.sessionManager.Remove(ctx, "authenticatedUserId")
+	app.sessionManager.Remove(ctx, "sessionVersion")
+	app.sessionManager.Remove(ctx, "userSessionId")
+	app.sessionManager.Remove(ctx, "authenticatedAt")
+	app.sessionManager.Remove(ctx, "rememberMe")
+	app.sessionManager.RememberMe(ctx, false)
+}
+
+// userSessionTouchInterval is how often a session's last seen time is brought up to date, rather than on every
+// request. Idle timeouts are only as precise as this.
+const userSessionTouchInterval = time.Minute
+
+// recordUserSession records the login on the current session, with the device it's from, so the user can see it on
+// the sessions page and revoke it.
+func (app *application) recordUserSession(r *http.Request, userID int) error {
+	id := uuid.NewString()
+	err := app.userSessions.Insert(id, userID, app.loginIP(r), r.UserAgent())
+	if err != nil {
+		return err
+	}
+	app.sessionManager.Put(r.Context(), "userSessionId", id)
+	return nil
+}
+
+// checkUserSession returns whether the login on the current session is still active, i.e. hasn't been revoked or,
+// unless it's remembered, been idle for longer than idleTimeout. Idle logins are revoked.
+func (app *application) checkUserSession(r *http.Request, userID int) (bool, error) {
+	id := app.sessionManager.GetString(r.Context(), "userSessionId")
+	if id == "" {
+		// Logged in before sessions were recorded, it's recorded now so it can be revoked like any other
+		return true, app.recordUserSession(r, userID)
+	}
+
+	session, err := app.userSessions.Get(id)
+	if errors.Is(err, models.ErrNoRecord) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if session.UserID != userID {
+		return false, nil
+	}
+	if !app.sessionManager.GetBool(r.Context(), "rememberMe") && time.Since(session.LastSeen) > app.idleTimeout {
+		err = app.userSessions.Delete(userID, id)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
+			return false, err
+		}
+		return false, nil
+	}
+
+	if time.Since(session.LastSeen) > userSessionTouchInterval {
+		err = app.userSessions.Touch(id)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// After the password, users with two-factor authentication have twoFactorTTL to enter a code, and
+// twoFactorMaxAttempts tries, before they have to start over.
+const (
+	twoFactorTTL         = 5 * time.Minute
+	twoFactorMaxAttempts = 5
+)
+
+// pendingTwoFactor returns the ID of the user who entered their password in this session but still has to enter a
+// code, or 0 if there's no such user or they took too long.
+func (app *application) pendingTwoFactor(r *http.Request) int {
+	id := app.sessionManager.GetInt(r.Context(), "twoFactorUserId")
+	started := time.Unix(app.sessionManager.GetInt64(r.Context(), "twoFactorStarted"), 0)
+	if id == 0 || time.Since(started) > twoFactorTTL {
+		return 0
+	}
+	return id
+}
+
+// clearTwoFactor forgets about a pending two-factor login.
+func (app *application) clearTwoFactor(r *http.Request) {
+	app.sessionManager.Remove(r.Context(), "twoFactorUserId")
+	app.sessionManager.Remove(r.Context(), "twoFactorStarted")
+	app.sessionManager.Remove(r.Context(), "twoFactorAttempts")
+	app.sessionManager.Remove(r.Context(), "twoFactorRememberMe")
+}
+
+// checkTwoFactorCode uses up a TOTP code or recovery code of a user. Wrong and already used codes return
+// models.ErrInvalidCredentials.
+func (app *application) checkTwoFactorCode(userID int, code string) error {
+	secret, err := app.twoFactor.Secret(userID)
+	if err != nil {
+		return err
+	}
+
+	code = strings.Join(strings.Fields(code), "")
+	if len(code) == totp.Digits && strings.Trim(code, "0123456789") == "" {
+		step, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			return models.ErrInvalidCredentials
+		}
+		return app.twoFactor.UseStep(userID, step)
+	}
+
+	return app.twoFactor.UseRecoveryCode(userID, token.Hash(normalizeRecoveryCode(code)))
+}
+
+// recoveryCodeCount is how many recovery codes are issued when two-factor authentication is enabled.
+const recoveryCodeCount = 10
+
+// newRecoveryCodes returns a set of random recovery codes, each of 80 bits written as four groups of four letters
+// and digits, e.g. "k3pq-7mzt-a2xe-wn5d".
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16]
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode undoes the formatting of a recovery code, so it matches however the user typed it in.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// twoFactorData is shown on the two-factor authentication page.
+type twoFactorData struct {
+	Enabled       bool
+	Secret        string       // While enrolling, for typing into an authenticator app
+	URI           template.URL // While enrolling, the otpauth:// URI of the secret
+	QR            template.HTML
+	RecoveryCodes []string // Right after enabling, the only time they're shown
+	CodesLeft     int
+}
+
+// twoFactorEnrollment returns what the user needs to add secret to their authenticator app.
+func twoFactorEnrollment(user *models.User, secret string) (*twoFactorData, error) {
+	uri := totp.URI(secret, "Clonebox", user.Email)
+
+	code, err := qr.EncodeString(uri, qr.M)
+	if err != nil {
+		return nil, err
+	}
+	var svg bytes.Buffer
+	if err = code.SVG(&svg); err != nil {
+		return nil, err
+	}
+
+	// The URI and SVG are built here rather than from user input, so they're safe to put in the page as they are
+	return &twoFactorData{Secret: secret, URI: template.URL(uri), QR: template.HTML(svg.String())}, nil
+}
+
+// maxPasskeyBody is the largest passkey ceremony response accepted, real ones are a few KB at most.
+const maxPasskeyBody = 64 << 10
+
+// relyingParty returns the WebAuthn relying party for the site at the base URL. Passkeys are bound to its host name,
+// so they stop working if the site moves to another domain.
+func (app *application) relyingParty(r *http.Request) *webauthn.RelyingParty {
+	host := app.baseHost(r)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &webauthn.RelyingParty{ID: host, Name: "Clonebox", Origin: app.baseURL(r)}
+}
+
+// userHandle returns the WebAuthn user handle of a user, their ID as 8 bytes.
+func userHandle(userID int) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userID))
+}
+
+// readPasskeyResponse reads the credential the passkey script posts as the body of a request.
+func readPasskeyResponse(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return io.ReadAll(http.MaxBytesReader(w, r.Body, maxPasskeyBody))
+}
+
+// writeJSON sends v as a JSON response, for the requests of the passkey script.
+func (app *application) writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		app.serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// jsonError sends an error message the passkey script shows to the user.
+func (app *application) jsonError(w http.ResponseWriter, status int, message string) {
+	app.writeJSON(w, status, map[string]string{"error": message})
+}
+
+// errSSOUnverifiedEmail is returned by ssoUser for identity provider accounts that aren't linked to a user yet, and
+// don't have a verified email address to find or create one by.
+var errSSOUnverifiedEmail = errors.New("identity provider hasn't verified the email address")
+
+// errSSOUnverifiedAccount is returned by ssoUser when the user with the identity provider account's email address
+// hasn't verified it. Anyone could have signed up with the address, and linking would give them a way in.
+var errSSOUnverifiedAccount = errors.New("user with the email address hasn't verified it")
+
+// ssoUser returns the user an identity provider account belongs to. Accounts seen before are linked by their subject.
+// New ones are linked to the verified user with the same email address, if the identity provider has verified it
+// too, and otherwise a user is created for them.
+func (app *application) ssoUser(claims *oidc.Claims) (*models.User, error) {
+	userID, err := app.identities.Get(claims.Issuer, claims.Subject)
+	if err == nil {
+		return app.users.Get(userID)
+	} else if !errors.Is(err, models.ErrNoRecord) {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, errSSOUnverifiedEmail
+	}
+
+	user, err := app.users.GetByEmail(claims.Email)
+	if errors.Is(err, models.ErrNoRecord) {
+		name := strings.TrimSpace(claims.Name)
+		if name == "" {
+			name, _, _ = strings.Cut(claims.Email, "@")
+		}
+		userID, err = app.users.Provision(name, claims.Email)
+		if err != nil {
+			return nil, err
+		}
+		app.infoLog.Printf("created user %d for %s account %s", userID, claims.Issuer, claims.Subject)
+	} else if err != nil {
+		return nil, err
+	} else {
+		if !user.Verified {
+			return nil, errSSOUnverifiedAccount
+		}
+		userID = user.ID
+		app.infoLog.Printf("linked user %d to %s account %s", userID, claims.Issuer, claims.Subject)
+	}
+
+	err = app.identities.Insert(claims.Issuer, claims.Subject, userID)
+	if errors.Is(err, models.ErrDuplicateIdentity) {
+		// Another login for the same account got there first
+		userID, err = app.identities.Get(claims.Issuer, claims.Subject)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return app.users.Get(userID)
+}
+
+// Failed logins are throttled per email address, against guessing one user's password, and per client IP, against
+// trying a few common passwords on many users. IPs get more room, as a lot of users can be behind one.
+var (
+	loginEmailPolicy = throttle.Policy{
+		Free:         3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 10,
+		Lockout:      15 * time.Minute,
+		Window:       time.Hour,
+	}
+	loginIPPolicy = throttle.Policy{
+		Free:         20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: 100,
+		Lockout:      time.Hour,
+		Window:       time.Hour,
+	}
+)
+
+// loginThrottle holds the limiters for failed logins, which share a store.
+type loginThrottle struct {
+	emails *throttle.Limiter
+	ips    *throttle.Limiter
+}
+
+func newLoginThrottle(store throttle.Store) *loginThrottle {
+	return &loginThrottle{
+		emails: &throttle.Limiter{Store: store, Policy: loginEmailPolicy, Prefix: "login-email"},
+		ips:    &throttle.Limiter{Store: store, Policy: loginIPPolicy, Prefix: "login-ip"},
+	}
+}
+
+// loginEmailKey normalizes an email address the way users are looked up by it, so case doesn't get around the
+// throttle.
+func loginEmailKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// loginIP returns the client IP logins are throttled by. Forwarded headers are only used if the request came from a
+// trusted proxy, otherwise anyone could get a fresh IP by sending them.
+func (app *application) loginIP(r *http.Request) string {
+	if app.fromTrustedProxy(r) {
+		return clientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attemptLogin counts a login for email from the request's IP as failed before it's attempted, and returns whether it
+// may be, going by whichever limiter makes it wait longer. Counting it up front keeps concurrent guesses from all
+// getting through on the same count. Logins that turn out fine are taken back with passLogin.
+func (app *application) attemptLogin(r *http.Request, email string) (throttle.Decision, error) {
+	now := time.Now()
+	ip := app.loginIP(r)
+
+	byEmail, err := app.loginThrottle.emails.Attempt(loginEmailKey(email), now)
+	if err != nil {
+		return throttle.Decision{}, err
+	}
+	if !byEmail.Allowed {
+		byIP, err := app.loginThrottle.ips.Check(ip, now)
+		if err != nil {
+			return throttle.Decision{}, err
+		}
+		if byIP.Allowed || byEmail.RetryAfter >= byIP.RetryAfter {
+			return byEmail, nil
+		}
+		return byIP, nil
+	}
+
+	byIP, err := app.loginThrottle.ips.Attempt(ip, now)
+	if err != nil {
+		return throttle.Decision{}, err
+	}
+	if !byIP.Allowed {
+		// The login isn't attempted after all, so it doesn't count against email
+		return byIP, app.loginThrottle.emails.Succeed(loginEmailKey(email))
+	}
+	return byIP, nil
+}
+
+// passLogin takes back the failure attemptLogin counted for a login whose password or code was right.
+func (app *application) passLogin(r *http.Request, email string) error {
+	err := app.loginThrottle.emails.Succeed(loginEmailKey(email))
+	if err != nil {
+		return err
+	}
+	return app.loginThrottle.ips.Succeed(app.loginIP(r))
+}
+
+// failLogin is called when a login attemptLogin counted had a wrong password or code. Lockouts it caused are logged as
+// security events.
+func (app *application) failLogin(r *http.Request, email string) error {
+	now := time.Now()
+	ip := app.loginIP(r)
+
+	byEmail, err := app.loginThrottle.emails.Check(loginEmailKey(email), now)
+	if err != nil {
+		return err
+	}
+	if byEmail.Locked {
+		app.securityLog.Printf("login for %s locked for %s after repeated failures, the last from %s",
+			loginEmailKey(email), loginEmailPolicy.Lockout, ip)
+	}
+
+	byIP, err := app.loginThrottle.ips.Check(ip, now)
+	if err != nil {
+		return err
+	}
+	if byIP.Locked {
+		app.securityLog.Printf("logins from %s locked for %s after repeated failures, the last for %s",
+			ip, loginIPPolicy.Lockout, loginEmailKey(email))
+	}
+	return nil
+}
+
+// throttledLoginMessage tells the user why their login wasn't attempted and how long to wait.
+func throttledLoginMessage(d throttle.Decision) string {
+	if d.Locked {
+		return fmt.Sprintf("Too many failed login attempts, logging in is locked for %s. "+
+			"If you've forgotten your password, you can reset it", waitTime(d.RetryAfter))
+	}
+	return fmt.Sprintf("Too many failed login attempts, please wait %s before trying again", waitTime(d.RetryAfter))
+}
+
+// waitTime writes a wait in whole seconds or minutes, rounded up so users don't try again too early.
+func waitTime(d time.Duration) string {
+	unit, name := time.Second, "second"
+	if d > time.Minute {
+		unit, name = time.Minute, "minute"
+	}
+	n := int((d + unit - 1) / unit)
+	if n == 1 {
+		return "1 " + name
+	}
+	return fmt.Sprintf("%d %ss", n, name)
+}
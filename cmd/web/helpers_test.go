@@ -0,0 +1,669 @@
+package main
+
+import (
+	"clonebox/internal/assert"
+	"clonebox/internal/models"
+	"clonebox/internal/models/mocks"
+	"clonebox/internal/scanner"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestContentDisposition(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		disposition string
+		fileName    string
+		want        string
+	}{
+		{
+			name:        "ASCII name",
+			disposition: "attachment",
+			fileName:    "report.pdf",
+			want:        `attachment; filename="report.pdf"`,
+		},
+		{
+			name:        "Inline",
+			disposition: "inline",
+			fileName:    "photo.png",
+			want:        `inline; filename="photo.png"`,
+		},
+		{
+			name:        "Quotes are replaced in fallback",
+			disposition: "attachment",
+			fileName:    `my "best" file.txt`,
+			want:        `attachment; filename="my _best_ file.txt"; filename*=UTF-8''my%20%22best%22%20file.txt`,
+		},
+		{
+			name:        "Non-ASCII name",
+			disposition: "attachment",
+			fileName:    "résumé.pdf",
+			want:        `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`,
+		},
+		{
+			name:        "CJK name",
+			disposition: "attachment",
+			fileName:    "文件.txt",
+			want:        `attachment; filename="__.txt"; filename*=UTF-8''%E6%96%87%E4%BB%B6.txt`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, contentDisposition(tt.disposition, tt.fileName), tt.want)
+		})
+	}
+}
+
+func TestPreviewKind(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name        string
+		contentType string
+		fileName    string
+		want        string
+	}{
+		{name: "PNG", contentType: "image/png", fileName: "a.png", want: "image"},
+		{name: "PDF", contentType: "application/pdf", fileName: "a.pdf", want: "pdf"},
+		{name: "MP4", contentType: "video/mp4", fileName: "a.mp4", want: "video"},
+		{name: "MP3", contentType: "audio/mpeg", fileName: "a.mp3", want: "audio"},
+		{name: "Plain text", contentType: "text/plain; charset=utf-8", fileName: "main.go", want: "text"},
+		{name: "HTML", contentType: "text/html; charset=utf-8", fileName: "a.html", want: ""},
+		{name: "HTML sniffed as text", contentType: "text/plain; charset=utf-8", fileName: "a.HTM", want: ""},
+		{name: "SVG sniffed as text", contentType: "text/plain; charset=utf-8", fileName: "logo.svg", want: ""},
+		{name: "SVG sniffed as XML", contentType: "text/xml; charset=utf-8", fileName: "logo", want: ""},
+		{name: "Binary", contentType: "application/octet-stream", fileName: "a.bin", want: ""},
+		{name: "Malformed", contentType: "", fileName: "a", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, previewKind(tt.contentType, tt.fileName), tt.want)
+		})
+	}
+}
+
+func TestZipEntryName(t *testing.T) {
+	t.Parallel()
+	seen := map[string]int{}
+	tests := []struct {
+		fileName string
+		want     string
+	}{
+		{fileName: "report.pdf", want: "report.pdf"},
+		{fileName: "report.pdf", want: "report (1).pdf"},
+		{fileName: "report.pdf", want: "report (2).pdf"},
+		{fileName: "README", want: "README"},
+		{fileName: "README", want: "README (1)"},
+		{fileName: "../../etc/passwd", want: ".._.._etc_passwd"},
+		{fileName: `C:\\evil.exe`, want: "C:__evil.exe"},
+		{fileName: "..", want: "file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fileName, func(t *testing.T) {
+			assert.Equal(t, zipEntryName(tt.fileName, seen), tt.want)
+		})
+	}
+}
+
+// stubScanner returns a fixed result or error for every scan.
+type stubScanner struct {
+	result scanner.Result
+	err    error
+}
+
+func (s stubScanner) Scan(ctx context.Context, r io.Reader) (scanner.Result, error) {
+	io.Copy(io.Discard, r)
+	return s.result, s.err
+}
+
+// slowResolver takes delay to look up each host, except hangingHost which it never finishes looking up. It keeps
+// track of how many lookups ran at once.
+type slowResolver struct {
+	delay time.Duration
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+}
+
+const hangingHost = "hangs.example.com"
+
+func (s *slowResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	s.mu.Lock()
+	s.running++
+	s.maxRunning = max(s.maxRunning, s.running)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.running--
+		s.mu.Unlock()
+	}()
+
+	delay := s.delay
+	if host == hangingHost {
+		delay = time.Hour
+	}
+	select {
+	case <-time.After(delay):
+		return []netip.Addr{netip.MustParseAddr("93.184.215.14")}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestImportLinksSlowLookups(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	resolver := &slowResolver{delay: 100 * time.Millisecond}
+	app.linkPolicy.Resolver = resolver
+
+	var rows []*bulkRow
+	for i := range bulkMaxRows - 1 {
+		rows = append(rows, &bulkRow{Line: i + 2, OriginalLink: fmt.Sprintf("https://slow-%d.example.com", i)})
+	}
+	rows = append(rows, &bulkRow{Line: bulkMaxRows + 1, OriginalLink: "https://" + hangingHost})
+
+	// One after the other the lookups would take most of a minute, and the hanging one forever
+	start := time.Now()
+	r := httptest.NewRequest(http.MethodPost, "/shorten/bulk", nil)
+	assert.NilError(t, app.importLinks(r, 1, rows))
+	if elapsed := time.Since(start); elapsed > bulkCheckTimeout+5*time.Second {
+		t.Errorf("import took %v", elapsed)
+	}
+	assert.Equal(t, resolver.maxRunning, bulkCheckWorkers)
+
+	// Hosts that don't resolve in time are treated like ones that don't resolve at all
+	for _, row := range rows {
+		assert.Equal(t, row.Status, bulkCreated)
+	}
+}
+
+func TestScanUpload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, []byte("some content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		scanner    scanner.Scanner
+		wantStatus string
+		wantResult string
+	}{
+		{
+			name:       "No scanner",
+			scanner:    scanner.Nop{},
+			wantStatus: models.ScanUnscanned,
+		},
+		{
+			name:       "Clean",
+			scanner:    stubScanner{result: scanner.Result{Clean: true}},
+			wantStatus: models.ScanClean,
+		},
+		{
+			name:       "Infected",
+			scanner:    stubScanner{result: scanner.Result{Signature: "Eicar-Test-Signature"}},
+			wantStatus: models.ScanInfected,
+			wantResult: "Eicar-Test-Signature",
+		},
+		{
+			name:       "Scanner unavailable",
+			scanner:    stubScanner{err: errors.New("scanner: connection refused")},
+			wantStatus: models.ScanFailed,
+			wantResult: "scanner: connection refused",
+		},
+		{
+			name:       "Long reply",
+			scanner:    stubScanner{result: scanner.Result{Signature: strings.Repeat("é", 300)}},
+			wantStatus: models.ScanInfected,
+			wantResult: strings.Repeat("é", scanResultMax),
+		},
+		{
+			name:       "Invalid reply",
+			scanner:    stubScanner{err: errors.New("scanner: unexpected reply \xff")},
+			wantStatus: models.ScanFailed,
+			wantResult: "scanner: unexpected reply \uFFFD",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApplication(t)
+			app.scanner = tt.scanner
+
+			status, result, err := app.scanUpload(context.Background(), path)
+			assert.NilError(t, err)
+			assert.Equal(t, status, tt.wantStatus)
+			assert.Equal(t, result, tt.wantResult)
+		})
+	}
+}
+
+func TestStoreUploadRescan(t *testing.T) {
+	t.Parallel()
+
+	// The mock file with this content couldn't be scanned when it was first uploaded
+	upload := func(app *application) *models.File {
+		uuid, err := app.storeUpload(context.Background(), 1, "big.iso", strings.NewReader("rescan me"), storageQuota{})
+		assert.NilError(t, err)
+		assert.Equal(t, uuid, "777777")
+
+		file, err := app.files.GetByUUID(uuid)
+		assert.NilError(t, err)
+		return file
+	}
+
+	t.Run("Scanner still unavailable", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.scanner = stubScanner{err: errors.New("scanner: connection refused")}
+
+		file := upload(app)
+		assert.Equal(t, file.ScanStatus, models.ScanFailed)
+	})
+
+	t.Run("Clean", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.scanner = stubScanner{result: scanner.Result{Clean: true}}
+
+		file := upload(app)
+		assert.Equal(t, file.ScanStatus, models.ScanClean)
+		assert.Equal(t, file.Quarantined(), false)
+	})
+
+	t.Run("Infected", func(t *testing.T) {
+		app := newTestApplication(t)
+		app.scanner = stubScanner{result: scanner.Result{Signature: "Eicar-Test-Signature"}}
+
+		file := upload(app)
+		assert.Equal(t, file.ScanStatus, models.ScanInfected)
+		assert.Equal(t, file.ScanResult, "Eicar-Test-Signature")
+	})
+
+	t.Run("No scanner", func(t *testing.T) {
+		// Without a scanner there's nothing to release it, an admin has to look at it
+		app := newTestApplication(t)
+
+		file := upload(app)
+		assert.Equal(t, file.ScanStatus, models.ScanFailed)
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		want       string
+	}{
+		{
+			name:       "Cloudflare",
+			remoteAddr: "172.18.0.2:41234",
+			header:     map[string]string{"CF-Connecting-IP": "203.0.113.7", "X-Forwarded-For": "198.51.100.1"},
+			want:       "203.0.113.7",
+		},
+		{
+			name:       "Forwarded",
+			remoteAddr: "172.18.0.2:41234",
+			header:     map[string]string{"X-Forwarded-For": "198.51.100.1, 172.18.0.3"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "Remote address",
+			remoteAddr: "192.0.2.10:41234",
+			want:       "192.0.2.10",
+		},
+		{
+			name:       "IPv6 remote address",
+			remoteAddr: "[2001:db8::1]:41234",
+			want:       "2001:db8::1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			assert.Equal(t, clientIP(r), tt.want)
+		})
+	}
+}
+
+func TestReferrerHost(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		referer string
+		want    string
+	}{
+		{name: "None", referer: "", want: ""},
+		{name: "URL", referer: "https://News.Example.org:8443/story?id=1", want: "news.example.org"},
+		{name: "Invalid", referer: "::not a url", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Referer", tt.referer)
+
+			assert.Equal(t, referrerHost(r), tt.want)
+		})
+	}
+}
+
+func TestAgentClass(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{
+			name:      "Empty",
+			userAgent: "",
+			want:      agentOther,
+		},
+		{
+			name:      "Googlebot",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:      agentBot,
+		},
+		{
+			name:      "curl",
+			userAgent: "curl/8.5.0",
+			want:      agentBot,
+		},
+		{
+			name:      "iPhone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148",
+			want:      agentMobile,
+		},
+		{
+			name:      "Android phone",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36",
+			want:      agentMobile,
+		},
+		{
+			name:      "Android tablet",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; SM-X710) AppleWebKit/537.36 Chrome/120.0 Safari/537.36",
+			want:      agentTablet,
+		},
+		{
+			name:      "iPad",
+			userAgent: "Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15",
+			want:      agentTablet,
+		},
+		{
+			name:      "Windows",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36",
+			want:      agentDesktop,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, agentClass(tt.userAgent), tt.want)
+		})
+	}
+}
+
+// recordingClicks captures inserted clicks, so tests can wait for the background write.
+type recordingClicks struct {
+	mocks.ClickModel
+	clicks chan *models.Click
+}
+
+func (m *recordingClicks) Insert(click *models.Click) error {
+	m.clicks <- click
+	return nil
+}
+
+func TestRecordClick(t *testing.T) {
+	t.Parallel()
+	app := newTestApplication(t)
+	recorder := &recordingClicks{clicks: make(chan *models.Click, 1)}
+	app.clicks = recorder
+
+	r := httptest.NewRequest(http.MethodGet, "/shorten/abcde", nil)
+	r.RemoteAddr = "192.0.2.10:41234"
+	r.Header.Set("Referer", "https://example.org/page")
+	r.Header.Set("User-Agent", "curl/8.5.0")
+	app.recordClick(r, "abcde")
+
+	select {
+	case click := <-recorder.clicks:
+		assert.Equal(t, click.ShortLink, "abcde")
+		assert.Equal(t, click.ReferrerHost, "example.org")
+		assert.Equal(t, click.AgentClass, agentBot)
+		assert.Equal(t, click.IPHash, app.hashIP("192.0.2.10"))
+		assert.Equal(t, len(click.IPHash), 64)
+		assert.Equal(t, strings.Contains(click.IPHash, "192.0.2.10"), false)
+	case <-time.After(time.Second):
+		t.Fatal("click wasn't recorded")
+	}
+}
+
+func TestNewClickChart(t *testing.T) {
+	t.Parallel()
+	today := time.Date(2025, 1, 10, 15, 0, 0, 0, time.UTC)
+	daily := []*models.DailyClicks{
+		{Day: time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC), Clicks: 2, Unique: 1},
+		{Day: time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC), Clicks: 4, Unique: 3},
+	}
+
+	chart := newClickChart(daily, today, 5)
+	assert.Equal(t, len(chart.Bars), 5)
+	assert.Equal(t, chart.Max, 4)
+
+	// Oldest first, days without clicks are empty bars
+	assert.Equal(t, chart.Bars[0].Day.Format(time.DateOnly), "2025-01-06")
+	assert.Equal(t, chart.Bars[0].Height, 0)
+	assert.Equal(t, chart.Bars[0].Y, chartHeight)
+
+	assert.Equal(t, chart.Bars[2].Clicks, 2)
+	assert.Equal(t, chart.Bars[2].Height, chartHeight/2)
+	assert.Equal(t, chart.Bars[4].Height, chartHeight)
+	assert.Equal(t, chart.Bars[4].Y, 0)
+	assert.Equal(t, chart.Bars[1].X, chartWidth/5)
+
+	// No clicks at all shouldn't divide by zero
+	chart = newClickChart(nil, today, 5)
+	assert.Equal(t, chart.Max, 0)
+	assert.Equal(t, chart.Bars[4].Height, 0)
+}
+
+func TestBaseURL(t *testing.T) {
+	t.Parallel()
+	proxies, err := parseTrustedProxies("172.18.0.0/16, ::1")
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name       string
+		canonical  string
+		remoteAddr string
+		tls        bool
+		header     map[string]string
+		want       string
+	}{
+		{
+			name:       "Request host",
+			remoteAddr: "192.0.2.10:41234",
+			want:       "http://example.com",
+		},
+		{
+			name:       "Request over TLS",
+			remoteAddr: "192.0.2.10:41234",
+			tls:        true,
+			want:       "https://example.com",
+		},
+		{
+			name:       "Trusted proxy",
+			remoteAddr: "172.18.0.2:41234",
+			header:     map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "clonebox.app"},
+			want:       "https://clonebox.app",
+		},
+		{
+			name:       "Trusted IPv6 proxy with several values",
+			remoteAddr: "[::1]:41234",
+			header:     map[string]string{"X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "clonebox.app, web:4000"},
+			want:       "https://clonebox.app",
+		},
+		{
+			name:       "Untrusted client",
+			remoteAddr: "192.0.2.10:41234",
+			header:     map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"},
+			want:       "http://example.com",
+		},
+		{
+			name:       "Trusted proxy with bad values",
+			remoteAddr: "172.18.0.2:41234",
+			header:     map[string]string{"X-Forwarded-Proto": "javascript", "X-Forwarded-Host": "evil.example/path"},
+			want:       "http://example.com",
+		},
+		{
+			name:       "Canonical URL",
+			canonical:  "https://clonebox.app",
+			remoteAddr: "172.18.0.2:41234",
+			header:     map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "other.example"},
+			want:       "https://clonebox.app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{canonicalURL: tt.canonical, trustedProxies: proxies}
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			assert.Equal(t, app.baseURL(r), tt.want)
+			assert.Equal(t, app.absoluteURL(r, "/shorten/abc"), tt.want+"/shorten/abc")
+			// Links in mail never come from the request
+			assert.Equal(t, app.mailURL("/user/verify"), tt.canonical+"/user/verify")
+		})
+	}
+}
+
+func TestParseBaseURL(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "", want: ""},
+		{raw: "https://clonebox.app", want: "https://clonebox.app"},
+		{raw: "https://clonebox.app/", want: "https://clonebox.app"},
+		{raw: "http://localhost:4000", want: "http://localhost:4000"},
+		{raw: "clonebox.app", wantErr: true},
+		{raw: "ftp://clonebox.app", wantErr: true},
+		{raw: "https://clonebox.app/app", wantErr: true},
+		{raw: "https://clonebox.app/?a=b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := parseBaseURL(tt.raw)
+			assert.Equal(t, err != nil, tt.wantErr)
+			assert.Equal(t, got, tt.want)
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Parallel()
+	prefixes, err := parseTrustedProxies("10.0.0.0/8,192.0.2.1 fd00::/8")
+	assert.NilError(t, err)
+	assert.Equal(t, len(prefixes), 3)
+	assert.Equal(t, prefixes[1].String(), "192.0.2.1/32")
+
+	_, err = parseTrustedProxies("10.0.0.0/33")
+	assert.Equal(t, err != nil, true)
+
+	_, err = parseTrustedProxies("proxy.internal")
+	assert.Equal(t, err != nil, true)
+}
+
+func TestParseBulkLinks(t *testing.T) {
+	t.Parallel()
+	input := "\xef\xbb\xbfURL,Alias\n" +
+		"https://one.example\n" +
+		"\n" +
+		",\n" +
+		" two.example , two\n" +
+		"\"https://three.example/?a=1,2\",three,ignored\n"
+
+	rows, err := parseBulkLinks([]byte(input))
+	assert.NilError(t, err)
+	assert.Equal(t, len(rows), 3)
+
+	assert.Equal(t, rows[0].Line, 2)
+	assert.Equal(t, rows[0].OriginalLink, "https://one.example")
+	assert.Equal(t, rows[0].Alias, "")
+
+	assert.Equal(t, rows[1].Line, 5)
+	assert.Equal(t, rows[1].OriginalLink, "two.example")
+	assert.Equal(t, rows[1].Alias, "two")
+
+	assert.Equal(t, rows[2].OriginalLink, "https://three.example/?a=1,2")
+	assert.Equal(t, rows[2].Alias, "three")
+
+	// Without a header the first row is a link
+	rows, err = parseBulkLinks([]byte("https://one.example"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(rows), 1)
+
+	_, err = parseBulkLinks([]byte("\"unterminated"))
+	assert.Equal(t, err != nil, true)
+}
+
+func TestCSVSafe(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, csvSafe("https://example.com"), "https://example.com")
+	assert.Equal(t, csvSafe("=HYPERLINK(\"x\")"), "'=HYPERLINK(\"x\")")
+	assert.Equal(t, csvSafe("-2+3"), "'-2+3")
+	assert.Equal(t, csvSafe("@SUM(A1)"), "'@SUM(A1)")
+	assert.Equal(t, csvSafe(""), "")
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := newRecoveryCodes()
+	assert.NilError(t, err)
+	assert.Equal(t, len(codes), recoveryCodeCount)
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		assert.Equal(t, recoveryCodeRX.MatchString("<li><code>"+code+"</code></li>"), true)
+		assert.Equal(t, seen[code], false)
+		seen[code] = true
+	}
+
+	// However they're typed in, codes hash the same
+	assert.Equal(t, normalizeRecoveryCode("ABCD-EFGH ijkl mnop"), "abcdefghijklmnop")
+}
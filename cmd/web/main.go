@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"database/sql"
 	"flag"
 	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strings"
 	"time"
@@ -19,7 +22,13 @@ import (
 	"github.com/alexedwards/scs/v2"
 	"github.com/go-playground/form/v4"
 
+	"clonebox/internal/mailer"
 	"clonebox/internal/models"
+	"clonebox/internal/oidc"
+	"clonebox/internal/scanner"
+	"clonebox/internal/shortcode"
+	"clonebox/internal/token"
+	"clonebox/internal/urlpolicy"
 
 	_ "github.com/go-sql-driver/mysql"
 )
@@ -28,13 +37,37 @@ type application struct {
 	debug          *bool
 	errorLog       *log.Logger
 	infoLog        *log.Logger
+	securityLog    *log.Logger
 	snippets       models.SnippetModelInterface
 	users          models.UserModelInterface
+	tokens         models.TokenModelInterface
+	tokenSigner    *token.Signer
+	twoFactor      models.TwoFactorModelInterface
+	passkeys       models.PasskeyModelInterface
+	identities     models.IdentityModelInterface
+	loginThrottle  *loginThrottle
+	userSessions   models.UserSessionModelInterface
+	sso            *oidc.Client
+	ssoName        string
+	mailer         mailer.Mailer
 	links          models.LinkMappingModelInterface
+	shortCodes     *shortcode.Generator
+	linkPolicy     *urlpolicy.Policy
+	canonicalURL   string
+	trustedProxies []netip.Prefix
+	clicks         models.ClickModelInterface
+	ipHashKey      []byte
 	files          models.FilesModelInterface
+	collections    models.CollectionModelInterface
+	uploadDir      string
+	scanner        scanner.Scanner
+	defaultQuota   storageQuota
+	uploadMaxBytes int64
 	templateCache  map[string]*template.Template
 	formDecoder    *form.Decoder
 	sessionManager *scs.SessionManager
+	idleTimeout    time.Duration // Logins that aren't remembered end after this long without a request
+	reauthAfter    time.Duration // Sensitive account changes ask for the password again once a login is this old
 	llmClient      *genai.Client
 	llmConfig      *genai.GenerateContentConfig
 }
@@ -42,6 +75,7 @@ type application struct {
 func main() {
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
 	errorLog := log.New(os.Stderr, "ERROR\t", log.Ldate|log.Ltime|log.Lshortfile)
+	securityLog := log.New(os.Stdout, "SECURITY\t", log.Ldate|log.Ltime)
 
 	addr := flag.String("addr", ":4000", "HTTP network address")
 
@@ -65,6 +99,31 @@ func main() {
 
 	dsn := flag.String("dsn", default_dsn, "MySQL data source name")
 	debug := flag.Bool("debug", false, "Enables debug mode (stack traces)")
+	uploadDir := flag.String("upload-dir", "/clonebox/uploads/", "Directory uploaded files are stored in")
+	quotaBytes := flag.Int64("quota-bytes", 1<<30, "Default per-user storage quota in bytes (0 for unlimited)")
+	quotaFiles := flag.Int("quota-files", 1000, "Default per-user limit on the number of stored files (0 for unlimited)")
+	uploadMaxBytes := flag.Int64("upload-max-bytes", 100<<20, "Largest upload request accepted in bytes, whatever the quota")
+	codeStrategy := flag.String("shortcode-strategy", "random", "How short link codes are generated (random or sequential)")
+	codeLength := flag.Int("shortcode-length", 6, "Initial length of generated short link codes")
+	codeSalt := flag.String("shortcode-salt", os.Getenv("SHORTCODE_SALT"), "Salt for the sequential short code strategy")
+	selfHosts := flag.String("self-hosts", os.Getenv("SELF_HOSTS"), "Comma separated host names this site is served under, short links to them can't be shortened")
+	blockedDomains := flag.String("blocked-domains", os.Getenv("BLOCKED_DOMAINS"), "Comma separated domains (and their subdomains) that can't be shortened")
+	blocklistFile := flag.String("blocklist-file", os.Getenv("BLOCKLIST_FILE"), "Hosts-style file of domains that can't be shortened")
+	ipHashKey := flag.String("ip-hash-key", os.Getenv("IP_HASH_KEY"), "Key client IPs of short link clicks are hashed with (random per run if empty)")
+	baseURL := flag.String("base-url", os.Getenv("BASE_URL"), "Canonical URL of the site used in absolute links, e.g. https://clonebox.app (worked out per request if empty)")
+	trustedProxies := flag.String("trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-Proto/Host headers are trusted")
+	clamdAddr := flag.String("clamd-addr", os.Getenv("CLAMD_ADDR"), "clamd TCP address uploads are scanned with (disabled if empty)")
+	smtpAddr := flag.String("smtp-addr", os.Getenv("SMTP_ADDR"), "SMTP server host:port mail is sent through (mail is written to the mail log if empty)")
+	smtpUsername := flag.String("smtp-username", os.Getenv("SMTP_USERNAME"), "SMTP username, the password is read from SMTP_PASSWORD (no authentication if empty)")
+	mailFrom := flag.String("mail-from", os.Getenv("MAIL_FROM"), "Sender address of mail, e.g. \"Clonebox <noreply@clonebox.app>\"")
+	mailLog := flag.String("mail-log", os.Getenv("MAIL_LOG"), "File mail is appended to instead of being sent when no SMTP server is configured (stdout if empty)")
+	tokenKey := flag.String("token-key", os.Getenv("TOKEN_KEY"), "Key the tokens in emailed links are signed with (random per run if empty)")
+	oidcIssuer := flag.String("oidc-issuer", os.Getenv("OIDC_ISSUER"), "OpenID Connect issuer URL to offer single sign-on with (disabled if empty)")
+	oidcClientID := flag.String("oidc-client-id", os.Getenv("OIDC_CLIENT_ID"), "OpenID Connect client ID, the secret is read from OIDC_CLIENT_SECRET (a public client if there's none)")
+	oidcName := flag.String("oidc-name", os.Getenv("OIDC_NAME"), "Name of the identity provider shown on the login page")
+	sessionIdleTimeout := flag.Duration("session-idle-timeout", 2*time.Hour, "How long a login lasts without a request, unless \"remember me\" was ticked")
+	rememberMeLifetime := flag.Duration("remember-me-lifetime", 30*24*time.Hour, "How long a login with \"remember me\" ticked lasts")
+	reauthenticateAfter := flag.Duration("reauthenticate-after", 10*time.Minute, "How old a login can be before sensitive account changes ask for the password again")
 
 	flag.Parse()
 
@@ -81,10 +140,144 @@ func main() {
 
 	formDecoder := form.NewDecoder()
 
+	links := &models.LinkMappingModel{DB: db}
+	var strategy shortcode.Strategy
+	switch *codeStrategy {
+	case "random":
+		strategy = shortcode.Random{}
+	case "sequential":
+		// Continue numbering after the existing links. Codes that were already handed out are skipped as collisions
+		count, err := links.Count()
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		sequential := &shortcode.Sequential{Salt: *codeSalt}
+		sequential.Seed(uint64(count))
+		strategy = sequential
+	default:
+		errorLog.Fatalf("unknown short code strategy %q", *codeStrategy)
+	}
+
+	// Destinations are checked against the configured domains, and resolved to catch names pointing at internal hosts
+	blocklists := urlpolicy.Blocklists{urlpolicy.NewDomains(strings.Split(*blockedDomains, ",")...)}
+	if *blocklistFile != "" {
+		domains, err := urlpolicy.LoadHostsFile(*blocklistFile)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("Loaded %d blocked domains from %s", len(domains), *blocklistFile)
+		blocklists = append(blocklists, domains)
+	}
+	linkPolicy := &urlpolicy.Policy{
+		SelfHosts: strings.FieldsFunc(*selfHosts, func(r rune) bool { return r == ',' || r == ' ' }),
+		Blocklist: blocklists,
+		Resolver:  net.DefaultResolver,
+	}
+
+	canonicalURL, err := parseBaseURL(*baseURL)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	proxies, err := parseTrustedProxies(*trustedProxies)
+	if err != nil {
+		errorLog.Fatal(err)
+	}
+	if canonicalURL == "" {
+		infoLog.Printf("No base URL configured, absolute links are built from each request's host")
+	}
+
+	// Without a configured key, clicks from the same client can only be matched up until the next restart
+	clickKey := []byte(*ipHashKey)
+	if len(clickKey) == 0 {
+		clickKey = make([]byte, 32)
+		if _, err := rand.Read(clickKey); err != nil {
+			errorLog.Fatal(err)
+		}
+	}
+
+	// Without a configured key, links in mail sent before a restart stop working
+	signingKey := []byte(*tokenKey)
+	if len(signingKey) == 0 {
+		signingKey = make([]byte, 32)
+		if _, err := rand.Read(signingKey); err != nil {
+			errorLog.Fatal(err)
+		}
+		infoLog.Printf("No token key configured, emailed links only work until the next restart")
+	}
+
+	var mail mailer.Mailer
+	if *smtpAddr != "" {
+		if *mailFrom == "" {
+			errorLog.Fatal("a sender address (-mail-from) is required to send mail")
+		}
+		if canonicalURL == "" {
+			errorLog.Fatal("a base URL (-base-url) is required to send mail, links in it can't be built from requests")
+		}
+		SMTP_PASS, exists := os.LookupEnv("SMTP_PASSWORD")
+		if !exists && *smtpUsername != "" {
+			raw_password, err := os.ReadFile("/run/secrets/smtp_password")
+			if err != nil {
+				errorLog.Printf("%s", err)
+			}
+			SMTP_PASS = strings.TrimSpace(string(raw_password))
+		}
+		mail = &mailer.SMTP{
+			Addr:     *smtpAddr,
+			Username: *smtpUsername,
+			Password: SMTP_PASS,
+			From:     *mailFrom,
+			Timeout:  30 * time.Second,
+		}
+	} else if *mailLog != "" {
+		f, err := os.OpenFile(*mailLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			errorLog.Fatal(err)
+		}
+		defer f.Close()
+		mail = &mailer.Log{W: f}
+		infoLog.Printf("No SMTP server configured, mail is written to %s", *mailLog)
+	} else {
+		mail = &mailer.Log{W: os.Stdout}
+		infoLog.Printf("No SMTP server configured, mail is written to stdout")
+	}
+
+	var sso *oidc.Client
+	if *oidcIssuer != "" {
+		if *oidcClientID == "" {
+			errorLog.Fatal("a client ID (-oidc-client-id) is required for single sign-on")
+		}
+		OIDC_SECRET, exists := os.LookupEnv("OIDC_CLIENT_SECRET")
+		if !exists {
+			raw_secret, err := os.ReadFile("/run/secrets/oidc_client_secret")
+			if err != nil {
+				infoLog.Printf("No OIDC client secret configured, logging in as a public client")
+			}
+			OIDC_SECRET = strings.TrimSpace(string(raw_secret))
+		}
+		sso = &oidc.Client{
+			Issuer:       *oidcIssuer,
+			ClientID:     *oidcClientID,
+			ClientSecret: OIDC_SECRET,
+			Scopes:       []string{"email", "profile"},
+		}
+		if *oidcName == "" {
+			*oidcName = "SSO"
+		}
+	}
+
+	var uploadScanner scanner.Scanner = scanner.Nop{}
+	if *clamdAddr != "" {
+		uploadScanner = &scanner.ClamAV{Addr: *clamdAddr, Timeout: time.Minute}
+	} else {
+		infoLog.Printf("No clamd address configured, uploads won't be scanned")
+	}
+
 	sessionManager := scs.New()
 	sessionManager.Store = mysqlstore.New(db)
-	sessionManager.Lifetime = 12 * time.Hour
+	sessionManager.Lifetime = *rememberMeLifetime
 	sessionManager.Cookie.Secure = true
+	// Session cookies only outlast the browser for logins with "remember me" ticked
+	sessionManager.Cookie.Persist = false
 
 	// Gemini integration - doing this here so i don't create a new geminiClient for every request
 	API_KEY, exists := os.LookupEnv("LLM_KEY")
@@ -124,13 +317,37 @@ func main() {
 		debug:          debug,
 		errorLog:       errorLog,
 		infoLog:        infoLog,
+		securityLog:    securityLog,
 		snippets:       &models.SnippetModel{DB: db},
 		users:          &models.UserModel{DB: db},
-		links:          &models.LinkMappingModel{DB: db},
+		tokens:         &models.TokenModel{DB: db},
+		tokenSigner:    &token.Signer{Key: signingKey},
+		twoFactor:      &models.TwoFactorModel{DB: db},
+		passkeys:       &models.PasskeyModel{DB: db},
+		identities:     &models.IdentityModel{DB: db},
+		loginThrottle:  newLoginThrottle(&models.LoginFailureModel{DB: db}),
+		userSessions:   &models.UserSessionModel{DB: db},
+		sso:            sso,
+		ssoName:        *oidcName,
+		mailer:         mail,
+		links:          links,
+		shortCodes:     shortcode.New(strategy, *codeLength, models.ErrDuplicateLink),
+		linkPolicy:     linkPolicy,
+		canonicalURL:   canonicalURL,
+		trustedProxies: proxies,
+		clicks:         &models.ClickModel{DB: db},
+		ipHashKey:      clickKey,
 		files:          &models.FileModel{DB: db},
+		collections:    &models.CollectionModel{DB: db},
+		uploadDir:      *uploadDir,
+		scanner:        uploadScanner,
+		defaultQuota:   storageQuota{Bytes: *quotaBytes, Files: *quotaFiles},
+		uploadMaxBytes: *uploadMaxBytes,
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
+		idleTimeout:    *sessionIdleTimeout,
+		reauthAfter:    *reauthenticateAfter,
 		llmClient:      geminiClient,
 		llmConfig:      geminiConfig,
 	}
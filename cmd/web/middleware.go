@@ -1,11 +1,13 @@
 package main
 
 import (
+	"clonebox/internal/models"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
+	"time"
 
 	"github.com/justinas/nosurf"
 )
@@ -24,21 +26,7 @@ func secureHeaders(next http.Handler) http.Handler {
 
 func (app *application) logRequest(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var remote string
-		// Finding real ip logic
-		// Cloudflare proxy -> Caddy -> Go
-		// 1. Cloudflare's specific header
-		if cf := r.Header.Get("CF-Connecting-IP"); cf != "" {
-			remote = cf
-		} else if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-			// 2. X-Forwarded-For is a comma-separated list
-			// The first IP should be the original client
-			ips := strings.Split(forwarded, ",")
-			remote = strings.TrimSpace(ips[0])
-		} else {
-			// 3. Default fallback
-			remote = r.RemoteAddr
-		}
+		remote := clientIP(r)
 
 		app.infoLog.Printf("%s - %s %s %s", remote, r.Proto, r.Method, r.URL.RequestURI())
 		next.ServeHTTP(w, r)
@@ -79,6 +67,48 @@ func (app *application) requireAuthentication(next http.Handler) http.Handler {
 	})
 }
 
+// requireRecentLogin guards sensitive account changes, sending users whose login is older than reauthAfter to enter
+// their password again first. It goes after requireAuthentication.
+func (app *application) requireRecentLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticatedAt := time.Unix(app.sessionManager.GetInt64(r.Context(), "authenticatedAt"), 0)
+		if time.Since(authenticatedAt) > app.reauthAfter {
+			// Forms can't be resubmitted after the detour, so only pages are returned to
+			if r.Method == http.MethodGet {
+				app.sessionManager.Put(r.Context(), "originalPath", r.URL.Path)
+			}
+			http.Redirect(w, r, "/user/reauthenticate", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAdmin must come after requireAuthentication in the chain. Non-admins get a 404 rather than a 403, so admin
+// pages aren't advertised to them.
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := app.sessionManager.GetInt(r.Context(), "authenticatedUserId")
+		user, err := app.users.Get(id)
+		if err != nil {
+			if errors.Is(err, models.ErrNoRecord) {
+				app.notFound(w)
+				return
+			}
+			app.serverError(w, err)
+			return
+		}
+
+		if !user.Admin {
+			app.notFound(w)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // CSRF Handling with noSurf
 func noSurf(next http.Handler) http.Handler {
 	csrfHandler := nosurf.New(next)
@@ -88,6 +118,12 @@ func noSurf(next http.Handler) http.Handler {
 		HttpOnly: true,
 	})
 
+	// fileUploadPost streams its multipart body, so it checks the token itself rather than letting nosurf buffer the
+	// whole upload just to find it
+	csrfHandler.ExemptFunc(func(r *http.Request) bool {
+		return r.Method == http.MethodPost && r.URL.Path == "/file"
+	})
+
 	csrfHandler.SetFailureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("CSRF validation failed for path: %s, reason: %v", r.URL.Path, nosurf.Reason(r))
 		http.Error(w, "CSRF validation failed", http.StatusBadRequest)
@@ -101,6 +137,26 @@ func noSurf(next http.Handler) http.Handler {
 	return csrfHandler
 }
 
+// requireVerified sends users who haven't verified their email address yet to the verification page. It goes after
+// requireAuthentication.
+func (app *application) requireVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := app.users.Get(app.sessionManager.GetInt(r.Context(), "authenticatedUserId"))
+		if err != nil {
+			app.serverError(w, err)
+			return
+		}
+
+		if !user.Verified {
+			app.sessionManager.Put(r.Context(), "flash", "Please verify your email address first")
+			http.Redirect(w, r, "/user/verify", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -114,16 +170,35 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 
 		// Otherwise, check to see if a user with that ID exists in database.
-		exists, err := app.users.Exists(id)
-		if err != nil {
+		user, err := app.users.Get(id)
+		if err != nil && !errors.Is(err, models.ErrNoRecord) {
 			app.serverError(w, err)
 			return
 		}
 
+		// Sessions from before the user's session version was bumped (e.g. by a password reset) have ended
+		if user != nil && user.SessionVersion != app.sessionManager.GetInt(r.Context(), "sessionVersion") {
+			app.clearLogin(r.Context())
+			user = nil
+		}
+
+		// So have sessions the user revoked from the sessions page
+		if user != nil {
+			active, err := app.checkUserSession(r, user.ID)
+			if err != nil {
+				app.serverError(w, err)
+				return
+			}
+			if !active {
+				app.clearLogin(r.Context())
+				user = nil
+			}
+		}
+
 		// If a matching user is found, we know that the request is coming from an authenticated user who exists in db.
 		// Also creates a new copy of the request (with an isAuthenticatedContextKey value of true in the request context)
 		// and assign it to r.
-		if exists {
+		if user != nil {
 			ctx := context.WithValue(r.Context(), isAuthenticatedContextKey, true)
 			r = r.WithContext(ctx)
 		}
@@ -29,6 +29,11 @@ func (app *application) routes() http.Handler {
 
 	router.HandlerFunc(http.MethodGet, "/ping", ping)
 
+	// Thumbnails are public and cacheable, so they skip the session middleware (and its Set-Cookie / Vary: Cookie)
+	router.HandlerFunc(http.MethodGet, "/file/thumb/:uuid", app.fileThumbnail)
+	// QR codes only depend on the target, so likewise
+	router.HandlerFunc(http.MethodGet, "/qr", app.qrCode)
+
 	// Middleware chain specific for handling dynamic application routes
 	dynamic := alice.New(app.sessionManager.LoadAndSave, noSurf, app.authenticate)
 
@@ -40,26 +45,92 @@ func (app *application) routes() http.Handler {
 	router.Handler(http.MethodPost, "/user/signup", dynamic.ThenFunc(app.userSignupPost))
 	router.Handler(http.MethodGet, "/user/login", dynamic.ThenFunc(app.userLogin))
 	router.Handler(http.MethodPost, "/user/login", dynamic.ThenFunc(app.userLoginPost))
-	router.Handler(http.MethodGet, "/shorten/:hash", dynamic.ThenFunc(app.linkRedirect))
+	router.Handler(http.MethodGet, "/user/login/2fa", dynamic.ThenFunc(app.userLoginTwoFactor))
+	router.Handler(http.MethodPost, "/user/login/2fa", dynamic.ThenFunc(app.userLoginTwoFactorPost))
+	router.Handler(http.MethodPost, "/user/login/passkey/begin", dynamic.ThenFunc(app.userLoginPasskeyBeginPost))
+	router.Handler(http.MethodPost, "/user/login/passkey/finish", dynamic.ThenFunc(app.userLoginPasskeyFinishPost))
+	router.Handler(http.MethodPost, "/user/login/sso", dynamic.ThenFunc(app.userLoginSSOPost))
+	router.Handler(http.MethodGet, "/user/login/sso/callback", dynamic.ThenFunc(app.userLoginSSOCallback))
+	router.Handler(http.MethodGet, "/user/verify", dynamic.ThenFunc(app.userVerify))
+	router.Handler(http.MethodGet, "/user/password/forgot", dynamic.ThenFunc(app.userPasswordForgot))
+	router.Handler(http.MethodPost, "/user/password/forgot", dynamic.ThenFunc(app.userPasswordForgotPost))
+	router.Handler(http.MethodGet, "/user/password/reset", dynamic.ThenFunc(app.userPasswordReset))
+	router.Handler(http.MethodPost, "/user/password/reset", dynamic.ThenFunc(app.userPasswordResetPost))
+	router.Handler(http.MethodGet, "/account/email/confirm", dynamic.ThenFunc(app.accountEmailConfirm))
 	router.Handler(http.MethodGet, "/file/view/:uuid", dynamic.ThenFunc(app.fileView))
 	router.Handler(http.MethodGet, "/file/download/:uuid", dynamic.ThenFunc(app.fileDownload))
+	router.Handler(http.MethodGet, "/file/preview/:uuid", dynamic.ThenFunc(app.filePreview))
+	router.Handler(http.MethodGet, "/file/collection/:uuid", dynamic.ThenFunc(app.fileCollectionView))
+	router.Handler(http.MethodGet, "/file/collection/:uuid/zip", dynamic.ThenFunc(app.fileCollectionZip))
 
 	// Protected (authenticated-only) and dynamic application route handling
 	protected := dynamic.Append(app.requireAuthentication)
 
+	// Uploading and shortening additionally need a verified email address
+	verified := protected.Append(app.requireVerified)
+
+	// Changing how the user logs in needs a recent login
+	sensitive := protected.Append(app.requireRecentLogin)
+
+	// httprouter doesn't allow /shorten/bulk next to /shorten/:hash, so "bulk" (a reserved alias) is picked out of the
+	// parameter instead. Imports are limited in size before nosurf reads the form for its token.
+	router.Handler(http.MethodGet, "/shorten/:hash",
+		aliasRoute("bulk", verified.ThenFunc(app.linkBulk), dynamic.ThenFunc(app.linkRedirect)))
+	router.Handler(http.MethodPost, "/shorten/:hash",
+		aliasRoute("bulk", http.MaxBytesHandler(verified.ThenFunc(app.linkBulkPost), bulkMaxBody),
+			dynamic.ThenFunc(app.linkContinuePost)))
+
 	router.Handler(http.MethodGet, "/account/view", protected.ThenFunc(app.accountView))
 	router.Handler(http.MethodGet, "/snippet/create", protected.ThenFunc(app.snippetCreate))
 	router.Handler(http.MethodPost, "/snippet/create", protected.ThenFunc(app.snippetCreatePost))
 	router.Handler(http.MethodPost, "/user/logout", protected.ThenFunc(app.userLogoutPost))
-	router.Handler(http.MethodGet, "/account/password/update", protected.ThenFunc(app.accountPasswordUpdate))
-	router.Handler(http.MethodPost, "/account/password/update", protected.ThenFunc(app.accountPasswordUpdatePost))
-	router.Handler(http.MethodGet, "/shorten", protected.ThenFunc(app.linkShorten))
-	router.Handler(http.MethodPost, "/shorten", protected.ThenFunc(app.linkShortenPost))
-	router.Handler(http.MethodGet, "/file", protected.ThenFunc(app.fileUpload))
-	router.Handler(http.MethodPost, "/file", protected.ThenFunc(app.fileUploadPost))
+	router.Handler(http.MethodPost, "/user/verify", protected.ThenFunc(app.userVerifyPost))
+	router.Handler(http.MethodGet, "/user/reauthenticate", protected.ThenFunc(app.userReauthenticate))
+	router.Handler(http.MethodPost, "/user/reauthenticate", protected.ThenFunc(app.userReauthenticatePost))
+	router.Handler(http.MethodGet, "/account/profile", protected.ThenFunc(app.accountProfile))
+	router.Handler(http.MethodPost, "/account/profile", protected.ThenFunc(app.accountProfilePost))
+	router.Handler(http.MethodGet, "/account/email", sensitive.ThenFunc(app.accountEmail))
+	router.Handler(http.MethodPost, "/account/email", sensitive.ThenFunc(app.accountEmailPost))
+	router.Handler(http.MethodGet, "/account/password/update", sensitive.ThenFunc(app.accountPasswordUpdate))
+	router.Handler(http.MethodPost, "/account/password/update", sensitive.ThenFunc(app.accountPasswordUpdatePost))
+	router.Handler(http.MethodGet, "/account/2fa", sensitive.ThenFunc(app.accountTwoFactor))
+	router.Handler(http.MethodPost, "/account/2fa/enable", sensitive.ThenFunc(app.accountTwoFactorEnablePost))
+	router.Handler(http.MethodPost, "/account/2fa/disable", sensitive.ThenFunc(app.accountTwoFactorDisablePost))
+	router.Handler(http.MethodPost, "/account/passkeys/begin", sensitive.ThenFunc(app.accountPasskeyBeginPost))
+	router.Handler(http.MethodPost, "/account/passkeys/finish", sensitive.ThenFunc(app.accountPasskeyFinishPost))
+	router.Handler(http.MethodPost, "/account/passkeys/delete", sensitive.ThenFunc(app.accountPasskeyDeletePost))
+	router.Handler(http.MethodGet, "/account/sessions", protected.ThenFunc(app.accountSessions))
+	router.Handler(http.MethodPost, "/account/sessions/revoke", protected.ThenFunc(app.accountSessionRevokePost))
+	router.Handler(http.MethodPost, "/account/sessions/revoke-all", protected.ThenFunc(app.accountSessionRevokeAllPost))
+	router.Handler(http.MethodGet, "/shorten", verified.ThenFunc(app.linkShorten))
+	router.Handler(http.MethodPost, "/shorten", verified.ThenFunc(app.linkShortenPost))
+	router.Handler(http.MethodGet, "/shorten/:hash/stats", protected.ThenFunc(app.linkStats))
+	router.Handler(http.MethodGet, "/shorten/:hash/edit", protected.ThenFunc(app.linkEdit))
+	router.Handler(http.MethodPost, "/shorten/:hash/edit", protected.ThenFunc(app.linkEditPost))
+	router.Handler(http.MethodPost, "/shorten/:hash/active", protected.ThenFunc(app.linkActivePost))
+	router.Handler(http.MethodGet, "/account/links", protected.ThenFunc(app.linkList))
+	router.Handler(http.MethodGet, "/account/links/export", protected.ThenFunc(app.linkExport))
+	router.Handler(http.MethodGet, "/file", verified.ThenFunc(app.fileUpload))
+	router.Handler(http.MethodPost, "/file", verified.ThenFunc(app.fileUploadPost))
 	router.Handler(http.MethodGet, "/bill_split", protected.ThenFunc(app.billSplit))
 	router.Handler(http.MethodPost, "/bill_split", protected.ThenFunc(app.billSplitPost))
 
+	// Admin-only routes
+	admin := protected.Append(app.requireAdmin)
+
+	router.Handler(http.MethodGet, "/admin/files", admin.ThenFunc(app.adminFiles))
+
 	standard := alice.New(app.recoverPanic, app.logRequest, secureHeaders)
 	return standard.Then(router)
 }
+
+// aliasRoute serves the requests for one value of a /shorten/:hash route's parameter with h, and all others with next.
+func aliasRoute(alias string, h, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName("hash") == alias {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
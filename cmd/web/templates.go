@@ -3,9 +3,12 @@ package main
 import (
 	"clonebox/internal/models"
 	"clonebox/ui"
+	"encoding/base64"
+	"fmt"
 	"html/template"
 	"io/fs"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,10 +20,22 @@ type templateData struct {
 	Link            *models.LinkMapping
 	Links           []*models.LinkMapping
 	File            *models.File
+	Files           []*models.File
+	Preview         *previewData
+	Collection      *models.Collection
+	Usage           *storageUsage
+	TwoFactor       *twoFactorData
+	Passkeys        []models.Passkey
+	Sessions        []models.UserSession
+	CurrentSession  string // ID of the session the page is being viewed in
+	Stats           *linkStats
+	LinkPreview     *linkPreviewData
+	QRTarget        string // Path of the page the QR code on this page points at, see qrCode
 	Form            any
 	Flash           string
 	IsAuthenticated bool
 	CSRFToken       string
+	SSOName         string // Name of the single sign-on identity provider, empty if there's none
 	User            *models.User
 	BillItems       []models.BillItem
 	ReceiptMimeType string
@@ -35,10 +50,79 @@ func humanDate(t time.Time) string {
 	return t.UTC().Format("02 Jan 2006 at 15:04")
 }
 
+// A humanBytes function which returns a byte count in binary units, e.g. "1.5 MiB".
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// A base64url function which encodes binary IDs, such as passkey credential IDs, for use in forms and URLs.
+func base64url(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// A deviceName function which describes a User-Agent header as a browser and operating system, e.g. "Firefox on
+// Windows", for telling a user's sessions apart. Like agentClass it only looks for the usual markers.
+func deviceName(userAgent string) string {
+	var browser string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	}
+
+	var os string
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		os = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		os = "Android"
+	case strings.Contains(userAgent, "Windows"):
+		os = "Windows"
+	case strings.Contains(userAgent, "Mac OS X"):
+		os = "macOS"
+	case strings.Contains(userAgent, "CrOS"):
+		os = "ChromeOS"
+	case strings.Contains(userAgent, "Linux"):
+		os = "Linux"
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return "Unknown device"
+	}
+}
+
 // Essentially a string-keyed map which acts as a lookup between the names of the custom template functions and the
 // functions themselves.
 var functions = template.FuncMap{
-	"humanDate": humanDate,
+	"humanDate":  humanDate,
+	"humanBytes": humanBytes,
+	"base64url":  base64url,
+	"deviceName": deviceName,
 }
 
 func newTemplateCache() (map[string]*template.Template, error) {
@@ -38,3 +38,65 @@ func TestHumanDate(t *testing.T) {
 		})
 	}
 }
+
+func TestHumanBytes(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name string
+		n    int64
+		want string
+	}{
+		{name: "Zero", n: 0, want: "0 B"},
+		{name: "Bytes", n: 1023, want: "1023 B"},
+		{name: "KiB", n: 1024, want: "1.0 KiB"},
+		{name: "MiB", n: 1536 << 10, want: "1.5 MiB"},
+		{name: "GiB", n: 1 << 30, want: "1.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, humanBytes(tt.n), tt.want)
+		})
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{
+			name:      "Firefox on Windows",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0",
+			want:      "Firefox on Windows",
+		},
+		{
+			name:      "Edge",
+			userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36 Edg/126.0.0.0",
+			want:      "Edge on Windows",
+		},
+		{
+			name:      "Safari on iPhone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1",
+			want:      "Safari on iOS",
+		},
+		{
+			name:      "Chrome on Android",
+			userAgent: "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Mobile Safari/537.36",
+			want:      "Chrome on Android",
+		},
+		{
+			name:      "Unknown",
+			userAgent: "Go-http-client/1.1",
+			want:      "Unknown device",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, deviceName(tt.userAgent), tt.want)
+		})
+	}
+}
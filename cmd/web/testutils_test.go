@@ -2,10 +2,19 @@ package main
 
 import (
 	"bytes"
+	"clonebox/internal/mailer"
+	"clonebox/internal/models"
 	"clonebox/internal/models/mocks"
+	"clonebox/internal/scanner"
+	"clonebox/internal/shortcode"
+	"clonebox/internal/throttle"
+	"clonebox/internal/token"
+	"clonebox/internal/urlpolicy"
+	"context"
 	"html"
 	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
@@ -37,8 +46,9 @@ func newTestApplication(t *testing.T) *application {
 
 	// Create a sessionManager instance
 	sessionManager := scs.New()
-	sessionManager.Lifetime = 12 * time.Hour
+	sessionManager.Lifetime = 30 * 24 * time.Hour
 	sessionManager.Cookie.Secure = true
+	sessionManager.Cookie.Persist = false
 	//sessionManager.Cookie.Secure = false
 
 	// Dummy LLM client and config for testing
@@ -48,17 +58,62 @@ func newTestApplication(t *testing.T) *application {
 	return &application{
 		errorLog:       log.New(io.Discard, "", 0),
 		infoLog:        log.New(io.Discard, "", 0),
+		securityLog:    log.New(io.Discard, "", 0),
 		templateCache:  templateCache,
 		formDecoder:    formDecoder,
 		sessionManager: sessionManager,
+		idleTimeout:    2 * time.Hour,
+		reauthAfter:    10 * time.Minute,
 		snippets:       &mocks.SnippetModel{},
 		users:          &mocks.UserModel{},
+		tokens:         &mocks.TokenModel{},
+		tokenSigner:    &token.Signer{Key: []byte("test")},
+		twoFactor:      &mocks.TwoFactorModel{},
+		passkeys:       &mocks.PasskeyModel{},
+		identities:     &mocks.IdentityModel{},
+		loginThrottle:  newLoginThrottle(&throttle.MemoryStore{}),
+		userSessions:   &mocks.UserSessionModel{},
+		mailer:         newTestMailer(),
 		links:          &mocks.LinkMappingModel{},
+		shortCodes:     shortcode.New(shortcode.Random{}, 6, models.ErrDuplicateLink),
+		linkPolicy:     &urlpolicy.Policy{Blocklist: urlpolicy.NewDomains("blocked.example")},
+		clicks:         &mocks.ClickModel{},
+		ipHashKey:      []byte("test"),
 		files:          &mocks.FileModel{},
+		collections:    &mocks.CollectionModel{},
+		uploadDir:      t.TempDir(),
+		uploadMaxBytes: 100 << 20,
+		scanner:        scanner.Nop{},
 		debug:          &debug,
 	}
 }
 
+// testMailer records the messages sent through it instead of delivering them.
+type testMailer struct {
+	sent chan *mailer.Message
+}
+
+func newTestMailer() *testMailer {
+	return &testMailer{sent: make(chan *mailer.Message, 10)}
+}
+
+func (m *testMailer) Send(ctx context.Context, msg *mailer.Message) error {
+	m.sent <- msg
+	return nil
+}
+
+// Waits for the next message the application sends, which happens in the background.
+func (m *testMailer) next(t *testing.T) *mailer.Message {
+	t.Helper()
+	select {
+	case msg := <-m.sent:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail sent")
+		return nil
+	}
+}
+
 // Initalizes and returns a new instance of the custom testServer type.
 func newTestServer(t *testing.T, h http.Handler) *testServer {
 	// Initialize the test server as normal.
@@ -155,3 +210,111 @@ func extractCSRFToken(t *testing.T, body string) string {
 
 	return html.UnescapeString(string(matches[1]))
 }
+
+// Logs in as the mock user and returns a CSRF token valid for the session.
+func (ts *testServer) login(t *testing.T) string {
+	t.Helper()
+	return ts.loginAs(t, "alice@example.com")
+}
+
+// Logs in as the mock user with the given email and returns a CSRF token valid for the session.
+func (ts *testServer) loginAs(t *testing.T, email string) string {
+	t.Helper()
+	_, _, body := ts.get(t, "/user/login")
+	validCSRFToken := extractCSRFToken(t, body)
+
+	form := url.Values{}
+	form.Add("email", email)
+	form.Add("password", "p@ssw0rd")
+	form.Add("csrf_token", validCSRFToken)
+	code, _, _ := ts.postForm(t, "/user/login", form)
+	if code != http.StatusSeeOther {
+		t.Fatalf("login failed with status %d", code)
+	}
+
+	return validCSRFToken
+}
+
+// testUpload is a file to be sent by postFiles.
+type testUpload struct {
+	field    string // Form field the file is sent under, "file" if empty
+	fileName string
+	content  []byte
+}
+
+// Makes a multipart POST request with the given form fields and files. Returns response status code, headers and
+// body.
+func (ts *testServer) postFiles(t *testing.T, urlPath string, form url.Values, files []testUpload) (int, http.Header, string) {
+	t.Helper()
+	var b bytes.Buffer
+	writer := multipart.NewWriter(&b)
+
+	// Fields go first, the same order a browser sends the upload form in
+	for key, values := range form {
+		for _, v := range values {
+			if err := writer.WriteField(key, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, f := range files {
+		field := f.field
+		if field == "" {
+			field = "file"
+		}
+		part, err := writer.CreateFormFile(field, f.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = part.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Referer", ts.URL+urlPath)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	body, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, rs.Header, string(body)
+}
+
+// Makes a POST request the way the passkey script does, with the CSRF token in a header rather than the body.
+// Returns response status code and body.
+func (ts *testServer) postPasskey(t *testing.T, urlPath, csrfToken, contentType string, body []byte) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, ts.URL+urlPath, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-CSRF-Token", csrfToken)
+	req.Header.Set("Referer", ts.URL+urlPath)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	respBody, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, respBody
+}
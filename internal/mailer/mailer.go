@@ -0,0 +1,174 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidHeader is returned for messages whose addresses or subject can't be put in a header as they are, e.g.
+// because they contain line breaks.
+var ErrInvalidHeader = errors.New("mailer: invalid header value")
+
+// Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Implementations return an error when a message couldn't be handed over for delivery.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// SMTP sends messages through an SMTP server. The connection is upgraded with STARTTLS when the server offers it, and
+// authenticated with PLAIN when a username is set (which net/smtp refuses to do unencrypted, except to localhost).
+type SMTP struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+	Timeout  time.Duration // For the whole exchange, none if zero
+}
+
+func (s *SMTP) Send(ctx context.Context, msg *Message) error {
+	data, err := format(s.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("mailer: %w", err)
+		}
+	}
+	if s.Username != "" {
+		if err = c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return fmt.Errorf("mailer: %w", err)
+		}
+	}
+
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("mailer: sender: %w", err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("mailer: recipient: %w", err)
+	}
+	if err = c.Mail(from.Address); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if err = c.Rcpt(to.Address); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if _, err = w.Write(data); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("mailer: %w", err)
+	}
+
+	return c.Quit()
+}
+
+// Log writes messages to W instead of sending them, for development and for trying out mail flows locally. W is
+// typically os.Stdout or a file.
+type Log struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+func (l *Log) Send(ctx context.Context, msg *Message) error {
+	if err := checkHeader(msg.To, msg.Subject); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := fmt.Fprintf(l.W, "To: %s\nSubject: %s\nDate: %s\n\n%s\n-----\n", msg.To, msg.Subject,
+		time.Now().Format(time.RFC1123Z), strings.TrimRight(msg.Body, "\n"))
+	return err
+}
+
+// checkHeader rejects values which would break out of their header line.
+func checkHeader(values ...string) error {
+	for _, v := range values {
+		if strings.ContainsAny(v, "\r\n") {
+			return ErrInvalidHeader
+		}
+	}
+	return nil
+}
+
+// format builds the message as sent over SMTP: headers, then the body as quoted-printable UTF-8 with CRLF line
+// endings.
+func format(from string, msg *Message, date time.Time) ([]byte, error) {
+	if err := checkHeader(from, msg.To, msg.Subject); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	b.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&b)
+	if _, err := qp.Write([]byte(msg.Body)); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"bytes"
+	"clonebox/internal/assert"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP listens on a local port and accepts a single message per connection without STARTTLS or authentication.
+// The envelope and data of each message are sent on the returned channel.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleSMTPConn(conn, received)
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func handleSMTPConn(conn net.Conn, received chan<- string) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+
+	var envelope strings.Builder
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL", "RCPT":
+			envelope.WriteString(line + "\n")
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			received <- envelope.String() + "\n" + string(data)
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPSend(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	s := &SMTP{Addr: addr, From: "Clonebox <noreply@clonebox.test>", Timeout: 5 * time.Second}
+
+	err := s.Send(context.Background(), &Message{
+		To:      "alice@example.com",
+		Subject: "Verify your email",
+		Body:    "Hi Alice,\n\nFollow this link.\n",
+	})
+	assert.NilError(t, err)
+
+	select {
+	case got := <-received:
+		assert.StringContains(t, got, "MAIL FROM:<noreply@clonebox.test>")
+		assert.StringContains(t, got, "RCPT TO:<alice@example.com>")
+		assert.StringContains(t, got, "Subject: Verify your email\n")
+		assert.StringContains(t, got, "Hi Alice,\n\nFollow this link.\n")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestSMTPSendUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := &SMTP{Addr: addr, From: "noreply@clonebox.test", Timeout: time.Second}
+	err = s.Send(context.Background(), &Message{To: "alice@example.com", Subject: "Hi", Body: "Hi"})
+	if err == nil {
+		t.Error("got nil error; want connection error")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	msg := &Message{To: "alice@example.com", Subject: "Grüße", Body: "Line one\nLine two é\n"}
+
+	data, err := format("noreply@clonebox.test", msg, date)
+	assert.NilError(t, err)
+
+	got := string(data)
+	assert.StringContains(t, got, "From: noreply@clonebox.test\r\n")
+	assert.StringContains(t, got, "To: alice@example.com\r\n")
+	assert.StringContains(t, got, "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n")
+	assert.StringContains(t, got, "Date: Mon, 19 Oct 2026 12:00:00 +0000\r\n")
+	assert.StringContains(t, got, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	assert.StringContains(t, got, "Line one\r\nLine two =C3=A9\r\n")
+}
+
+func TestFormatHeaderInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		from string
+		msg  *Message
+	}{
+		{
+			name: "Recipient",
+			from: "noreply@clonebox.test",
+			msg:  &Message{To: "alice@example.com\r\nBcc: eve@example.com", Subject: "Hi"},
+		},
+		{
+			name: "Subject",
+			from: "noreply@clonebox.test",
+			msg:  &Message{To: "alice@example.com", Subject: "Hi\nBcc: eve@example.com"},
+		},
+		{
+			name: "Sender",
+			from: "noreply@clonebox.test\n",
+			msg:  &Message{To: "alice@example.com", Subject: "Hi"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := format(tt.from, tt.msg, time.Now())
+			assert.Equal(t, err, ErrInvalidHeader)
+		})
+	}
+}
+
+func TestLogSend(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Log{W: &buf}
+
+	err := l.Send(context.Background(), &Message{To: "alice@example.com", Subject: "Hi", Body: "Follow this link.\n"})
+	assert.NilError(t, err)
+
+	got := buf.String()
+	assert.StringContains(t, got, "To: alice@example.com\nSubject: Hi\n")
+	assert.StringContains(t, got, "\n\nFollow this link.\n-----\n")
+
+	err = l.Send(context.Background(), &Message{To: "alice@example.com\nBcc: eve@example.com", Subject: "Hi"})
+	assert.Equal(t, err, ErrInvalidHeader)
+}
@@ -0,0 +1,157 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+)
+
+type ClickModelInterface interface {
+	Insert(click *Click) error
+	Daily(short string, since time.Time) ([]*DailyClicks, error)
+	Referrers(short string, since time.Time, n int) ([]*ClickCount, error)
+	Agents(short string, since time.Time) ([]*ClickCount, error)
+	Totals(ownerID int) (map[string]int, error)
+}
+
+// Click is a single visit of a short link. The client IP is only ever stored hashed.
+type Click struct {
+	ShortLink    string
+	Clicked      time.Time
+	ReferrerHost string
+	AgentClass   string
+	IPHash       string
+}
+
+// DailyClicks is the number of clicks, and of distinct (hashed) client IPs, on a single UTC day.
+type DailyClicks struct {
+	Day    time.Time
+	Clicks int
+	Unique int
+}
+
+// ClickCount is the number of clicks sharing a referrer host or user agent class.
+type ClickCount struct {
+	Label  string
+	Clicks int
+}
+
+type ClickModel struct {
+	DB *sql.DB
+}
+
+// Insert records a click. Clicks on short links that don't exist (anymore) are silently dropped.
+func (m *ClickModel) Insert(click *Click) error {
+	stmt := `INSERT INTO link_clicks (link_id, clicked, referrer_host, agent_class, ip_hash)
+				SELECT id, ?, ?, ?, ? FROM link_mapping WHERE short_link = ?`
+
+	_, err := m.DB.Exec(stmt, click.Clicked.UTC(), click.ReferrerHost, click.AgentClass, click.IPHash, click.ShortLink)
+	return err
+}
+
+// Daily returns the clicks per day on a short link since the given time, oldest first. Days without clicks are left
+// out.
+func (m *ClickModel) Daily(short string, since time.Time) ([]*DailyClicks, error) {
+	stmt := `SELECT DATE(c.clicked) AS day, COUNT(*), COUNT(DISTINCT c.ip_hash) FROM link_clicks c
+				JOIN link_mapping l ON l.id = c.link_id
+				WHERE l.short_link = ? AND c.clicked >= ?
+				GROUP BY day ORDER BY day`
+
+	rows, err := m.DB.Query(stmt, short, since.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []*DailyClicks{}
+	for rows.Next() {
+		d := &DailyClicks{}
+		err = rows.Scan(&d.Day, &d.Clicks, &d.Unique)
+		if err != nil {
+			return nil, err
+		}
+		days = append(days, d)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return days, nil
+}
+
+// Referrers returns the n referrer hosts with the most clicks on a short link since the given time. Clicks without a
+// referrer are counted under an empty label.
+func (m *ClickModel) Referrers(short string, since time.Time, n int) ([]*ClickCount, error) {
+	stmt := `SELECT c.referrer_host, COUNT(*) AS clicks FROM link_clicks c
+				JOIN link_mapping l ON l.id = c.link_id
+				WHERE l.short_link = ? AND c.clicked >= ?
+				GROUP BY c.referrer_host ORDER BY clicks DESC, c.referrer_host LIMIT ?`
+
+	return m.counts(stmt, short, since.UTC(), n)
+}
+
+// Agents returns the clicks on a short link since the given time per user agent class.
+func (m *ClickModel) Agents(short string, since time.Time) ([]*ClickCount, error) {
+	stmt := `SELECT c.agent_class, COUNT(*) AS clicks FROM link_clicks c
+				JOIN link_mapping l ON l.id = c.link_id
+				WHERE l.short_link = ? AND c.clicked >= ?
+				GROUP BY c.agent_class ORDER BY clicks DESC, c.agent_class`
+
+	return m.counts(stmt, short, since.UTC())
+}
+
+func (m *ClickModel) counts(stmt string, args ...any) ([]*ClickCount, error) {
+	rows, err := m.DB.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []*ClickCount{}
+	for rows.Next() {
+		c := &ClickCount{}
+		err = rows.Scan(&c.Label, &c.Clicks)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// Totals returns the number of clicks on each of a user's short links, by short code. Links that were never clicked
+// are left out.
+func (m *ClickModel) Totals(ownerID int) (map[string]int, error) {
+	stmt := `SELECT l.short_link, COUNT(*) FROM link_clicks c
+				JOIN link_mapping l ON l.id = c.link_id
+				WHERE l.owner_id = ?
+				GROUP BY l.short_link`
+
+	rows, err := m.DB.Query(stmt, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]int{}
+	for rows.Next() {
+		var short string
+		var clicks int
+		err = rows.Scan(&short, &clicks)
+		if err != nil {
+			return nil, err
+		}
+		totals[short] = clicks
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return totals, nil
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+	"time"
+)
+
+var clicksSince = time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC)
+
+func TestClickModel_Insert(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	tests := []struct {
+		name       string
+		short      string
+		wantClicks int
+	}{
+		{
+			name:       "Short link exists",
+			short:      "123456",
+			wantClicks: 4,
+		},
+		{
+			name:       "Short link doesn't exist",
+			short:      "qwerty",
+			wantClicks: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := ClickModel{db}
+
+			err := m.Insert(&Click{
+				ShortLink:  tt.short,
+				Clicked:    time.Date(2025, 1, 3, 10, 0, 0, 0, time.UTC),
+				AgentClass: "bot",
+				IPHash:     "cccc",
+			})
+			assert.NilError(t, err)
+
+			days, err := m.Daily("123456", clicksSince)
+			assert.NilError(t, err)
+
+			clicks := 0
+			for _, d := range days {
+				clicks += d.Clicks
+			}
+			assert.Equal(t, clicks, tt.wantClicks)
+		})
+	}
+}
+
+func TestClickModel_Daily(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := ClickModel{db}
+
+	days, err := m.Daily("123456", clicksSince)
+	assert.NilError(t, err)
+	assert.Equal(t, len(days), 2)
+	assert.Equal(t, days[0].Day.Format(time.DateOnly), "2025-01-01")
+	assert.Equal(t, days[0].Clicks, 2)
+	assert.Equal(t, days[0].Unique, 1)
+	assert.Equal(t, days[1].Clicks, 1)
+
+	days, err = m.Daily("123456", time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC))
+	assert.NilError(t, err)
+	assert.Equal(t, len(days), 1)
+}
+
+func TestClickModel_Breakdowns(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := ClickModel{db}
+
+	referrers, err := m.Referrers("123456", clicksSince, 10)
+	assert.NilError(t, err)
+	assert.Equal(t, len(referrers), 2)
+	assert.Equal(t, referrers[0].Label, "example.org")
+	assert.Equal(t, referrers[0].Clicks, 2)
+
+	agents, err := m.Agents("123456", clicksSince)
+	assert.NilError(t, err)
+	assert.Equal(t, len(agents), 2)
+	assert.Equal(t, agents[0].Label, "desktop")
+	assert.Equal(t, agents[0].Clicks, 2)
+}
+
+func TestClickModel_Totals(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := ClickModel{db}
+
+	totals, err := m.Totals(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(totals), 1)
+	assert.Equal(t, totals["123456"], 3)
+
+	totals, err = m.Totals(2)
+	assert.NilError(t, err)
+	assert.Equal(t, len(totals), 0)
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"time"
+)
+
+type CollectionModelInterface interface {
+	Insert(uuid string, fileUUIDs []string) error
+	Get(uuid string) (*Collection, error)
+}
+
+// Collection groups several uploaded files under a single share UUID. Files are de-duplicated by checksum, so the
+// same file can be part of any number of collections.
+type Collection struct {
+	ID             int
+	CollectionUUID string
+	Created        time.Time
+	Files          []*File
+}
+
+type CollectionModel struct {
+	DB *sql.DB
+}
+
+// Insert creates a collection containing the files with the given UUIDs. The collection and its file list are written
+// in a single transaction, so a collection is never visible with only some of its files.
+func (m *CollectionModel) Insert(uuid string, fileUUIDs []string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `INSERT INTO collections (collection_uuid, created) VALUES (?, UTC_TIMESTAMP())`
+	result, err := tx.Exec(stmt, uuid)
+	if err != nil {
+		var mySqlErr *mysql.MySQLError
+		if errors.As(err, &mySqlErr) {
+			if mySqlErr.Number == 1062 {
+				return ErrDuplicateUUID
+			}
+		}
+		return err
+	}
+
+	collectionID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	// position keeps the files in upload order. INSERT IGNORE skips a file picked twice in the same upload.
+	stmt = `INSERT IGNORE INTO collection_files (collection_id, file_id, position)
+				SELECT ?, id, ? FROM files WHERE file_uuid = ?`
+	for i, fileUUID := range fileUUIDs {
+		_, err = tx.Exec(stmt, collectionID, i, fileUUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get returns a collection and its files (in upload order) by the collection's share UUID.
+func (m *CollectionModel) Get(uuid string) (*Collection, error) {
+	c := &Collection{}
+
+	stmt := `SELECT id, collection_uuid, created FROM collections WHERE collection_uuid = ?`
+	err := m.DB.QueryRow(stmt, uuid).Scan(&c.ID, &c.CollectionUUID, &c.Created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		} else {
+			return nil, err
+		}
+	}
+
+	// fileColumns are unqualified, which works as collection_files has no columns of the same names
+	stmt = `SELECT ` + fileColumns + ` FROM collection_files JOIN files ON files.id = collection_files.file_id
+				WHERE collection_id = ? ORDER BY position`
+
+	rows, err := m.DB.Query(stmt, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		c.Files = append(c.Files, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+)
+
+func TestCollectionModel_Get(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	tests := []struct {
+		name      string
+		uuid      string
+		wantFiles int
+		wantErr   error
+	}{
+		{
+			name:      "Collection exists in db",
+			uuid:      "abcdef",
+			wantFiles: 1,
+			wantErr:   nil,
+		},
+		{
+			name:    "Collection doesn't exist in db",
+			uuid:    "qwerty",
+			wantErr: ErrNoRecord,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := CollectionModel{db}
+			res, err := m.Get(tt.uuid)
+			assert.Equal(t, err, tt.wantErr)
+			if res != nil {
+				assert.Equal(t, res.CollectionUUID, tt.uuid)
+				assert.Equal(t, len(res.Files), tt.wantFiles)
+				assert.Equal(t, res.Files[0].FileUUID, "123456")
+			}
+		})
+	}
+}
+
+func TestCollectionModel_Insert(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	tests := []struct {
+		name      string
+		uuid      string
+		fileUUIDs []string
+		wantFiles int
+		wantErr   error
+	}{
+		{
+			name:      "Insert Success",
+			uuid:      "987654",
+			fileUUIDs: []string{"123456"},
+			wantFiles: 1,
+			wantErr:   nil,
+		},
+		{
+			name:      "Same file twice",
+			uuid:      "987654",
+			fileUUIDs: []string{"123456", "123456"},
+			wantFiles: 1,
+			wantErr:   nil,
+		},
+		{
+			name:      "Insert Duplicate UUID",
+			uuid:      "abcdef",
+			fileUUIDs: []string{"123456"},
+			wantErr:   ErrDuplicateUUID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := CollectionModel{db}
+			err := m.Insert(tt.uuid, tt.fileUUIDs)
+			assert.Equal(t, err, tt.wantErr)
+			if err == nil {
+				res, err := m.Get(tt.uuid)
+				assert.NilError(t, err)
+				assert.Equal(t, len(res.Files), tt.wantFiles)
+			}
+		})
+	}
+}
@@ -14,4 +14,14 @@ var (
 	ErrDuplicateLink = errors.New("models: duplicate short short")
 
 	ErrDuplicateUUID = errors.New("models: duplicate UUID detected")
+
+	ErrDuplicatePasskey = errors.New("models: duplicate passkey")
+
+	ErrDuplicateIdentity = errors.New("models: identity already linked")
+
+	ErrLinkInactive = errors.New("models: link is inactive")
+
+	ErrLinkExpired = errors.New("models: link has expired")
+
+	ErrLinkUsedUp = errors.New("models: link has reached its maximum uses")
 )
@@ -7,10 +7,21 @@ import (
 	"time"
 )
 
+// Scan statuses recorded against every uploaded file.
+const (
+	ScanUnscanned = "unscanned" // No scanner configured
+	ScanClean     = "clean"
+	ScanInfected  = "infected"
+	ScanFailed    = "failed" // The scanner couldn't give a verdict, treated like infected until an admin looks at it
+)
+
 type FilesModelInterface interface {
-	Insert(fileName string, uuid string, fileSize int, checksum string, storagePath string) error
+	Insert(fileName string, uuid string, fileSize int, checksum string, storagePath string, scanStatus string, scanResult string, ownerID int) error
 	GetByUUID(uuid string) (*File, error)
 	GetByChecksum(checksum string) (*File, error)
+	SetScan(uuid string, scanStatus string, scanResult string) error
+	Latest(n int) ([]*File, error)
+	Usage(ownerID int) (int64, int, error)
 }
 
 type FileModel struct {
@@ -25,13 +36,38 @@ type File struct {
 	Checksum    string
 	UploadTime  time.Time
 	StoragePath string
+	ScanStatus  string
+	ScanResult  string
+}
+
+// Quarantined reports whether the file failed its upload scan. Quarantined files can't be downloaded or previewed.
+func (f *File) Quarantined() bool {
+	return f.ScanStatus == ScanInfected || f.ScanStatus == ScanFailed
+}
+
+// fileColumns is the column list scanned by scanFile, in order.
+const fileColumns = `id, file_name, file_uuid, file_size, checksum, storage_path, upload_date, scan_status, scan_result`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanFile(row rowScanner) (*File, error) {
+	f := &File{}
+	err := row.Scan(&f.ID, &f.FileName, &f.FileUUID, &f.FileSize, &f.Checksum, &f.StoragePath, &f.UploadTime,
+		&f.ScanStatus, &f.ScanResult)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
 }
 
-func (m *FileModel) Insert(fileName string, uuid string, fileSize int, checksum string, storagePath string) error {
-	stmt := `INSERT INTO files (file_name, file_uuid, file_size, checksum, storage_path, upload_date) VALUES (
-				?, ?, ?, ?, ?, UTC_TIMESTAMP())`
+func (m *FileModel) Insert(fileName string, uuid string, fileSize int, checksum string, storagePath string, scanStatus string, scanResult string, ownerID int) error {
+	stmt := `INSERT INTO files (file_name, file_uuid, file_size, checksum, storage_path, upload_date, scan_status, scan_result, owner_id)
+				VALUES (?, ?, ?, ?, ?, UTC_TIMESTAMP(), ?, ?, ?)`
 
-	_, err := m.DB.Exec(stmt, fileName, uuid, fileSize, checksum, storagePath)
+	_, err := m.DB.Exec(stmt, fileName, uuid, fileSize, checksum, storagePath, scanStatus, scanResult, ownerID)
 	if err != nil {
 		var mySqlErr *mysql.MySQLError
 		if errors.As(err, &mySqlErr) {
@@ -46,11 +82,9 @@ func (m *FileModel) Insert(fileName string, uuid string, fileSize int, checksum
 }
 
 func (m *FileModel) GetByUUID(uuid string) (*File, error) {
-	stmt := `SELECT * FROM files WHERE file_uuid = ?`
+	stmt := `SELECT ` + fileColumns + ` FROM files WHERE file_uuid = ?`
 
-	s := &File{}
-
-	err := m.DB.QueryRow(stmt, uuid).Scan(&s.ID, &s.FileName, &s.FileUUID, &s.FileSize, &s.Checksum, &s.StoragePath, &s.UploadTime)
+	s, err := scanFile(m.DB.QueryRow(stmt, uuid))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -63,11 +97,9 @@ func (m *FileModel) GetByUUID(uuid string) (*File, error) {
 }
 
 func (m *FileModel) GetByChecksum(checksum string) (*File, error) {
-	stmt := `SELECT * FROM files WHERE checksum = ?`
-
-	s := &File{}
+	stmt := `SELECT ` + fileColumns + ` FROM files WHERE checksum = ?`
 
-	err := m.DB.QueryRow(stmt, checksum).Scan(&s.ID, &s.FileName, &s.FileUUID, &s.FileSize, &s.Checksum, &s.StoragePath, &s.UploadTime)
+	s, err := scanFile(m.DB.QueryRow(stmt, checksum))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, ErrNoRecord
@@ -78,3 +110,52 @@ func (m *FileModel) GetByChecksum(checksum string) (*File, error) {
 
 	return s, nil
 }
+
+// SetScan records the outcome of scanning a file again.
+func (m *FileModel) SetScan(uuid string, scanStatus string, scanResult string) error {
+	stmt := `UPDATE files SET scan_status = ?, scan_result = ? WHERE file_uuid = ?`
+
+	_, err := m.DB.Exec(stmt, scanStatus, scanResult, uuid)
+	return err
+}
+
+// Latest returns the n most recently uploaded files, newest first.
+func (m *FileModel) Latest(n int) ([]*File, error) {
+	stmt := `SELECT ` + fileColumns + ` FROM files ORDER BY id DESC LIMIT ?`
+
+	rows, err := m.DB.Query(stmt, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []*File{}
+	for rows.Next() {
+		f, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Usage returns the total size in bytes and the number of files uploaded by a user. Only files whose blob was stored
+// for that user count -- uploading content someone else already uploaded is de-duplicated and costs nothing.
+func (m *FileModel) Usage(ownerID int) (int64, int, error) {
+	var bytes int64
+	var count int
+
+	stmt := `SELECT COALESCE(SUM(file_size), 0), COUNT(*) FROM files WHERE owner_id = ?`
+	err := m.DB.QueryRow(stmt, ownerID).Scan(&bytes, &count)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return bytes, count, nil
+}
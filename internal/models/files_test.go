@@ -106,6 +106,7 @@ func TestFileModel_Insert(t *testing.T) {
 		fileSize    int
 		checksum    string
 		storagePath string
+		scanStatus  string
 		wantErr     error
 	}{
 		{
@@ -115,6 +116,17 @@ func TestFileModel_Insert(t *testing.T) {
 			fileSize:    1000,
 			checksum:    "qwerty",
 			storagePath: "/clonebox/upload",
+			scanStatus:  ScanClean,
+			wantErr:     nil,
+		},
+		{
+			name:        "Insert Quarantined",
+			fileName:    "eicar.com",
+			fileUUID:    "987654",
+			fileSize:    68,
+			checksum:    "44d88612fea8a8f36de82e1278abb02f",
+			storagePath: "/clonebox/upload",
+			scanStatus:  ScanInfected,
 			wantErr:     nil,
 		},
 		{
@@ -141,8 +153,97 @@ func TestFileModel_Insert(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			db := newTestDB(t)
 			m := FileModel{db}
-			err := m.Insert(tt.fileName, tt.fileUUID, tt.fileSize, tt.checksum, tt.storagePath)
+			err := m.Insert(tt.fileName, tt.fileUUID, tt.fileSize, tt.checksum, tt.storagePath, tt.scanStatus, "", 1)
 			assert.Equal(t, err, tt.wantErr)
+			if err == nil && tt.scanStatus != "" {
+				res, err := m.GetByUUID(tt.fileUUID)
+				assert.NilError(t, err)
+				assert.Equal(t, res.ScanStatus, tt.scanStatus)
+				assert.Equal(t, res.Quarantined(), tt.scanStatus == ScanInfected)
+			}
+		})
+	}
+}
+
+func TestFileModel_Latest(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := FileModel{db}
+
+	err := m.Insert("newer.pdf", "987654", 10, "qwerty", "/clonebox/upload", ScanClean, "", 1)
+	assert.NilError(t, err)
+
+	files, err := m.Latest(5)
+	assert.NilError(t, err)
+	assert.Equal(t, len(files), 2)
+	assert.Equal(t, files[0].FileUUID, "987654")
+	assert.Equal(t, files[0].ScanStatus, ScanClean)
+	assert.Equal(t, files[1].FileUUID, "123456")
+	assert.Equal(t, files[1].ScanStatus, ScanUnscanned)
+}
+
+func TestFileModel_SetScan(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := FileModel{db}
+
+	err := m.SetScan("123456", ScanFailed, "scanner: connection refused")
+	assert.NilError(t, err)
+	f, err := m.GetByUUID("123456")
+	assert.NilError(t, err)
+	assert.Equal(t, f.ScanStatus, ScanFailed)
+	assert.Equal(t, f.ScanResult, "scanner: connection refused")
+
+	err = m.SetScan("123456", ScanClean, "")
+	assert.NilError(t, err)
+	f, err = m.GetByUUID("123456")
+	assert.NilError(t, err)
+	assert.Equal(t, f.Quarantined(), false)
+}
+
+func TestFileModel_Usage(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	tests := []struct {
+		name      string
+		ownerID   int
+		wantBytes int64
+		wantCount int
+	}{
+		{
+			name:      "User with uploads",
+			ownerID:   1,
+			wantBytes: 1100,
+			wantCount: 2,
+		},
+		{
+			name:      "User without uploads",
+			ownerID:   2,
+			wantBytes: 0,
+			wantCount: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := FileModel{db}
+
+			err := m.Insert("newer.pdf", "987654", 1000, "qwerty", "/clonebox/upload", ScanClean, "", 1)
+			assert.NilError(t, err)
+
+			bytes, count, err := m.Usage(tt.ownerID)
+			assert.NilError(t, err)
+			assert.Equal(t, bytes, tt.wantBytes)
+			assert.Equal(t, count, tt.wantCount)
 		})
 	}
 }
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type IdentityModelInterface interface {
+	Get(issuer, subject string) (int, error)
+	Insert(issuer, subject string, userID int) error
+}
+
+// IdentityModel links users to their accounts at single sign-on identity providers. An account is identified by the
+// provider's issuer URL and the subject it gives the user, which unlike the email address never changes.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// Get returns the ID of the user linked to an identity provider account.
+func (m *IdentityModel) Get(issuer, subject string) (int, error) {
+	var userID int
+	stmt := `SELECT user_id FROM user_identities WHERE issuer = ? AND subject = ?`
+
+	err := m.DB.QueryRow(stmt, issuer, subject).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+	return userID, nil
+}
+
+// Insert links an identity provider account to a user. An account that's already linked returns
+// ErrDuplicateIdentity.
+func (m *IdentityModel) Insert(issuer, subject string, userID int) error {
+	stmt := `INSERT INTO user_identities (issuer, subject, user_id, created) VALUES (?, ?, ?, UTC_TIMESTAMP())`
+
+	_, err := m.DB.Exec(stmt, issuer, subject, userID)
+	if err != nil {
+		var mySqlErr *mysql.MySQLError
+		if errors.As(err, &mySqlErr) && mySqlErr.Number == 1062 {
+			return ErrDuplicateIdentity
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+)
+
+func TestIdentityModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := IdentityModel{db}
+
+	_, err := m.Get("https://sso.example.com", "1234")
+	assert.Equal(t, err, ErrNoRecord)
+
+	assert.NilError(t, m.Insert("https://sso.example.com", "1234", 1))
+	userID, err := m.Get("https://sso.example.com", "1234")
+	assert.NilError(t, err)
+	assert.Equal(t, userID, 1)
+
+	// The same subject at another issuer is someone else
+	_, err = m.Get("https://other.example.com", "1234")
+	assert.Equal(t, err, ErrNoRecord)
+
+	assert.Equal(t, m.Insert("https://sso.example.com", "1234", 1), ErrDuplicateIdentity)
+}
@@ -4,23 +4,34 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/go-sql-driver/mysql"
+	"time"
 )
 
 type LinkMappingModelInterface interface {
 	//
-	Insert(original, short string) error
+	Insert(original, short string, ownerID int, expires time.Time, maxUses int) error
+	InsertBatch(fn func(insert LinkInsertFunc) error) error
+	Get(short string) (*LinkMapping, error)
+	Use(short string) (*LinkMapping, error)
 	GetOriginal(short string) (string, error)
-	GetShort(original string) (string, error)
-	Exists(original string) (bool, error)
+	GetShort(ownerID int, original string) (string, error)
+	Exists(ownerID int, original string) (bool, error)
 	Latest() ([]*LinkMapping, error)
+	Count() (int, error)
+	ByOwner(ownerID int) ([]*LinkMapping, error)
+	Retarget(short, original string) error
+	SetActive(short string, active bool) error
+	SetInterstitial(short string, interstitial bool) error
 }
 
 type LinkMappingModel struct {
 	DB *sql.DB
 }
 
+// Latest returns the 5 newest links that are public enough to list on the home page. One-time, expiring and
+// disabled links were made for someone in particular, and listing them would let anyone use them up.
 func (m *LinkMappingModel) Latest() ([]*LinkMapping, error) {
-	stmt := `SELECT original_link, short_link FROM link_mapping
+	stmt := `SELECT original_link, short_link FROM link_mapping WHERE ` + reusableLink + `
 				ORDER BY ID DESC LIMIT 5`
 
 	rows, err := m.DB.Query(stmt)
@@ -49,11 +60,27 @@ func (m *LinkMappingModel) Latest() ([]*LinkMapping, error) {
 	return links, nil
 }
 
-func (m *LinkMappingModel) Exists(original string) (bool, error) {
+// Count returns the number of links that have been shortened.
+func (m *LinkMappingModel) Count() (int, error) {
+	var count int
+	stmt := `SELECT COUNT(*) FROM link_mapping`
+
+	err := m.DB.QueryRow(stmt).Scan(&count)
+	return count, err
+}
+
+// reusableLink matches the links that can be handed out again to someone shortening the same destination: active
+// ones without an expiry or use limit. Any other link doesn't work, or will stop working, differently than asked for.
+const reusableLink = `active AND expires IS NULL AND max_uses IS NULL`
+
+// Exists reports whether ownerID has a reusable link to the original link. Other users' links to it don't count,
+// they're theirs to edit or disable.
+func (m *LinkMappingModel) Exists(ownerID int, original string) (bool, error) {
 	var exists bool
-	stmt := `SELECT EXISTS(SELECT TRUE FROM link_mapping WHERE original_link = ?)`
+	stmt := `SELECT EXISTS(SELECT TRUE FROM link_mapping WHERE owner_id = ? AND original_link = ? AND ` +
+		reusableLink + `)`
 
-	err := m.DB.QueryRow(stmt, original).Scan(&exists)
+	err := m.DB.QueryRow(stmt, ownerID, original).Scan(&exists)
 	return exists, err
 }
 
@@ -71,10 +98,13 @@ func (m *LinkMappingModel) GetOriginal(hash string) (string, error) {
 	return originalLink, nil
 }
 
-func (m *LinkMappingModel) GetShort(link string) (string, error) {
+// GetShort returns the short code of ownerID's reusable link to the original link, the oldest one if there are
+// several.
+func (m *LinkMappingModel) GetShort(ownerID int, link string) (string, error) {
 	var originalLink string
-	stmt := `SELECT short_link FROM link_mapping WHERE original_link = ?`
-	err := m.DB.QueryRow(stmt, link).Scan(&originalLink)
+	stmt := `SELECT short_link FROM link_mapping WHERE owner_id = ? AND original_link = ? AND ` + reusableLink +
+		` ORDER BY id LIMIT 1`
+	err := m.DB.QueryRow(stmt, ownerID, link).Scan(&originalLink)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return "", ErrNoRecord
@@ -90,12 +120,239 @@ type LinkMapping struct {
 	ID           int
 	OriginalLink string
 	ShortLink    string
+	OwnerID      int // 0 for links created before links had owners
+	Active       bool
+	Created      time.Time
+	Expires      time.Time // Zero for links that never expire
+	MaxUses      int       // 0 for unlimited, 1 for one-time links
+	Uses         int
+	Interstitial bool // Visitors always see the preview page before being redirected
+}
+
+// Expired reports whether the link's expiry time has passed.
+func (l *LinkMapping) Expired() bool {
+	return !l.Expires.IsZero() && !time.Now().Before(l.Expires)
+}
+
+// UsedUp reports whether the link has been followed as often as it may be.
+func (l *LinkMapping) UsedUp() bool {
+	return l.MaxUses > 0 && l.Uses >= l.MaxUses
+}
+
+// Usable returns why the link can't be followed: ErrLinkInactive, ErrLinkExpired or ErrLinkUsedUp. It returns nil
+// for links that can be followed.
+func (l *LinkMapping) Usable() error {
+	switch {
+	case !l.Active:
+		return ErrLinkInactive
+	case l.Expired():
+		return ErrLinkExpired
+	case l.UsedUp():
+		return ErrLinkUsedUp
+	default:
+		return nil
+	}
+}
+
+// linkColumns is the column list scanLink expects, in order.
+const linkColumns = `id, original_link, short_link, owner_id, active, created, expires, max_uses, uses, interstitial`
+
+func scanLink(row rowScanner) (*LinkMapping, error) {
+	l := &LinkMapping{}
+	var ownerID, maxUses sql.NullInt64
+	var expires sql.NullTime
+
+	err := row.Scan(&l.ID, &l.OriginalLink, &l.ShortLink, &ownerID, &l.Active, &l.Created, &expires, &maxUses, &l.Uses,
+		&l.Interstitial)
+	if err != nil {
+		return nil, err
+	}
+	l.OwnerID = int(ownerID.Int64)
+	l.Expires = expires.Time
+	l.MaxUses = int(maxUses.Int64)
+
+	return l, nil
 }
 
-func (m *LinkMappingModel) Insert(original, short string) error {
-	stmt := `INSERT INTO link_mapping (original_link, short_link)
-				VALUES (?, ?)`
-	_, err := m.DB.Exec(stmt, original, short)
+// Use counts a visit of a short link and returns the link. The check and the count happen in a single UPDATE, so a
+// one-time link can't be followed twice by concurrent requests. Links which can't be used (anymore) return
+// ErrLinkInactive, ErrLinkExpired or ErrLinkUsedUp, together with the link.
+func (m *LinkMappingModel) Use(short string) (*LinkMapping, error) {
+	stmt := `UPDATE link_mapping SET uses = uses + 1
+				WHERE short_link = ? AND active
+				AND (expires IS NULL OR expires > UTC_TIMESTAMP())
+				AND (max_uses IS NULL OR uses < max_uses)`
+
+	result, err := m.DB.Exec(stmt, short)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := m.Get(short)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		return l, nil
+	}
+
+	// Nothing was counted, so find out why
+	if err = l.Usable(); err != nil {
+		return l, err
+	}
+	return l, ErrLinkUsedUp
+}
+
+// Get returns a link by its short code, whether it's active or not.
+func (m *LinkMappingModel) Get(short string) (*LinkMapping, error) {
+	stmt := `SELECT ` + linkColumns + ` FROM link_mapping WHERE short_link = ?`
+
+	l, err := scanLink(m.DB.QueryRow(stmt, short))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// ByOwner returns all links created by a user, newest first.
+func (m *LinkMappingModel) ByOwner(ownerID int) ([]*LinkMapping, error) {
+	stmt := `SELECT ` + linkColumns + ` FROM link_mapping WHERE owner_id = ? ORDER BY id DESC`
+
+	rows, err := m.DB.Query(stmt, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []*LinkMapping{}
+	for rows.Next() {
+		l, err := scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// Retarget points an existing short link at a new destination.
+func (m *LinkMappingModel) Retarget(short, original string) error {
+	stmt := `UPDATE link_mapping SET original_link = ? WHERE short_link = ?`
+
+	result, err := m.DB.Exec(stmt, original, short)
+	if err != nil {
+		return err
+	}
+
+	return noRowsAffected(result, m.DB, short)
+}
+
+// SetActive enables or disables a short link. Inactive links stay reserved but no longer redirect.
+func (m *LinkMappingModel) SetActive(short string, active bool) error {
+	stmt := `UPDATE link_mapping SET active = ? WHERE short_link = ?`
+
+	result, err := m.DB.Exec(stmt, active, short)
+	if err != nil {
+		return err
+	}
+
+	return noRowsAffected(result, m.DB, short)
+}
+
+// SetInterstitial sets whether every visitor of a short link is shown the preview page first.
+func (m *LinkMappingModel) SetInterstitial(short string, interstitial bool) error {
+	stmt := `UPDATE link_mapping SET interstitial = ? WHERE short_link = ?`
+
+	result, err := m.DB.Exec(stmt, interstitial, short)
+	if err != nil {
+		return err
+	}
+
+	return noRowsAffected(result, m.DB, short)
+}
+
+// noRowsAffected turns an UPDATE that matched no link into ErrNoRecord. MySQL reports rows changed rather than
+// matched, so an UPDATE that sets the current values also affects no rows; that's told apart by checking whether
+// the link exists.
+func noRowsAffected(result sql.Result, db *sql.DB, short string) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	err = db.QueryRow(`SELECT EXISTS(SELECT TRUE FROM link_mapping WHERE short_link = ?)`, short).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// Insert adds a link created by ownerID. A zero expires means the link never expires, a maxUses of 0 that it can be
+// used any number of times. Short codes are unique, one already existing returns ErrDuplicateLink. Destinations
+// aren't, different users each get their own link to the same one.
+func (m *LinkMappingModel) Insert(original, short string, ownerID int, expires time.Time, maxUses int) error {
+	return insertLink(m.DB, original, short, ownerID, expires, maxUses)
+}
+
+// LinkInsertFunc inserts a single link, with the same arguments and errors as LinkMappingModel.Insert.
+type LinkInsertFunc func(original, short string, ownerID int, expires time.Time, maxUses int) error
+
+// InsertBatch runs fn in a transaction, passing it an insert function that works like Insert within it. The inserted
+// links are committed together if fn returns nil, and none of them are otherwise. An insert failing with
+// ErrDuplicateLink only undoes itself, so fn can note it and carry on with the next link.
+func (m *LinkMappingModel) InsertBatch(fn func(insert LinkInsertFunc) error) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(func(original, short string, ownerID int, expires time.Time, maxUses int) error {
+		return insertLink(tx, original, short, ownerID, expires, maxUses)
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+func insertLink(db execer, original, short string, ownerID int, expires time.Time, maxUses int) error {
+	var expiresAt sql.NullTime
+	if !expires.IsZero() {
+		expiresAt = sql.NullTime{Time: expires.UTC(), Valid: true}
+	}
+
+	stmt := `INSERT INTO link_mapping (original_link, short_link, owner_id, active, created, expires, max_uses)
+				VALUES (?, ?, NULLIF(?, 0), TRUE, UTC_TIMESTAMP(), ?, NULLIF(?, 0))`
+	_, err := db.Exec(stmt, original, short, ownerID, expiresAt, maxUses)
 	if err != nil {
 		var mySqlErr *mysql.MySQLError
 		if errors.As(err, &mySqlErr) {
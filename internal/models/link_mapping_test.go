@@ -2,7 +2,9 @@ package models
 
 import (
 	"clonebox/internal/assert"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestLinkMappingModel_Exists(t *testing.T) {
@@ -12,19 +14,28 @@ func TestLinkMappingModel_Exists(t *testing.T) {
 
 	tests := []struct {
 		name         string
+		ownerID      int
 		originalLink string
 		want         bool
 	}{
 		{
 			name:         "Link exists in db",
+			ownerID:      1,
 			originalLink: "https://existent.com",
 			want:         true,
 		},
 		{
 			name:         "Link doesn't exist in db",
+			ownerID:      1,
 			originalLink: "https://nonexistent.com",
 			want:         false,
 		},
+		{
+			name:         "Another user's link",
+			ownerID:      2,
+			originalLink: "https://existent.com",
+			want:         false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -32,7 +43,7 @@ func TestLinkMappingModel_Exists(t *testing.T) {
 			db := newTestDB(t)
 			m := LinkMappingModel{db}
 
-			exists, err := m.Exists(tt.originalLink)
+			exists, err := m.Exists(tt.ownerID, tt.originalLink)
 			assert.Equal(t, exists, tt.want)
 			assert.NilError(t, err)
 		})
@@ -82,33 +93,60 @@ func TestLinkMappingModel_GetShort(t *testing.T) {
 
 	tests := []struct {
 		name     string
+		ownerID  int
 		original string
 		want     string
 		wantErr  error
 	}{
 		{
 			name:     "Original Link Exists",
+			ownerID:  1,
 			original: "https://existent.com",
 			want:     "123456",
 			wantErr:  nil,
 		},
 		{
 			name:     "Original Link Does Not Exist",
+			ownerID:  1,
 			original: "https://nonexistent.com",
 			want:     "",
 			wantErr:  ErrNoRecord,
 		},
+		{
+			name:     "Another User's Link",
+			ownerID:  2,
+			original: "https://existent.com",
+			want:     "",
+			wantErr:  ErrNoRecord,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db := newTestDB(t)
 			m := LinkMappingModel{db}
-			short, err := m.GetShort(tt.original)
+			short, err := m.GetShort(tt.ownerID, tt.original)
 			assert.Equal(t, short, tt.want)
 			assert.Equal(t, err, tt.wantErr)
 		})
 	}
+
+	t.Run("Only reusable links", func(t *testing.T) {
+		db := newTestDB(t)
+		m := LinkMappingModel{db}
+
+		err := m.Insert("https://limited.com", "expire", 1, time.Now().Add(time.Hour), 0)
+		assert.NilError(t, err)
+		err = m.Insert("https://limited.com", "onetim", 1, time.Time{}, 1)
+		assert.NilError(t, err)
+		err = m.SetActive("123456", false)
+		assert.NilError(t, err)
+
+		for _, original := range []string{"https://limited.com", "https://existent.com"} {
+			_, err = m.GetShort(1, original)
+			assert.Equal(t, err, ErrNoRecord)
+		}
+	})
 }
 
 func TestLinkMappingModel_Insert(t *testing.T) {
@@ -140,6 +178,12 @@ func TestLinkMappingModel_Insert(t *testing.T) {
 			short:    "123456",
 			wantErr:  ErrDuplicateLink,
 		},
+		{
+			name:     "Insert Same Destination",
+			original: "https://existent.com",
+			short:    "abcdef",
+			wantErr:  nil,
+		},
 	}
 
 	for _, tt := range tests {
@@ -147,17 +191,300 @@ func TestLinkMappingModel_Insert(t *testing.T) {
 			db := newTestDB(t)
 			m := LinkMappingModel{db}
 
-			err := m.Insert(tt.original, tt.short)
+			err := m.Insert(tt.original, tt.short, 1, time.Time{}, 0)
 			assert.Equal(t, err, tt.wantErr)
 			if err == nil {
 				o, err2 := m.GetOriginal(tt.short)
 				assert.Equal(t, o, tt.original)
 				assert.NilError(t, err2)
+			}
+		})
+	}
+}
 
-				s, err2 := m.GetShort(tt.original)
-				assert.Equal(t, s, tt.short)
-				assert.NilError(t, err2)
+func TestLinkMappingModel_InsertBatch(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		db := newTestDB(t)
+		m := LinkMappingModel{db}
+
+		err := m.InsertBatch(func(insert LinkInsertFunc) error {
+			assert.NilError(t, insert("https://batch-one.com", "batch1", 1, time.Time{}, 0))
+			// A duplicate only fails that insert, the others still go in
+			assert.Equal(t, insert("https://batch-dup.com", "123456", 1, time.Time{}, 0), ErrDuplicateLink)
+			assert.NilError(t, insert("https://batch-two.com", "batch2", 1, time.Time{}, 0))
+			return nil
+		})
+		assert.NilError(t, err)
+
+		for _, short := range []string{"batch1", "batch2"} {
+			_, err = m.Get(short)
+			assert.NilError(t, err)
+		}
+		exists, err := m.Exists(1, "https://batch-dup.com")
+		assert.NilError(t, err)
+		assert.Equal(t, exists, false)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		db := newTestDB(t)
+		m := LinkMappingModel{db}
+
+		errAbort := errors.New("abort")
+		err := m.InsertBatch(func(insert LinkInsertFunc) error {
+			assert.NilError(t, insert("https://batch-one.com", "batch1", 1, time.Time{}, 0))
+			return errAbort
+		})
+		assert.Equal(t, err, errAbort)
+
+		_, err = m.Get("batch1")
+		assert.Equal(t, err, ErrNoRecord)
+	})
+}
+
+func TestLinkMappingModel_Latest(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := LinkMappingModel{db}
+
+	// Only plain links are listed
+	assert.NilError(t, m.Insert("https://onetime.com", "onetim", 1, time.Time{}, 1))
+	assert.NilError(t, m.Insert("https://expiring.com", "expire", 1, time.Now().Add(time.Hour), 0))
+	assert.NilError(t, m.Insert("https://newest.com", "newest", 1, time.Time{}, 0))
+
+	links, err := m.Latest()
+	assert.NilError(t, err)
+	assert.Equal(t, len(links), 2)
+	assert.Equal(t, links[0].ShortLink, "newest")
+	assert.Equal(t, links[1].ShortLink, "123456")
+}
+
+func TestLinkMappingModel_Count(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := LinkMappingModel{db}
+
+	count, err := m.Count()
+	assert.NilError(t, err)
+	assert.Equal(t, count, 1)
+}
+
+func TestLinkMappingModel_Get(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := LinkMappingModel{db}
+
+	l, err := m.Get("123456")
+	assert.NilError(t, err)
+	assert.Equal(t, l.OriginalLink, "https://existent.com")
+	assert.Equal(t, l.OwnerID, 1)
+	assert.Equal(t, l.Active, true)
+
+	_, err = m.Get("qwerty")
+	assert.Equal(t, err, ErrNoRecord)
+}
+
+func TestLinkMappingModel_ByOwner(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := LinkMappingModel{db}
+
+	// Links without an owner aren't anyone's
+	err := m.Insert("https://ownerless.com", "abcdef", 0, time.Time{}, 0)
+	assert.NilError(t, err)
+
+	links, err := m.ByOwner(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(links), 1)
+	assert.Equal(t, links[0].ShortLink, "123456")
+
+	l, err := m.Get("abcdef")
+	assert.NilError(t, err)
+	assert.Equal(t, l.OwnerID, 0)
+}
+
+func TestLinkMappingModel_Retarget(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	tests := []struct {
+		name     string
+		short    string
+		original string
+		wantErr  error
+	}{
+		{
+			name:     "Retarget Success",
+			short:    "123456",
+			original: "https://elsewhere.com",
+		},
+		{
+			name:     "Same destination",
+			short:    "123456",
+			original: "https://existent.com",
+		},
+		{
+			name:     "Destination shortened before",
+			short:    "abcdef",
+			original: "https://existent.com",
+		},
+		{
+			name:     "Short link doesn't exist",
+			short:    "qwerty",
+			original: "https://elsewhere.com",
+			wantErr:  ErrNoRecord,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := LinkMappingModel{db}
+			err := m.Insert("https://other.com", "abcdef", 1, time.Time{}, 0)
+			assert.NilError(t, err)
+
+			err = m.Retarget(tt.short, tt.original)
+			assert.Equal(t, err, tt.wantErr)
+			if err == nil {
+				o, err := m.GetOriginal(tt.short)
+				assert.NilError(t, err)
+				assert.Equal(t, o, tt.original)
 			}
 		})
 	}
 }
+
+func TestLinkMappingModel_SetActive(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := LinkMappingModel{db}
+
+	err := m.SetActive("123456", false)
+	assert.NilError(t, err)
+	l, err := m.Get("123456")
+	assert.NilError(t, err)
+	assert.Equal(t, l.Active, false)
+
+	// Setting the current value again isn't an error
+	err = m.SetActive("123456", false)
+	assert.NilError(t, err)
+
+	err = m.SetActive("qwerty", true)
+	assert.Equal(t, err, ErrNoRecord)
+}
+
+func TestLinkMappingModel_Use(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	tests := []struct {
+		name     string
+		expires  time.Time
+		maxUses  int
+		active   bool
+		uses     int
+		wantErrs []error
+	}{
+		{
+			name:     "Unlimited",
+			active:   true,
+			uses:     3,
+			wantErrs: []error{nil, nil, nil},
+		},
+		{
+			name:     "One-time",
+			maxUses:  1,
+			active:   true,
+			uses:     3,
+			wantErrs: []error{nil, ErrLinkUsedUp, ErrLinkUsedUp},
+		},
+		{
+			name:     "Not expired yet",
+			expires:  time.Now().Add(time.Hour),
+			active:   true,
+			uses:     1,
+			wantErrs: []error{nil},
+		},
+		{
+			name:     "Expired",
+			expires:  time.Now().Add(-time.Hour),
+			active:   true,
+			uses:     1,
+			wantErrs: []error{ErrLinkExpired},
+		},
+		{
+			name:     "Inactive",
+			active:   false,
+			uses:     1,
+			wantErrs: []error{ErrLinkInactive},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			m := LinkMappingModel{db}
+
+			err := m.Insert("https://limited.com", "abcdef", 1, tt.expires, tt.maxUses)
+			assert.NilError(t, err)
+			err = m.SetActive("abcdef", tt.active)
+			assert.NilError(t, err)
+
+			for i := range tt.uses {
+				l, err := m.Use("abcdef")
+				assert.Equal(t, err, tt.wantErrs[i])
+				assert.Equal(t, l.OriginalLink, "https://limited.com")
+			}
+		})
+	}
+
+	t.Run("Doesn't exist", func(t *testing.T) {
+		db := newTestDB(t)
+		m := LinkMappingModel{db}
+
+		_, err := m.Use("qwerty")
+		assert.Equal(t, err, ErrNoRecord)
+	})
+}
+
+func TestLinkMappingModel_SetInterstitial(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	db := newTestDB(t)
+	m := LinkMappingModel{db}
+
+	l, err := m.Get("123456")
+	assert.NilError(t, err)
+	assert.Equal(t, l.Interstitial, false)
+
+	err = m.SetInterstitial("123456", true)
+	assert.NilError(t, err)
+	l, err = m.Get("123456")
+	assert.NilError(t, err)
+	assert.Equal(t, l.Interstitial, true)
+
+	err = m.SetInterstitial("qwerty", true)
+	assert.Equal(t, err, ErrNoRecord)
+}
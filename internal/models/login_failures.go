@@ -0,0 +1,77 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// LoginFailureModel counts failed logins per key in the database, for package throttle, so lockouts survive restarts
+// and are shared between instances. Keys are hashes made by the throttle.
+type LoginFailureModel struct {
+	DB *sql.DB
+}
+
+// Get returns the number of failures recorded for key and when the last one was.
+func (m *LoginFailureModel) Get(key string) (int, time.Time, error) {
+	var failures int
+	var last time.Time
+	stmt := `SELECT failures, last_failure FROM login_failures WHERE key_hash = ?`
+
+	err := m.DB.QueryRow(stmt, key).Scan(&failures, &last)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, time.Time{}, nil
+		}
+		return 0, time.Time{}, err
+	}
+	return failures, last, nil
+}
+
+// Fail records a failure for key at now and returns the new count, which starts over if the last failure is more than
+// window ago, along with when the failure before it was. Failures forgotten this way are deleted along the way.
+func (m *LoginFailureModel) Fail(key string, now time.Time, window time.Duration) (int, time.Time, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	// The count and previous_failure are updated before last_failure, so they're compared against the failure before
+	stmt := `INSERT INTO login_failures (key_hash, failures, last_failure, expires) VALUES (?, 1, ?, ?)
+	ON DUPLICATE KEY UPDATE failures = IF(expires < VALUES(last_failure), 1, failures + 1),
+	previous_failure = IF(expires < VALUES(last_failure), NULL, last_failure),
+	last_failure = VALUES(last_failure), expires = VALUES(expires)`
+
+	_, err = tx.Exec(stmt, key, now.UTC(), now.Add(window).UTC())
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	// The row stays locked until the commit, so no other failure can come between the update and this
+	var failures int
+	var previous sql.NullTime
+	stmt = `SELECT failures, previous_failure FROM login_failures WHERE key_hash = ?`
+	if err = tx.QueryRow(stmt, key).Scan(&failures, &previous); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM login_failures WHERE expires < ?`, now.UTC()); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return failures, previous.Time, tx.Commit()
+}
+
+// Undo takes back one of key's failures.
+func (m *LoginFailureModel) Undo(key string) error {
+	stmt := `UPDATE login_failures SET failures = failures - 1 WHERE key_hash = ? AND failures > 0`
+	_, err := m.DB.Exec(stmt, key)
+	return err
+}
+
+// Reset forgets key's failures.
+func (m *LoginFailureModel) Reset(key string) error {
+	_, err := m.DB.Exec(`DELETE FROM login_failures WHERE key_hash = ?`, key)
+	return err
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+	"time"
+)
+
+func TestLoginFailureModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := LoginFailureModel{db}
+	now := time.Now().UTC().Truncate(time.Second)
+
+	failures, _, err := m.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 0)
+
+	failures, previous, err := m.Fail("key", now, time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 1)
+	assert.Equal(t, previous.IsZero(), true)
+
+	for want := 2; want <= 3; want++ {
+		failures, previous, err = m.Fail("key", now.Add(time.Duration(want)*time.Second), time.Hour)
+		assert.NilError(t, err)
+		assert.Equal(t, failures, want)
+		assert.Equal(t, previous.Equal(now.Add(time.Duration(want-1)*time.Second)), true)
+	}
+	failures, last, err := m.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 3)
+	assert.Equal(t, last.Equal(now.Add(3*time.Second)), true)
+
+	assert.NilError(t, m.Undo("key"))
+	failures, _, err = m.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 2)
+
+	// A failure after a quiet window starts the count over
+	failures, previous, err = m.Fail("key", now.Add(2*time.Hour), time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 1)
+	assert.Equal(t, previous.IsZero(), true)
+
+	// Forgotten failures of other keys are deleted by the next failure
+	_, _, err = m.Fail("other", now.Add(3*time.Hour), time.Hour)
+	assert.NilError(t, err)
+	var rows int
+	err = db.QueryRow(`SELECT COUNT(*) FROM login_failures WHERE key_hash = ?`, "key").Scan(&rows)
+	assert.NilError(t, err)
+	assert.Equal(t, rows, 0)
+
+	assert.NilError(t, m.Reset("key"))
+	failures, _, err = m.Get("key")
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 0)
+}
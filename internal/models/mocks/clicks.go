@@ -0,0 +1,52 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"time"
+)
+
+type ClickModel struct{}
+
+func (m *ClickModel) Insert(click *models.Click) error {
+	return nil
+}
+
+func (m *ClickModel) Daily(short string, since time.Time) ([]*models.DailyClicks, error) {
+	switch short {
+	case "abcde":
+		day := time.Now().UTC().Truncate(24 * time.Hour)
+		return []*models.DailyClicks{
+			{Day: day.AddDate(0, 0, -1), Clicks: 3, Unique: 2},
+			{Day: day, Clicks: 5, Unique: 4},
+		}, nil
+	default:
+		return []*models.DailyClicks{}, nil
+	}
+}
+
+func (m *ClickModel) Referrers(short string, since time.Time, n int) ([]*models.ClickCount, error) {
+	switch short {
+	case "abcde":
+		return []*models.ClickCount{{Label: "news.example.org", Clicks: 6}, {Label: "", Clicks: 2}}, nil
+	default:
+		return []*models.ClickCount{}, nil
+	}
+}
+
+func (m *ClickModel) Agents(short string, since time.Time) ([]*models.ClickCount, error) {
+	switch short {
+	case "abcde":
+		return []*models.ClickCount{{Label: "mobile", Clicks: 5}, {Label: "desktop", Clicks: 3}}, nil
+	default:
+		return []*models.ClickCount{}, nil
+	}
+}
+
+func (m *ClickModel) Totals(ownerID int) (map[string]int, error) {
+	switch ownerID {
+	case 1:
+		return map[string]int{"abcde": 8}, nil
+	default:
+		return map[string]int{}, nil
+	}
+}
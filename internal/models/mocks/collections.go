@@ -0,0 +1,35 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"time"
+)
+
+type CollectionModel struct {
+	// StoragePath overrides where the mock collection's file blobs are read from, same as FileModel.StoragePath
+	StoragePath string
+}
+
+func (m *CollectionModel) Insert(uuid string, fileUUIDs []string) error {
+	return nil
+}
+
+func (m *CollectionModel) Get(uuid string) (*models.Collection, error) {
+	switch uuid {
+	case "abcdef":
+		// Two different files uploaded under the same name
+		first, second := *mockFile, *mockFile
+		second.ID, second.FileUUID, second.Checksum = 2, "654321", "qwerty"
+		if m.StoragePath != "" {
+			first.StoragePath, second.StoragePath = m.StoragePath, m.StoragePath
+		}
+		return &models.Collection{
+			ID:             1,
+			CollectionUUID: "abcdef",
+			Created:        time.Now(),
+			Files:          []*models.File{&first, &second},
+		}, nil
+	default:
+		return nil, models.ErrNoRecord
+	}
+}
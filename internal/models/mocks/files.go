@@ -1,6 +1,9 @@
 package mocks
 
-import "clonebox/internal/models"
+import (
+	"clonebox/internal/models"
+	"sync"
+)
 
 var mockFile = &models.File{
 	ID:          1,
@@ -9,29 +12,107 @@ var mockFile = &models.File{
 	FileSize:    10,
 	Checksum:    "abcdef",
 	StoragePath: "/clonebox/upload",
+	ScanStatus:  models.ScanClean,
 }
 
-type FileModel struct{}
+var mockQuarantinedFile = &models.File{
+	ID:          3,
+	FileName:    "eicar.com",
+	FileUUID:    "999999",
+	FileSize:    68,
+	Checksum:    "44d88612fea8a8f36de82e1278abb02f",
+	StoragePath: "/clonebox/upload",
+	ScanStatus:  models.ScanInfected,
+	ScanResult:  "Eicar-Test-Signature",
+}
 
-func (f *FileModel) Insert(fileName string, uuid string, fileSize int, checksum string, storagePath string) error {
-	//TODO implement me
-	panic("implement me")
+// mockScanFailedFile couldn't be scanned when it was uploaded. Its content is "rescan me".
+var mockScanFailedFile = &models.File{
+	ID:          4,
+	FileName:    "big.iso",
+	FileUUID:    "777777",
+	FileSize:    9,
+	Checksum:    "9394ece8bba2e41c3ce16f106f086a98",
+	StoragePath: "/clonebox/upload",
+	ScanStatus:  models.ScanFailed,
+	ScanResult:  "scanner: connection refused",
+}
+
+type FileModel struct {
+	// StoragePath overrides where the mock file's blob is read from, for tests which need to serve real bytes
+	StoragePath string
+
+	mu    sync.Mutex
+	scans map[string][2]string // Status and result set by SetScan, by UUID
+}
+
+// withScan returns a copy of file with the scan set by SetScan, if there was one.
+func (f *FileModel) withScan(file models.File) *models.File {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if scan, ok := f.scans[file.FileUUID]; ok {
+		file.ScanStatus, file.ScanResult = scan[0], scan[1]
+	}
+	return &file
+}
+
+func (f *FileModel) Insert(fileName string, uuid string, fileSize int, checksum string, storagePath string, scanStatus string, scanResult string, ownerID int) error {
+	return nil
 }
 
 func (f *FileModel) GetByUUID(uuid string) (*models.File, error) {
+	var file models.File
 	switch uuid {
 	case "123456":
-		return mockFile, nil
+		file = *mockFile
+	case "999999":
+		file = *mockQuarantinedFile
+	case "777777":
+		file = *mockScanFailedFile
 	default:
 		return nil, models.ErrNoRecord
 	}
+
+	if f.StoragePath != "" {
+		file.StoragePath = f.StoragePath
+	}
+	return f.withScan(file), nil
 }
 
 func (f *FileModel) GetByChecksum(checksum string) (*models.File, error) {
 	switch checksum {
 	case "abcdef":
 		return mockFile, nil
+	case mockScanFailedFile.Checksum:
+		return f.withScan(*mockScanFailedFile), nil
 	default:
 		return nil, models.ErrNoRecord
 	}
 }
+
+func (f *FileModel) SetScan(uuid string, scanStatus string, scanResult string) error {
+	if _, err := f.GetByUUID(uuid); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.scans == nil {
+		f.scans = map[string][2]string{}
+	}
+	f.scans[uuid] = [2]string{scanStatus, scanResult}
+	return nil
+}
+
+func (f *FileModel) Latest(n int) ([]*models.File, error) {
+	return []*models.File{mockQuarantinedFile, mockFile}, nil
+}
+
+func (f *FileModel) Usage(ownerID int) (int64, int, error) {
+	switch ownerID {
+	case 1:
+		return int64(mockFile.FileSize), 1, nil
+	default:
+		return 0, 0, nil
+	}
+}
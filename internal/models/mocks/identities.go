@@ -0,0 +1,38 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"sync"
+)
+
+// IdentityModel keeps the links between users and identity provider accounts in memory.
+type IdentityModel struct {
+	mu    sync.Mutex
+	links map[[2]string]int
+}
+
+func (m *IdentityModel) Get(issuer, subject string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	userID, ok := m.links[[2]string{issuer, subject}]
+	if !ok {
+		return 0, models.ErrNoRecord
+	}
+	return userID, nil
+}
+
+func (m *IdentityModel) Insert(issuer, subject string, userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{issuer, subject}
+	if _, ok := m.links[key]; ok {
+		return models.ErrDuplicateIdentity
+	}
+	if m.links == nil {
+		m.links = make(map[[2]string]int)
+	}
+	m.links[key] = userID
+	return nil
+}
@@ -2,43 +2,155 @@ package mocks
 
 import (
 	"clonebox/internal/models"
+	"slices"
+	"time"
 )
 
+var mockLink = &models.LinkMapping{
+	ID:           1,
+	OriginalLink: "https://existent.com",
+	ShortLink:    "abcde",
+	OwnerID:      1,
+	Active:       true,
+	Created:      time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC),
+}
+
+// mockInactiveLink was disabled by its owner.
+var mockInactiveLink = &models.LinkMapping{
+	ID:           2,
+	OriginalLink: "https://inactive.com",
+	ShortLink:    "inact",
+	OwnerID:      1,
+	Active:       false,
+	Created:      time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC),
+}
+
+// mockOthersLink belongs to the admin user, not alice. Its owner forces the preview page.
+var mockOthersLink = &models.LinkMapping{
+	ID:           3,
+	OriginalLink: "https://others.com/landing?ref=qr",
+	ShortLink:    "other",
+	OwnerID:      2,
+	Active:       true,
+	Created:      time.Date(2025, 1, 3, 10, 0, 0, 0, time.UTC),
+	Interstitial: true,
+}
+
+// mockExpiredLink expired at the start of 2025.
+var mockExpiredLink = &models.LinkMapping{
+	ID:           4,
+	OriginalLink: "https://expired.com",
+	ShortLink:    "expir",
+	OwnerID:      1,
+	Active:       true,
+	Created:      time.Date(2024, 12, 1, 10, 0, 0, 0, time.UTC),
+	Expires:      time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+// mockUsedUpLink is a one-time link that has already been followed.
+var mockUsedUpLink = &models.LinkMapping{
+	ID:           5,
+	OriginalLink: "https://onetime.com",
+	ShortLink:    "once1",
+	OwnerID:      1,
+	Active:       true,
+	Created:      time.Date(2025, 1, 4, 10, 0, 0, 0, time.UTC),
+	MaxUses:      1,
+	Uses:         1,
+}
+
+var mockLinks = []*models.LinkMapping{mockLink, mockInactiveLink, mockOthersLink, mockExpiredLink, mockUsedUpLink}
+
 type LinkMappingModel struct{}
 
-func (m *LinkMappingModel) Insert(original, short string) error {
-	//TODO implement me
-	panic("implement me")
+func (m *LinkMappingModel) Insert(original, short string, ownerID int, expires time.Time, maxUses int) error {
+	if _, err := m.Get(short); err == nil {
+		return models.ErrDuplicateLink
+	}
+	return nil
+}
+
+func (m *LinkMappingModel) InsertBatch(fn func(insert models.LinkInsertFunc) error) error {
+	return fn(m.Insert)
+}
+
+func (m *LinkMappingModel) Get(short string) (*models.LinkMapping, error) {
+	for _, l := range mockLinks {
+		if l.ShortLink == short {
+			// Copy, so handlers can't change the shared mock
+			link := *l
+			return &link, nil
+		}
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (m *LinkMappingModel) Use(short string) (*models.LinkMapping, error) {
+	l, err := m.Get(short)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, l.Usable()
 }
 
 func (m *LinkMappingModel) Latest() ([]*models.LinkMapping, error) {
-	//TODO implement me
-	panic("implement me")
+	links := []*models.LinkMapping{}
+	for _, l := range slices.Backward(mockLinks) {
+		if l.Active && l.Expires.IsZero() && l.MaxUses == 0 {
+			links = append(links, l)
+		}
+	}
+	return links, nil
 }
 
-func (m *LinkMappingModel) GetOriginal(short string) (string, error) {
-	switch short {
-	case "abcde":
-		return "https://existent.com", nil
-	default:
-		return "", models.ErrNoRecord
+func (m *LinkMappingModel) Count() (int, error) {
+	return 1, nil
+}
+
+func (m *LinkMappingModel) ByOwner(ownerID int) ([]*models.LinkMapping, error) {
+	links := []*models.LinkMapping{}
+	for _, l := range mockLinks {
+		if l.OwnerID == ownerID {
+			links = append(links, l)
+		}
 	}
+	return links, nil
 }
 
-func (m *LinkMappingModel) GetShort(original string) (string, error) {
-	switch original {
-	case "https://existent.com":
-		return "abcde", nil
-	default:
-		return "", models.ErrNoRecord
+func (m *LinkMappingModel) Retarget(short, original string) error {
+	_, err := m.Get(short)
+	return err
+}
+
+func (m *LinkMappingModel) SetActive(short string, active bool) error {
+	_, err := m.Get(short)
+	return err
+}
+
+func (m *LinkMappingModel) SetInterstitial(short string, interstitial bool) error {
+	_, err := m.Get(short)
+	return err
+}
+
+func (m *LinkMappingModel) GetOriginal(short string) (string, error) {
+	l, err := m.Get(short)
+	if err != nil {
+		return "", err
 	}
+	return l.OriginalLink, nil
 }
 
-func (m *LinkMappingModel) Exists(original string) (bool, error) {
-	switch original {
-	case "https://nonexistent.com":
-		return false, nil
-	default:
-		return true, nil
+func (m *LinkMappingModel) GetShort(ownerID int, original string) (string, error) {
+	for _, l := range mockLinks {
+		if l.OwnerID == ownerID && l.OriginalLink == original && l.Active && l.Expires.IsZero() && l.MaxUses == 0 {
+			return l.ShortLink, nil
+		}
 	}
+	return "", models.ErrNoRecord
+}
+
+func (m *LinkMappingModel) Exists(ownerID int, original string) (bool, error) {
+	_, err := m.GetShort(ownerID, original)
+	return err == nil, nil
 }
@@ -0,0 +1,88 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PasskeyModel keeps passkeys in memory, so handler tests can register one with a software authenticator and log
+// in with it.
+type PasskeyModel struct {
+	mu       sync.Mutex
+	passkeys []models.Passkey
+}
+
+func (m *PasskeyModel) Insert(userID int, name string, id, publicKey []byte, signCount uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.index(id) >= 0 {
+		return models.ErrDuplicatePasskey
+	}
+	m.passkeys = append(m.passkeys, models.Passkey{
+		ID:        slices.Clone(id),
+		UserID:    userID,
+		PublicKey: slices.Clone(publicKey),
+		SignCount: signCount,
+		Name:      name,
+		Created:   time.Now(),
+	})
+	return nil
+}
+
+func (m *PasskeyModel) Get(id []byte) (*models.Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(id)
+	if i < 0 {
+		return nil, models.ErrNoRecord
+	}
+	p := m.passkeys[i]
+	return &p, nil
+}
+
+func (m *PasskeyModel) ByUser(userID int) ([]models.Passkey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var passkeys []models.Passkey
+	for _, p := range m.passkeys {
+		if p.UserID == userID {
+			passkeys = append(passkeys, p)
+		}
+	}
+	return passkeys, nil
+}
+
+func (m *PasskeyModel) Use(id []byte, signCount uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.index(id); i >= 0 {
+		m.passkeys[i].SignCount = signCount
+		m.passkeys[i].LastUsed = time.Now()
+	}
+	return nil
+}
+
+func (m *PasskeyModel) Delete(userID int, id []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(id)
+	if i < 0 || m.passkeys[i].UserID != userID {
+		return models.ErrNoRecord
+	}
+	m.passkeys = slices.Delete(m.passkeys, i, i+1)
+	return nil
+}
+
+// index returns the position of the passkey with a credential ID, or -1. Called with mu held.
+func (m *PasskeyModel) index(id []byte) int {
+	return slices.IndexFunc(m.passkeys, func(p models.Passkey) bool {
+		return string(p.ID) == string(id)
+	})
+}
@@ -0,0 +1,54 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"sync"
+	"time"
+)
+
+type mockToken struct {
+	userID int
+	scope  string
+	expiry time.Time
+}
+
+// TokenModel keeps tokens in memory, so handler tests can follow a mailed link end to end.
+type TokenModel struct {
+	mu     sync.Mutex
+	tokens map[string]mockToken
+}
+
+func (m *TokenModel) Insert(hash string, userID int, scope string, expiry time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = make(map[string]mockToken)
+	}
+	m.tokens[hash] = mockToken{userID: userID, scope: scope, expiry: expiry}
+	return nil
+}
+
+func (m *TokenModel) Use(hash, scope string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tokens[hash]
+	if !ok || t.scope != scope || !time.Now().Before(t.expiry) {
+		return 0, models.ErrNoRecord
+	}
+	delete(m.tokens, hash)
+	return t.userID, nil
+}
+
+func (m *TokenModel) DeleteAllForUser(userID int, scope string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range m.tokens {
+		if t.userID == userID && t.scope == scope {
+			delete(m.tokens, hash)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"sync"
+)
+
+// MockTOTPSecret is the secret of mockTwoFactorUser, who has two-factor authentication enabled from the start.
+const MockTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+// mockRecoveryCodeHash is the hash of mockTwoFactorUser's one recovery code, "abcd-efgh-ijkl-mnop".
+const mockRecoveryCodeHash = "f39dac6cbaba535e2c207cd0cd8f154974223c848f727f98b3564cea569b41cf"
+
+type mockTwoFactor struct {
+	secret   string
+	lastStep int64
+	codes    map[string]bool
+}
+
+// TwoFactorModel keeps the two-factor state of the mock users in memory.
+type TwoFactorModel struct {
+	mu    sync.Mutex
+	users map[int]*mockTwoFactor
+}
+
+// state returns the user's two-factor state, setting up mockTwoFactorUser's on first use. Called with mu held.
+func (m *TwoFactorModel) state(userID int) *mockTwoFactor {
+	if m.users == nil {
+		m.users = map[int]*mockTwoFactor{
+			5: {secret: MockTOTPSecret, codes: map[string]bool{mockRecoveryCodeHash: true}},
+		}
+	}
+	return m.users[userID]
+}
+
+func (m *TwoFactorModel) Enable(userID int, secret string, step int64, recoveryHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.state(userID)
+	codes := make(map[string]bool)
+	for _, hash := range recoveryHashes {
+		codes[hash] = true
+	}
+	m.users[userID] = &mockTwoFactor{secret: secret, lastStep: step, codes: codes}
+	return nil
+}
+
+func (m *TwoFactorModel) Disable(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.state(userID)
+	delete(m.users, userID)
+	return nil
+}
+
+func (m *TwoFactorModel) Secret(userID int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.state(userID)
+	if s == nil {
+		return "", models.ErrNoRecord
+	}
+	return s.secret, nil
+}
+
+func (m *TwoFactorModel) UseStep(userID int, step int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.state(userID)
+	if s == nil || step <= s.lastStep {
+		return models.ErrInvalidCredentials
+	}
+	s.lastStep = step
+	return nil
+}
+
+func (m *TwoFactorModel) UseRecoveryCode(userID int, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.state(userID)
+	if s == nil || !s.codes[hash] {
+		return models.ErrInvalidCredentials
+	}
+	delete(s.codes, hash)
+	return nil
+}
+
+func (m *TwoFactorModel) RecoveryCodesLeft(userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.state(userID)
+	if s == nil {
+		return 0, nil
+	}
+	return len(s.codes), nil
+}
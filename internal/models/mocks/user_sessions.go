@@ -0,0 +1,94 @@
+package mocks
+
+import (
+	"clonebox/internal/models"
+	"slices"
+	"sync"
+	"time"
+)
+
+// UserSessionModel keeps logins in memory, so handler tests can list and revoke the sessions they log in with.
+type UserSessionModel struct {
+	mu       sync.Mutex
+	sessions []models.UserSession
+}
+
+func (m *UserSessionModel) Insert(id string, userID int, ip, userAgent string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sessions = append(m.sessions, models.UserSession{
+		ID:        id,
+		UserID:    userID,
+		IP:        ip,
+		UserAgent: userAgent,
+		Created:   now,
+		LastSeen:  now,
+	})
+	return nil
+}
+
+func (m *UserSessionModel) Get(id string) (*models.UserSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(id)
+	if i < 0 {
+		return nil, models.ErrNoRecord
+	}
+	s := m.sessions[i]
+	return &s, nil
+}
+
+func (m *UserSessionModel) ByUser(userID int) ([]models.UserSession, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sessions []models.UserSession
+	for _, s := range slices.Backward(m.sessions) {
+		if s.UserID == userID {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *UserSessionModel) Touch(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i := m.index(id); i >= 0 {
+		m.sessions[i].LastSeen = time.Now()
+	}
+	return nil
+}
+
+func (m *UserSessionModel) Delete(userID int, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.index(id)
+	if i < 0 || m.sessions[i].UserID != userID {
+		return models.ErrNoRecord
+	}
+	m.sessions = slices.Delete(m.sessions, i, i+1)
+	return nil
+}
+
+func (m *UserSessionModel) DeleteAllForUser(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sessions = slices.DeleteFunc(m.sessions, func(s models.UserSession) bool {
+		return s.UserID == userID
+	})
+	return nil
+}
+
+// index returns the position of the login with an ID, or -1. Called with mu held.
+func (m *UserSessionModel) index(id string) int {
+	return slices.IndexFunc(m.sessions, func(s models.UserSession) bool {
+		return s.ID == id
+	})
+}
@@ -1,8 +1,56 @@
 package mocks
 
-import "clonebox/internal/models"
+import (
+	"clonebox/internal/models"
+	"sync"
+	"time"
+)
 
-type UserModel struct{}
+var mockUser = &models.User{
+	ID:       1,
+	Name:     "Alice Jones",
+	Email:    "alice@example.com",
+	Created:  time.Now(),
+	Verified: true,
+}
+
+var mockAdmin = &models.User{
+	ID:       2,
+	Name:     "Bob Admin",
+	Email:    "admin@example.com",
+	Created:  time.Now(),
+	Admin:    true,
+	Verified: true,
+}
+
+// mockUnverified hasn't followed the link sent to their email address yet
+var mockUnverified = &models.User{
+	ID:      3,
+	Name:    "Carol New",
+	Email:   "carol@example.com",
+	Created: time.Now(),
+}
+
+// mockTwoFactorUser has two-factor authentication enabled, see TwoFactorModel
+var mockTwoFactorUser = &models.User{
+	ID:       5,
+	Name:     "Erin Secure",
+	Email:    "erin@example.com",
+	Created:  time.Now(),
+	Verified: true,
+}
+
+type UserModel struct {
+	// Session versions bumped by PasswordReset, by user ID
+	mu       sync.Mutex
+	versions map[int]int
+	// Users created by Provision, from ID 6 up
+	provisioned []models.User
+	// Profile changes to the fixed users, by user ID
+	names         map[int]string
+	emails        map[int]string
+	pendingEmails map[int]string
+}
 
 func (m *UserModel) PasswordUpdate(id int, currentPassword string, newPassword string) error {
 	//TODO implement me
@@ -10,16 +58,74 @@ func (m *UserModel) PasswordUpdate(id int, currentPassword string, newPassword s
 }
 
 func (m *UserModel) Get(id int) (*models.User, error) {
-	//TODO implement me
-	panic("implement me")
+	var user models.User
+	switch id {
+	case 1:
+		user = *mockUser
+	case 2:
+		user = *mockAdmin
+	case 3:
+		user = *mockUnverified
+	case 5:
+		user = *mockTwoFactorUser
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if i := id - 6; i >= 0 && i < len(m.provisioned) {
+		user = m.provisioned[i]
+	}
+	if user.ID == 0 {
+		return nil, models.ErrNoRecord
+	}
+	user.SessionVersion = m.versions[id]
+	if name, ok := m.names[id]; ok {
+		user.Name = name
+	}
+	if email, ok := m.emails[id]; ok {
+		user.Email = email
+	}
+	user.PendingEmail = m.pendingEmails[id]
+	return &user, nil
 }
 
-func (m *UserModel) Insert(name, email, password string) error {
+func (m *UserModel) GetByEmail(email string) (*models.User, error) {
+	for _, id := range []int{mockUser.ID, mockAdmin.ID, mockUnverified.ID, mockTwoFactorUser.ID} {
+		if u, _ := m.Get(id); u.Email == email {
+			return u, nil
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range m.provisioned {
+		if u.Email == email {
+			return &u, nil
+		}
+	}
+	return nil, models.ErrNoRecord
+}
+
+func (m *UserModel) PasswordReset(id int, newPassword string) error {
+	if _, err := m.Get(id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.versions == nil {
+		m.versions = make(map[int]int)
+	}
+	m.versions[id]++
+	return nil
+}
+
+func (m *UserModel) Insert(name, email, password string) (int, error) {
 	switch email {
 	case "dupe@mock.com":
-		return models.ErrDuplicateEmail
+		return 0, models.ErrDuplicateEmail
 	default:
-		return nil
+		return 4, nil
 	}
 }
 
@@ -27,15 +133,80 @@ func (m *UserModel) Authenticate(email, password string) (int, error) {
 	if email == "alice@example.com" && password == "p@ssw0rd" {
 		return 1, nil
 	}
+	if email == "admin@example.com" && password == "p@ssw0rd" {
+		return 2, nil
+	}
+	if email == "carol@example.com" && password == "p@ssw0rd" {
+		return 3, nil
+	}
+	if email == "erin@example.com" && password == "p@ssw0rd" {
+		return 5, nil
+	}
 
 	return 0, models.ErrInvalidCredentials
 }
 
 func (m *UserModel) Exists(id int) (bool, error) {
 	switch id {
-	case 1:
+	case 1, 2, 3, 5:
 		return true, nil
 	default:
 		return false, nil
 	}
 }
+
+func (m *UserModel) SetVerified(id int) error {
+	return nil
+}
+
+func (m *UserModel) Provision(name, email string) (int, error) {
+	if _, err := m.GetByEmail(email); err == nil || email == "dupe@mock.com" {
+		return 0, models.ErrDuplicateEmail
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := 6 + len(m.provisioned)
+	m.provisioned = append(m.provisioned, models.User{ID: id, Name: name, Email: email, Created: time.Now(), Verified: true})
+	return id, nil
+}
+
+func (m *UserModel) UpdateName(id int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.names == nil {
+		m.names = make(map[int]string)
+	}
+	m.names[id] = name
+	return nil
+}
+
+func (m *UserModel) SetPendingEmail(id int, email string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pendingEmails == nil {
+		m.pendingEmails = make(map[int]string)
+	}
+	m.pendingEmails[id] = email
+	return nil
+}
+
+// ConfirmEmail fails with ErrDuplicateEmail for dupe@mock.com, standing in for an address taken in the meantime.
+func (m *UserModel) ConfirmEmail(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	email, ok := m.pendingEmails[id]
+	if !ok {
+		return models.ErrNoRecord
+	}
+	if email == "dupe@mock.com" {
+		return models.ErrDuplicateEmail
+	}
+	if m.emails == nil {
+		m.emails = make(map[int]string)
+	}
+	m.emails[id] = email
+	delete(m.pendingEmails, id)
+	return nil
+}
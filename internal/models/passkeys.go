@@ -0,0 +1,121 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+type PasskeyModelInterface interface {
+	Insert(userID int, name string, id, publicKey []byte, signCount uint32) error
+	Get(id []byte) (*Passkey, error)
+	ByUser(userID int) ([]Passkey, error)
+	Use(id []byte, signCount uint32) error
+	Delete(userID int, id []byte) error
+}
+
+// Passkey is a WebAuthn credential a user can log in with. PublicKey is COSE encoded, and checked by package
+// webauthn.
+type Passkey struct {
+	ID        []byte
+	UserID    int
+	PublicKey []byte
+	SignCount uint32
+	Name      string
+	Created   time.Time
+	LastUsed  time.Time // Zero if never used
+}
+
+type PasskeyModel struct {
+	DB *sql.DB
+}
+
+const passkeyColumns = `id, user_id, public_key, sign_count, name, created, last_used`
+
+func scanPasskey(row rowScanner, p *Passkey) error {
+	var lastUsed sql.NullTime
+	err := row.Scan(&p.ID, &p.UserID, &p.PublicKey, &p.SignCount, &p.Name, &p.Created, &lastUsed)
+	p.LastUsed = lastUsed.Time
+	return err
+}
+
+// Insert stores a newly registered passkey. A credential ID that's already registered, to this or another user,
+// returns ErrDuplicatePasskey.
+func (m *PasskeyModel) Insert(userID int, name string, id, publicKey []byte, signCount uint32) error {
+	stmt := `INSERT INTO passkeys (id, user_id, public_key, sign_count, name, created)
+	VALUES (?, ?, ?, ?, ?, UTC_TIMESTAMP())`
+
+	_, err := m.DB.Exec(stmt, id, userID, publicKey, signCount, name)
+	if err != nil {
+		var mySqlErr *mysql.MySQLError
+		if errors.As(err, &mySqlErr) && mySqlErr.Number == 1062 {
+			return ErrDuplicatePasskey
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the passkey with a credential ID.
+func (m *PasskeyModel) Get(id []byte) (*Passkey, error) {
+	stmt := `SELECT ` + passkeyColumns + ` FROM passkeys WHERE id = ?`
+
+	p := &Passkey{}
+	err := scanPasskey(m.DB.QueryRow(stmt, id), p)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// ByUser returns a user's passkeys, oldest first.
+func (m *PasskeyModel) ByUser(userID int) ([]Passkey, error) {
+	stmt := `SELECT ` + passkeyColumns + ` FROM passkeys WHERE user_id = ? ORDER BY created, id`
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var p Passkey
+		if err = scanPasskey(rows, &p); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+// Use records a login with a passkey and the authenticator's new signature counter.
+func (m *PasskeyModel) Use(id []byte, signCount uint32) error {
+	stmt := `UPDATE passkeys SET sign_count = ?, last_used = UTC_TIMESTAMP() WHERE id = ?`
+
+	_, err := m.DB.Exec(stmt, signCount, id)
+	return err
+}
+
+// Delete removes one of a user's passkeys. Other users' passkeys return ErrNoRecord.
+func (m *PasskeyModel) Delete(userID int, id []byte) error {
+	stmt := `DELETE FROM passkeys WHERE id = ? AND user_id = ?`
+
+	result, err := m.DB.Exec(stmt, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+)
+
+func TestPasskeyModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := PasskeyModel{db}
+
+	passkeys, err := m.ByUser(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(passkeys), 0)
+
+	assert.NilError(t, m.Insert(1, "Laptop", []byte("credential-1"), []byte{0xa0}, 0))
+	assert.NilError(t, m.Insert(1, "Phone", []byte("credential-2"), []byte{0xa0}, 7))
+	assert.Equal(t, m.Insert(1, "Again", []byte("credential-1"), []byte{0xa0}, 0), ErrDuplicatePasskey)
+
+	p, err := m.Get([]byte("credential-2"))
+	assert.NilError(t, err)
+	assert.Equal(t, p.UserID, 1)
+	assert.Equal(t, p.Name, "Phone")
+	assert.Equal(t, p.SignCount, uint32(7))
+	assert.Equal(t, p.LastUsed.IsZero(), true)
+
+	assert.NilError(t, m.Use([]byte("credential-2"), 8))
+	p, err = m.Get([]byte("credential-2"))
+	assert.NilError(t, err)
+	assert.Equal(t, p.SignCount, uint32(8))
+	assert.Equal(t, p.LastUsed.IsZero(), false)
+
+	passkeys, err = m.ByUser(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(passkeys), 2)
+
+	// Only the owner can delete a passkey
+	assert.Equal(t, m.Delete(2, []byte("credential-1")), ErrNoRecord)
+	assert.NilError(t, m.Delete(1, []byte("credential-1")))
+	_, err = m.Get([]byte("credential-1"))
+	assert.Equal(t, err, ErrNoRecord)
+}
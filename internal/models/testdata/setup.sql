@@ -13,26 +13,126 @@ CREATE TABLE users
     name            VARCHAR(255) NOT NULL,
     email           VARCHAR(255) NOT NULL,
     hashed_password CHAR(60)     NOT NULL,
-    created         DATETIME     NOT NULL
+    created         DATETIME     NOT NULL,
+    admin           BOOLEAN      NOT NULL DEFAULT FALSE,
+    quota_bytes     BIGINT       NULL,
+    quota_files     INTEGER      NULL,
+    verified        BOOLEAN      NOT NULL DEFAULT FALSE,
+    session_version INTEGER      NOT NULL DEFAULT 0,
+    totp_secret     VARCHAR(64)  NULL,
+    totp_last_step  BIGINT       NOT NULL DEFAULT 0,
+    pending_email   VARCHAR(255) NULL
 );
 ALTER TABLE users
     ADD CONSTRAINT users_uc_email UNIQUE (email);
-INSERT INTO users (name, email, hashed_password, created)
+INSERT INTO users (name, email, hashed_password, created, verified)
 VALUES ('Alice Jones',
         'alice@example.com',
         '$2a$12$RB1A2rdzmXNzt5uPOU9hWOgojGbYCWlV3jJj6474KhdRM947r/gwC',
-        '2022-01-01 10:00:00');
+        '2022-01-01 10:00:00',
+        TRUE);
+
+CREATE TABLE tokens
+(
+    hash    CHAR(64)    NOT NULL PRIMARY KEY,
+    user_id INTEGER     NOT NULL,
+    scope   VARCHAR(20) NOT NULL,
+    expiry  DATETIME    NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_tokens_user_id ON tokens (user_id);
+
+CREATE TABLE recovery_codes
+(
+    user_id INTEGER  NOT NULL,
+    hash    CHAR(64) NOT NULL,
+    PRIMARY KEY (user_id, hash),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+
+CREATE TABLE passkeys
+(
+    id         VARBINARY(255) NOT NULL PRIMARY KEY,
+    user_id    INTEGER        NOT NULL,
+    public_key BLOB           NOT NULL,
+    sign_count INT UNSIGNED   NOT NULL DEFAULT 0,
+    name       VARCHAR(100)   NOT NULL,
+    created    DATETIME       NOT NULL,
+    last_used  DATETIME       NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_passkeys_user_id ON passkeys (user_id);
+
+CREATE TABLE user_sessions
+(
+    id         CHAR(36)     NOT NULL PRIMARY KEY,
+    user_id    INTEGER      NOT NULL,
+    ip         VARCHAR(45)  NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    created    DATETIME     NOT NULL,
+    last_seen  DATETIME     NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_user_sessions_user_id ON user_sessions (user_id);
+
+CREATE TABLE login_failures
+(
+    key_hash         CHAR(64)    NOT NULL PRIMARY KEY,
+    failures         INTEGER     NOT NULL,
+    last_failure     DATETIME(6) NOT NULL,
+    previous_failure DATETIME(6) NULL,
+    expires          DATETIME(6) NOT NULL
+);
+CREATE INDEX idx_login_failures_expires ON login_failures (expires);
+
+CREATE TABLE user_identities
+(
+    issuer  VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INTEGER      NOT NULL,
+    created DATETIME     NOT NULL,
+    PRIMARY KEY (issuer, subject),
+    FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
 
 CREATE TABLE link_mapping
 (
     id            INTEGER      NOT NULL PRIMARY KEY AUTO_INCREMENT,
-    original_link VARCHAR(100) NOT NULL UNIQUE,
-    short_link    VARCHAR(100) NOT NULL UNIQUE
+    original_link VARCHAR(100) NOT NULL,
+    short_link    VARCHAR(100) NOT NULL UNIQUE,
+    owner_id      INTEGER      NULL,
+    active        BOOLEAN      NOT NULL DEFAULT TRUE,
+    created       DATETIME     NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires       DATETIME     NULL,
+    max_uses      INTEGER      NULL,
+    uses          INTEGER      NOT NULL DEFAULT 0,
+    interstitial  BOOLEAN      NOT NULL DEFAULT FALSE,
+    FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE SET NULL
 );
+CREATE INDEX idx_link_mapping_owner_original ON link_mapping (owner_id, original_link);
 
-INSERT INTO link_mapping (original_link, short_link)
+INSERT INTO link_mapping (original_link, short_link, owner_id, created)
 VALUES ('https://existent.com',
-        '123456');
+        '123456',
+        1,
+        '2025-01-01 10:00:00');
+
+CREATE TABLE link_clicks
+(
+    id            INTEGER      NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    link_id       INTEGER      NOT NULL,
+    clicked       DATETIME     NOT NULL,
+    referrer_host VARCHAR(255) NOT NULL DEFAULT '',
+    agent_class   VARCHAR(20)  NOT NULL DEFAULT '',
+    ip_hash       CHAR(64)     NOT NULL,
+    FOREIGN KEY (link_id) REFERENCES link_mapping (id) ON DELETE CASCADE
+);
+CREATE INDEX idx_link_clicks_link_id_clicked ON link_clicks (link_id, clicked);
+
+INSERT INTO link_clicks (link_id, clicked, referrer_host, agent_class, ip_hash)
+VALUES (1, '2025-01-01 10:00:00', 'example.org', 'desktop', 'aaaa'),
+       (1, '2025-01-01 11:00:00', 'example.org', 'mobile', 'aaaa'),
+       (1, '2025-01-02 10:00:00', '', 'desktop', 'bbbb');
 
 CREATE TABLE files
 (
@@ -42,14 +142,43 @@ CREATE TABLE files
     file_size    INTEGER             NOT NULL,
     checksum     VARCHAR(100)        NOT NULL,
     storage_path VARCHAR(100)        NOT NULL,
-    upload_date  DATETIME            NOT NULL
+    upload_date  DATETIME            NOT NULL,
+    scan_status  VARCHAR(20)         NOT NULL DEFAULT 'unscanned',
+    scan_result  VARCHAR(255)        NOT NULL DEFAULT '',
+    owner_id     INTEGER             NULL,
+    FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE SET NULL
 );
+CREATE INDEX idx_files_owner_id ON files (owner_id);
 CREATE INDEX idx_files_file_name ON files (file_name);
 
-INSERT INTO files (file_name, file_uuid, file_size, checksum, storage_path, upload_date)
+INSERT INTO files (file_name, file_uuid, file_size, checksum, storage_path, upload_date, owner_id)
 VALUES ('test_file.pdf',
         '123456',
         100,
         'abcdef',
         '/clonebox/upload',
-        '2025-01-01 10:00:00');
\ No newline at end of file
+        '2025-01-01 10:00:00',
+        1);
+
+CREATE TABLE collections
+(
+    id              INTEGER             NOT NULL PRIMARY KEY AUTO_INCREMENT,
+    collection_uuid VARCHAR(100) UNIQUE NOT NULL,
+    created         DATETIME            NOT NULL
+);
+
+CREATE TABLE collection_files
+(
+    collection_id INTEGER NOT NULL,
+    file_id       INTEGER NOT NULL,
+    position      INTEGER NOT NULL,
+    PRIMARY KEY (collection_id, file_id),
+    FOREIGN KEY (collection_id) REFERENCES collections (id) ON DELETE CASCADE,
+    FOREIGN KEY (file_id) REFERENCES files (id) ON DELETE CASCADE
+);
+
+INSERT INTO collections (collection_uuid, created)
+VALUES ('abcdef', '2025-01-01 10:00:00');
+
+INSERT INTO collection_files (collection_id, file_id, position)
+VALUES (1, 1, 0);
\ No newline at end of file
@@ -1,4 +1,13 @@
-DROP TABLE users;
-DROP TABLE snippets;
+DROP TABLE collection_files;
+DROP TABLE collections;
+DROP TABLE files;
+DROP TABLE link_clicks;
 DROP TABLE link_mapping;
-DROP TABLE files;
\ No newline at end of file
+DROP TABLE user_identities;
+DROP TABLE login_failures;
+DROP TABLE user_sessions;
+DROP TABLE passkeys;
+DROP TABLE recovery_codes;
+DROP TABLE tokens;
+DROP TABLE users;
+DROP TABLE snippets;
\ No newline at end of file
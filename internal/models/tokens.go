@@ -0,0 +1,72 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Token scopes, a token is only accepted for the purpose it was issued for.
+const (
+	ScopeVerification  = "verification"
+	ScopePasswordReset = "password-reset"
+	ScopeEmailChange   = "email-change"
+)
+
+type TokenModelInterface interface {
+	Insert(hash string, userID int, scope string, expiry time.Time) error
+	Use(hash, scope string) (int, error)
+	DeleteAllForUser(userID int, scope string) error
+}
+
+// TokenModel stores the hashes of the tokens mailed to users. The tokens themselves are created and checked by
+// package token.
+type TokenModel struct {
+	DB *sql.DB
+}
+
+// Insert stores a token's hash for a user.
+func (m *TokenModel) Insert(hash string, userID int, scope string, expiry time.Time) error {
+	stmt := `INSERT INTO tokens (hash, user_id, scope, expiry) VALUES (?, ?, ?, ?)`
+
+	_, err := m.DB.Exec(stmt, hash, userID, scope, expiry.UTC())
+	return err
+}
+
+// Use redeems a token and returns the ID of the user it was issued to. Tokens can be used once, unknown, expired and
+// already used tokens return ErrNoRecord.
+func (m *TokenModel) Use(hash, scope string) (int, error) {
+	var userID int
+	stmt := `SELECT user_id FROM tokens WHERE hash = ? AND scope = ? AND expiry > UTC_TIMESTAMP()`
+
+	err := m.DB.QueryRow(stmt, hash, scope).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNoRecord
+		}
+		return 0, err
+	}
+
+	// Only the request which deletes the token gets to use it
+	result, err := m.DB.Exec(`DELETE FROM tokens WHERE hash = ?`, hash)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrNoRecord
+	}
+
+	return userID, nil
+}
+
+// DeleteAllForUser removes a user's outstanding tokens for scope, e.g. once one of them has been used.
+func (m *TokenModel) DeleteAllForUser(userID int, scope string) error {
+	stmt := `DELETE FROM tokens WHERE user_id = ? AND scope = ?`
+
+	_, err := m.DB.Exec(stmt, userID, scope)
+	return err
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenModelUse(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := TokenModel{db}
+
+	assert.NilError(t, m.Insert("valid", 1, ScopeVerification, time.Now().Add(time.Hour)))
+	assert.NilError(t, m.Insert("expired", 1, ScopeVerification, time.Now().Add(-time.Hour)))
+
+	_, err := m.Use("valid", "other")
+	assert.Equal(t, err, ErrNoRecord)
+	_, err = m.Use("expired", ScopeVerification)
+	assert.Equal(t, err, ErrNoRecord)
+	_, err = m.Use("unknown", ScopeVerification)
+	assert.Equal(t, err, ErrNoRecord)
+
+	userID, err := m.Use("valid", ScopeVerification)
+	assert.NilError(t, err)
+	assert.Equal(t, userID, 1)
+
+	// Tokens can only be used once
+	_, err = m.Use("valid", ScopeVerification)
+	assert.Equal(t, err, ErrNoRecord)
+}
+
+func TestTokenModelDeleteAllForUser(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := TokenModel{db}
+
+	assert.NilError(t, m.Insert("first", 1, ScopeVerification, time.Now().Add(time.Hour)))
+	assert.NilError(t, m.Insert("second", 1, ScopeVerification, time.Now().Add(time.Hour)))
+	assert.NilError(t, m.Insert("other", 1, "other", time.Now().Add(time.Hour)))
+
+	assert.NilError(t, m.DeleteAllForUser(1, ScopeVerification))
+
+	_, err := m.Use("first", ScopeVerification)
+	assert.Equal(t, err, ErrNoRecord)
+	_, err = m.Use("second", ScopeVerification)
+	assert.Equal(t, err, ErrNoRecord)
+
+	userID, err := m.Use("other", "other")
+	assert.NilError(t, err)
+	assert.Equal(t, userID, 1)
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type TwoFactorModelInterface interface {
+	Enable(userID int, secret string, step int64, recoveryHashes []string) error
+	Disable(userID int) error
+	Secret(userID int) (string, error)
+	UseStep(userID int, step int64) error
+	UseRecoveryCode(userID int, hash string) error
+	RecoveryCodesLeft(userID int) (int, error)
+}
+
+// TwoFactorModel stores users' TOTP secrets and the hashes of their recovery codes.
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+// Enable turns on two-factor authentication for a user, replacing any earlier recovery codes. step is the time step
+// of the code the user confirmed the secret with, which can't be used again.
+func (m *TwoFactorModel) Enable(userID int, secret string, step int64, recoveryHashes []string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `UPDATE users SET totp_secret = ?, totp_last_step = ? WHERE ID = ?`
+	result, err := tx.Exec(stmt, secret, step, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, hash) VALUES (?, ?)`, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Disable turns off two-factor authentication for a user and removes their recovery codes.
+func (m *TwoFactorModel) Disable(userID int) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`UPDATE users SET totp_secret = NULL WHERE ID = ?`, userID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Secret returns a user's TOTP secret, or ErrNoRecord if they haven't enabled two-factor authentication.
+func (m *TwoFactorModel) Secret(userID int) (string, error) {
+	var secret sql.NullString
+	stmt := `SELECT totp_secret FROM users WHERE ID = ?`
+
+	err := m.DB.QueryRow(stmt, userID).Scan(&secret)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoRecord
+		}
+		return "", err
+	}
+	if !secret.Valid {
+		return "", ErrNoRecord
+	}
+
+	return secret.String, nil
+}
+
+// UseStep records that a user logged in with the code of a time step. Codes of that step and earlier ones were used
+// up by it, so they return ErrInvalidCredentials. The check and the update happen in a single UPDATE, so concurrent
+// requests can't both use a code.
+func (m *TwoFactorModel) UseStep(userID int, step int64) error {
+	stmt := `UPDATE users SET totp_last_step = ? WHERE ID = ? AND totp_last_step < ?`
+
+	result, err := m.DB.Exec(stmt, step, userID, step)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+// UseRecoveryCode uses up one of a user's recovery codes. Unknown and already used codes return
+// ErrInvalidCredentials.
+func (m *TwoFactorModel) UseRecoveryCode(userID int, hash string) error {
+	stmt := `DELETE FROM recovery_codes WHERE user_id = ? AND hash = ?`
+
+	result, err := m.DB.Exec(stmt, userID, hash)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrInvalidCredentials
+	}
+
+	return nil
+}
+
+// RecoveryCodesLeft returns how many of a user's recovery codes haven't been used yet.
+func (m *TwoFactorModel) RecoveryCodesLeft(userID int) (int, error) {
+	var count int
+	stmt := `SELECT COUNT(*) FROM recovery_codes WHERE user_id = ?`
+
+	err := m.DB.QueryRow(stmt, userID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"testing"
+)
+
+func TestTwoFactorModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := TwoFactorModel{db}
+
+	_, err := m.Secret(1)
+	assert.Equal(t, err, ErrNoRecord)
+
+	assert.NilError(t, m.Enable(1, "JBSWY3DPEHPK3PXP", 100, []string{"first", "second"}))
+	secret, err := m.Secret(1)
+	assert.NilError(t, err)
+	assert.Equal(t, secret, "JBSWY3DPEHPK3PXP")
+
+	// The step confirmed with at enrollment and earlier ones are used up
+	assert.Equal(t, m.UseStep(1, 100), ErrInvalidCredentials)
+	assert.Equal(t, m.UseStep(1, 99), ErrInvalidCredentials)
+	assert.NilError(t, m.UseStep(1, 101))
+	assert.Equal(t, m.UseStep(1, 101), ErrInvalidCredentials)
+
+	left, err := m.RecoveryCodesLeft(1)
+	assert.NilError(t, err)
+	assert.Equal(t, left, 2)
+
+	assert.NilError(t, m.UseRecoveryCode(1, "first"))
+	assert.Equal(t, m.UseRecoveryCode(1, "first"), ErrInvalidCredentials)
+	assert.Equal(t, m.UseRecoveryCode(1, "unknown"), ErrInvalidCredentials)
+	left, err = m.RecoveryCodesLeft(1)
+	assert.NilError(t, err)
+	assert.Equal(t, left, 1)
+
+	assert.NilError(t, m.Disable(1))
+	_, err = m.Secret(1)
+	assert.Equal(t, err, ErrNoRecord)
+	assert.Equal(t, m.UseRecoveryCode(1, "second"), ErrInvalidCredentials)
+
+	assert.Equal(t, m.Enable(99, "JBSWY3DPEHPK3PXP", 0, nil), ErrNoRecord)
+}
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type UserSessionModelInterface interface {
+	Insert(id string, userID int, ip, userAgent string) error
+	Get(id string) (*UserSession, error)
+	ByUser(userID int) ([]UserSession, error)
+	Touch(id string) error
+	Delete(userID int, id string) error
+	DeleteAllForUser(userID int) error
+}
+
+// UserSession is a login on one device. Sessions themselves are kept by the session manager, this records who they
+// belong to so users can see where they're logged in and end them. A login whose record is gone has been revoked.
+type UserSession struct {
+	ID        string
+	UserID    int
+	IP        string
+	UserAgent string
+	Created   time.Time
+	LastSeen  time.Time
+}
+
+type UserSessionModel struct {
+	DB *sql.DB
+}
+
+// Longest user agent kept, anything after is cut off.
+const maxUserAgent = 255
+
+const userSessionColumns = `id, user_id, ip, user_agent, created, last_seen`
+
+func scanUserSession(row rowScanner, s *UserSession) error {
+	return row.Scan(&s.ID, &s.UserID, &s.IP, &s.UserAgent, &s.Created, &s.LastSeen)
+}
+
+// Insert records a new login.
+func (m *UserSessionModel) Insert(id string, userID int, ip, userAgent string) error {
+	stmt := `INSERT INTO user_sessions (id, user_id, ip, user_agent, created, last_seen)
+	VALUES (?, ?, ?, ?, UTC_TIMESTAMP(), UTC_TIMESTAMP())`
+
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+	_, err := m.DB.Exec(stmt, id, userID, ip, userAgent)
+	return err
+}
+
+// Get returns a login. Revoked ones return ErrNoRecord.
+func (m *UserSessionModel) Get(id string) (*UserSession, error) {
+	stmt := `SELECT ` + userSessionColumns + ` FROM user_sessions WHERE id = ?`
+
+	s := &UserSession{}
+	err := scanUserSession(m.DB.QueryRow(stmt, id), s)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// ByUser returns a user's logins, most recently seen first.
+func (m *UserSessionModel) ByUser(userID int) ([]UserSession, error) {
+	stmt := `SELECT ` + userSessionColumns + ` FROM user_sessions WHERE user_id = ? ORDER BY last_seen DESC, created DESC`
+
+	rows, err := m.DB.Query(stmt, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []UserSession
+	for rows.Next() {
+		var s UserSession
+		if err = scanUserSession(rows, &s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Touch records that a login was just used.
+func (m *UserSessionModel) Touch(id string) error {
+	_, err := m.DB.Exec(`UPDATE user_sessions SET last_seen = UTC_TIMESTAMP() WHERE id = ?`, id)
+	return err
+}
+
+// Delete revokes one of a user's logins. Other users' logins return ErrNoRecord.
+func (m *UserSessionModel) Delete(userID int, id string) error {
+	stmt := `DELETE FROM user_sessions WHERE id = ? AND user_id = ?`
+
+	result, err := m.DB.Exec(stmt, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// DeleteAllForUser revokes all of a user's logins.
+func (m *UserSessionModel) DeleteAllForUser(userID int) error {
+	_, err := m.DB.Exec(`DELETE FROM user_sessions WHERE user_id = ?`, userID)
+	return err
+}
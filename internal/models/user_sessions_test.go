@@ -0,0 +1,43 @@
+package models
+
+import (
+	"clonebox/internal/assert"
+	"strings"
+	"testing"
+)
+
+func TestUserSessionModel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := UserSessionModel{db}
+
+	assert.NilError(t, m.Insert("session-1", 1, "192.0.2.1", "Laptop browser"))
+	assert.NilError(t, m.Insert("session-2", 1, "2001:db8::1", strings.Repeat("x", 300)))
+
+	s, err := m.Get("session-2")
+	assert.NilError(t, err)
+	assert.Equal(t, s.UserID, 1)
+	assert.Equal(t, s.IP, "2001:db8::1")
+	assert.Equal(t, len(s.UserAgent), maxUserAgent)
+	assert.Equal(t, s.Created.IsZero(), false)
+
+	assert.NilError(t, m.Touch("session-1"))
+
+	sessions, err := m.ByUser(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(sessions), 2)
+
+	// Only the owner can revoke a session
+	assert.Equal(t, m.Delete(2, "session-1"), ErrNoRecord)
+	assert.NilError(t, m.Delete(1, "session-1"))
+	_, err = m.Get("session-1")
+	assert.Equal(t, err, ErrNoRecord)
+
+	assert.NilError(t, m.DeleteAllForUser(1))
+	sessions, err = m.ByUser(1)
+	assert.NilError(t, err)
+	assert.Equal(t, len(sessions), 0)
+}
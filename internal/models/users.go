@@ -1,7 +1,9 @@
 package models
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"github.com/go-sql-driver/mysql"
 	"golang.org/x/crypto/bcrypt"
@@ -10,11 +12,18 @@ import (
 )
 
 type UserModelInterface interface {
-	Insert(name, email, password string) error
+	Insert(name, email, password string) (int, error)
 	Authenticate(email, password string) (int, error)
 	Exists(id int) (bool, error)
 	Get(id int) (*User, error)
+	GetByEmail(email string) (*User, error)
 	PasswordUpdate(id int, currentPassword string, newPassword string) error
+	PasswordReset(id int, newPassword string) error
+	SetVerified(id int) error
+	Provision(name, email string) (int, error)
+	UpdateName(id int, name string) error
+	SetPendingEmail(id int, email string) error
+	ConfirmEmail(id int) error
 }
 
 // User field names and types align with the columns in the database "users" table
@@ -24,6 +33,16 @@ type User struct {
 	Email          string
 	HashedPassword []byte
 	Created        time.Time
+	Admin          bool
+	// Per-user storage quota overrides. nil means the configured default applies.
+	QuotaBytes *int64
+	QuotaFiles *int
+	// Whether the user has followed the link sent to their email address
+	Verified bool
+	// Incremented to end all of the user's sessions, which remember the version they were logged in with
+	SessionVersion int
+	// Address the user asked to change their email to, until they follow the link sent to it. Empty if none.
+	PendingEmail string
 }
 
 // UserModel wraps a database connection pool.
@@ -31,18 +50,18 @@ type UserModel struct {
 	DB *sql.DB
 }
 
-// Insert adds a new record to the "users" table.
-func (m *UserModel) Insert(name, email, password string) error {
+// Insert adds a new, unverified record to the "users" table and returns its ID.
+func (m *UserModel) Insert(name, email, password string) (int, error) {
 	// Create a bcrypt hash of the plaintext password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	stmt := `INSERT INTO users (name, email, hashed_password, created)
 			 VALUES(?, ?, ?, UTC_TIMESTAMP())`
 
-	_, err = m.DB.Exec(stmt, name, email, string(hashedPassword))
+	result, err := m.DB.Exec(stmt, name, email, string(hashedPassword))
 	if err != nil {
 
 		// If this returns an error, errors.As() checks whether the error has the type *mysql.MySQLError. If it does, the
@@ -52,12 +71,34 @@ func (m *UserModel) Insert(name, email, password string) error {
 		var mySqlErr *mysql.MySQLError
 		if errors.As(err, &mySqlErr) {
 			if mySqlErr.Number == 1062 && strings.Contains(mySqlErr.Message, "users_uc_email") {
-				return ErrDuplicateEmail
+				return 0, ErrDuplicateEmail
 			}
 		}
+		return 0, err
 	}
 
-	return nil
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// Provision creates a user who logged in through single sign-on, with an email address the identity provider has
+// verified. They get a random password nobody knows, and can set one through a password reset if they want to log in
+// without the identity provider.
+func (m *UserModel) Provision(name, email string) (int, error) {
+	password := make([]byte, 32)
+	if _, err := rand.Read(password); err != nil {
+		return 0, err
+	}
+	id, err := m.Insert(name, email, hex.EncodeToString(password))
+	if err != nil {
+		return 0, err
+	}
+
+	return id, m.SetVerified(id)
 }
 
 // Authenticate verifies whether a user exists with provided email address and password. This will return the relevant
@@ -101,11 +142,22 @@ func (m *UserModel) Exists(id int) (bool, error) {
 	return exists, err
 }
 
+// userColumns is the column list scanUser expects, in order.
+const userColumns = `ID, name, email, created, admin, quota_bytes, quota_files, verified, session_version, pending_email`
+
+func scanUser(row rowScanner, user *User) error {
+	var pendingEmail sql.NullString
+	err := row.Scan(&user.ID, &user.Name, &user.Email, &user.Created, &user.Admin, &user.QuotaBytes, &user.QuotaFiles,
+		&user.Verified, &user.SessionVersion, &pendingEmail)
+	user.PendingEmail = pendingEmail.String
+	return err
+}
+
 func (m *UserModel) Get(id int) (*User, error) {
 	var user User
 
-	stmt := `SELECT ID, name, email, created FROM users WHERE ID = ?`
-	err := m.DB.QueryRow(stmt, id).Scan(&user.ID, &user.Name, &user.Email, &user.Created)
+	stmt := `SELECT ` + userColumns + ` FROM users WHERE ID = ?`
+	err := scanUser(m.DB.QueryRow(stmt, id), &user)
 	//if errors.Is(err, sql.ErrNoRows) {
 	//	return nil, ErrNoRecord
 	//} else if err != nil {
@@ -126,7 +178,7 @@ func (m *UserModel) Get(id int) (*User, error) {
 func (m *UserModel) PasswordUpdate(id int, currentPassword string, newPassword string) error {
 	// Retrieve user from ID
 	var user User
-	stmt := `SELECT * FROM users WHERE ID = ?`
+	stmt := `SELECT ID, name, email, hashed_password, created FROM users WHERE ID = ?`
 	err := m.DB.QueryRow(stmt, id).Scan(&user.ID, &user.Name, &user.Email, &user.HashedPassword, &user.Created)
 	//if errors.Is(err, sql.ErrNoRows) {
 	//	return ErrNoRecord
@@ -165,3 +217,94 @@ func (m *UserModel) PasswordUpdate(id int, currentPassword string, newPassword s
 
 	return nil
 }
+
+// GetByEmail returns the user with the given email address, or ErrNoRecord.
+func (m *UserModel) GetByEmail(email string) (*User, error) {
+	var user User
+
+	stmt := `SELECT ` + userColumns + ` FROM users WHERE email = ?`
+	err := scanUser(m.DB.QueryRow(stmt, email), &user)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNoRecord
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// PasswordReset sets a new password without knowing the current one, for users who've proven they own the account
+// some other way. All of the user's sessions end.
+func (m *UserModel) PasswordReset(id int, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), 12)
+	if err != nil {
+		return err
+	}
+
+	stmt := `UPDATE users SET hashed_password = ?, session_version = session_version + 1 WHERE ID = ?`
+	result, err := m.DB.Exec(stmt, string(hashedPassword), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+
+	return nil
+}
+
+// SetVerified marks a user's email address as verified.
+func (m *UserModel) SetVerified(id int) error {
+	stmt := `UPDATE users SET verified = TRUE WHERE ID = ?`
+
+	_, err := m.DB.Exec(stmt, id)
+	return err
+}
+
+// UpdateName changes a user's display name.
+func (m *UserModel) UpdateName(id int, name string) error {
+	stmt := `UPDATE users SET name = ? WHERE ID = ?`
+
+	_, err := m.DB.Exec(stmt, name, id)
+	return err
+}
+
+// SetPendingEmail records the address a user wants to change their email to, replacing any earlier one. The change
+// is made by ConfirmEmail once they've shown they can read mail sent to it.
+func (m *UserModel) SetPendingEmail(id int, email string) error {
+	stmt := `UPDATE users SET pending_email = ? WHERE ID = ?`
+
+	_, err := m.DB.Exec(stmt, email, id)
+	return err
+}
+
+// ConfirmEmail changes a user's email to their pending address, which is verified by the confirmation. Users without
+// one return ErrNoRecord, and addresses another user has taken in the meantime ErrDuplicateEmail.
+func (m *UserModel) ConfirmEmail(id int) error {
+	stmt := `UPDATE users SET email = pending_email, pending_email = NULL, verified = TRUE
+	WHERE ID = ? AND pending_email IS NOT NULL`
+
+	result, err := m.DB.Exec(stmt, id)
+	if err != nil {
+		var mySqlErr *mysql.MySQLError
+		if errors.As(err, &mySqlErr) && mySqlErr.Number == 1062 && strings.Contains(mySqlErr.Message, "users_uc_email") {
+			return ErrDuplicateEmail
+		}
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
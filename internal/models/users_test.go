@@ -44,3 +44,109 @@ func TestUserModelExists(t *testing.T) {
 		})
 	}
 }
+
+func TestUserModelInsert(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := UserModel{db}
+
+	id, err := m.Insert("Bob", "bob@example.com", "pa$$word")
+	assert.NilError(t, err)
+	assert.Equal(t, id, 2)
+
+	// New users start out unverified
+	user, err := m.Get(id)
+	assert.NilError(t, err)
+	assert.Equal(t, user.Verified, false)
+
+	assert.NilError(t, m.SetVerified(id))
+	user, err = m.Get(id)
+	assert.NilError(t, err)
+	assert.Equal(t, user.Verified, true)
+
+	_, err = m.Insert("Alice Again", "alice@example.com", "pa$$word")
+	assert.Equal(t, err, ErrDuplicateEmail)
+}
+
+func TestUserModelProvision(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := UserModel{db}
+
+	id, err := m.Provision("Bob", "bob@example.com")
+	assert.NilError(t, err)
+
+	// The identity provider verified the address already
+	user, err := m.Get(id)
+	assert.NilError(t, err)
+	assert.Equal(t, user.Verified, true)
+
+	_, err = m.Provision("Alice Again", "alice@example.com")
+	assert.Equal(t, err, ErrDuplicateEmail)
+}
+
+func TestUserModelPasswordReset(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := UserModel{db}
+
+	user, err := m.GetByEmail("alice@example.com")
+	assert.NilError(t, err)
+	assert.Equal(t, user.ID, 1)
+	assert.Equal(t, user.SessionVersion, 0)
+
+	_, err = m.GetByEmail("nobody@example.com")
+	assert.Equal(t, err, ErrNoRecord)
+
+	assert.NilError(t, m.PasswordReset(1, "n3wPa$$word"))
+
+	// The new password works and the user's sessions are ended
+	id, err := m.Authenticate("alice@example.com", "n3wPa$$word")
+	assert.NilError(t, err)
+	assert.Equal(t, id, 1)
+	user, err = m.Get(1)
+	assert.NilError(t, err)
+	assert.Equal(t, user.SessionVersion, 1)
+
+	assert.Equal(t, m.PasswordReset(99, "n3wPa$$word"), ErrNoRecord)
+}
+
+func TestUserModelChangeEmail(t *testing.T) {
+	if testing.Short() {
+		t.Skip("models: skipping integration test")
+	}
+
+	db := newTestDB(t)
+	m := UserModel{db}
+
+	assert.Equal(t, m.ConfirmEmail(1), ErrNoRecord)
+
+	assert.NilError(t, m.UpdateName(1, "Alice Smith"))
+	assert.NilError(t, m.SetPendingEmail(1, "alice@example.org"))
+	user, err := m.Get(1)
+	assert.NilError(t, err)
+	assert.Equal(t, user.Name, "Alice Smith")
+	assert.Equal(t, user.Email, "alice@example.com")
+	assert.Equal(t, user.PendingEmail, "alice@example.org")
+
+	assert.NilError(t, m.ConfirmEmail(1))
+	user, err = m.GetByEmail("alice@example.org")
+	assert.NilError(t, err)
+	assert.Equal(t, user.ID, 1)
+	assert.Equal(t, user.PendingEmail, "")
+
+	// Another user took the address after it was asked for
+	id, err := m.Insert("Bob", "bob@example.com", "pa$$word")
+	assert.NilError(t, err)
+	assert.NilError(t, m.SetPendingEmail(id, "alice@example.org"))
+	assert.Equal(t, m.ConfirmEmail(id), ErrDuplicateEmail)
+}
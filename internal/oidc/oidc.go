@@ -0,0 +1,475 @@
+// Package oidc implements the relying party side of OpenID Connect (https://openid.net/specs/openid-connect-core-1_0.html)
+// for single sign-on: the authorization code flow with PKCE (RFC 7636), and validation of the ID tokens it returns
+// against the issuer's published keys (JWKS). The issuer's endpoints are found through discovery.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned, wrapped with the reason, for ID tokens that don't validate.
+	ErrInvalidToken = errors.New("oidc: invalid ID token")
+
+	// ErrProvider is returned, wrapped, when the issuer can't be reached or answers with something unusable.
+	ErrProvider = errors.New("oidc: provider error")
+)
+
+const (
+	// leeway allows for clock differences between the issuer and this server when checking token times.
+	leeway = time.Minute
+
+	// jwksRefreshInterval limits how often the keys are fetched again for tokens signed with an unknown key, in
+	// case the issuer rotated them.
+	jwksRefreshInterval = time.Minute
+
+	// maxResponse bounds what's read from the issuer.
+	maxResponse = 1 << 20
+)
+
+// Client is an OpenID Connect client registered with an issuer. It's safe for concurrent use. The issuer's
+// configuration is discovered the first time it's needed, so it doesn't have to be reachable when the client is
+// created.
+type Client struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string   // Empty for public clients, which rely on PKCE alone
+	Scopes       []string // Requested on top of "openid"
+
+	// HTTPClient is used to talk to the issuer, http.DefaultClient with a timeout if nil.
+	HTTPClient *http.Client
+
+	mu          sync.Mutex
+	config      *providerConfig
+	keys        map[string]*jwk
+	keysFetched time.Time
+}
+
+type providerConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+var defaultHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return defaultHTTPClient
+}
+
+// Random values for one login. State ties the callback to the session that started the login, Nonce ties the ID
+// token to it, and Verifier proves to the token endpoint that the code is being redeemed by whoever asked for it.
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewLogin returns fresh random values for a login.
+func NewLogin() (*Login, error) {
+	values := make([]string, 3)
+	for i := range values {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return &Login{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// Challenge returns the S256 PKCE code challenge for the login's verifier.
+func (l *Login) Challenge() string {
+	sum := sha256.Sum256([]byte(l.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the URL at the issuer to send the user to to log in. They come back to redirectURI with the code
+// and state as query parameters.
+func (c *Client) AuthURL(ctx context.Context, redirectURI string, login *Login) (string, error) {
+	config, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", c.ClientID)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("scope", strings.Join(append([]string{"openid"}, c.Scopes...), " "))
+	v.Set("state", login.State)
+	v.Set("nonce", login.Nonce)
+	v.Set("code_challenge", login.Challenge())
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(config.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return config.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// CheckState reports whether the state a callback came back with is the one the login was started with.
+func CheckState(got, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+// Claims are the claims of a validated ID token used to find or create the user.
+type Claims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// Exchange redeems an authorization code at the token endpoint, and returns the claims of the validated ID token.
+func (c *Client) Exchange(ctx context.Context, code, redirectURI string, login *Login) (*Claims, error) {
+	config, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("code_verifier", login.Verifier)
+	if c.ClientSecret == "" {
+		form.Set("client_id", c.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+
+	var resp struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := c.doJSON(req, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || resp.IDToken == "" {
+		if resp.Error != "" {
+			return nil, fmt.Errorf("%w: token endpoint: %s %s", ErrProvider, resp.Error, resp.ErrorDescription)
+		}
+		return nil, fmt.Errorf("%w: token endpoint returned %d without an ID token", ErrProvider, status)
+	}
+
+	return c.Verify(ctx, resp.IDToken, login.Nonce)
+}
+
+// Verify validates an ID token issued to this client for a login with nonce, and returns its claims.
+func (c *Client) Verify(ctx context.Context, rawToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if !key.verify(header.Alg, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims struct {
+		Claims
+		Audience  audience `json:"aud"`
+		AZP       string   `json:"azp"`
+		Nonce     string   `json:"nonce"`
+		Expiry    int64    `json:"exp"`
+		IssuedAt  int64    `json:"iat"`
+		NotBefore int64    `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	config, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != config.Issuer:
+		return nil, fmt.Errorf("%w: issuer %q", ErrInvalidToken, claims.Issuer)
+	case !slices.Contains(claims.Audience, c.ClientID):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrInvalidToken)
+	case len(claims.Audience) > 1 && claims.AZP != c.ClientID:
+		return nil, fmt.Errorf("%w: authorized party %q", ErrInvalidToken, claims.AZP)
+	case nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	case claims.Expiry == 0 || now.After(time.Unix(claims.Expiry, 0).Add(leeway)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.IssuedAt == 0 || now.Before(time.Unix(claims.IssuedAt, 0).Add(-leeway)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-leeway)):
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return &claims.Claims, nil
+}
+
+// audience is the aud claim, which is either a string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidToken, err)
+	}
+	return nil
+}
+
+// discover fetches the issuer's configuration, once.
+func (c *Client) discover(ctx context.Context) (*providerConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config != nil {
+		return c.config, nil
+	}
+
+	wellKnown := strings.TrimSuffix(c.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	var config providerConfig
+	status, err := c.doJSON(req, &config)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery returned %d", ErrProvider, status)
+	}
+
+	// The issuer has to match what was configured, so another issuer's configuration can't be substituted
+	if config.Issuer != c.Issuer {
+		return nil, fmt.Errorf("%w: discovered issuer %q doesn't match %q", ErrProvider, config.Issuer, c.Issuer)
+	}
+	if config.AuthorizationEndpoint == "" || config.TokenEndpoint == "" || config.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete discovery document", ErrProvider)
+	}
+
+	c.config = &config
+	return c.config, nil
+}
+
+// key returns the issuer's signing key with ID kid, fetching the key set if it isn't known.
+func (c *Client) key(ctx context.Context, kid string) (*jwk, error) {
+	config, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if k := c.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	if time.Since(c.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	status, err := c.doJSON(req, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: key set returned %d", ErrProvider, status)
+	}
+
+	c.keys = make(map[string]*jwk)
+	for _, raw := range set.Keys {
+		// Keys of unsupported types, and encryption keys, are skipped rather than failing the whole set
+		if k, err := parseJWK(raw); err == nil {
+			c.keys[k.kid] = k
+		}
+	}
+	c.keysFetched = time.Now()
+
+	if k := c.lookupKey(kid); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// lookupKey finds a cached key. Tokens without a key ID are accepted if the issuer has a single key. Called with mu
+// held.
+func (c *Client) lookupKey(kid string) *jwk {
+	if kid == "" && len(c.keys) == 1 {
+		for _, k := range c.keys {
+			return k
+		}
+	}
+	return c.keys[kid]
+}
+
+// doJSON sends a request to the issuer and decodes the JSON response into v, whatever the status.
+func (c *Client) doJSON(req *http.Request, v any) (int, error) {
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrProvider, err)
+	}
+	if err = json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("%w: %s", ErrProvider, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// jwk is a signing key from the issuer's key set (RFC 7517).
+type jwk struct {
+	kid string
+	alg string // Empty if the key doesn't restrict it
+	pub crypto.PublicKey
+}
+
+func parseJWK(raw []byte) (*jwk, error) {
+	var k struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		Use string `json:"use"`
+		Alg string `json:"alg"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return nil, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return nil, errors.New("oidc: not a signing key")
+	}
+
+	b := func(s string) []byte {
+		data, _ := base64.RawURLEncoding.DecodeString(s)
+		return data
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, e := b(k.N), b(k.E)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("oidc: bad RSA key")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return &jwk{kid: k.Kid, alg: k.Alg, pub: pub}, nil
+	case "EC":
+		x, y := b(k.X), b(k.Y)
+		if k.Crv != "P-256" || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("oidc: unsupported EC key")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+		return &jwk{kid: k.Kid, alg: k.Alg, pub: pub}, nil
+	default:
+		return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+	}
+}
+
+// verify checks a JWS signature made with alg. Only RS256 and ES256 are accepted, never "none", and the algorithm has
+// to fit the key, so a token can't pick a weaker one.
+func (k *jwk) verify(alg string, signed, sig []byte) bool {
+	if k.alg != "" && k.alg != alg {
+		return false
+	}
+	digest := sha256.Sum256(signed)
+
+	switch pub := k.pub.(type) {
+	case *rsa.PublicKey:
+		return alg == "RS256" && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS ECDSA signatures are r and s concatenated, not ASN.1
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest[:], r, s)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,192 @@
+package oidc
+
+import (
+	"clonebox/internal/assert"
+	"clonebox/internal/oidc/oidctest"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testUser = oidctest.User{Subject: "1234", Email: "alice@example.com", EmailVerified: true, Name: "Alice Jones"}
+
+// authorize follows AuthURL to the issuer and returns the query of the redirect back.
+func authorize(t *testing.T, c *Client, login *Login) url.Values {
+	t.Helper()
+	authURL, err := c.AuthURL(context.Background(), "https://app.example/callback", login)
+	assert.NilError(t, err)
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusFound)
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	assert.NilError(t, err)
+	assert.Equal(t, location.Host, "app.example")
+	return location.Query()
+}
+
+func TestCodeFlow(t *testing.T) {
+	for _, secret := range []string{"secret", ""} {
+		t.Run("Secret "+secret, func(t *testing.T) {
+			iss := oidctest.NewIssuer("clonebox", secret)
+			defer iss.Close()
+			iss.LogIn(&testUser)
+
+			c := &Client{Issuer: iss.URL, ClientID: "clonebox", ClientSecret: secret, Scopes: []string{"email", "profile"}}
+			login, err := NewLogin()
+			assert.NilError(t, err)
+
+			q := authorize(t, c, login)
+			assert.Equal(t, CheckState(q.Get("state"), login.State), true)
+
+			claims, err := c.Exchange(context.Background(), q.Get("code"), "https://app.example/callback", login)
+			assert.NilError(t, err)
+			assert.Equal(t, *claims, Claims{
+				Issuer: iss.URL, Subject: "1234", Email: "alice@example.com", EmailVerified: true, Name: "Alice Jones",
+			})
+
+			// Codes are single use
+			_, err = c.Exchange(context.Background(), q.Get("code"), "https://app.example/callback", login)
+			if !errors.Is(err, ErrProvider) {
+				t.Errorf("got %v; want ErrProvider", err)
+			}
+		})
+	}
+}
+
+func TestCodeFlowWrongVerifier(t *testing.T) {
+	iss := oidctest.NewIssuer("clonebox", "secret")
+	defer iss.Close()
+	iss.LogIn(&testUser)
+
+	c := &Client{Issuer: iss.URL, ClientID: "clonebox", ClientSecret: "secret"}
+	login, err := NewLogin()
+	assert.NilError(t, err)
+	q := authorize(t, c, login)
+
+	// An intercepted code is useless without the verifier
+	stolen := *login
+	stolen.Verifier = "attacker"
+	_, err = c.Exchange(context.Background(), q.Get("code"), "https://app.example/callback", &stolen)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("got %v; want invalid_grant", err)
+	}
+}
+
+func TestCodeFlowDenied(t *testing.T) {
+	iss := oidctest.NewIssuer("clonebox", "secret")
+	defer iss.Close()
+
+	c := &Client{Issuer: iss.URL, ClientID: "clonebox", ClientSecret: "secret"}
+	login, err := NewLogin()
+	assert.NilError(t, err)
+
+	q := authorize(t, c, login)
+	assert.Equal(t, q.Get("error"), "access_denied")
+	assert.Equal(t, q.Get("code"), "")
+}
+
+func TestCheckState(t *testing.T) {
+	assert.Equal(t, CheckState("abc", "abc"), true)
+	assert.Equal(t, CheckState("abd", "abc"), false)
+	assert.Equal(t, CheckState("", ""), false)
+}
+
+func TestVerify(t *testing.T) {
+	iss := oidctest.NewIssuer("clonebox", "secret")
+	defer iss.Close()
+	c := &Client{Issuer: iss.URL, ClientID: "clonebox", ClientSecret: "secret"}
+
+	claims := func(change func(map[string]any)) string {
+		c := iss.Claims(testUser, "nonce")
+		change(c)
+		return iss.IDToken(c)
+	}
+	hour := time.Hour
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "Wrong nonce", token: claims(func(c map[string]any) { c["nonce"] = "other" })},
+		{name: "No nonce", token: claims(func(c map[string]any) { delete(c, "nonce") })},
+		{name: "Expired", token: claims(func(c map[string]any) { c["exp"] = time.Now().Add(-hour).Unix() })},
+		{name: "No expiry", token: claims(func(c map[string]any) { delete(c, "exp") })},
+		{name: "Issued in the future", token: claims(func(c map[string]any) { c["iat"] = time.Now().Add(hour).Unix() })},
+		{name: "Other issuer", token: claims(func(c map[string]any) { c["iss"] = "https://evil.example" })},
+		{name: "Other audience", token: claims(func(c map[string]any) { c["aud"] = "other" })},
+		{name: "Shared audience", token: claims(func(c map[string]any) { c["aud"] = []string{"clonebox", "other"} })},
+		{name: "No subject", token: claims(func(c map[string]any) { c["sub"] = "" })},
+		{name: "Malformed", token: "not.a-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.Verify(context.Background(), tt.token, "nonce")
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got %v; want ErrInvalidToken", err)
+			}
+		})
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		got, err := c.Verify(context.Background(), claims(func(map[string]any) {}), "nonce")
+		assert.NilError(t, err)
+		assert.Equal(t, got.Subject, "1234")
+
+		// With several audiences, the token has to say which one it was for
+		got, err = c.Verify(context.Background(), claims(func(c map[string]any) {
+			c["aud"] = []string{"other", "clonebox"}
+			c["azp"] = "clonebox"
+		}), "nonce")
+		assert.NilError(t, err)
+		assert.Equal(t, got.Subject, "1234")
+	})
+
+	t.Run("Tampered", func(t *testing.T) {
+		parts := strings.Split(claims(func(map[string]any) {}), ".")
+		payload := iss.Claims(testUser, "nonce")
+		payload["sub"] = "admin"
+		forged := strings.Split(iss.IDToken(payload), ".")[1]
+
+		_, err := c.Verify(context.Background(), parts[0]+"."+forged+"."+parts[2], "nonce")
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("got %v; want ErrInvalidToken", err)
+		}
+	})
+
+	t.Run("Unsigned", func(t *testing.T) {
+		parts := strings.Split(claims(func(map[string]any) {}), ".")
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test-key"}`))
+
+		_, err := c.Verify(context.Background(), header+"."+parts[1]+".", "nonce")
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("got %v; want ErrInvalidToken", err)
+		}
+	})
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	iss := oidctest.NewIssuer("clonebox", "secret")
+	defer iss.Close()
+
+	c := &Client{Issuer: iss.URL + "/", ClientID: "clonebox"}
+	_, err := c.AuthURL(context.Background(), "https://app.example/callback", &Login{})
+	if !errors.Is(err, ErrProvider) {
+		t.Errorf("got %v; want ErrProvider", err)
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	// RFC 7636, appendix B
+	login := &Login{Verifier: "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"}
+	assert.Equal(t, login.Challenge(), "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM")
+}
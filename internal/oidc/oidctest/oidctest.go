@@ -0,0 +1,230 @@
+// Package oidctest runs a local OpenID Connect issuer, to test single sign-on without a real identity provider. It
+// serves discovery, a key set, an authorization endpoint which logs in a preset user without asking, and a token
+// endpoint which checks PKCE.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// KeyID is the key ID in the headers of the tokens the issuer signs.
+const KeyID = "test-key"
+
+// User is who the issuer logs in.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type grant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	user        User
+}
+
+// Issuer is a running mock issuer. Its URL is the issuer identifier.
+type Issuer struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	user   *User
+	grants map[string]*grant
+}
+
+// NewIssuer starts an issuer with a client registered. Call Close when done with it.
+func NewIssuer(clientID, clientSecret string) *Issuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	iss := &Issuer{ClientID: clientID, ClientSecret: clientSecret, key: key, grants: make(map[string]*grant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", iss.discovery)
+	mux.HandleFunc("GET /jwks", iss.jwks)
+	mux.HandleFunc("GET /authorize", iss.authorize)
+	mux.HandleFunc("POST /token", iss.token)
+	iss.Server = httptest.NewServer(mux)
+	return iss
+}
+
+// LogIn sets the user the authorization endpoint logs in from now on. With nil, it denies access instead.
+func (iss *Issuer) LogIn(user *User) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.user = user
+}
+
+// IDToken signs a token with claims, which are used as they are, for testing how clients validate tokens.
+func (iss *Issuer) IDToken(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": KeyID})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, iss.key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "." + encode(sig)
+}
+
+// Claims returns the usual claims of an ID token for user, issued now to the client.
+func (iss *Issuer) Claims(user User, nonce string) map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":            iss.URL,
+		"sub":            user.Subject,
+		"aud":            iss.ClientID,
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"name":           user.Name,
+	}
+}
+
+func (iss *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                                iss.URL,
+		"authorization_endpoint":                iss.URL + "/authorize",
+		"token_endpoint":                        iss.URL + "/token",
+		"jwks_uri":                              iss.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (iss *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := iss.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": KeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   encode(pub.N.Bytes()),
+			"e":   encode(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (iss *Issuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != iss.ClientID {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+
+	callback := redirectURI.Query()
+	callback.Set("state", q.Get("state"))
+
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	switch {
+	case q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		callback.Set("error", "invalid_request")
+	case iss.user == nil:
+		callback.Set("error", "access_denied")
+	default:
+		code := make([]byte, 16)
+		rand.Read(code)
+		iss.grants[encode(code)] = &grant{
+			clientID:    iss.ClientID,
+			redirectURI: q.Get("redirect_uri"),
+			challenge:   q.Get("code_challenge"),
+			nonce:       q.Get("nonce"),
+			user:        *iss.user,
+		}
+		callback.Set("code", encode(code))
+	}
+
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (iss *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != iss.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(iss.ClientSecret)) != 1 {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	iss.mu.Lock()
+	g := iss.grants[r.PostForm.Get("code")]
+	// Codes can be redeemed once, even if the attempt fails
+	delete(iss.grants, r.PostForm.Get("code"))
+	iss.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case r.PostForm.Get("grant_type") != "authorization_code":
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+	case g == nil || g.redirectURI != r.PostForm.Get("redirect_uri") || encode(verifier[:]) != g.challenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+			"id_token":     iss.IDToken(iss.Claims(g.user, g.nonce)),
+		})
+	}
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	writeJSON(w, status, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
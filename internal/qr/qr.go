@@ -0,0 +1,589 @@
+// Package qr encodes QR codes (ISO/IEC 18004) and renders them as PNG or SVG. Only byte mode is implemented, which is
+// all URLs need.
+package qr
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// Level is the error correction level. Higher levels survive more damage but hold less data.
+type Level int
+
+const (
+	L Level = iota // Recovers ~7% of codewords
+	M              // ~15%
+	Q              // ~25%
+	H              // ~30%
+)
+
+// formatBits are the level's two bit value in the format information, which isn't in L, M, Q, H order.
+func (l Level) formatBits() int {
+	return [...]int{1, 0, 3, 2}[l]
+}
+
+const (
+	minVersion = 1
+	maxVersion = 40
+)
+
+// ErrTooLong is returned when the data doesn't fit in the largest QR code at the requested level.
+var ErrTooLong = errors.New("qr: data too long")
+
+// Code is an encoded QR code.
+type Code struct {
+	Version int
+	Level   Level
+	Mask    int
+	// Size is the width and height in modules.
+	Size int
+
+	modules    [][]bool // [y][x], true is dark
+	isFunction [][]bool // Modules that are part of the fixed patterns rather than data
+}
+
+// Dark reports whether the module at column x, row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Encode encodes data in byte mode, in the smallest version that fits at the given level.
+func Encode(data []byte, level Level) (*Code, error) {
+	if level < L || level > H {
+		return nil, fmt.Errorf("qr: invalid level %d", level)
+	}
+
+	version := 0
+	for v := minVersion; v <= maxVersion; v++ {
+		if 4+charCountBits(v)+len(data)*8 <= numDataCodewords(v, level)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	// Mode indicator, character count, the data itself
+	var bb bitBuffer
+	bb.append(0b0100, 4)
+	bb.append(len(data), charCountBits(version))
+	for _, b := range data {
+		bb.append(int(b), 8)
+	}
+
+	// Terminator, padding to a whole byte, then alternating pad bytes up to capacity
+	capacity := numDataCodewords(version, level) * 8
+	bb.append(0, min(4, capacity-len(bb)))
+	bb.append(0, (8-len(bb)%8)%8)
+	for pad := 0xEC; len(bb) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.append(pad, 8)
+	}
+
+	codewords := make([]byte, len(bb)/8)
+	for i, bit := range bb {
+		if bit {
+			codewords[i>>3] |= 1 << (7 - i&7)
+		}
+	}
+
+	c := newCode(version, level)
+	c.drawCodewords(addECCAndInterleave(codewords, version, level))
+
+	// Pick the mask with the lowest penalty, as the spec requires
+	bestMask, bestPenalty := 0, -1
+	for mask := range 8 {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if penalty := c.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		c.applyMask(mask) // XOR undoes it
+	}
+
+	c.Mask = bestMask
+	c.applyMask(bestMask)
+	c.drawFormatBits(bestMask)
+
+	return c, nil
+}
+
+// EncodeString is Encode for strings.
+func EncodeString(s string, level Level) (*Code, error) {
+	return Encode([]byte(s), level)
+}
+
+type bitBuffer []bool
+
+// append adds the low n bits of v, most significant first.
+func (bb *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*bb = append(*bb, (v>>i)&1 != 0)
+	}
+}
+
+// charCountBits is the width of the byte mode character count field.
+func charCountBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// eccCodewordsPerBlock and numECCBlocks are the error correction tables of the spec, indexed by [level][version].
+var eccCodewordsPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+var numECCBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// numRawDataModules is the number of modules available for data and error correction codewords in a version, i.e.
+// everything except the function patterns and format/version information.
+func numRawDataModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		n -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// numDataCodewords is the number of 8 bit data codewords a version holds at a level.
+func numDataCodewords(version int, level Level) int {
+	return numRawDataModules(version)/8 - eccCodewordsPerBlock[level][version]*numECCBlocks[level][version]
+}
+
+// addECCAndInterleave splits the data into blocks, appends Reed-Solomon error correction to each, and interleaves
+// the blocks codeword by codeword.
+func addECCAndInterleave(data []byte, version int, level Level) []byte {
+	numBlocks := numECCBlocks[level][version]
+	blockECCLen := eccCodewordsPerBlock[level][version]
+	rawCodewords := numRawDataModules(version) / 8
+	numShortBlocks := numBlocks - rawCodewords%numBlocks
+	shortBlockLen := rawCodewords / numBlocks
+
+	divisor := rsDivisor(blockECCLen)
+	blocks := make([][]byte, numBlocks)
+	for i, k := 0, 0; i < numBlocks; i++ {
+		datLen := shortBlockLen - blockECCLen
+		if i >= numShortBlocks {
+			datLen++
+		}
+
+		block := append([]byte{}, data[k:k+datLen]...)
+		k += datLen
+		ecc := rsRemainder(block, divisor)
+		if i < numShortBlocks {
+			block = append(block, 0) // Placeholder so all blocks line up, skipped when interleaving
+		}
+		blocks[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := range blocks[0] {
+		for j, block := range blocks {
+			if i != shortBlockLen-blockECCLen || j >= numShortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+
+	return result
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree, highest coefficient first with the
+// leading 1 left out.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+
+	root := byte(1)
+	for range degree {
+		for j := range result {
+			result[j] = gfMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMul(root, 0x02)
+	}
+
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= gfMul(d, factor)
+		}
+	}
+	return result
+}
+
+// gfMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// newCode returns a code of the given version with all function patterns drawn.
+func newCode(version int, level Level) *Code {
+	size := version*4 + 17
+	c := &Code{Version: version, Level: level, Size: size}
+	c.modules = make([][]bool, size)
+	c.isFunction = make([][]bool, size)
+	for i := range size {
+		c.modules[i] = make([]bool, size)
+		c.isFunction[i] = make([]bool, size)
+	}
+
+	// Timing patterns
+	for i := range size {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns (with their separators) in three corners
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	// Alignment patterns, except where they'd overlap the finders
+	positions := alignmentPositions(version)
+	n := len(positions)
+	for i := range n {
+		for j := range n {
+			if i == 0 && j == 0 || i == 0 && j == n-1 || i == n-1 && j == 0 {
+				continue
+			}
+			c.drawAlignment(positions[i], positions[j])
+		}
+	}
+
+	// Reserve the format information areas, drawn for real once the mask is known
+	c.drawFormatBits(0)
+	c.drawVersion()
+
+	return c
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.isFunction[y][x] = true
+}
+
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the row/column coordinates of the alignment pattern centres.
+func alignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+
+	numAlign := version/7 + 2
+	step := (version*8 + numAlign*3 + 5) / (numAlign*4 - 4) * 2
+	result := make([]int, numAlign)
+	result[0] = 6
+	for i, pos := numAlign-1, version*4+17-7; i >= 1; i, pos = i-1, pos-step {
+		result[i] = pos
+	}
+	return result
+}
+
+// formatBits returns the 15 bit BCH coded, masked format information for a level and mask.
+func formatBits(level Level, mask int) int {
+	data := level.formatBits()<<3 | mask
+	rem := data
+	for range 10 {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// versionBits returns the 18 bit BCH coded version information, only present from version 7.
+func versionBits(version int) int {
+	rem := version
+	for range 12 {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func (c *Code) drawFormatBits(mask int) {
+	bits := formatBits(c.Level, mask)
+	bit := func(i int) bool { return (bits>>i)&1 != 0 }
+
+	// Next to the top left finder
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	// Split between the top right and bottom left finders
+	for i := range 8 {
+		c.setFunction(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(i))
+	}
+	c.setFunction(8, c.Size-8, true) // Always dark
+}
+
+func (c *Code) drawVersion() {
+	if c.Version < 7 {
+		return
+	}
+
+	bits := versionBits(c.Version)
+	for i := range 18 {
+		dark := (bits>>i)&1 != 0
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, dark)
+		c.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the two module wide zigzag columns, right to left, skipping function
+// modules.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip the vertical timing pattern
+		}
+		for vert := range c.Size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert // Upwards
+				}
+				if !c.isFunction[y][x] && i < len(data)*8 {
+					c.modules[y][x] = (data[i>>3]>>(7-i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// masked reports whether a mask inverts the module at x, y.
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := range c.Size {
+		for x := range c.Size {
+			if !c.isFunction[y][x] && masked(mask, x, y) {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// Penalty weights of the mask evaluation rules.
+const (
+	penaltyN1 = 3
+	penaltyN2 = 3
+	penaltyN3 = 40
+	penaltyN4 = 10
+)
+
+// finderLike is the 1:1:3:1:1 dark/light ratio of a finder pattern, with four light modules on one side.
+var finderLike = []bool{true, false, true, true, true, false, true, false, false, false, false}
+
+// penalty scores the current modules; masks with lower scores are easier to read.
+func (c *Code) penalty() int {
+	result := 0
+	size := c.Size
+
+	line := make([]bool, size)
+	for _, vertical := range []bool{false, true} {
+		for a := range size {
+			for b := range size {
+				if vertical {
+					line[b] = c.modules[b][a]
+				} else {
+					line[b] = c.modules[a][b]
+				}
+			}
+
+			// Runs of five or more modules of the same colour
+			run := 1
+			for i := 1; i <= size; i++ {
+				if i < size && line[i] == line[i-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					result += penaltyN1 + run - 5
+				}
+				run = 1
+			}
+
+			// Patterns that look like finders
+			for i := 0; i+len(finderLike) <= size; i++ {
+				if matches(line[i:], finderLike, false) || matches(line[i:], finderLike, true) {
+					result += penaltyN3
+				}
+			}
+		}
+	}
+
+	// 2x2 blocks of the same colour
+	dark := 0
+	for y := range size {
+		for x := range size {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size {
+				m := c.modules[y][x]
+				if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+					result += penaltyN2
+				}
+			}
+		}
+	}
+
+	// Balance of dark and light modules, in steps of 5% away from half
+	total := size * size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	result += k * penaltyN4
+
+	return result
+}
+
+// matches reports whether line starts with pattern, or its reverse.
+func matches(line, pattern []bool, reverse bool) bool {
+	for i, want := range pattern {
+		if reverse {
+			want = pattern[len(pattern)-1-i]
+		}
+		if line[i] != want {
+			return false
+		}
+	}
+	return true
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// QuietZone is the light border around the code the spec asks for, in modules.
+const QuietZone = 4
+
+// Image returns the code as a grayscale image with each module scale pixels wide, including the quiet zone.
+func (c *Code) Image(scale int) image.Image {
+	scale = max(scale, 1)
+	width := (c.Size + 2*QuietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, width, width))
+
+	for y := range width {
+		for x := range width {
+			mx, my := x/scale-QuietZone, y/scale-QuietZone
+			v := color.Gray{Y: 0xFF}
+			if mx >= 0 && mx < c.Size && my >= 0 && my < c.Size && c.modules[my][mx] {
+				v = color.Gray{Y: 0x00}
+			}
+			img.SetGray(x, y, v)
+		}
+	}
+
+	return img
+}
+
+// PNG writes the code as a PNG with each module scale pixels wide.
+func (c *Code) PNG(w io.Writer, scale int) error {
+	return png.Encode(w, c.Image(scale))
+}
+
+// SVG writes the code as an SVG image, one unit per module. The dark modules are drawn as a single path.
+func (c *Code) SVG(w io.Writer) error {
+	width := c.Size + 2*QuietZone
+
+	var path strings.Builder
+	for y := range c.Size {
+		for x := range c.Size {
+			if c.modules[y][x] {
+				fmt.Fprintf(&path, "M%d,%dh1v1h-1z", x+QuietZone, y+QuietZone)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#FFFFFF"/><path d="%s" fill="#000000"/></svg>`+"\n",
+		width, width, path.String())
+	return err
+}
@@ -0,0 +1,275 @@
+package qr
+
+import (
+	"bytes"
+	"clonebox/internal/assert"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestRSRemainder(t *testing.T) {
+	// Version 1-M "01234567" from the worked example in the spec
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+
+	assert.Equal(t, bytes.Equal(rsRemainder(data, rsDivisor(10)), want), true)
+}
+
+func TestFormatBits(t *testing.T) {
+	tests := []struct {
+		level Level
+		mask  int
+		want  int
+	}{
+		{level: L, mask: 0, want: 0b111011111000100},
+		{level: M, mask: 0, want: 0b101010000010010},
+		{level: M, mask: 5, want: 0b100000011001110},
+		{level: Q, mask: 7, want: 0b010101111101101},
+		{level: H, mask: 3, want: 0b001100111010000},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, formatBits(tt.level, tt.mask), tt.want)
+	}
+}
+
+func TestVersionBits(t *testing.T) {
+	assert.Equal(t, versionBits(7), 0b000111110010010100)
+	assert.Equal(t, versionBits(40), 0b101000110001101001)
+}
+
+func TestCapacity(t *testing.T) {
+	// Total codewords and byte mode capacity per the spec's tables
+	assert.Equal(t, numRawDataModules(1)/8, 26)
+	assert.Equal(t, numRawDataModules(40)/8, 3706)
+	assert.Equal(t, numDataCodewords(1, M), 16)
+	assert.Equal(t, numDataCodewords(10, M), 216)
+	assert.Equal(t, numDataCodewords(40, L), 2956)
+
+	c, err := Encode(bytes.Repeat([]byte("a"), 14), M)
+	assert.NilError(t, err)
+	assert.Equal(t, c.Version, 1)
+
+	c, err = Encode(bytes.Repeat([]byte("a"), 15), M)
+	assert.NilError(t, err)
+	assert.Equal(t, c.Version, 2)
+
+	c, err = Encode(bytes.Repeat([]byte("a"), 2953), L)
+	assert.NilError(t, err)
+	assert.Equal(t, c.Version, 40)
+
+	_, err = Encode(bytes.Repeat([]byte("a"), 2954), L)
+	assert.Equal(t, err, ErrTooLong)
+}
+
+func TestAlignmentPositions(t *testing.T) {
+	assert.Equal(t, len(alignmentPositions(1)), 0)
+	assert.Equal(t, slicesEqual(alignmentPositions(2), []int{6, 18}), true)
+	assert.Equal(t, slicesEqual(alignmentPositions(7), []int{6, 22, 38}), true)
+	assert.Equal(t, slicesEqual(alignmentPositions(32), []int{6, 34, 60, 86, 112, 138}), true)
+	assert.Equal(t, slicesEqual(alignmentPositions(40), []int{6, 30, 58, 86, 114, 142, 170}), true)
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		level Level
+	}{
+		{name: "Version 1", data: "hello", level: M},
+		{name: "Short link", data: "https://clonebox.example.com/shorten/abc123", level: M},
+		{name: "Multiple blocks", data: strings.Repeat("0123456789", 10), level: Q},
+		{name: "Version information", data: strings.Repeat("clonebox ", 30), level: H},
+		{name: "Version 40", data: strings.Repeat("x", 2000), level: L},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Encode([]byte(tt.data), tt.level)
+			assert.NilError(t, err)
+			assert.Equal(t, c.Size, c.Version*4+17)
+
+			// Format information must decode to the level and mask in both copies
+			assert.Equal(t, readFormatBits(c, true), formatBits(tt.level, c.Mask))
+			assert.Equal(t, readFormatBits(c, false), formatBits(tt.level, c.Mask))
+
+			// Finder pattern centres are dark, separators light
+			for _, p := range [][2]int{{3, 3}, {c.Size - 4, 3}, {3, c.Size - 4}} {
+				assert.Equal(t, c.Dark(p[0], p[1]), true)
+			}
+			assert.Equal(t, c.Dark(7, 7), false)
+
+			codewords := readCodewords(c)
+			data := deinterleave(t, codewords, c.Version, tt.level)
+			assert.Equal(t, decodeBytes(data, c.Version), tt.data)
+		})
+	}
+}
+
+func TestPNG(t *testing.T) {
+	c, err := EncodeString("https://example.com", M)
+	assert.NilError(t, err)
+
+	var buf bytes.Buffer
+	assert.NilError(t, c.PNG(&buf, 4))
+
+	img, err := png.Decode(&buf)
+	assert.NilError(t, err)
+	assert.Equal(t, img.Bounds().Dx(), (c.Size+2*QuietZone)*4)
+
+	// Quiet zone is light, the top left finder's corner dark
+	r, _, _, _ := img.At(0, 0).RGBA()
+	assert.Equal(t, r, uint32(0xFFFF))
+	r, _, _, _ = img.At(QuietZone*4, QuietZone*4).RGBA()
+	assert.Equal(t, r, uint32(0))
+}
+
+func TestSVG(t *testing.T) {
+	c, err := EncodeString("https://example.com", M)
+	assert.NilError(t, err)
+
+	var buf bytes.Buffer
+	assert.NilError(t, c.SVG(&buf))
+
+	svg := buf.String()
+	assert.StringContains(t, svg, `viewBox="0 0 33 33"`)
+	assert.StringContains(t, svg, "M4,4h1v1h-1z")
+}
+
+func slicesEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// readFormatBits reads the format information next to the top left finder, or the copy split between the other two.
+func readFormatBits(c *Code, topLeft bool) int {
+	bits := 0
+	set := func(i, x, y int) {
+		if c.Dark(x, y) {
+			bits |= 1 << i
+		}
+	}
+
+	if topLeft {
+		for i := 0; i <= 5; i++ {
+			set(i, 8, i)
+		}
+		set(6, 8, 7)
+		set(7, 8, 8)
+		set(8, 7, 8)
+		for i := 9; i < 15; i++ {
+			set(i, 14-i, 8)
+		}
+	} else {
+		for i := range 8 {
+			set(i, c.Size-1-i, 8)
+		}
+		for i := 8; i < 15; i++ {
+			set(i, 8, c.Size-15+i)
+		}
+	}
+
+	return bits
+}
+
+// readCodewords reads the zigzag placement back, removing the mask, the way a decoder would.
+func readCodewords(c *Code) []byte {
+	var result []byte
+	var cur byte
+	n := 0
+
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := range c.Size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.Size - 1 - vert
+				}
+				if c.isFunction[y][x] {
+					continue
+				}
+				cur <<= 1
+				if c.Dark(x, y) != masked(c.Mask, x, y) {
+					cur |= 1
+				}
+				if n++; n%8 == 0 {
+					result = append(result, cur)
+					cur = 0
+				}
+			}
+		}
+	}
+
+	return result
+}
+
+// deinterleave splits the codewords back into blocks, checks each block's error correction and returns the data
+// codewords.
+func deinterleave(t *testing.T, codewords []byte, version int, level Level) []byte {
+	t.Helper()
+
+	numBlocks := numECCBlocks[level][version]
+	eccLen := eccCodewordsPerBlock[level][version]
+	raw := numRawDataModules(version) / 8
+	numShort := numBlocks - raw%numBlocks
+	shortLen := raw / numBlocks
+
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := range shortLen + 1 {
+		for j := range blocks {
+			if i == shortLen-eccLen && j < numShort {
+				continue
+			}
+			blocks[j] = append(blocks[j], codewords[k])
+			k++
+		}
+	}
+
+	var data []byte
+	divisor := rsDivisor(eccLen)
+	for _, block := range blocks {
+		dat, ecc := block[:len(block)-eccLen], block[len(block)-eccLen:]
+		assert.Equal(t, bytes.Equal(rsRemainder(dat, divisor), ecc), true)
+		data = append(data, dat...)
+	}
+
+	return data
+}
+
+// decodeBytes parses a byte mode segment.
+func decodeBytes(data []byte, version int) string {
+	bit := func(i int) int { return int(data[i>>3]>>(7-i&7)) & 1 }
+	read := func(pos *int, n int) int {
+		v := 0
+		for range n {
+			v = v<<1 | bit(*pos)
+			*pos++
+		}
+		return v
+	}
+
+	pos := 0
+	if read(&pos, 4) != 0b0100 {
+		return ""
+	}
+	length := read(&pos, charCountBits(version))
+
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = byte(read(&pos, 8))
+	}
+	return string(out)
+}
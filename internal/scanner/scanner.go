@@ -0,0 +1,126 @@
+// Package scanner checks uploads for malware before they're stored, through ClamAV's clamd daemon or not at all.
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Result is the verdict of a scan. Signature names what was found when Clean is false.
+type Result struct {
+	Clean     bool
+	Signature string
+}
+
+// Scanner inspects uploaded content before it's committed. Implementations return an error only when they couldn't
+// reach a verdict, a detection is reported through Result.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (Result, error)
+}
+
+// Nop is used when no scanner is configured. It never inspects anything, so Enabled lets callers record uploads as
+// unscanned rather than clean.
+type Nop struct{}
+
+func (Nop) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	return Result{Clean: true}, nil
+}
+
+// Enabled reports whether s actually inspects content.
+func Enabled(s Scanner) bool {
+	if s == nil {
+		return false
+	}
+	_, nop := s.(Nop)
+	return !nop
+}
+
+// chunkSize is how much of the stream is sent to clamd per INSTREAM chunk.
+const chunkSize = 64 << 10
+
+// ClamAV scans content with a clamd daemon over TCP using the INSTREAM command.
+type ClamAV struct {
+	Addr    string
+	Timeout time.Duration
+}
+
+// Scan streams r to clamd and parses its reply. clamd replies with "stream: OK" for clean content, and
+// "stream: <signature> FOUND" on a detection. Anything else (e.g. "INSTREAM size limit exceeded. ERROR") is returned
+// as an error.
+func (c *ClamAV) Scan(ctx context.Context, r io.Reader) (Result, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return Result{}, fmt.Errorf("scanner: %w", err)
+	}
+	defer conn.Close()
+
+	// Whichever of Timeout and the context deadline comes first applies
+	var deadline time.Time
+	if c.Timeout > 0 {
+		deadline = time.Now().Add(c.Timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	if !deadline.IsZero() {
+		conn.SetDeadline(deadline)
+	}
+
+	// The "z" prefix makes clamd expect and use NUL terminated commands and replies
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return Result{}, fmt.Errorf("scanner: %w", err)
+	}
+
+	// Each chunk is prefixed with its length as a 4 byte big-endian integer, and a zero length chunk ends the stream
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				return Result{}, fmt.Errorf("scanner: %w", err)
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return Result{}, readErr
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return Result{}, fmt.Errorf("scanner: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(errors.Is(err, io.EOF) && reply != "") {
+		return Result{}, fmt.Errorf("scanner: reading reply: %w", err)
+	}
+
+	return parseReply(reply)
+}
+
+func parseReply(reply string) (Result, error) {
+	reply = strings.TrimRight(reply, "\x00\n")
+	verdict, ok := strings.CutPrefix(reply, "stream: ")
+	if !ok {
+		return Result{}, fmt.Errorf("scanner: unexpected reply %q", reply)
+	}
+
+	switch {
+	case verdict == "OK":
+		return Result{Clean: true}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return Result{Clean: false, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	}
+
+	return Result{}, fmt.Errorf("scanner: clamd error %q", verdict)
+}
@@ -0,0 +1,162 @@
+package scanner
+
+import (
+	"bytes"
+	"clonebox/internal/assert"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd listens on a local port and speaks enough of the clamd protocol to answer INSTREAM: anything containing
+// the EICAR test string is reported as infected, a stream over limit bytes gets a size limit error.
+func fakeClamd(t *testing.T, limit int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handleClamdConn(conn, limit)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func handleClamdConn(conn net.Conn, limit int) {
+	defer conn.Close()
+
+	cmd := make([]byte, len("zINSTREAM\x00"))
+	if _, err := io.ReadFull(conn, cmd); err != nil || string(cmd) != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+
+	var stream bytes.Buffer
+	for {
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		if size == 0 {
+			break
+		}
+		if _, err := io.CopyN(&stream, conn, int64(size)); err != nil {
+			return
+		}
+		if stream.Len() > limit {
+			conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+			return
+		}
+	}
+
+	if bytes.Contains(stream.Bytes(), []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+		conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		return
+	}
+	conn.Write([]byte("stream: OK\x00"))
+}
+
+func TestClamAVScan(t *testing.T) {
+	addr := fakeClamd(t, 1<<20)
+
+	tests := []struct {
+		name    string
+		content io.Reader
+		want    Result
+		wantErr bool
+	}{
+		{
+			name:    "Clean",
+			content: strings.NewReader("just some text"),
+			want:    Result{Clean: true},
+		},
+		{
+			name:    "Empty",
+			content: strings.NewReader(""),
+			want:    Result{Clean: true},
+		},
+		{
+			name:    "EICAR",
+			content: strings.NewReader(eicar),
+			want:    Result{Clean: false, Signature: "Eicar-Test-Signature"},
+		},
+		{
+			name:    "EICAR after several chunks",
+			content: io.MultiReader(bytes.NewReader(make([]byte, 3*chunkSize+17)), strings.NewReader(eicar)),
+			want:    Result{Clean: false, Signature: "Eicar-Test-Signature"},
+		},
+		{
+			name:    "Over size limit",
+			content: bytes.NewReader(make([]byte, 2<<20)),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ClamAV{Addr: addr, Timeout: 5 * time.Second}
+			res, err := c.Scan(context.Background(), tt.content)
+			assert.Equal(t, err != nil, tt.wantErr)
+			assert.Equal(t, res, tt.want)
+		})
+	}
+}
+
+func TestClamAVUnreachable(t *testing.T) {
+	// Grab a free port and close it again so nothing is listening there
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c := &ClamAV{Addr: addr, Timeout: time.Second}
+	_, err = c.Scan(context.Background(), strings.NewReader("hello"))
+	if err == nil {
+		t.Error("got: nil; expected an error")
+	}
+}
+
+func TestParseReply(t *testing.T) {
+	tests := []struct {
+		reply   string
+		want    Result
+		wantErr bool
+	}{
+		{reply: "stream: OK\x00", want: Result{Clean: true}},
+		{reply: "stream: Win.Test.EICAR_HDB-1 FOUND\x00", want: Result{Signature: "Win.Test.EICAR_HDB-1"}},
+		{reply: "stream: Can't allocate memory ERROR\x00", wantErr: true},
+		{reply: "INSTREAM size limit exceeded. ERROR\x00", wantErr: true},
+		{reply: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reply, func(t *testing.T) {
+			res, err := parseReply(tt.reply)
+			assert.Equal(t, err != nil, tt.wantErr)
+			assert.Equal(t, res, tt.want)
+		})
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	assert.Equal(t, Enabled(nil), false)
+	assert.Equal(t, Enabled(Nop{}), false)
+	assert.Equal(t, Enabled(&ClamAV{}), true)
+}
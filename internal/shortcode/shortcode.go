@@ -0,0 +1,193 @@
+// Package shortcode generates the codes short links are served under.
+package shortcode
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"math/bits"
+	mrand "math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// Alphabet is the base62 alphabet codes are built from. Every character is safe in a URL path segment.
+const Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+const base = uint64(len(Alphabet))
+
+// ErrExhausted is returned by Generate when no free code was found within the generator's attempt limit.
+var ErrExhausted = errors.New("shortcode: no free code found")
+
+// Strategy produces candidate codes. length is the minimum length wanted, a strategy may return longer codes when
+// it needs to.
+type Strategy interface {
+	Code(length int) (string, error)
+}
+
+// Random draws every character uniformly from Alphabet.
+type Random struct {
+	// Rand is the source of randomness, crypto/rand is used when nil.
+	Rand io.Reader
+}
+
+func (s Random) Code(length int) (string, error) {
+	src := s.Rand
+	if src == nil {
+		src = rand.Reader
+	}
+
+	max := big.NewInt(int64(base))
+	code := make([]byte, length)
+	for i := range code {
+		n, err := rand.Int(src, max)
+		if err != nil {
+			return "", fmt.Errorf("shortcode: %w", err)
+		}
+		code[i] = Alphabet[n.Int64()]
+	}
+
+	return string(code), nil
+}
+
+// sequentialMaxLength is the longest code Sequential can produce, as 62^11 no longer fits in a uint64.
+const sequentialMaxLength = 10
+
+// Sequential numbers links from a counter and obfuscates the number hashids-style, so consecutive links don't get
+// guessable consecutive codes. For codes of the same length the mapping is a bijection, so it never collides with
+// itself; collisions can only come from codes created some other way (e.g. aliases), and skip to the next number.
+// Codes get longer on their own as the counter outgrows the keyspace of the current length.
+type Sequential struct {
+	// Salt shuffles the alphabet and picks the obfuscation offset. Changing it changes every code generated afterwards.
+	Salt string
+
+	counter  atomic.Uint64
+	once     sync.Once
+	alphabet []byte
+	offset   uint64
+}
+
+// multiplier scrambles the counter. It's odd and not a multiple of 31, so it's invertible modulo any power of 62.
+const multiplier = 0x9E3779B97F4A7C15
+
+// Seed sets the next number the counter hands out, typically the number of links that already exist.
+func (s *Sequential) Seed(n uint64) {
+	s.counter.Store(n)
+}
+
+func (s *Sequential) init() {
+	sum := sha256.Sum256([]byte(s.Salt))
+	rng := mrand.New(mrand.NewPCG(binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])))
+
+	s.alphabet = []byte(Alphabet)
+	rng.Shuffle(len(s.alphabet), func(i, j int) {
+		s.alphabet[i], s.alphabet[j] = s.alphabet[j], s.alphabet[i]
+	})
+	s.offset = binary.BigEndian.Uint64(sum[16:24])
+}
+
+func (s *Sequential) Code(length int) (string, error) {
+	s.once.Do(s.init)
+	return s.encode(s.counter.Add(1)-1, length)
+}
+
+// encode maps n to a code of at least length characters.
+func (s *Sequential) encode(n uint64, length int) (string, error) {
+	length = max(length, 1)
+
+	// Find the shortest length whose keyspace still holds n
+	space := uint64(1)
+	for range length {
+		space *= base
+	}
+	for n >= space {
+		if length >= sequentialMaxLength {
+			return "", ErrExhausted
+		}
+		length++
+		space *= base
+	}
+	if length > sequentialMaxLength {
+		return "", ErrExhausted
+	}
+
+	// (n * multiplier + offset) mod space, without overflowing
+	hi, lo := bits.Mul64(n%space, multiplier%space)
+	v := bits.Rem64(hi, lo, space)
+	v = (v + s.offset%space) % space
+
+	code := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		code[i] = s.alphabet[v%base]
+		v /= base
+	}
+
+	return string(code), nil
+}
+
+// Generator hands out codes from a Strategy and retries on collisions. Collisions are taken as a sign the keyspace is
+// filling up, so after GrowAfter consecutive collisions the code length is increased, and stays increased for later
+// calls.
+type Generator struct {
+	Strategy Strategy
+	// MaxLength caps how far the length can grow.
+	MaxLength int
+	// MaxAttempts is how many codes are tried per Generate call before giving up with ErrExhausted.
+	MaxAttempts int
+	// GrowAfter is the number of consecutive collisions that bump the length.
+	GrowAfter int
+	// Collision is the error insert returns when a code is already taken.
+	Collision error
+
+	length atomic.Int64
+}
+
+// New returns a Generator starting at length with sensible retry defaults.
+func New(strategy Strategy, length int, collision error) *Generator {
+	g := &Generator{
+		Strategy:    strategy,
+		MaxLength:   max(length, 16),
+		MaxAttempts: 10,
+		GrowAfter:   3,
+		Collision:   collision,
+	}
+	g.length.Store(int64(length))
+	return g
+}
+
+// Length returns the length codes are currently generated with.
+func (g *Generator) Length() int {
+	return int(g.length.Load())
+}
+
+// Generate produces codes and passes them to insert until one is stored. insert returning an error matching
+// g.Collision means the code is taken and another is tried, any other error is returned as is.
+func (g *Generator) Generate(insert func(code string) error) (string, error) {
+	collisions := 0
+	for range g.MaxAttempts {
+		length := g.Length()
+		code, err := g.Strategy.Code(length)
+		if err != nil {
+			return "", err
+		}
+
+		err = insert(code)
+		if err == nil {
+			return code, nil
+		}
+		if !errors.Is(err, g.Collision) {
+			return "", err
+		}
+
+		collisions++
+		if g.GrowAfter > 0 && collisions%g.GrowAfter == 0 && length < g.MaxLength {
+			g.length.CompareAndSwap(int64(length), int64(length+1))
+		}
+	}
+
+	return "", ErrExhausted
+}
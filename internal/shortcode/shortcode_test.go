@@ -0,0 +1,176 @@
+package shortcode
+
+import (
+	"clonebox/internal/assert"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var errTaken = errors.New("taken")
+
+func TestRandom(t *testing.T) {
+	for _, length := range []int{1, 6, 12} {
+		code, err := Random{}.Code(length)
+		assert.NilError(t, err)
+		assert.Equal(t, len(code), length)
+
+		for _, c := range code {
+			assert.Equal(t, strings.ContainsRune(Alphabet, c), true)
+		}
+	}
+}
+
+func TestSequential(t *testing.T) {
+	t.Run("Bijective per length", func(t *testing.T) {
+		s := &Sequential{Salt: "test"}
+		seen := map[string]bool{}
+		for range base * base {
+			code, err := s.Code(2)
+			assert.NilError(t, err)
+			assert.Equal(t, len(code), 2)
+			assert.Equal(t, seen[code], false)
+			seen[code] = true
+		}
+
+		// The keyspace of length 2 is used up, so codes get longer
+		code, err := s.Code(2)
+		assert.NilError(t, err)
+		assert.Equal(t, len(code), 3)
+	})
+
+	t.Run("Not consecutive", func(t *testing.T) {
+		s := &Sequential{Salt: "test"}
+		a, _ := s.Code(6)
+		b, _ := s.Code(6)
+		assert.Equal(t, a[:5] == b[:5], false)
+	})
+
+	t.Run("Salt changes codes", func(t *testing.T) {
+		a, _ := (&Sequential{Salt: "one"}).Code(6)
+		b, _ := (&Sequential{Salt: "two"}).Code(6)
+		assert.Equal(t, a == b, false)
+	})
+
+	t.Run("Seed", func(t *testing.T) {
+		s := &Sequential{Salt: "test"}
+		s.Seed(1000)
+		seeded, _ := s.Code(1)
+		assert.Equal(t, len(seeded), 2)
+
+		u := &Sequential{Salt: "test"}
+		for range 1000 {
+			u.Code(1)
+		}
+		want, _ := u.Code(1)
+		assert.Equal(t, seeded, want)
+	})
+
+	t.Run("Keyspace exhausted", func(t *testing.T) {
+		s := &Sequential{}
+		s.Seed(^uint64(0))
+		_, err := s.Code(6)
+		assert.Equal(t, errors.Is(err, ErrExhausted), true)
+	})
+}
+
+// fixedStrategy hands out codes from a list, one per call.
+type fixedStrategy struct {
+	codes   []string
+	lengths []int
+}
+
+func (s *fixedStrategy) Code(length int) (string, error) {
+	s.lengths = append(s.lengths, length)
+	code := s.codes[0]
+	s.codes = s.codes[1:]
+	return code, nil
+}
+
+func TestGenerator(t *testing.T) {
+	t.Run("Retries collisions", func(t *testing.T) {
+		taken := map[string]bool{"aaa": true, "bbb": true}
+		g := New(&fixedStrategy{codes: []string{"aaa", "bbb", "ccc"}}, 3, errTaken)
+
+		code, err := g.Generate(func(code string) error {
+			if taken[code] {
+				return errTaken
+			}
+			return nil
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, code, "ccc")
+		assert.Equal(t, g.Length(), 3)
+	})
+
+	t.Run("Grows after collisions", func(t *testing.T) {
+		s := &fixedStrategy{codes: []string{"a", "b", "c", "d", "e"}}
+		g := New(s, 3, errTaken)
+		g.GrowAfter = 2
+
+		calls := 0
+		code, err := g.Generate(func(code string) error {
+			calls++
+			if calls < 5 {
+				return errTaken
+			}
+			return nil
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, code, "e")
+		assert.Equal(t, len(s.lengths), 5)
+		assert.Equal(t, s.lengths[1], 3)
+		assert.Equal(t, s.lengths[2], 4)
+		assert.Equal(t, s.lengths[4], 5)
+
+		// The grown length sticks for later calls
+		assert.Equal(t, g.Length(), 5)
+	})
+
+	t.Run("Gives up", func(t *testing.T) {
+		g := New(Random{}, 6, errTaken)
+		g.MaxAttempts = 4
+
+		calls := 0
+		_, err := g.Generate(func(code string) error {
+			calls++
+			return errTaken
+		})
+		assert.Equal(t, errors.Is(err, ErrExhausted), true)
+		assert.Equal(t, calls, 4)
+	})
+
+	t.Run("Other errors", func(t *testing.T) {
+		boom := errors.New("boom")
+		g := New(Random{}, 6, errTaken)
+
+		calls := 0
+		_, err := g.Generate(func(code string) error {
+			calls++
+			return boom
+		})
+		assert.Equal(t, err, boom)
+		assert.Equal(t, calls, 1)
+	})
+
+	t.Run("Filling a small keyspace", func(t *testing.T) {
+		// Only 62 one character codes exist, so filling them forces the generator onto longer codes
+		taken := map[string]bool{}
+		g := New(Random{}, 1, errTaken)
+		g.MaxAttempts = 50
+
+		for range 200 {
+			_, err := g.Generate(func(code string) error {
+				if taken[code] {
+					return errTaken
+				}
+				taken[code] = true
+				return nil
+			})
+			assert.NilError(t, err)
+		}
+
+		assert.Equal(t, len(taken), 200)
+		assert.Equal(t, g.Length() > 1, true)
+	})
+}
@@ -0,0 +1,210 @@
+// Package throttle slows down and locks out password guessing. Failed attempts are counted per key (an email
+// address, a client IP), and once a key has had a few, it has to wait before trying again, progressively longer,
+// until it's locked out for a while.
+//
+// Attempts are rejected rather than made to wait, so a throttled client doesn't tie up the server.
+package throttle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Store keeps failure counts. Keys are opaque fixed-length hashes. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the number of failures recorded for key and when the last one was, or 0 if there are none.
+	Get(key string) (failures int, last time.Time, err error)
+
+	// Fail records a failure for key at now and returns the new count, along with when the failure before it was.
+	// Failures older than window are forgotten first, so the count starts over (and there's no failure before it).
+	// The count and the time must come from the same update, as seen by concurrent callers.
+	Fail(key string, now time.Time, window time.Duration) (failures int, previous time.Time, err error)
+
+	// Undo takes back one of key's failures.
+	Undo(key string) error
+
+	// Reset forgets key's failures.
+	Reset(key string) error
+}
+
+// Policy says how a kind of key is throttled.
+type Policy struct {
+	Free      int           // Failures allowed before there's a delay
+	BaseDelay time.Duration // Delay after the first failure beyond Free, which doubles with each one after
+	MaxDelay  time.Duration
+
+	LockoutAfter int           // Failures after which the key is locked out
+	Lockout      time.Duration // How long a lockout lasts
+
+	Window time.Duration // Failures are forgotten after this long without another one, at least Lockout
+}
+
+// RetryAt returns when a key with failures, the last of them at last, can try again, and whether it's locked out.
+// Times before now mean it can try straight away.
+func (p Policy) RetryAt(failures int, last time.Time) (time.Time, bool) {
+	switch {
+	case failures >= p.LockoutAfter:
+		return last.Add(p.Lockout), true
+	case failures > p.Free:
+		delay := p.BaseDelay
+		for i := p.Free + 1; i < failures && delay < p.MaxDelay; i++ {
+			delay *= 2
+		}
+		return last.Add(min(delay, p.MaxDelay)), false
+	default:
+		return time.Time{}, false
+	}
+}
+
+// Limiter throttles keys of one kind according to its policy.
+type Limiter struct {
+	Store  Store
+	Policy Policy
+	Prefix string // Keeps the keys of different limiters sharing a store apart, e.g. "email"
+}
+
+// Decision is the outcome of checking a key.
+type Decision struct {
+	Allowed    bool
+	Locked     bool          // Whether the key is locked out rather than only delayed
+	RetryAfter time.Duration // How long until the key may try again, if it isn't allowed
+}
+
+// Check returns whether key may make an attempt now.
+func (l *Limiter) Check(key string, now time.Time) (Decision, error) {
+	failures, last, err := l.Store.Get(l.hash(key))
+	if err != nil {
+		return Decision{}, err
+	}
+	if now.Sub(last) > l.Policy.Window {
+		return Decision{Allowed: true}, nil
+	}
+
+	retryAt, locked := l.Policy.RetryAt(failures, last)
+	if !now.Before(retryAt) {
+		return Decision{Allowed: true}, nil
+	}
+	return Decision{Locked: locked, RetryAfter: retryAt.Sub(now)}, nil
+}
+
+// Attempt counts an attempt for key as a failure before it's made, and returns whether it may be made. Counting first
+// means concurrent attempts each see the ones before them, so a burst of them can't all get through on the count
+// they started with. Attempts that aren't allowed are taken back, ones that turn out fine should be with Succeed.
+func (l *Limiter) Attempt(key string, now time.Time) (Decision, error) {
+	d, err := l.Check(key, now)
+	if err != nil || !d.Allowed {
+		return d, err
+	}
+
+	failures, previous, err := l.Store.Fail(l.hash(key), now, l.Policy.Window)
+	if err != nil {
+		return Decision{}, err
+	}
+	if failures <= 1 {
+		return Decision{Allowed: true}, nil
+	}
+
+	retryAt, locked := l.Policy.RetryAt(failures-1, previous)
+	if !now.Before(retryAt) {
+		return Decision{Allowed: true}, nil
+	}
+	if err = l.Store.Undo(l.hash(key)); err != nil {
+		return Decision{}, err
+	}
+	return Decision{Locked: locked, RetryAfter: retryAt.Sub(now)}, nil
+}
+
+// Succeed takes back the failure Attempt counted for an attempt that turned out fine.
+func (l *Limiter) Succeed(key string) error {
+	return l.Store.Undo(l.hash(key))
+}
+
+// Fail records a failed attempt for key that Attempt didn't count, and returns whether it locked the key out.
+func (l *Limiter) Fail(key string, now time.Time) (bool, error) {
+	failures, _, err := l.Store.Fail(l.hash(key), now, l.Policy.Window)
+	if err != nil {
+		return false, err
+	}
+	return failures >= l.Policy.LockoutAfter, nil
+}
+
+// Reset forgets key's failures, e.g. once it's proven to be legitimate.
+func (l *Limiter) Reset(key string) error {
+	return l.Store.Reset(l.hash(key))
+}
+
+// hash keeps the keys out of the store, which may be a database table.
+func (l *Limiter) hash(key string) string {
+	sum := sha256.Sum256([]byte(l.Prefix + "\x00" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryStore is a Store which keeps failures in memory, for running without a database. Counts are lost on restart.
+type MemoryStore struct {
+	mu       sync.Mutex
+	failures map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	count  int
+	last   time.Time
+	window time.Duration
+}
+
+func (s *MemoryStore) Get(key string) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.failures[key]
+	if !ok {
+		return 0, time.Time{}, nil
+	}
+	return e.count, e.last, nil
+}
+
+func (s *MemoryStore) Fail(key string, now time.Time, window time.Duration) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures == nil {
+		s.failures = make(map[string]*memoryEntry)
+	}
+
+	// Forgotten entries are dropped as they're found, which keeps the map from growing without bound
+	for k, e := range s.failures {
+		if now.Sub(e.last) > e.window {
+			delete(s.failures, k)
+		}
+	}
+
+	e, ok := s.failures[key]
+	if !ok {
+		e = &memoryEntry{}
+		s.failures[key] = e
+	}
+	previous := e.last
+	e.count++
+	e.last = now
+	e.window = window
+	return e.count, previous, nil
+}
+
+func (s *MemoryStore) Undo(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.failures[key]; ok && e.count > 0 {
+		e.count--
+	}
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.failures, key)
+	return nil
+}
@@ -0,0 +1,164 @@
+package throttle
+
+import (
+	"clonebox/internal/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	Free:         3,
+	BaseDelay:    time.Second,
+	MaxDelay:     8 * time.Second,
+	LockoutAfter: 10,
+	Lockout:      15 * time.Minute,
+	Window:       time.Hour,
+}
+
+func TestPolicyRetryAt(t *testing.T) {
+	last := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		failures   int
+		wantDelay  time.Duration
+		wantLocked bool
+	}{
+		{failures: 0},
+		{failures: 3},
+		{failures: 4, wantDelay: time.Second},
+		{failures: 5, wantDelay: 2 * time.Second},
+		{failures: 6, wantDelay: 4 * time.Second},
+		{failures: 7, wantDelay: 8 * time.Second},
+		{failures: 9, wantDelay: 8 * time.Second},
+		{failures: 10, wantDelay: 15 * time.Minute, wantLocked: true},
+		{failures: 25, wantDelay: 15 * time.Minute, wantLocked: true},
+	}
+
+	for _, tt := range tests {
+		retryAt, locked := testPolicy.RetryAt(tt.failures, last)
+		if tt.wantDelay == 0 {
+			assert.Equal(t, retryAt.IsZero(), true)
+		} else {
+			assert.Equal(t, retryAt.Sub(last), tt.wantDelay)
+		}
+		assert.Equal(t, locked, tt.wantLocked)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	store := &MemoryStore{}
+	l := &Limiter{Store: store, Policy: testPolicy, Prefix: "email"}
+	now := time.Unix(1_700_000_000, 0)
+
+	fail := func() bool {
+		d, err := l.Check("alice@example.com", now)
+		assert.NilError(t, err)
+		if !d.Allowed {
+			t.Fatalf("attempt at %v not allowed, retry after %v", now, d.RetryAfter)
+		}
+		locked, err := l.Fail("alice@example.com", now)
+		assert.NilError(t, err)
+		return locked
+	}
+
+	// The free attempts can be made back to back
+	for range testPolicy.Free {
+		assert.Equal(t, fail(), false)
+	}
+	assert.Equal(t, fail(), false)
+
+	d, err := l.Check("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d, Decision{RetryAfter: time.Second})
+
+	// Other keys and limiters aren't affected
+	d, err = l.Check("bob@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Allowed, true)
+	other := &Limiter{Store: store, Policy: testPolicy, Prefix: "ip"}
+	d, err = other.Check("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Allowed, true)
+
+	// Waiting out the delays gets to the lockout
+	locked := false
+	for !locked {
+		now = now.Add(testPolicy.MaxDelay)
+		locked = fail()
+	}
+	d, err = l.Check("alice@example.com", now.Add(time.Minute))
+	assert.NilError(t, err)
+	assert.Equal(t, d, Decision{Locked: true, RetryAfter: 14 * time.Minute})
+
+	now = now.Add(testPolicy.Lockout)
+	d, err = l.Check("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Allowed, true)
+
+	assert.NilError(t, l.Reset("alice@example.com"))
+	failures, _, err := store.Get(l.hash("alice@example.com"))
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 0)
+}
+
+func TestLimiterWindow(t *testing.T) {
+	l := &Limiter{Store: &MemoryStore{}, Policy: testPolicy, Prefix: "email"}
+	now := time.Unix(1_700_000_000, 0)
+
+	for range testPolicy.Free + 1 {
+		_, err := l.Fail("alice@example.com", now)
+		assert.NilError(t, err)
+	}
+	d, err := l.Check("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Allowed, false)
+
+	// After a quiet window, the count starts over
+	now = now.Add(testPolicy.Window + time.Second)
+	d, err = l.Check("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Allowed, true)
+	_, err = l.Fail("alice@example.com", now)
+	assert.NilError(t, err)
+	failures, _, err := l.Store.Get(l.hash("alice@example.com"))
+	assert.NilError(t, err)
+	assert.Equal(t, failures, 1)
+}
+
+func TestLimiterAttempt(t *testing.T) {
+	l := &Limiter{Store: &MemoryStore{}, Policy: testPolicy, Prefix: "email"}
+	now := time.Unix(1_700_000_000, 0)
+
+	// A burst of attempts at once only lets through as many as the policy allows back to back
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for range 50 {
+		wg.Go(func() {
+			d, err := l.Attempt("alice@example.com", now)
+			if err != nil {
+				t.Error(err)
+			}
+			if d.Allowed {
+				allowed.Add(1)
+			}
+		})
+	}
+	wg.Wait()
+	assert.Equal(t, int(allowed.Load()), testPolicy.Free+1)
+
+	// Attempts that weren't allowed aren't counted
+	failures, _, err := l.Store.Get(l.hash("alice@example.com"))
+	assert.NilError(t, err)
+	assert.Equal(t, failures, testPolicy.Free+1)
+
+	// Attempts that turned out fine are taken back
+	assert.NilError(t, l.Succeed("alice@example.com"))
+	d, err := l.Attempt("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d.Allowed, true)
+	d, err = l.Attempt("alice@example.com", now)
+	assert.NilError(t, err)
+	assert.Equal(t, d, Decision{RetryAfter: time.Second})
+}
@@ -0,0 +1,101 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	// Registers the decoders used by image.Decode
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+// MaxPixels is the largest source image (width * height) Generate will decode. Anything bigger is treated as
+// unsupported so a small, highly compressed upload can't be used to exhaust memory.
+const MaxPixels = 50_000_000
+
+var ErrUnsupported = errors.New("thumbnail: unsupported image format")
+
+// Generate decodes a GIF, JPEG or PNG image from r, scales it down to fit within a size x size box (keeping its aspect
+// ratio) and writes the result to w as a PNG. Images already smaller than the box are re-encoded as-is. Returns
+// ErrUnsupported if r isn't a decodable image.
+func Generate(r io.ReadSeeker, w io.Writer, size int) error {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return ErrUnsupported
+		}
+		return err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return ErrUnsupported
+	}
+
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	src, _, err := image.Decode(r)
+	if err != nil {
+		if errors.Is(err, image.ErrFormat) {
+			return ErrUnsupported
+		}
+		return err
+	}
+
+	return png.Encode(w, Resize(src, size))
+}
+
+// Resize scales src down to fit within a size x size box, keeping its aspect ratio. Each destination pixel is the
+// average of the source pixels it covers (a box filter), which is cheap and gives decent results when shrinking.
+func Resize(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	srcW, srcH := b.Dx(), b.Dy()
+
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, max(1, srcH*size/srcW)
+		} else {
+			dstW, dstH = max(1, srcW*size/srcH), size
+		}
+	}
+
+	// Work on a zero-origin RGBA copy so pixels can be read straight from Pix
+	rgba := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(rgba, rgba.Bounds(), src, b.Min, draw.Src)
+	if dstW == srcW && dstH == srcH {
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, max((y+1)*srcH/dstH, y*srcH/dstH+1)
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, max((x+1)*srcW/dstW, x*srcW/dstW+1)
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					bl += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(bl / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,110 @@
+package thumbnail
+
+import (
+	"bytes"
+	"clonebox/internal/assert"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   func(t *testing.T) []byte
+		wantW   int
+		wantH   int
+		wantErr error
+	}{
+		{
+			name:  "Landscape PNG",
+			input: func(t *testing.T) []byte { return encodePNG(t, 800, 400) },
+			wantW: 256,
+			wantH: 128,
+		},
+		{
+			name:  "Portrait JPEG",
+			input: func(t *testing.T) []byte { return encodeJPEG(t, 300, 600) },
+			wantW: 128,
+			wantH: 256,
+		},
+		{
+			name:  "Already small",
+			input: func(t *testing.T) []byte { return encodePNG(t, 10, 20) },
+			wantW: 10,
+			wantH: 20,
+		},
+		{
+			name:  "Very thin",
+			input: func(t *testing.T) []byte { return encodePNG(t, 2000, 1) },
+			wantW: 256,
+			wantH: 1,
+		},
+		{
+			name:    "Not an image",
+			input:   func(t *testing.T) []byte { return []byte("just some text") },
+			wantErr: ErrUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Generate(bytes.NewReader(tt.input(t)), &out, 256)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got: %v; want: %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			img, err := png.Decode(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, img.Bounds().Dx(), tt.wantW)
+			assert.Equal(t, img.Bounds().Dy(), tt.wantH)
+		})
+	}
+}
+
+func TestResizeAverages(t *testing.T) {
+	// Alternating black and white columns should average out to grey
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			if x%2 == 0 {
+				src.Set(x, y, color.White)
+			} else {
+				src.Set(x, y, color.Black)
+			}
+		}
+	}
+
+	dst := Resize(src, 2)
+	r, g, b, _ := dst.At(0, 0).RGBA()
+	assert.Equal(t, r>>8, 127)
+	assert.Equal(t, g>>8, 127)
+	assert.Equal(t, b>>8, 127)
+}
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
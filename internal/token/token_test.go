@@ -0,0 +1,66 @@
+package token
+
+import (
+	"clonebox/internal/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignerCheck(t *testing.T) {
+	s := &Signer{Key: []byte("secret")}
+
+	valid, hash, expiry, err := s.New("verify", time.Hour)
+	assert.NilError(t, err)
+	assert.Equal(t, len(hash), 64)
+	assert.Equal(t, hash, Hash(valid))
+	assert.Equal(t, expiry.After(time.Now().Add(59*time.Minute)), true)
+
+	expired, _, _, err := s.New("verify", -time.Second)
+	assert.NilError(t, err)
+
+	payload, sig, _ := strings.Cut(valid, ".")
+	// Flipping the first character keeps the payload decodable but changes the random part
+	tampered := string(payload[0]^1) + payload[1:] + "." + sig
+
+	other := &Signer{Key: []byte("other")}
+
+	tests := []struct {
+		name      string
+		signer    *Signer
+		scope     string
+		plaintext string
+		wantErr   error
+	}{
+		{name: "Valid", signer: s, scope: "verify", plaintext: valid},
+		{name: "Expired", signer: s, scope: "verify", plaintext: expired, wantErr: ErrExpired},
+		{name: "Other scope", signer: s, scope: "reset", plaintext: valid, wantErr: ErrInvalid},
+		{name: "Other key", signer: other, scope: "verify", plaintext: valid, wantErr: ErrInvalid},
+		{name: "Tampered", signer: s, scope: "verify", plaintext: tampered, wantErr: ErrInvalid},
+		{name: "No signature", signer: s, scope: "verify", plaintext: payload, wantErr: ErrInvalid},
+		{name: "Truncated", signer: s, scope: "verify", plaintext: payload[4:] + "." + sig, wantErr: ErrInvalid},
+		{name: "Not base64", signer: s, scope: "verify", plaintext: "!!!." + sig, wantErr: ErrInvalid},
+		{name: "Empty", signer: s, scope: "verify", plaintext: "", wantErr: ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.signer.Check(tt.scope, tt.plaintext)
+			assert.Equal(t, err, tt.wantErr)
+			if tt.wantErr == nil {
+				assert.Equal(t, got, hash)
+			}
+		})
+	}
+}
+
+func TestSignerNewUnique(t *testing.T) {
+	s := &Signer{Key: []byte("secret")}
+
+	a, _, _, err := s.New("verify", time.Hour)
+	assert.NilError(t, err)
+	b, _, _, err := s.New("verify", time.Hour)
+	assert.NilError(t, err)
+
+	assert.Equal(t, a == b, false)
+}
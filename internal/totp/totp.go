@@ -0,0 +1,106 @@
+// Package totp implements the time-based one-time passwords of RFC 6238, as used by authenticator apps: HMAC-SHA1,
+// six digits and a 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 // Seconds
+
+	// skew is how many periods a code may be off by, to allow for clock drift and slow typing.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a random 160 bit secret, base32 encoded the way authenticator apps expect it.
+func NewSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(key), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return nil, fmt.Errorf("totp: invalid secret: %w", err)
+	}
+	return key, nil
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / Period
+}
+
+// Code returns the code for secret at time t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(Step(t)), Digits), nil
+}
+
+// Validate checks code against the codes for secret around time t, and returns the time step it belongs to. Callers
+// should remember the step and reject codes from it, and earlier steps, from then on, so a code can't be used twice.
+func Validate(secret, code string, t time.Time) (step int64, ok bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+
+	now := Step(t)
+	for s := now - skew; s <= now+skew; s++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(s), Digits)), []byte(code)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the otpauth:// URI authenticator apps import a secret from, usually shown as a QR code.
+func URI(secret, issuer, account string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(Period))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + v.Encode()
+}
+
+// hotp is the HMAC-based one-time password of RFC 4226.
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for range digits {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
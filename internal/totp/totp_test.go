@@ -0,0 +1,96 @@
+package totp
+
+import (
+	"clonebox/internal/assert"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, appendix B. The key is the ASCII string "12345678901234567890".
+func TestHOTPRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "94287082"},
+		{unix: 1111111109, want: "07081804"},
+		{unix: 1111111111, want: "14050471"},
+		{unix: 1234567890, want: "89005924"},
+		{unix: 2000000000, want: "69279037"},
+		{unix: 20000000000, want: "65353130"},
+	}
+
+	for _, tt := range tests {
+		got := hotp(key, uint64(Step(time.Unix(tt.unix, 0))), 8)
+		assert.Equal(t, got, tt.want)
+	}
+}
+
+func TestCode(t *testing.T) {
+	secret := encoding.EncodeToString([]byte("12345678901234567890"))
+
+	code, err := Code(secret, time.Unix(59, 0))
+	assert.NilError(t, err)
+	// The last six digits of the eight digit vector
+	assert.Equal(t, code, "287082")
+
+	_, err = Code("not base32!", time.Now())
+	if err == nil {
+		t.Error("got nil error; want invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	assert.NilError(t, err)
+	assert.Equal(t, len(secret), 32)
+
+	now := time.Unix(1_700_000_000, 0)
+	code, err := Code(secret, now)
+	assert.NilError(t, err)
+
+	tests := []struct {
+		name     string
+		code     string
+		at       time.Time
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "Current", code: code, at: now, wantStep: Step(now), wantOK: true},
+		{name: "One period late", code: code, at: now.Add(Period * time.Second), wantStep: Step(now), wantOK: true},
+		{name: "One period early", code: code, at: now.Add(-Period * time.Second), wantStep: Step(now), wantOK: true},
+		{name: "Two periods late", code: code, at: now.Add(2 * Period * time.Second)},
+		{name: "Wrong code", code: "000000", at: now},
+		{name: "Too short", code: code[:5], at: now},
+		{name: "Empty", code: "", at: now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Guard against the wrong code test accidentally being right
+			if tt.code == "000000" && code == "000000" {
+				t.Skip("generated code happens to be 000000")
+			}
+			step, ok := Validate(secret, tt.code, tt.at)
+			assert.Equal(t, ok, tt.wantOK)
+			assert.Equal(t, step, tt.wantStep)
+		})
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("JBSWY3DPEHPK3PXP", "Clonebox", "alice@example.com")
+
+	u, err := url.Parse(uri)
+	assert.NilError(t, err)
+	assert.Equal(t, u.Scheme, "otpauth")
+	assert.Equal(t, u.Host, "totp")
+	assert.Equal(t, u.Path, "/Clonebox:alice@example.com")
+	assert.Equal(t, u.Query().Get("secret"), "JBSWY3DPEHPK3PXP")
+	assert.Equal(t, u.Query().Get("issuer"), "Clonebox")
+	assert.Equal(t, u.Query().Get("digits"), "6")
+	assert.Equal(t, u.Query().Get("period"), "30")
+}
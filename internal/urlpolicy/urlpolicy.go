@@ -0,0 +1,354 @@
+// Package urlpolicy decides which destinations short links may point at.
+package urlpolicy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrScheme = errors.New("urlpolicy: only http and https links are allowed")
+
+	ErrInternal = errors.New("urlpolicy: links to internal or private addresses aren't allowed")
+
+	ErrSelfReference = errors.New("urlpolicy: links to other short links aren't allowed")
+
+	ErrBlocked = errors.New("urlpolicy: links to this domain aren't allowed")
+)
+
+// Blocklist reports whether links to a host are forbidden. host is lower case and has no port or trailing dot.
+type Blocklist interface {
+	Blocked(host string) bool
+}
+
+// Resolver looks up the addresses of a host name. *net.Resolver satisfies it.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Policy checks link destinations. The zero value only applies the checks that don't need configuration.
+type Policy struct {
+	// SelfHosts are the host names this application is reachable under. Links back to its short links are rejected,
+	// as they'd only redirect to each other (possibly in a loop).
+	SelfHosts []string
+	// Blocklist, when set, rejects configured domains.
+	Blocklist Blocklist
+	// Resolver, when set, is used to reject host names that resolve to internal addresses. Without it only IP
+	// literals and well known internal names are caught.
+	Resolver Resolver
+}
+
+// Check returns nil if rawURL may be shortened, or one of the package's errors saying why not. selfHosts are added to
+// p.SelfHosts, e.g. the host of the current request.
+func (p *Policy) Check(ctx context.Context, rawURL string, selfHosts ...string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("urlpolicy: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrScheme
+	}
+
+	host := normalizeHost(u.Hostname())
+	if host == "" {
+		return ErrInternal
+	}
+
+	for _, self := range slices.Concat(p.SelfHosts, selfHosts) {
+		if self = normalizeHost(hostOnly(self)); self != "" && host == self && isShortLinkPath(u.Path) {
+			return ErrSelfReference
+		}
+	}
+
+	if p.Blocklist != nil && p.Blocklist.Blocked(host) {
+		return ErrBlocked
+	}
+
+	if addr, ok := parseIP(host); ok {
+		if Internal(addr) {
+			return ErrInternal
+		}
+		return nil
+	} else if endsInNumber(host) {
+		// Browsers take these for IPv4 addresses and refuse them, other clients may still make something of them
+		return ErrInternal
+	}
+
+	if internalName(host) {
+		return ErrInternal
+	}
+
+	if p.Resolver != nil {
+		addrs, err := p.Resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			// Hosts that don't resolve (yet) can't be used to reach anything internal right now
+			return nil
+		}
+		for _, addr := range addrs {
+			if Internal(addr) {
+				return ErrInternal
+			}
+		}
+	}
+
+	return nil
+}
+
+// isShortLinkPath reports whether p is served by the short link redirect. It's cleaned first the way clients and
+// the router do, so dot segments and doubled slashes don't hide it.
+func isShortLinkPath(p string) bool {
+	p = strings.ToLower(path.Clean("/" + p))
+	return strings.HasPrefix(p, "/shorten/") || p == "/shorten"
+}
+
+// hostOnly strips a port from host, if it has one.
+func hostOnly(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// internalName reports whether host is a name that only makes sense on a local network.
+func internalName(host string) bool {
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return true
+	}
+
+	for _, suffix := range []string{".localhost", ".local", ".internal", ".lan", ".home.arpa"} {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseIP parses host as an IP address. IPv4 addresses are parsed the way browsers do (see the WHATWG URL standard),
+// which besides dotted decimal accepts fewer than four parts and octal or hex ones: "127.1", "0x7f.1",
+// "0177.0.0.1", "2130706433" and "0x7f000001" are all 127.0.0.1.
+func parseIP(host string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap(), true
+	}
+
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return netip.Addr{}, false
+	}
+
+	var n uint64
+	for i, part := range parts {
+		v, ok := parseIPv4Number(part)
+		if !ok {
+			return netip.Addr{}, false
+		}
+
+		// The last part fills all the bytes the ones before it didn't
+		if i < len(parts)-1 {
+			if v > 255 {
+				return netip.Addr{}, false
+			}
+			n |= v << (8 * (3 - i))
+		} else {
+			if v >= 1<<(8*(4-i)) {
+				return netip.Addr{}, false
+			}
+			n |= v
+		}
+	}
+	return netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}), true
+}
+
+// parseIPv4Number parses one part of an IPv4 address: hex with a 0x prefix, octal with a leading 0, decimal
+// otherwise. "0x" alone is 0.
+func parseIPv4Number(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+
+	base := 10
+	if len(s) >= 2 && (s[:2] == "0x" || s[:2] == "0X") {
+		s, base = s[2:], 16
+		if s == "" {
+			return 0, true
+		}
+	} else if len(s) >= 2 && s[0] == '0' {
+		s, base = s[1:], 8
+	}
+
+	// ParseUint would also take a sign or underscores
+	for _, c := range strings.ToLower(s) {
+		if i := strings.IndexRune("0123456789abcdef", c); i < 0 || i >= base {
+			return 0, false
+		}
+	}
+
+	n, err := strconv.ParseUint(s, base, 32)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// endsInNumber reports whether browsers would take host for an IPv4 address, valid or not: its last part is a
+// number, as in "1.2.3.256" or "example.0x10".
+func endsInNumber(host string) bool {
+	last := host[strings.LastIndexByte(host, '.')+1:]
+	if last != "" && strings.Trim(last, "0123456789") == "" {
+		return true
+	}
+	_, ok := parseIPv4Number(last)
+	return ok
+}
+
+// reserved are ranges that aren't reachable on the public internet, beyond what netip.Addr's methods cover.
+var reserved = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),  // Documentation
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+// Prefixes of IPv6 addresses that carry an IPv4 address, which is where they lead.
+var (
+	sixToFour = netip.MustParsePrefix("2002::/16")
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+)
+
+// Internal reports whether addr is a loopback, private, link-local or otherwise non-public address.
+func Internal(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	// 6to4 addresses embed the IPv4 address after the prefix, NAT64 ones in the last four bytes
+	if sixToFour.Contains(addr) {
+		b := addr.As16()
+		return Internal(netip.AddrFrom4([4]byte(b[2:6])))
+	}
+	if nat64.Contains(addr) {
+		b := addr.As16()
+		return Internal(netip.AddrFrom4([4]byte(b[12:16])))
+	}
+
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsUnspecified() || addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() || addr.IsInterfaceLocalMulticast() || addr.IsMulticast() {
+		return true
+	}
+
+	for _, prefix := range reserved {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Domains blocks a set of domains and all of their subdomains.
+type Domains map[string]bool
+
+// NewDomains returns a Domains blocking the given domains.
+func NewDomains(domains ...string) Domains {
+	d := Domains{}
+	for _, domain := range domains {
+		if domain = normalizeHost(strings.TrimSpace(domain)); domain != "" {
+			d[domain] = true
+		}
+	}
+	return d
+}
+
+func (d Domains) Blocked(host string) bool {
+	for {
+		if d[host] {
+			return true
+		}
+
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// ParseHosts reads a hosts-style blocklist: one entry per line, either "<address> <domain>..." as in /etc/hosts or a
+// bare domain. Everything after a # is a comment. The addresses themselves are ignored, as are the names local
+// hosts files use for the machine itself.
+func ParseHosts(r io.Reader) (Domains, error) {
+	d := Domains{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		// Entries starting with an address list domains after it
+		if _, ok := parseIP(fields[0]); ok && len(fields) > 1 {
+			fields = fields[1:]
+		}
+
+		for _, domain := range fields {
+			domain = normalizeHost(domain)
+			switch domain {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback":
+				continue
+			}
+			d[domain] = true
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("urlpolicy: %w", err)
+	}
+
+	return d, nil
+}
+
+// LoadHostsFile reads a hosts-style blocklist from a file, see ParseHosts.
+func LoadHostsFile(path string) (Domains, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("urlpolicy: %w", err)
+	}
+	defer f.Close()
+
+	return ParseHosts(f)
+}
+
+// Blocklists combines several blocklists, blocking a host if any of them does.
+type Blocklists []Blocklist
+
+func (b Blocklists) Blocked(host string) bool {
+	for _, list := range b {
+		if list.Blocked(host) {
+			return true
+		}
+	}
+	return false
+}
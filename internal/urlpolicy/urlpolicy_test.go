@@ -0,0 +1,183 @@
+package urlpolicy
+
+import (
+	"clonebox/internal/assert"
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeResolver resolves host names from a fixed table.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, ok := f[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	var ips []netip.Addr
+	for _, a := range addrs {
+		ips = append(ips, netip.MustParseAddr(a))
+	}
+	return ips, nil
+}
+
+func TestCheck(t *testing.T) {
+	policy := &Policy{
+		SelfHosts: []string{"clonebox.example.com"},
+		Blocklist: NewDomains("evil.example", "Tracker.Example.net."),
+		Resolver: fakeResolver{
+			"public.example.org":   {"93.184.216.34"},
+			"rebind.example.org":   {"93.184.216.34", "10.0.0.5"},
+			"loopback.example.org": {"::1"},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		url       string
+		selfHosts []string
+		wantErr   error
+	}{
+		{name: "Public host", url: "https://example.com/page", wantErr: nil},
+		{name: "Public host resolved", url: "https://public.example.org", wantErr: nil},
+		{name: "Unresolvable host", url: "https://nxdomain.example.org", wantErr: nil},
+		{name: "Public IP", url: "http://93.184.216.34/", wantErr: nil},
+		{name: "Public IPv6", url: "http://[2606:2800:220:1::1]/", wantErr: nil},
+		{name: "FTP", url: "ftp://example.com/file", wantErr: ErrScheme},
+		{name: "JavaScript", url: "javascript:alert(1)", wantErr: ErrScheme},
+		{name: "No host", url: "https:///path", wantErr: ErrInternal},
+		{name: "Localhost", url: "http://localhost:8080/admin", wantErr: ErrInternal},
+		{name: "Localhost trailing dot", url: "http://LOCALHOST./", wantErr: ErrInternal},
+		{name: "Localhost subdomain", url: "http://app.localhost/", wantErr: ErrInternal},
+		{name: "Internal name", url: "http://db.internal/", wantErr: ErrInternal},
+		{name: "mDNS name", url: "http://printer.local/", wantErr: ErrInternal},
+		{name: "Single label", url: "http://intranet/", wantErr: ErrInternal},
+		{name: "Loopback", url: "http://127.0.0.1/", wantErr: ErrInternal},
+		{name: "Loopback range", url: "http://127.1.2.3/", wantErr: ErrInternal},
+		{name: "Loopback integer", url: "http://2130706433/", wantErr: ErrInternal},
+		{name: "Loopback hex", url: "http://0x7f000001/", wantErr: ErrInternal},
+		{name: "Loopback shorthand", url: "http://127.1/", wantErr: ErrInternal},
+		{name: "Loopback hex parts", url: "http://0x7f.1/", wantErr: ErrInternal},
+		{name: "Loopback octal", url: "http://0177.0.0.1/", wantErr: ErrInternal},
+		{name: "Private mixed bases", url: "http://0xa.0.010.1/", wantErr: ErrInternal},
+		{name: "Public shorthand", url: "http://93.12113954/", wantErr: nil},
+		{name: "Octal public-looking", url: "http://012.1.2.3/", wantErr: ErrInternal},
+		{name: "Part too large", url: "http://1.2.3.256/", wantErr: ErrInternal},
+		{name: "Too many parts", url: "http://1.2.3.4.5/", wantErr: ErrInternal},
+		{name: "Bad octal", url: "http://1.2.3.08/", wantErr: ErrInternal},
+		{name: "Ends in hex", url: "http://example.0x1/", wantErr: ErrInternal},
+		{name: "Numeric-looking name", url: "https://1e100.net/", wantErr: nil},
+		{name: "IPv6 loopback", url: "http://[::1]/", wantErr: ErrInternal},
+		{name: "IPv4-mapped loopback", url: "http://[::ffff:127.0.0.1]/", wantErr: ErrInternal},
+		{name: "6to4 private", url: "http://[2002:a00:1::1]/", wantErr: ErrInternal},
+		{name: "6to4 metadata", url: "http://[2002:a9fe:a9fe::]/", wantErr: ErrInternal},
+		{name: "6to4 public", url: "http://[2002:808:808::1]/", wantErr: nil},
+		{name: "NAT64 loopback", url: "http://[64:ff9b::127.0.0.1]/", wantErr: ErrInternal},
+		{name: "NAT64 private", url: "http://[64:ff9b::c0a8:101]/", wantErr: ErrInternal},
+		{name: "NAT64 public", url: "http://[64:ff9b::8.8.8.8]/", wantErr: nil},
+		{name: "Unspecified", url: "http://0.0.0.0/", wantErr: ErrInternal},
+		{name: "Private 10/8", url: "http://10.1.2.3/", wantErr: ErrInternal},
+		{name: "Private 172.16/12", url: "http://172.20.0.1/", wantErr: ErrInternal},
+		{name: "Private 192.168/16", url: "http://192.168.1.1/", wantErr: ErrInternal},
+		{name: "Link-local metadata", url: "http://169.254.169.254/latest/meta-data/", wantErr: ErrInternal},
+		{name: "Carrier-grade NAT", url: "http://100.64.0.1/", wantErr: ErrInternal},
+		{name: "Unique local IPv6", url: "http://[fd00::1]/", wantErr: ErrInternal},
+		{name: "Resolves to private", url: "https://rebind.example.org/", wantErr: ErrInternal},
+		{name: "Resolves to loopback", url: "https://loopback.example.org/", wantErr: ErrInternal},
+		{name: "Short link", url: "https://clonebox.example.com/shorten/abc123", wantErr: ErrSelfReference},
+		{name: "Short link upper case", url: "https://CloneBox.example.com/Shorten/abc123", wantErr: ErrSelfReference},
+		{name: "Short link dot segment", url: "https://clonebox.example.com/./shorten/abc123", wantErr: ErrSelfReference},
+		{name: "Short link double slash", url: "https://clonebox.example.com//shorten/abc123", wantErr: ErrSelfReference},
+		{name: "Short link parent segment", url: "https://clonebox.example.com/foo/../shorten/abc123", wantErr: ErrSelfReference},
+		{name: "Own file page", url: "https://clonebox.example.com/file/view/123", wantErr: nil},
+		{
+			name:      "Short link on request host",
+			url:       "http://localhost.example.net:4000/shorten/abc123",
+			selfHosts: []string{"localhost.example.net:4000"},
+			wantErr:   ErrSelfReference,
+		},
+		{name: "Blocked domain", url: "https://evil.example/", wantErr: ErrBlocked},
+		{name: "Blocked subdomain", url: "https://www.evil.example/", wantErr: ErrBlocked},
+		{name: "Blocked normalised", url: "https://tracker.example.net/", wantErr: ErrBlocked},
+		{name: "Similar domain", url: "https://notevil.example/", wantErr: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Check(context.Background(), tt.url, tt.selfHosts...)
+			assert.Equal(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestCheckWithoutConfig(t *testing.T) {
+	// The zero Policy still rejects internal addresses
+	var policy Policy
+
+	assert.Equal(t, policy.Check(context.Background(), "http://127.0.0.1/"), ErrInternal)
+	assert.Equal(t, policy.Check(context.Background(), "https://example.com/shorten/abc"), nil)
+}
+
+func TestParseHosts(t *testing.T) {
+	input := `# Blocklist
+127.0.0.1 localhost
+::1 ip6-localhost ip6-loopback
+0.0.0.0 ads.example.com
+0.0.0.0 tracker.example.net metrics.example.net # trailing comment
+malware.example.org
+
+   Phishing.Example.
+`
+
+	domains, err := ParseHosts(strings.NewReader(input))
+	assert.NilError(t, err)
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{host: "ads.example.com", want: true},
+		{host: "cdn.ads.example.com", want: true},
+		{host: "tracker.example.net", want: true},
+		{host: "metrics.example.net", want: true},
+		{host: "malware.example.org", want: true},
+		{host: "phishing.example", want: true},
+		{host: "example.com", want: false},
+		{host: "localhost", want: false},
+		{host: "ip6-loopback", want: false},
+		{host: "0.0.0.0", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			assert.Equal(t, domains.Blocked(tt.host), tt.want)
+		})
+	}
+}
+
+func TestLoadHostsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(path, []byte("0.0.0.0 blocked.example\n"), 0o644)
+	assert.NilError(t, err)
+
+	domains, err := LoadHostsFile(path)
+	assert.NilError(t, err)
+	assert.Equal(t, domains.Blocked("blocked.example"), true)
+
+	_, err = LoadHostsFile(filepath.Join(t.TempDir(), "missing"))
+	assert.Equal(t, err != nil, true)
+}
+
+func TestBlocklists(t *testing.T) {
+	lists := Blocklists{NewDomains("one.example"), NewDomains("two.example")}
+
+	assert.Equal(t, lists.Blocked("one.example"), true)
+	assert.Equal(t, lists.Blocked("www.two.example"), true)
+	assert.Equal(t, lists.Blocked("three.example"), false)
+}
@@ -11,6 +11,10 @@ import (
 // Double check this
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+// AliasRX matches custom short link aliases: letters, digits, hyphens and underscores only, so they're safe to use as
+// a URL path segment without escaping.
+var AliasRX = regexp.MustCompile("^[a-zA-Z0-9_-]+$")
+
 // Validator type contains a map of validation errors for form fields.
 type Validator struct {
 	FieldErrors    map[string]string
@@ -0,0 +1,163 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var errCBOR = errors.New("webauthn: malformed CBOR")
+
+// maxCBORDepth bounds the nesting of decoded items, the structures WebAuthn uses are only a few levels deep.
+const maxCBORDepth = 16
+
+// decodeCBOR decodes the first CBOR item in data and returns it along with the bytes after it. It supports the subset
+// of CBOR (RFC 8949) authenticators produce: definite lengths only, with integers decoded as int64, byte strings as
+// []byte, text as string, arrays as []any and maps as map[any]any.
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeItem(data, 0)
+}
+
+func decodeItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maxCBORDepth || len(data) == 0 {
+		return nil, nil, errCBOR
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// Simple values and floats carry their value in the additional information rather than a length
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25:
+			if len(data) < 2 {
+				return nil, nil, errCBOR
+			}
+			return float64(halfToFloat(binary.BigEndian.Uint16(data))), data[2:], nil
+		case 26:
+			if len(data) < 4 {
+				return nil, nil, errCBOR
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+		case 27:
+			if len(data) < 8 {
+				return nil, nil, errCBOR
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+		default:
+			return nil, nil, errCBOR
+		}
+	}
+
+	n, data, err := readArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return int64(n), data, nil
+	case 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errCBOR
+		}
+		return -1 - int64(n), data, nil
+	case 2, 3:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		b := data[:n]
+		if major == 3 {
+			return string(b), data[n:], nil
+		}
+		return append([]byte(nil), b...), data[n:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the allocation by the input
+		if n > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			arr[i], data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return arr, data, nil
+	case 5:
+		if n > uint64(len(data)) {
+			return nil, nil, errCBOR
+		}
+		m := make(map[any]any, n)
+		for range n {
+			var k, v any
+			k, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errCBOR
+			}
+			v, data, err = decodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, data, nil
+	default:
+		// Tags aren't used by WebAuthn, their content is returned as is
+		return decodeItem(data, depth+1)
+	}
+}
+
+// readArgument reads the length or value that follows an initial byte.
+func readArgument(info byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	default:
+		// Indefinite lengths (31) and reserved values
+		return 0, nil, errCBOR
+	}
+}
+
+// halfToFloat converts an IEEE 754 half precision float.
+func halfToFloat(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch exp {
+	case 0:
+		// Zero and subnormals
+		f := float32(frac) / (1 << 24)
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0xff<<23 | frac<<13)
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+	}
+}
@@ -0,0 +1,82 @@
+package webauthn
+
+import (
+	"clonebox/internal/assert"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Examples from RFC 8949, appendix A.
+func TestDecodeCBOR(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		want any
+	}{
+		{name: "Zero", hex: "00", want: int64(0)},
+		{name: "One byte uint", hex: "1818", want: int64(24)},
+		{name: "Two byte uint", hex: "1903e8", want: int64(1000)},
+		{name: "Eight byte uint", hex: "1b000000e8d4a51000", want: int64(1000000000000)},
+		{name: "Negative", hex: "3903e7", want: int64(-1000)},
+		{name: "Bytes", hex: "4401020304", want: []byte{1, 2, 3, 4}},
+		{name: "Text", hex: "6449455446", want: "IETF"},
+		{name: "Array", hex: "8301820203820405", want: []any{int64(1), []any{int64(2), int64(3)}, []any{int64(4), int64(5)}}},
+		{name: "Map", hex: "a201020304", want: map[any]any{int64(1): int64(2), int64(3): int64(4)}},
+		{name: "Text keys", hex: "a26161016162820203", want: map[any]any{"a": int64(1), "b": []any{int64(2), int64(3)}}},
+		{name: "Half float", hex: "f93c00", want: float64(1)},
+		{name: "Single float", hex: "fa47c35000", want: float64(100000)},
+		{name: "Double float", hex: "fb3ff199999999999a", want: 1.1},
+		{name: "True", hex: "f5", want: true},
+		{name: "Null", hex: "f6", want: nil},
+		{name: "Tag", hex: "c11a514b67b0", want: int64(1363896240)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.hex)
+			assert.NilError(t, err)
+
+			got, rest, err := decodeCBOR(data)
+			assert.NilError(t, err)
+			assert.Equal(t, len(rest), 0)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v; want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCBORRest(t *testing.T) {
+	got, rest, err := decodeCBOR([]byte{0x01, 0x02, 0x03})
+	assert.NilError(t, err)
+	assert.Equal(t, got, any(int64(1)))
+	assert.Equal(t, len(rest), 2)
+}
+
+func TestDecodeCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+	}{
+		{name: "Empty", hex: ""},
+		{name: "Truncated uint", hex: "1903"},
+		{name: "Truncated bytes", hex: "4401"},
+		{name: "Huge array", hex: "9bffffffffffffffff"},
+		{name: "Indefinite length", hex: "9f01ff"},
+		{name: "Array key", hex: "a18001"},
+		{name: "Too deep", hex: "818181818181818181818181818181818100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.hex)
+			assert.NilError(t, err)
+
+			_, _, err = decodeCBOR(data)
+			if err == nil {
+				t.Error("got nil error; want malformed CBOR")
+			}
+		})
+	}
+}
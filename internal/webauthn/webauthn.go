@@ -0,0 +1,456 @@
+// Package webauthn implements the relying party side of WebAuthn (https://www.w3.org/TR/webauthn-2/) for passkey
+// login: creating the options passed to navigator.credentials.create() and get() in the browser, and verifying what
+// they return. Attestation isn't requested or checked, so any authenticator the user chooses can be registered.
+//
+// Binary values are exchanged with the browser as unpadded base64url strings.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	// ErrVerification is returned, wrapped with the reason, for responses that don't check out.
+	ErrVerification = errors.New("webauthn: verification failed")
+
+	// ErrUnsupportedKey is returned for credential public keys of algorithms this package can't verify.
+	ErrUnsupportedKey = errors.New("webauthn: unsupported public key")
+)
+
+// COSE algorithm identifiers of the supported signature algorithms, in order of preference.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// Timeout is how long, in milliseconds, the browser lets the user take to complete a ceremony.
+const Timeout = 5 * 60 * 1000
+
+// Authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// RelyingParty is this site, as far as authenticators are concerned. ID is the domain credentials are scoped to, and
+// Origin the scheme://host[:port] pages calling the WebAuthn API are served from.
+type RelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+// NewChallenge returns a random challenge for a ceremony. It has to be kept server-side (e.g. in the session) until
+// the response comes back, and used only once.
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// Bytes is a binary value, encoded in JSON as an unpadded base64url string.
+type Bytes []byte
+
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+// CredentialDescriptor identifies an existing credential.
+type CredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   Bytes  `json:"id"`
+}
+
+type rpEntity struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	ID          Bytes  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	RequireResident  bool   `json:"requireResidentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the publicKey options of navigator.credentials.create().
+type CreationOptions struct {
+	RP                     rpEntity               `json:"rp"`
+	User                   userEntity             `json:"user"`
+	Challenge              Bytes                  `json:"challenge"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int                    `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the publicKey options of navigator.credentials.get().
+type RequestOptions struct {
+	Challenge        Bytes                  `json:"challenge"`
+	Timeout          int                    `json:"timeout"`
+	RPID             string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// CreationOptions returns the options to register a passkey for a user with. userHandle identifies the user to the
+// authenticator and comes back when logging in, it mustn't contain personal information. The user's existing
+// credentials are excluded, so the same authenticator isn't registered twice.
+func (rp *RelyingParty) CreationOptions(challenge, userHandle []byte, name, displayName string, exclude [][]byte) *CreationOptions {
+	opts := &CreationOptions{
+		RP:        rpEntity{ID: rp.ID, Name: rp.Name},
+		User:      userEntity{ID: userHandle, Name: name, DisplayName: displayName},
+		Challenge: challenge,
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: AlgES256},
+			{Type: "public-key", Alg: AlgEdDSA},
+			{Type: "public-key", Alg: AlgRS256},
+		},
+		Timeout:            Timeout,
+		ExcludeCredentials: []CredentialDescriptor{},
+		// Passkeys are discoverable, so logging in doesn't need a user name first
+		AuthenticatorSelection: authenticatorSelection{
+			ResidentKey:      "required",
+			RequireResident:  true,
+			UserVerification: "required",
+		},
+		Attestation: "none",
+	}
+	for _, id := range exclude {
+		opts.ExcludeCredentials = append(opts.ExcludeCredentials, CredentialDescriptor{Type: "public-key", ID: id})
+	}
+	return opts
+}
+
+// RequestOptions returns the options to log in with any passkey for this site.
+func (rp *RelyingParty) RequestOptions(challenge []byte) *RequestOptions {
+	return &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          Timeout,
+		RPID:             rp.ID,
+		AllowCredentials: []CredentialDescriptor{},
+		UserVerification: "required",
+	}
+}
+
+// Credential is a newly registered public key credential.
+type Credential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// attestationResponse is the PublicKeyCredential returned by navigator.credentials.create().
+type attestationResponse struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AttestationObject Bytes `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// VerifyRegistration checks the response to CreationOptions made with challenge, and returns the new credential.
+func (rp *RelyingParty) VerifyRegistration(challenge []byte, body []byte) (*Credential, error) {
+	var resp attestationResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrVerification, err)
+	}
+	if resp.Type != "public-key" {
+		return nil, fmt.Errorf("%w: credential type %q", ErrVerification, resp.Type)
+	}
+
+	if err := rp.checkClientData(resp.Response.ClientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	obj, _, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: attestation object: %s", ErrVerification, err)
+	}
+	m, ok := obj.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: attestation object isn't a map", ErrVerification)
+	}
+	authData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%w: missing authenticator data", ErrVerification)
+	}
+
+	data, err := rp.parseAuthData(authData)
+	if err != nil {
+		return nil, err
+	}
+	if data.flags&flagAttestedCredData == 0 {
+		return nil, fmt.Errorf("%w: no attested credential", ErrVerification)
+	}
+	if !bytes.Equal(data.credentialID, resp.RawID) {
+		return nil, fmt.Errorf("%w: credential ID mismatch", ErrVerification)
+	}
+	if _, err = parsePublicKey(data.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &Credential{ID: data.credentialID, PublicKey: data.publicKey, SignCount: data.signCount}, nil
+}
+
+// Assertion is the PublicKeyCredential returned by navigator.credentials.get(). Parse it with ParseAssertion, look
+// up the credential by CredentialID, then check it with VerifyAssertion.
+type Assertion struct {
+	ID       string `json:"id"`
+	RawID    Bytes  `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    Bytes `json:"clientDataJSON"`
+		AuthenticatorData Bytes `json:"authenticatorData"`
+		Signature         Bytes `json:"signature"`
+		UserHandle        Bytes `json:"userHandle"`
+	} `json:"response"`
+}
+
+// ParseAssertion decodes an assertion sent by the browser.
+func ParseAssertion(body []byte) (*Assertion, error) {
+	var a Assertion
+	if err := json.Unmarshal(body, &a); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrVerification, err)
+	}
+	if a.Type != "public-key" || len(a.RawID) == 0 {
+		return nil, fmt.Errorf("%w: not a public key credential", ErrVerification)
+	}
+	return &a, nil
+}
+
+// CredentialID returns the ID of the credential that made the assertion.
+func (a *Assertion) CredentialID() []byte {
+	return a.RawID
+}
+
+// UserHandle returns the user handle the credential was registered with, if the authenticator returned it.
+func (a *Assertion) UserHandle() []byte {
+	return a.Response.UserHandle
+}
+
+// VerifyAssertion checks an assertion made in response to RequestOptions with challenge, against the stored public
+// key and signature counter of the credential. It returns the new counter value to store.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, a *Assertion, publicKey []byte, signCount uint32) (uint32, error) {
+	if err := rp.checkClientData(a.Response.ClientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, err
+	}
+
+	data, err := rp.parseAuthData(a.Response.AuthenticatorData)
+	if err != nil {
+		return 0, err
+	}
+
+	key, err := parsePublicKey(publicKey)
+	if err != nil {
+		return 0, err
+	}
+	clientDataHash := sha256.Sum256(a.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), a.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, a.Response.Signature) {
+		return 0, fmt.Errorf("%w: bad signature", ErrVerification)
+	}
+
+	// Authenticators which count signatures never repeat a value, one that does may have been cloned. Counters of 0
+	// mean the authenticator doesn't count (most synced passkeys don't).
+	if (data.signCount != 0 || signCount != 0) && data.signCount <= signCount {
+		return 0, fmt.Errorf("%w: signature counter went from %d to %d", ErrVerification, signCount, data.signCount)
+	}
+
+	return data.signCount, nil
+}
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+func (rp *RelyingParty) checkClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return fmt.Errorf("%w: client data: %s", ErrVerification, err)
+	}
+	if cd.Type != typ {
+		return fmt.Errorf("%w: client data type %q", ErrVerification, cd.Type)
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return fmt.Errorf("%w: challenge mismatch", ErrVerification)
+	}
+	if cd.Origin != rp.Origin || cd.CrossOrigin {
+		return fmt.Errorf("%w: origin %q", ErrVerification, cd.Origin)
+	}
+	return nil
+}
+
+type authData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// parseAuthData parses authenticator data, checking it's for this relying party and that the user was present and
+// verified (e.g. by a fingerprint or PIN), which is what makes a passkey more than something you have.
+func (rp *RelyingParty) parseAuthData(raw []byte) (*authData, error) {
+	if len(raw) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrVerification)
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, fmt.Errorf("%w: relying party ID mismatch", ErrVerification)
+	}
+
+	data := &authData{flags: raw[32], signCount: binary.BigEndian.Uint32(raw[33:37])}
+	if data.flags&flagUserPresent == 0 {
+		return nil, fmt.Errorf("%w: user not present", ErrVerification)
+	}
+	if data.flags&flagUserVerified == 0 {
+		return nil, fmt.Errorf("%w: user not verified", ErrVerification)
+	}
+
+	if data.flags&flagAttestedCredData != 0 {
+		// AAGUID, credential ID length and credential ID, then the COSE key
+		rest := raw[37:]
+		if len(rest) < 18 {
+			return nil, fmt.Errorf("%w: attested credential data too short", ErrVerification)
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if n == 0 || len(rest) < n {
+			return nil, fmt.Errorf("%w: bad credential ID", ErrVerification)
+		}
+		data.credentialID = append([]byte(nil), rest[:n]...)
+		rest = rest[n:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%w: credential public key: %s", ErrVerification, err)
+		}
+		data.publicKey = append([]byte(nil), rest[:len(rest)-len(after)]...)
+	}
+
+	return data, nil
+}
+
+// publicKey verifies signatures with a credential public key.
+type publicKey struct {
+	verify func(data, sig []byte) bool
+}
+
+// COSE key parameters
+const (
+	coseKty    = 1
+	coseAlg    = 3
+	coseCrv    = -1
+	coseX      = -2 // Also the RSA modulus
+	coseY      = -3 // Also the RSA exponent
+	coseKtyOKP = 1
+	coseKtyEC2 = 2
+	coseKtyRSA = 3
+	coseP256   = 1
+	coseEd     = 6
+)
+
+// parsePublicKey decodes a COSE_Key (RFC 9053) of one of the supported algorithms.
+func parsePublicKey(raw []byte) (*publicKey, error) {
+	decoded, _, err := decodeCBOR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, err)
+	}
+	m, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, ErrUnsupportedKey
+	}
+	kty, _ := m[int64(coseKty)].(int64)
+	alg, _ := m[int64(coseAlg)].(int64)
+	crv, _ := m[int64(coseCrv)].(int64)
+	x, _ := m[int64(coseX)].([]byte)
+	y, _ := m[int64(coseY)].([]byte)
+
+	switch {
+	case alg == AlgES256 && kty == coseKtyEC2 && crv == coseP256:
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ErrUnsupportedKey
+		}
+		point := append(append([]byte{4}, x...), y...)
+		pub, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedKey, err)
+		}
+		return &publicKey{verify: func(data, sig []byte) bool {
+			digest := sha256.Sum256(data)
+			return ecdsa.VerifyASN1(pub, digest[:], sig)
+		}}, nil
+
+	case alg == AlgEdDSA && kty == coseKtyOKP && crv == coseEd:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		pub := ed25519.PublicKey(x)
+		return &publicKey{verify: func(data, sig []byte) bool {
+			return ed25519.Verify(pub, data, sig)
+		}}, nil
+
+	case alg == AlgRS256 && kty == coseKtyRSA:
+		if len(x) < 256 || len(y) == 0 || len(y) > 4 {
+			return nil, ErrUnsupportedKey
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(x), E: int(new(big.Int).SetBytes(y).Int64())}
+		return &publicKey{verify: func(data, sig []byte) bool {
+			digest := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("%w: algorithm %d", ErrUnsupportedKey, alg)
+	}
+}
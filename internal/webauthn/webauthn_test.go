@@ -0,0 +1,181 @@
+package webauthn
+
+import (
+	"clonebox/internal/assert"
+	"clonebox/internal/webauthn/webauthntest"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var testRP = &RelyingParty{ID: "example.com", Name: "Clonebox", Origin: "https://example.com"}
+
+// register runs a registration ceremony between rp and the authenticator.
+func register(t *testing.T, rp *RelyingParty, auth *webauthntest.Authenticator) (*Credential, error) {
+	t.Helper()
+
+	challenge, err := NewChallenge()
+	assert.NilError(t, err)
+	opts, err := json.Marshal(rp.CreationOptions(challenge, []byte{0, 0, 0, 0, 0, 0, 0, 1}, "alice@example.com", "Alice", nil))
+	assert.NilError(t, err)
+
+	body, err := auth.Create(opts)
+	assert.NilError(t, err)
+	return rp.VerifyRegistration(challenge, body)
+}
+
+// login runs an authentication ceremony between rp and the authenticator, checking it against cred.
+func login(t *testing.T, rp *RelyingParty, auth *webauthntest.Authenticator, cred *Credential) (uint32, error) {
+	t.Helper()
+
+	challenge, err := NewChallenge()
+	assert.NilError(t, err)
+	opts, err := json.Marshal(rp.RequestOptions(challenge))
+	assert.NilError(t, err)
+
+	body, err := auth.Get(opts)
+	assert.NilError(t, err)
+	a, err := ParseAssertion(body)
+	assert.NilError(t, err)
+	assert.Equal(t, string(a.CredentialID()), string(cred.ID))
+	assert.Equal(t, string(a.UserHandle()), string([]byte{0, 0, 0, 0, 0, 0, 0, 1}))
+
+	return rp.VerifyAssertion(challenge, a, cred.PublicKey, cred.SignCount)
+}
+
+func TestCeremonies(t *testing.T) {
+	auth := webauthntest.New(testRP.Origin)
+
+	cred, err := register(t, testRP, auth)
+	assert.NilError(t, err)
+	assert.Equal(t, len(cred.ID), 16)
+	assert.Equal(t, cred.SignCount, uint32(0))
+
+	count, err := login(t, testRP, auth, cred)
+	assert.NilError(t, err)
+	assert.Equal(t, count, uint32(1))
+
+	// A counter that didn't go up means the credential may have been cloned
+	cred.SignCount = 5
+	_, err = login(t, testRP, auth, cred)
+	if !errors.Is(err, ErrVerification) {
+		t.Errorf("got %v; want ErrVerification for a counter going backwards", err)
+	}
+}
+
+func TestVerifyRegistrationFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		auth *webauthntest.Authenticator
+		rp   *RelyingParty
+	}{
+		{name: "Wrong origin", auth: webauthntest.New("https://evil.example"), rp: testRP},
+		{name: "Wrong RP ID", auth: webauthntest.New(testRP.Origin), rp: &RelyingParty{ID: "evil.example", Origin: testRP.Origin}},
+		{name: "No user verification", auth: &webauthntest.Authenticator{Origin: testRP.Origin, SkipUserVerification: true}, rp: testRP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			challenge, err := NewChallenge()
+			assert.NilError(t, err)
+			opts, err := json.Marshal(tt.rp.CreationOptions(challenge, []byte{1}, "alice@example.com", "Alice", nil))
+			assert.NilError(t, err)
+			body, err := tt.auth.Create(opts)
+			assert.NilError(t, err)
+
+			// The options carried the wrong RP ID, check against the right one
+			_, err = testRP.VerifyRegistration(challenge, body)
+			if !errors.Is(err, ErrVerification) {
+				t.Errorf("got %v; want ErrVerification", err)
+			}
+		})
+	}
+
+	t.Run("Wrong challenge", func(t *testing.T) {
+		challenge, err := NewChallenge()
+		assert.NilError(t, err)
+		opts, err := json.Marshal(testRP.CreationOptions(challenge, []byte{1}, "alice@example.com", "Alice", nil))
+		assert.NilError(t, err)
+		body, err := webauthntest.New(testRP.Origin).Create(opts)
+		assert.NilError(t, err)
+
+		other, err := NewChallenge()
+		assert.NilError(t, err)
+		_, err = testRP.VerifyRegistration(other, body)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("got %v; want ErrVerification", err)
+		}
+	})
+
+	t.Run("Garbage", func(t *testing.T) {
+		_, err := testRP.VerifyRegistration([]byte("challenge"), []byte(`{"type":"public-key"}`))
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("got %v; want ErrVerification", err)
+		}
+	})
+}
+
+func TestExcludeCredentials(t *testing.T) {
+	auth := webauthntest.New(testRP.Origin)
+	cred, err := register(t, testRP, auth)
+	assert.NilError(t, err)
+
+	opts, err := json.Marshal(testRP.CreationOptions([]byte("challenge"), []byte{1}, "alice@example.com", "Alice", [][]byte{cred.ID}))
+	assert.NilError(t, err)
+	_, err = auth.Create(opts)
+	if !errors.Is(err, webauthntest.ErrExcluded) {
+		t.Errorf("got %v; want ErrExcluded", err)
+	}
+}
+
+func TestVerifyAssertionFailures(t *testing.T) {
+	auth := webauthntest.New(testRP.Origin)
+	cred, err := register(t, testRP, auth)
+	assert.NilError(t, err)
+
+	assertion := func(t *testing.T, challenge []byte) *Assertion {
+		opts, err := json.Marshal(testRP.RequestOptions(challenge))
+		assert.NilError(t, err)
+		body, err := auth.Get(opts)
+		assert.NilError(t, err)
+		a, err := ParseAssertion(body)
+		assert.NilError(t, err)
+		return a
+	}
+
+	t.Run("Bad signature", func(t *testing.T) {
+		a := assertion(t, []byte("challenge"))
+		a.Response.Signature[len(a.Response.Signature)-1] ^= 1
+		_, err := testRP.VerifyAssertion([]byte("challenge"), a, cred.PublicKey, 0)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("got %v; want ErrVerification", err)
+		}
+	})
+
+	t.Run("Wrong challenge", func(t *testing.T) {
+		a := assertion(t, []byte("challenge"))
+		_, err := testRP.VerifyAssertion([]byte("other"), a, cred.PublicKey, 0)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("got %v; want ErrVerification", err)
+		}
+	})
+
+	t.Run("Other credential's key", func(t *testing.T) {
+		other, err := register(t, testRP, webauthntest.New(testRP.Origin))
+		assert.NilError(t, err)
+
+		a := assertion(t, []byte("challenge"))
+		_, err = testRP.VerifyAssertion([]byte("challenge"), a, other.PublicKey, 0)
+		if !errors.Is(err, ErrVerification) {
+			t.Errorf("got %v; want ErrVerification", err)
+		}
+	})
+
+	t.Run("Unsupported key", func(t *testing.T) {
+		a := assertion(t, []byte("challenge"))
+		_, err := testRP.VerifyAssertion([]byte("challenge"), a, []byte{0xa0}, 0)
+		if !errors.Is(err, ErrUnsupportedKey) {
+			t.Errorf("got %v; want ErrUnsupportedKey", err)
+		}
+	})
+}
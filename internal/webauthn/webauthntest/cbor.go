@@ -0,0 +1,53 @@
+package webauthntest
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// encodeMap encodes alternating keys and values as a CBOR map. Keys and values may be int64, string, []byte, or
+// already encoded items, passed as cborItem.
+func encodeMap(pairs ...any) cborItem {
+	out := encodeHead(5, uint64(len(pairs)/2))
+	for _, v := range pairs {
+		out = append(out, encodeItem(v)...)
+	}
+	return out
+}
+
+// cborItem is an already encoded CBOR item.
+type cborItem []byte
+
+func encodeItem(v any) []byte {
+	switch v := v.(type) {
+	case cborItem:
+		return v
+	case int64:
+		if v < 0 {
+			return encodeHead(1, uint64(-1-v))
+		}
+		return encodeHead(0, uint64(v))
+	case string:
+		return append(encodeHead(3, uint64(len(v))), v...)
+	case []byte:
+		return append(encodeHead(2, uint64(len(v))), v...)
+	default:
+		panic(fmt.Sprintf("webauthntest: can't encode %T", v))
+	}
+}
+
+func encodeHead(major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return []byte{major | byte(n)}
+	case n <= 0xff:
+		return []byte{major | 24, byte(n)}
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16([]byte{major | 25}, uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32([]byte{major | 26}, uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64([]byte{major | 27}, n)
+	}
+}
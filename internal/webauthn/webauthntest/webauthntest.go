@@ -0,0 +1,231 @@
+// Package webauthntest provides a software authenticator, to test passkey registration and login without a browser
+// or security key. It speaks the JSON the passkey script in the browser exchanges with the server: it takes the
+// options the server sends and returns the credential the script would post back.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrExcluded is returned by Create when the authenticator already holds one of the excluded credentials.
+	ErrExcluded = errors.New("webauthntest: credential already registered")
+
+	// ErrNoCredential is returned by Get when the authenticator has no credential for the relying party.
+	ErrNoCredential = errors.New("webauthntest: no credential")
+)
+
+// Authenticator flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// Authenticator is a software passkey authenticator with ECDSA P-256 credentials. It behaves as if the user were
+// present and verified for every ceremony, unless SkipUserVerification is set.
+type Authenticator struct {
+	// Origin is the origin the simulated browser reports, e.g. "https://example.com".
+	Origin string
+
+	// SkipUserVerification leaves the UV flag unset, as an authenticator without a PIN or biometrics would.
+	SkipUserVerification bool
+
+	mu          sync.Mutex
+	credentials []*credential
+}
+
+type credential struct {
+	id         []byte
+	key        *ecdsa.PrivateKey
+	rpID       string
+	userHandle []byte
+	signCount  uint32
+}
+
+// New returns an authenticator for pages served from origin.
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+type descriptor struct {
+	ID string `json:"id"`
+}
+
+type creationOptions struct {
+	RP struct {
+		ID string `json:"id"`
+	} `json:"rp"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Challenge          string       `json:"challenge"`
+	ExcludeCredentials []descriptor `json:"excludeCredentials"`
+}
+
+type requestOptions struct {
+	Challenge        string       `json:"challenge"`
+	RPID             string       `json:"rpId"`
+	AllowCredentials []descriptor `json:"allowCredentials"`
+}
+
+// Create makes a new credential from the JSON publicKey options of navigator.credentials.create(), and returns the
+// JSON of the resulting PublicKeyCredential.
+func (a *Authenticator) Create(options []byte) ([]byte, error) {
+	var opts creationOptions
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, err
+	}
+	userHandle, err := decode(opts.User.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, c := range a.credentials {
+		for _, d := range opts.ExcludeCredentials {
+			if d.ID == encode(c.id) {
+				return nil, ErrExcluded
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cred := &credential{id: make([]byte, 16), key: key, rpID: opts.RP.ID, userHandle: userHandle}
+	if _, err := rand.Read(cred.id); err != nil {
+		return nil, err
+	}
+
+	// Attested credential data: an all-zero AAGUID, the credential ID and its COSE key
+	point, err := key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	coseKey := encodeMap(
+		int64(1), int64(2), // kty: EC2
+		int64(3), int64(-7), // alg: ES256
+		int64(-1), int64(1), // crv: P-256
+		int64(-2), point[1:33],
+		int64(-3), point[33:],
+	)
+	attested := make([]byte, 18, 18+len(cred.id)+len(coseKey))
+	binary.BigEndian.PutUint16(attested[16:], uint16(len(cred.id)))
+	attested = append(append(attested, cred.id...), coseKey...)
+
+	authData := a.authData(cred, flagAttestedCredData, attested)
+	attestationObject := encodeMap("fmt", "none", "attStmt", encodeMap(), "authData", authData)
+
+	a.credentials = append(a.credentials, cred)
+
+	return json.Marshal(map[string]any{
+		"id":    encode(cred.id),
+		"rawId": encode(cred.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(a.clientData("webauthn.create", opts.Challenge)),
+			"attestationObject": encode(attestationObject),
+		},
+	})
+}
+
+// Get signs in with a credential for the relying party, from the JSON publicKey options of
+// navigator.credentials.get(), and returns the JSON of the resulting PublicKeyCredential. Without allowed
+// credentials in the options, the most recently created discoverable credential is used.
+func (a *Authenticator) Get(options []byte) ([]byte, error) {
+	var opts requestOptions
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cred *credential
+	for _, c := range slices.Backward(a.credentials) {
+		allowed := len(opts.AllowCredentials) == 0 || slices.ContainsFunc(opts.AllowCredentials, func(d descriptor) bool {
+			return d.ID == encode(c.id)
+		})
+		if c.rpID == opts.RPID && allowed {
+			cred = c
+			break
+		}
+	}
+	if cred == nil {
+		return nil, ErrNoCredential
+	}
+
+	cred.signCount++
+	authData := a.authData(cred, 0, nil)
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]any{
+		"id":    encode(cred.id),
+		"rawId": encode(cred.id),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(sig),
+			"userHandle":        encode(cred.userHandle),
+		},
+	})
+}
+
+// Forget removes all credentials, as if the authenticator had been reset.
+func (a *Authenticator) Forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.credentials = nil
+}
+
+func (a *Authenticator) clientData(typ, challenge string) []byte {
+	data, _ := json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   strings.TrimRight(challenge, "="),
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+func (a *Authenticator) authData(cred *credential, flags byte, attested []byte) []byte {
+	flags |= flagUserPresent
+	if !a.SkipUserVerification {
+		flags |= flagUserVerified
+	}
+
+	rpIDHash := sha256.Sum256([]byte(cred.rpID))
+	data := append(rpIDHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], cred.signCount)
+	return append(data, attested...)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,122 @@
+// Passkey registration (account page) and login (login page). The server sends the WebAuthn options as JSON, with
+// binary values as base64url strings, and takes the created credential back the same way.
+
+function base64urlToBuffer(s) {
+    const base64 = s.replace(/-/g, '+').replace(/_/g, '/')
+    const binary = atob(base64 + '='.repeat((4 - base64.length % 4) % 4))
+    return Uint8Array.from(binary, c => c.charCodeAt(0)).buffer
+}
+
+function bufferToBase64url(buffer) {
+    const binary = String.fromCharCode(...new Uint8Array(buffer))
+    return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+}
+
+// passkeyPost posts to one of the passkey endpoints and returns the JSON response, throwing the server's message
+// if there is one.
+async function passkeyPost(url, csrfToken, body, contentType) {
+    const response = await fetch(url, {
+        method: 'POST',
+        headers: {'X-CSRF-Token': csrfToken, 'Content-Type': contentType},
+        body: body,
+        credentials: 'same-origin',
+    })
+    // Adding a passkey to an old login sends the user to confirm their password first
+    if (response.redirected) {
+        window.location.assign(response.url)
+        return new Promise(() => {})
+    }
+    const data = await response.json().catch(() => ({}))
+    if (!response.ok) {
+        throw new Error(data.error || 'Something went wrong, please try again')
+    }
+    return data
+}
+
+function credentialToJSON(credential) {
+    const response = {clientDataJSON: bufferToBase64url(credential.response.clientDataJSON)}
+    if (credential.response.attestationObject) {
+        response.attestationObject = bufferToBase64url(credential.response.attestationObject)
+    }
+    if (credential.response.authenticatorData) {
+        response.authenticatorData = bufferToBase64url(credential.response.authenticatorData)
+        response.signature = bufferToBase64url(credential.response.signature)
+        if (credential.response.userHandle) {
+            response.userHandle = bufferToBase64url(credential.response.userHandle)
+        }
+    }
+    return JSON.stringify({
+        id: credential.id,
+        rawId: bufferToBase64url(credential.rawId),
+        type: credential.type,
+        response: response,
+    })
+}
+
+function showPasskeyError(form, message) {
+    let error = form.querySelector('.error')
+    if (!error) {
+        error = document.createElement('div')
+        error.className = 'error'
+        form.prepend(error)
+    }
+    error.textContent = message
+}
+
+async function registerPasskey(form) {
+    const csrfToken = form.elements['csrf_token'].value
+    const params = new URLSearchParams({name: form.elements['name'].value})
+    const options = await passkeyPost('/account/passkeys/begin', csrfToken, params, 'application/x-www-form-urlencoded')
+
+    options.challenge = base64urlToBuffer(options.challenge)
+    options.user.id = base64urlToBuffer(options.user.id)
+    for (const c of options.excludeCredentials) {
+        c.id = base64urlToBuffer(c.id)
+    }
+    const credential = await navigator.credentials.create({publicKey: options})
+
+    const result = await passkeyPost('/account/passkeys/finish', csrfToken, credentialToJSON(credential), 'application/json')
+    window.location.assign(result.redirect)
+}
+
+async function loginWithPasskey(form) {
+    const csrfToken = form.elements['csrf_token'].value
+    const options = await passkeyPost('/user/login/passkey/begin', csrfToken, '', 'application/x-www-form-urlencoded')
+
+    options.challenge = base64urlToBuffer(options.challenge)
+    for (const c of options.allowCredentials) {
+        c.id = base64urlToBuffer(c.id)
+    }
+    const credential = await navigator.credentials.get({publicKey: options})
+
+    const result = await passkeyPost('/user/login/passkey/finish', csrfToken, credentialToJSON(credential), 'application/json')
+    window.location.assign(result.redirect)
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+    const forms = [
+        [document.getElementById('passkey-register'), registerPasskey],
+        [document.getElementById('passkey-login'), loginWithPasskey],
+    ]
+    for (const [form, ceremony] of forms) {
+        if (!form) {
+            continue
+        }
+        if (!window.PublicKeyCredential) {
+            showPasskeyError(form, "This browser doesn't support passkeys")
+            form.querySelector('input[type="submit"]').disabled = true
+            continue
+        }
+        form.addEventListener('submit', async (event) => {
+            event.preventDefault()
+            try {
+                await ceremony(form)
+            } catch (err) {
+                // Cancelling the browser's dialog isn't worth an error message
+                if (err.name !== 'NotAllowedError') {
+                    showPasskeyError(form, err.message)
+                }
+            }
+        })
+    }
+})